@@ -0,0 +1,276 @@
+package main
+
+// The ACIA's registers
+const (
+	aciaData    = 0x0 // transmit data on writes, received data on reads
+	aciaStatus  = 0x1 // status on reads, a programmed reset on writes
+	aciaCommand = 0x2
+	aciaControl = 0x3
+)
+
+// The bits of the status register
+const (
+	aciaParityError uint8 = 1 << iota
+	aciaFramingError
+	aciaOverrun
+	aciaRxFull  // the receive data register holds a byte
+	aciaTxEmpty // the transmit data register can take a byte
+	aciaDCD     // carrier lost, which it never is here
+	aciaDSR     // data set not ready, which it never is here
+	aciaIRQ     // an interrupt is pending
+)
+
+// aciaBaudRates are the baud rates the low four bits of the control register
+// select. Zero selects an external clock, which is taken to be fast.
+var aciaBaudRates = [16]int64{
+	115200, 50, 75, 110, 135, 150, 300, 600,
+	1200, 1800, 2400, 3600, 4800, 7200, 9600, 19200,
+}
+
+// ACIA is a 6551 asynchronous communications interface adapter: a serial
+// port with a receive and a transmit data register, status, command and
+// control registers, and an IRQ output for a byte being received or the
+// transmitter becoming free.
+//
+// Transmitted bytes go to the host through output, a character time after
+// they are written at the baud rate the control register selects. Bytes
+// from the host come through the input log as <name>, and wait in a queue
+// until the receive data register is free, as though the sender paid
+// attention to flow control, so nothing pasted in is lost to overruns.
+type ACIA struct {
+	label      string
+	irq        func(active bool)
+	output     func(b uint8)
+	clockSpeed int64 // in Hz, for the time characters take
+
+	command, control uint8
+	rx               uint8
+	rxFull           bool
+	rxQueue          []uint8 // bytes from the host that have not arrived yet
+	rxTimer          int     // cycles until the next one does
+	tx               uint8
+	txFull           bool
+	txTimer          int // cycles until tx is sent
+	// irqFlag is the IRQ bit of the status register, which reading it clears
+	irqFlag bool
+	// irqActive is whether the IRQ output is low
+	irqActive bool
+}
+
+// newACIA creates an ACIA clocked at clockSpeed, with its IRQ output
+// connected to irq and what it transmits going to output
+func newACIA(label string, clockSpeed int64, irq func(active bool), output func(b uint8)) *ACIA {
+	a := &ACIA{label: label, clockSpeed: clockSpeed, irq: irq, output: output}
+	a.reset()
+	return a
+}
+
+// reset puts the ACIA in the state it comes out of reset in, with its
+// receiver interrupt disabled and the terminal not ready
+func (a *ACIA) reset() {
+	*a = ACIA{label: a.label, clockSpeed: a.clockSpeed, irq: a.irq, output: a.output, rxQueue: a.rxQueue}
+	a.command = 0x02
+	a.updateIRQ()
+}
+
+func (a *ACIA) name() string { return a.label }
+
+func (a *ACIA) size() int { return 4 }
+
+// ready is whether the terminal ready bit (DTR) of the command register is
+// set, which enables the receiver and interrupts
+func (a *ACIA) ready() bool { return a.command&0x01 != 0 }
+
+// rxInterrupts is whether receiving a byte interrupts
+func (a *ACIA) rxInterrupts() bool { return a.command&0x02 == 0 }
+
+// txInterrupts is whether the transmitter becoming free interrupts
+func (a *ACIA) txInterrupts() bool { return a.command&0x0C == 0x04 }
+
+// echo is whether received bytes are sent straight back, which only happens
+// with transmitter interrupts disabled and RTS high
+func (a *ACIA) echo() bool { return a.command&0x10 != 0 && a.command&0x0C == 0 }
+
+// wordMask masks a byte to the word length, from 8 bits down to 5
+func (a *ACIA) wordMask() uint8 {
+	return 0xFF >> (a.control >> 5 & 3)
+}
+
+// characterCycles returns the number of CPU cycles a character takes to send
+// at the baud rate: a start bit, the data bits, a parity bit if there is one
+// and the stop bits
+func (a *ACIA) characterCycles() int {
+	bits := int64(1 + 8 - (a.control >> 5 & 3) + 1)
+	if a.command&0x20 != 0 {
+		bits++
+	}
+	if a.control&0x80 != 0 {
+		bits++
+	}
+	cycles := int(a.clockSpeed * bits / aciaBaudRates[a.control&0x0F])
+	if cycles < 1 {
+		return 1
+	}
+	return cycles
+}
+
+// status returns the status register
+func (a *ACIA) status() uint8 {
+	var status uint8
+	if !a.txFull {
+		status |= aciaTxEmpty
+	}
+	if a.rxFull {
+		status |= aciaRxFull
+	}
+	if a.irqFlag {
+		status |= aciaIRQ
+	}
+	return status
+}
+
+// interrupt sets the IRQ flag
+func (a *ACIA) interrupt() {
+	a.irqFlag = true
+	a.updateIRQ()
+}
+
+// updateIRQ drives the IRQ output from the flag. Clearing DTR holds it off.
+func (a *ACIA) updateIRQ() {
+	active := a.irqFlag && a.ready()
+	if active != a.irqActive {
+		a.irqActive = active
+		if a.irq != nil {
+			a.irq(active)
+		}
+	}
+}
+
+func (a *ACIA) peek(register uint16) uint8 {
+	switch register {
+	case aciaData:
+		return a.rx
+	case aciaStatus:
+		return a.status()
+	case aciaCommand:
+		return a.command
+	default:
+		return a.control
+	}
+}
+
+func (a *ACIA) read(register uint16) uint8 {
+	value := a.peek(register)
+	switch register {
+	case aciaData:
+		a.rxFull = false
+	case aciaStatus:
+		a.irqFlag = false
+		a.updateIRQ()
+	}
+	return value
+}
+
+func (a *ACIA) write(register uint16, value uint8) {
+	switch register {
+	case aciaData:
+		// A byte written before the last one went is sent at once rather
+		// than lost, for programs written for the WDC 65C51, whose status
+		// always says the transmitter is free
+		if a.txFull {
+			a.send()
+		}
+		a.tx = value
+		a.txFull = true
+		a.txTimer = a.characterCycles()
+	case aciaStatus:
+		// A programmed reset clears the low five bits of the command register
+		a.command &= 0xE0
+	case aciaCommand:
+		wasEnabled := a.txInterrupts()
+		a.command = value
+		// Enabling transmitter interrupts while it is free interrupts
+		if a.txInterrupts() && !wasEnabled && !a.txFull {
+			a.irqFlag = true
+		}
+	case aciaControl:
+		a.control = value
+	}
+	a.updateIRQ()
+}
+
+// send transmits the byte in the transmit data register
+func (a *ACIA) send() {
+	a.txFull = false
+	if a.output != nil {
+		a.output(a.tx & a.wordMask())
+	}
+}
+
+func (a *ACIA) tick(cycles int) {
+	if a.txFull {
+		a.txTimer -= cycles
+		if a.txTimer <= 0 {
+			a.send()
+			if a.txInterrupts() {
+				a.interrupt()
+			}
+		}
+	}
+	if len(a.rxQueue) > 0 && a.ready() {
+		a.rxTimer -= cycles
+		if a.rxTimer <= 0 && !a.rxFull {
+			a.rx = a.rxQueue[0] & a.wordMask()
+			a.rxQueue = a.rxQueue[1:]
+			a.rxFull = true
+			a.rxTimer = a.characterCycles()
+			if a.echo() && a.output != nil {
+				a.output(a.rx)
+			}
+			if a.rxInterrupts() {
+				a.interrupt()
+			}
+		}
+	}
+}
+
+// receive queues a byte from the host
+func (a *ACIA) receive(b uint8) {
+	a.rxQueue = append(a.rxQueue, b)
+}
+
+// connectInput takes the bytes the host sends
+func (a *ACIA) connectInput(l *InputLog) {
+	l.handle(a.label, func(value int) { a.receive(uint8(value)) })
+}
+
+func (a *ACIA) saveState(e *stateEncoder) {
+	for _, b := range []uint8{a.command, a.control, a.rx, a.tx} {
+		e.u8(b)
+	}
+	for _, b := range []bool{a.rxFull, a.txFull, a.irqFlag, a.irqActive} {
+		e.bool(b)
+	}
+	e.u32(uint32(a.rxTimer))
+	e.u32(uint32(a.txTimer))
+	e.u32(uint32(len(a.rxQueue)))
+	e.bytes(a.rxQueue)
+}
+
+func (a *ACIA) loadState(d *stateDecoder) {
+	for _, b := range []*uint8{&a.command, &a.control, &a.rx, &a.tx} {
+		*b = d.u8()
+	}
+	for _, b := range []*bool{&a.rxFull, &a.txFull, &a.irqFlag, &a.irqActive} {
+		*b = d.bool()
+	}
+	a.rxTimer = int(int32(d.u32()))
+	a.txTimer = int(int32(d.u32()))
+	// The queue's length is checked against the chunk's, as the decoder
+	// would pad out any length it was given
+	if n := int(d.u32()); n <= len(d.data)-d.pos {
+		a.rxQueue = d.take(n)
+	} else {
+		a.rxQueue = nil
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newTestACIA creates an ACIA clocked at 1 MHz, with its IRQ output recorded
+// in irq and what it sends in out
+func newTestACIA() (*ACIA, *bool, *[]uint8) {
+	irq := false
+	var out []uint8
+	a := newACIA("acia", mhzToHz(1), func(active bool) { irq = active }, func(b uint8) { out = append(out, b) })
+	return a, &irq, &out
+}
+
+func TestACIATransmit(t *testing.T) {
+	a, irq, out := newTestACIA()
+	// 19200 baud, 8 bits and a stop bit: 520 cycles a character at 1 MHz
+	a.write(aciaControl, 0x1F)
+	// DTR, transmitter interrupts enabled, which interrupts as it is free
+	a.write(aciaCommand, 0x05)
+	if !*irq || a.read(aciaStatus)&(aciaIRQ|aciaTxEmpty) != aciaIRQ|aciaTxEmpty {
+		t.Fatal("expected an interrupt on enabling transmitter interrupts")
+	}
+	if *irq {
+		t.Fatal("reading the status should clear the interrupt")
+	}
+	a.write(aciaData, 'A')
+	if a.peek(aciaStatus)&aciaTxEmpty != 0 {
+		t.Error("the transmitter should be busy")
+	}
+	a.tick(519)
+	if len(*out) != 0 || *irq {
+		t.Fatalf("sent too soon: %q", *out)
+	}
+	a.tick(1)
+	if !bytes.Equal(*out, []uint8("A")) || !*irq || a.peek(aciaStatus)&aciaTxEmpty == 0 {
+		t.Fatalf("expected A sent and an interrupt, got %q, IRQ %v", *out, *irq)
+	}
+
+	// Seven bit words, with transmitter interrupts off
+	a.read(aciaStatus)
+	a.write(aciaControl, 0x3F)
+	a.write(aciaCommand, 0x09)
+	a.write(aciaData, 0xC1)
+	// A byte written while the last is going sends that at once
+	a.write(aciaData, 'C')
+	a.tick(1000)
+	if !bytes.Equal(*out, []uint8("AAC")) || *irq {
+		t.Errorf("expected AAC and no interrupt, got %q, IRQ %v", *out, *irq)
+	}
+}
+
+func TestACIAReceive(t *testing.T) {
+	a, irq, out := newTestACIA()
+	a.write(aciaControl, 0x1F)
+	a.receive('h')
+	a.receive('i')
+	// Nothing is received until the terminal is ready
+	a.tick(1000)
+	if a.peek(aciaStatus)&aciaRxFull != 0 {
+		t.Fatal("received with DTR off")
+	}
+	// DTR, receiver interrupts enabled, echoing
+	a.write(aciaCommand, 0x11)
+	a.tick(1)
+	if !*irq || a.read(aciaStatus) != aciaIRQ|aciaRxFull|aciaTxEmpty {
+		t.Fatalf("expected a receive interrupt, status $%02X", a.peek(aciaStatus))
+	}
+	// The next byte waits for this one to be read
+	a.tick(2000)
+	if got := a.read(aciaData); got != 'h' {
+		t.Errorf("expected h, got %q", got)
+	}
+	if a.peek(aciaStatus)&aciaRxFull != 0 {
+		t.Error("reading the data should empty the receiver")
+	}
+	a.tick(1)
+	if got := a.read(aciaData); got != 'i' {
+		t.Errorf("expected i, got %q", got)
+	}
+	if !bytes.Equal(*out, []uint8("hi")) {
+		t.Errorf("expected hi echoed, got %q", *out)
+	}
+
+	// A programmed reset drops DTR, holding interrupts off
+	a.receive('!')
+	a.write(aciaStatus, 0)
+	a.tick(1000)
+	if *irq || a.peek(aciaCommand) != 0 {
+		t.Errorf("expected no interrupt after a reset, IRQ %v command $%02X", *irq, a.peek(aciaCommand))
+	}
+}
+
+func TestACIAOnTheBus(t *testing.T) {
+	// Echo what is received, uppercased, until a newline
+	program := []uint8{
+		0xA9, 0x0B, // LDA #$0B (DTR, no interrupts)
+		0x8D, 0x02, 0x50, // STA $5002
+		0xA9, 0x10, // LDA #$10 (an external clock)
+		0x8D, 0x03, 0x50, // STA $5003
+		0xAD, 0x01, 0x50, // loop: LDA $5001
+		0x29, 0x08, // AND #$08
+		0xF0, 0xF9, // BEQ loop
+		0xAD, 0x00, 0x50, // LDA $5000
+		0x29, 0xDF, // AND #$DF
+		0x8D, 0x00, 0x50, // STA $5000
+		0xC9, 0x0A, // CMP #$0A
+		0xD0, 0xED, // BNE loop
+		0x00, // BRK
+	}
+	cpu := newTestCPU(t, NMOS6502, program)
+	cpu.clockSpeed = mhzToHz(1)
+	cpu.input = newInputLog(cpu)
+	var out []uint8
+	acia := newACIA("acia", cpu.clockSpeed, cpu.newIRQLine(), func(b uint8) { out = append(out, b) })
+	if err := cpu.attach(acia, 0x5000, 0x5003); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []uint8("abc\n") {
+		cpu.input.send("acia", int(b))
+	}
+	runUntilBreak(t, cpu)
+	// Let the newline go
+	cpu.MMU.tick(100)
+	if !bytes.Equal(out, []uint8("ABC\n")) {
+		t.Errorf("expected ABC, got %q", out)
+	}
+
+	// The queue of bytes still to come goes in save states
+	acia.receive('x')
+	var buf bytes.Buffer
+	if err := cpu.saveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	acia.reset()
+	acia.rxQueue = nil
+	if err := cpu.loadState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(acia.rxQueue, []uint8("x")) || acia.command != 0x0B || acia.control != 0x10 {
+		t.Errorf("ACIA state not restored: %+v", acia)
+	}
+}
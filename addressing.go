@@ -69,11 +69,9 @@ var addressingModes = map[int]func(*CPU) uint16{
 		// Add the X register to the address
 		effectiveAddress := baseAddress + uint16(cpu.X)
 
-		// Check for page boundary crossing
-		if effectiveAddress>>8 != baseAddress>>8 {
-			// Page boundary crossed, so increment the cycle count
-			cpu.cycles++
-		}
+		// Note whether a page boundary was crossed, which costs reads an
+		// extra cycle
+		cpu.pageCrossed = effectiveAddress>>8 != baseAddress>>8
 		// Return the effective address
 		return effectiveAddress
 	},
@@ -86,11 +84,9 @@ var addressingModes = map[int]func(*CPU) uint16{
 		// Add the Y register to the address
 		effectiveAddress := baseAddress + uint16(cpu.Y)
 
-		// Check for page boundary crossing
-		if effectiveAddress>>8 != baseAddress>>8 {
-			// Page boundary crossed, so increment the cycle count
-			cpu.cycles++
-		}
+		// Note whether a page boundary was crossed, which costs reads an
+		// extra cycle
+		cpu.pageCrossed = effectiveAddress>>8 != baseAddress>>8
 		// Return the effective address
 		return effectiveAddress
 	},
@@ -101,50 +97,60 @@ var addressingModes = map[int]func(*CPU) uint16{
 		// Increment the program counter by two
 		cpu.PC += 2
 
-		// Check for page boundary crossing
-		if address&0xFF == 0xFF {
-			// Page boundary crossed, so read the address from the next page (fixes JMP ($xxFF) bug)
+		// Check for page boundary crossing. The NMOS 6502 reads the high byte
+		// from the start of the same page (the JMP ($xxFF) bug), which the
+		// 65C02 fixes.
+		if address&0xFF == 0xFF && cpu.variant == NMOS6502 {
 			return uint16(cpu.MMU.readByte(address)) | uint16(cpu.MMU.readByte(address&0xFF00))<<8
 		}
 		return cpu.MMU.readWord(address)
 	},
 	// (Indirect, X)
 	11: func(cpu *CPU) uint16 {
-		// Read the address from the next byte and add the X register
-		address := (uint16(cpu.MMU.readByte(cpu.PC) + cpu.X))
+		// Read the zero page address from the next byte and add the X register,
+		// wrapping around within the zero page
+		pointer := cpu.MMU.readByte(cpu.PC) + cpu.X
 		cpu.PC++
-		// Read the address from the same page
-		address = cpu.MMU.readWord(address)
-
-		// Check if the address is in the page boundary
-		if (address+uint16(cpu.X))&0xFF < address&0xFF {
-			// Address is in the page boundary, so read the address from the next page (fixes JMP ($xxFF) bug)
-			low := cpu.MMU.readByte(address & 0xFF00)
-			high := cpu.MMU.readByte((address & 0xFF00) | ((address + uint16(cpu.X)) & 0xFF))
-			return uint16(high)<<8 | uint16(low)
-		} else {
-			// Address is not in the page boundary, so read the address from the same page
-			return cpu.MMU.readWord(address + uint16(cpu.X))
-		}
+		// Read the address from the zero page
+		return cpu.readZeroPageWord(pointer)
 	},
 	// (Indirect), Y
 	12: func(cpu *CPU) uint16 {
-		// Read the address from the next byte
-		address := uint16(cpu.MMU.readByte(cpu.PC))
+		// Read the zero page address from the next byte
+		pointer := cpu.MMU.readByte(cpu.PC)
 		cpu.PC++
-		// Read the address from the same page
-		address = cpu.MMU.readWord(address)
+		// Read the base address from the zero page and add the Y register
+		baseAddress := cpu.readZeroPageWord(pointer)
+		effectiveAddress := baseAddress + uint16(cpu.Y)
 
-		// Check if the address is in the page boundary
-		if (address+uint16(cpu.Y))&0xFF < address&0xFF {
-			// Address is in the page boundary, so read the address from the next page (fixes JMP ($xxFF) bug)
-			low := cpu.MMU.readByte(address & 0xFF00)
-			high := cpu.MMU.readByte((address & 0xFF00) | ((address + uint16(cpu.Y)) & 0xFF))
-			return uint16(high)<<8 | uint16(low)
-		} else {
-			// Address is not in the page boundary, so read the address from the same page
-			return cpu.MMU.readWord(address + uint16(cpu.Y))
-		}
+		// Note whether a page boundary was crossed, which costs reads an
+		// extra cycle
+		cpu.pageCrossed = effectiveAddress>>8 != baseAddress>>8
+		return effectiveAddress
+	},
+	// (Zero Page), 65C02 only
+	13: func(cpu *CPU) uint16 {
+		// Read the zero page address from the next byte
+		pointer := cpu.MMU.readByte(cpu.PC)
+		cpu.PC++
+		// Read the address from the zero page
+		return cpu.readZeroPageWord(pointer)
+	},
+	// (Absolute, X), 65C02 only
+	14: func(cpu *CPU) uint16 {
+		// Read the address from the next two bytes and add the X register
+		address := cpu.MMU.readWord(cpu.PC) + uint16(cpu.X)
+		cpu.PC += 2
+		// Read the address from there
+		return cpu.MMU.readWord(address)
+	},
+	// Zero Page, Relative, 65C02 only
+	15: func(cpu *CPU) uint16 {
+		// Read the zero page address from the next byte. The branch offset
+		// after it is fetched by the instruction.
+		address := cpu.MMU.readByte(cpu.PC)
+		cpu.PC++
+		return uint16(address)
 	},
 }
 
@@ -163,4 +169,13 @@ var addressingModeNames = map[int]string{
 	10: "Indirect",
 	11: "IndirectX",
 	12: "IndirectY",
+	13: "ZeroPageIndirect",
+	14: "AbsoluteIndexedIndirect",
+	15: "ZeroPageRelative",
+}
+
+// readZeroPageWord reads a pointer from the zero page, wrapping around from
+// $FF to $00 for the high byte
+func (cpu *CPU) readZeroPageWord(address uint8) uint16 {
+	return uint16(cpu.MMU.readByte(uint16(address))) | uint16(cpu.MMU.readByte(uint16(address+1)))<<8
 }
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Addressing modes, matching the keys of addressingModes and addressingModeNames
+const (
+	modeImplied     = 0
+	modeAccumulator = 1
+	modeImmediate   = 2
+	modeZeroPage    = 3
+	modeZeroPageX   = 4
+	modeZeroPageY   = 5
+	modeRelative    = 6
+	modeAbsolute    = 7
+	modeAbsoluteX   = 8
+	modeAbsoluteY   = 9
+	modeIndirect    = 10
+	modeIndirectX   = 11
+	modeIndirectY   = 12
+	// 65C02 only
+	modeZeroPageIndirect        = 13
+	modeAbsoluteIndexedIndirect = 14
+	modeZeroPageRelative        = 15
+)
+
+// opcodeTables map a mnemonic and addressing mode to its opcode, for each
+// variant
+var opcodeTables = map[Variant]map[string]map[int]uint8{
+	NMOS6502:  buildOpcodeTable(instructions),
+	CMOS65C02: buildOpcodeTable(cmosInstructions),
+}
+
+// buildOpcodeTable builds the opcode table for an instruction set. The 65C02's
+// undefined opcodes, which are NOPs, are left out so that NOP assembles to $EA.
+func buildOpcodeTable(set map[uint8]Instruction) map[string]map[int]uint8 {
+	table := map[string]map[int]uint8{}
+	for opcode, inst := range set {
+		if inst.mnemonic == "NOP" && opcode != 0xEA {
+			continue
+		}
+		if table[inst.mnemonic] == nil {
+			table[inst.mnemonic] = map[int]uint8{}
+		}
+		table[inst.mnemonic][inst.addressingMode] = opcode
+	}
+	return table
+}
+
+// sourceText is a line of assembler source and where it came from
+type sourceText struct {
+	file   string
+	number int
+	text   string
+}
+
+// assemblerError is an error at a particular source line
+type assemblerError struct {
+	file   string
+	number int
+	err    error
+}
+
+func (e *assemblerError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.file, e.number, e.err)
+}
+
+// assemblerErrors is the list of errors found while assembling
+type assemblerErrors []*assemblerError
+
+func (errs assemblerErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Assembler is a two-pass assembler for the test.asm dialect: labels ending in
+// a colon, lowercase or uppercase mnemonics, name = value equates and the
+// .org, .byte, .word and .include directives
+type Assembler struct {
+	// variant is the CPU whose instructions are assembled
+	variant Variant
+	symbols map[string]int
+	lines   []sourceText
+	// modes remembers the addressing mode chosen for each line in the first
+	// pass, so that forward references cannot change an instruction's size
+	modes  map[int]int
+	pass   int
+	pc     int
+	memory [RAMSize]uint8
+	used   [RAMSize]bool
+	errors assemblerErrors
+}
+
+// NewAssembler creates an assembler for a variant with no symbols defined
+func NewAssembler(variant Variant) *Assembler {
+	return &Assembler{variant: variant, symbols: map[string]int{}, modes: map[int]int{}}
+}
+
+// assembleFile assembles a source file and everything it includes
+func (asm *Assembler) assembleFile(fileName string) error {
+	lines, err := readSource(fileName, 0)
+	if err != nil {
+		return err
+	}
+	asm.lines = lines
+	// The first pass defines the labels, the second emits the code
+	for asm.pass = 1; asm.pass <= 2; asm.pass++ {
+		asm.pc = 0
+		for i, line := range asm.lines {
+			if err := asm.assembleLine(i, line.text); err != nil {
+				// Undefined symbols may still be defined later in the first pass
+				if _, undefined := err.(*undefinedSymbolError); undefined && asm.pass == 1 {
+					continue
+				}
+				asm.errors = append(asm.errors, &assemblerError{file: line.file, number: line.number, err: err})
+			}
+		}
+		if len(asm.errors) > 0 {
+			return asm.errors
+		}
+	}
+	return nil
+}
+
+// maxIncludeDepth stops files that include themselves
+const maxIncludeDepth = 16
+
+// readSource reads a source file, expanding .include directives in place
+func readSource(fileName string, depth int) ([]sourceText, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("%s: includes nested too deeply", fileName)
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var lines []sourceText
+	for i, text := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		_, directive, operand := splitSourceLine(text)
+		if strings.ToLower(directive) != ".include" {
+			lines = append(lines, sourceText{file: fileName, number: i + 1, text: text})
+			continue
+		}
+		// Included files are found relative to the file including them
+		name, err := unquote(operand)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fileName, i+1, err)
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(fileName), name)
+		}
+		included, err := readSource(name, depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fileName, i+1, err)
+		}
+		lines = append(lines, included...)
+	}
+	return lines, nil
+}
+
+// splitSourceLine splits a line into its label, mnemonic or directive, and
+// operand, dropping any comment. An equate (name = value) comes back with its
+// name as the label and "=" as the op.
+func splitSourceLine(text string) (label, op, operand string) {
+	text = strings.TrimSpace(stripComment(text))
+	// name = value defines an equate
+	if i := strings.Index(text, "="); i > 0 && isSymbol(strings.TrimSpace(text[:i])) {
+		return strings.TrimSpace(text[:i]), "=", strings.TrimSpace(text[i+1:])
+	}
+	// A label is a symbol followed by a colon
+	if i := strings.Index(text, ":"); i > 0 && isSymbol(text[:i]) {
+		label = text[:i]
+		text = strings.TrimSpace(text[i+1:])
+	}
+	// The mnemonic or directive runs up to the first space
+	if i := strings.IndexFunc(text, unicode.IsSpace); i >= 0 {
+		return label, text[:i], strings.TrimSpace(text[i+1:])
+	}
+	return label, text, ""
+}
+
+// stripComment removes a ; comment, ignoring semicolons in strings and
+// character constants
+func stripComment(text string) string {
+	quoted := false
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '"':
+			quoted = !quoted
+		case quoted:
+		case text[i] == '\'':
+			// Skip the character after the quote
+			i++
+		case text[i] == ';':
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// isSymbol reports whether s is a valid symbol name
+func isSymbol(s string) bool {
+	if s == "" || !isSymbolStart(rune(s[0])) {
+		return false
+	}
+	for _, r := range s {
+		if !isSymbolChar(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// unquote removes the double quotes around a string
+func unquote(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", fmt.Errorf("expected a quoted string, got %q", s)
+	}
+	return s[1 : len(s)-1], nil
+}
+
+// assembleLine assembles the line at the given index in the current pass
+func (asm *Assembler) assembleLine(index int, text string) error {
+	label, op, operand := splitSourceLine(text)
+	if op == "=" {
+		value, err := asm.eval(operand)
+		if err != nil {
+			return err
+		}
+		return asm.define(label, value)
+	}
+	if label != "" {
+		if err := asm.define(label, asm.pc); err != nil {
+			return err
+		}
+	}
+	if op == "" {
+		return nil
+	}
+	switch strings.ToLower(op) {
+	case ".org":
+		value, err := asm.eval(operand)
+		if err != nil {
+			return err
+		}
+		if value < 0 || value >= RAMSize {
+			return fmt.Errorf(".org address $%X is outside the 64KB address space", value)
+		}
+		asm.pc = value
+		return nil
+	case ".byte", ".db":
+		return asm.emitData(operand, 1)
+	case ".word", ".dw":
+		return asm.emitData(operand, 2)
+	}
+	if strings.HasPrefix(op, ".") {
+		return fmt.Errorf("unknown directive %q", op)
+	}
+	return asm.emitInstruction(index, op, operand)
+}
+
+// define sets a symbol, complaining if the first pass defines it twice
+func (asm *Assembler) define(name string, value int) error {
+	if _, exists := asm.symbols[name]; exists && asm.pass == 1 {
+		return fmt.Errorf("symbol %q is already defined", name)
+	}
+	asm.symbols[name] = value
+	return nil
+}
+
+// eval evaluates an expression using the symbols defined so far
+func (asm *Assembler) eval(s string) (int, error) {
+	return evalExpr(s, &exprContext{
+		symbol: func(name string) (int, bool) {
+			value, ok := asm.symbols[name]
+			return value, ok
+		},
+		pc: asm.pc,
+	})
+}
+
+// emit writes bytes at the program counter in the second pass
+func (asm *Assembler) emit(data ...uint8) error {
+	if asm.pc+len(data) > RAMSize {
+		return fmt.Errorf("code runs past the end of the 64KB address space")
+	}
+	if asm.pass == 2 {
+		for i, b := range data {
+			asm.memory[asm.pc+i] = b
+			asm.used[asm.pc+i] = true
+		}
+	}
+	asm.pc += len(data)
+	return nil
+}
+
+// emitData handles .byte and .word, whose operands are a comma separated list
+// of expressions (and, for .byte, strings)
+func (asm *Assembler) emitData(operand string, size int) error {
+	items := splitOperands(operand)
+	if len(items) == 0 {
+		return fmt.Errorf("missing data")
+	}
+	for _, item := range items {
+		if size == 1 && strings.HasPrefix(item, "\"") {
+			text, err := unquote(item)
+			if err != nil {
+				return err
+			}
+			if err := asm.emit([]uint8(text)...); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := asm.eval(item)
+		if err != nil {
+			// Leave room for the value in the first pass
+			if _, undefined := err.(*undefinedSymbolError); undefined && asm.pass == 1 {
+				asm.pc += size
+				continue
+			}
+			return err
+		}
+		if size == 1 {
+			if err := checkRange(value, 8); err != nil {
+				return err
+			}
+			err = asm.emit(uint8(value))
+		} else {
+			if err := checkRange(value, 16); err != nil {
+				return err
+			}
+			err = asm.emit(uint8(value), uint8(value>>8))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitOperands splits on commas that are not inside quotes or brackets
+func splitOperands(s string) []string {
+	var items []string
+	depth := 0
+	quoted := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" || len(items) > 0 {
+		items = append(items, last)
+	}
+	return items
+}
+
+// checkRange makes sure a value fits in the given number of bits, allowing
+// negative numbers down to the signed minimum
+func checkRange(value int, bits uint) error {
+	if value < -(1<<(bits-1)) || value >= 1<<bits {
+		return fmt.Errorf("value %d does not fit in %d bits", value, bits)
+	}
+	return nil
+}
+
+// parsedOperand is an instruction operand split into its addressing syntax
+// and expression
+type parsedOperand struct {
+	modes         []int  // candidate modes, smallest first
+	expression    string // the address or value, if any
+	forceAbsolute bool   // a: prefix, never use zero page
+}
+
+// parseOperand works out which addressing modes an operand's syntax allows
+func parseOperand(operand string) parsedOperand {
+	s := strings.TrimSpace(operand)
+	lower := strings.ToLower(strings.ReplaceAll(s, " ", ""))
+	switch {
+	case s == "":
+		return parsedOperand{modes: []int{modeImplied, modeAccumulator}}
+	case lower == "a":
+		return parsedOperand{modes: []int{modeAccumulator}}
+	case strings.HasPrefix(s, "#"):
+		return parsedOperand{modes: []int{modeImmediate}, expression: s[1:]}
+	case strings.HasPrefix(lower, "(") && strings.HasSuffix(lower, ",x)"):
+		return parsedOperand{modes: []int{modeIndirectX, modeAbsoluteIndexedIndirect}, expression: s[1:strings.LastIndex(s, ",")]}
+	case strings.HasPrefix(lower, "(") && strings.HasSuffix(lower, "),y"):
+		return parsedOperand{modes: []int{modeIndirectY}, expression: s[1:strings.LastIndex(s, ")")]}
+	}
+	parsed := parsedOperand{expression: s}
+	// a: forces absolute addressing, as in ca65
+	if strings.HasPrefix(lower, "a:") {
+		parsed.forceAbsolute = true
+		parsed.expression = strings.TrimSpace(s[2:])
+		lower = lower[2:]
+	}
+	switch {
+	case strings.HasSuffix(lower, ",x"):
+		parsed.modes = []int{modeZeroPageX, modeAbsoluteX}
+	case strings.HasSuffix(lower, ",y"):
+		parsed.modes = []int{modeZeroPageY, modeAbsoluteY}
+	case strings.HasPrefix(lower, "(") && strings.HasSuffix(lower, ")") && isBracketed(lower):
+		// (address) is indirect: JMP's, or the 65C02's (zp)
+		parsed.modes = []int{modeIndirect, modeZeroPageIndirect}
+		parsed.expression = strings.TrimSpace(parsed.expression[1 : len(parsed.expression)-1])
+		return parsed
+	default:
+		parsed.modes = []int{modeRelative, modeZeroPage, modeAbsolute}
+		return parsed
+	}
+	parsed.expression = strings.TrimSpace(parsed.expression[:strings.LastIndex(parsed.expression, ",")])
+	return parsed
+}
+
+// isBracketed reports whether the whole of s is inside one pair of brackets
+func isBracketed(s string) bool {
+	depth := 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 && i != len(s)-1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// emitInstruction assembles one instruction
+func (asm *Assembler) emitInstruction(index int, mnemonic, operand string) error {
+	code, mode, err := encodeInstruction(asm.variant, mnemonic, operand, asm.pc, asm.modes[index], asm.pass == 1, asm.eval)
+	if asm.pass == 1 {
+		asm.modes[index] = mode
+	}
+	if err != nil {
+		// Leave room for the instruction in the first pass
+		if _, undefined := err.(*undefinedSymbolError); undefined && asm.pass == 1 && mode >= 0 {
+			asm.pc += asm.variant.instructionSet()[opcodeTables[asm.variant][strings.ToUpper(mnemonic)][mode]].length
+		}
+		return err
+	}
+	return asm.emit(code...)
+}
+
+// encodeInstruction encodes an instruction for a variant at address pc. In the
+// first pass (or on its own) it picks the addressing mode and returns it; later
+// passes hand that mode back in so that the instruction keeps its size. If the
+// operand cannot be evaluated yet the chosen mode is still returned, or -1 if
+// there is no valid mode at all.
+func encodeInstruction(variant Variant, mnemonic, operand string, pc, previousMode int, choose bool, eval func(string) (int, error)) ([]uint8, int, error) {
+	modes, ok := opcodeTables[variant][strings.ToUpper(mnemonic)]
+	if !ok {
+		return nil, -1, fmt.Errorf("unknown instruction %q for the %s", mnemonic, variant)
+	}
+	if opcode, ok := modes[modeZeroPageRelative]; ok {
+		return encodeBitBranch(opcode, operand, pc, eval)
+	}
+	parsed := parseOperand(operand)
+	// Evaluate the operand, if there is one
+	value, valueErr := 0, error(nil)
+	if parsed.expression != "" {
+		value, valueErr = eval(parsed.expression)
+		if valueErr != nil {
+			if _, undefined := valueErr.(*undefinedSymbolError); !undefined {
+				return nil, -1, valueErr
+			}
+		}
+	}
+	mode := previousMode
+	if choose {
+		mode = chooseMode(modes, parsed, value, valueErr == nil)
+		if mode < 0 {
+			return nil, -1, fmt.Errorf("%s does not support operand %q on the %s", strings.ToUpper(mnemonic), operand, variant)
+		}
+	}
+	if valueErr != nil {
+		return nil, mode, valueErr
+	}
+	opcode := modes[mode]
+	switch variant.instructionSet()[opcode].length {
+	case 1:
+		return []uint8{opcode}, mode, nil
+	case 2:
+		if mode == modeRelative {
+			// Branches are relative to the end of the instruction
+			offset := value - (pc + 2)
+			if offset < -128 || offset > 127 {
+				return nil, mode, fmt.Errorf("branch target $%04X is out of range", value)
+			}
+			return []uint8{opcode, uint8(offset)}, mode, nil
+		}
+		if err := checkRange(value, 8); err != nil {
+			return nil, mode, err
+		}
+		return []uint8{opcode, uint8(value)}, mode, nil
+	default:
+		if err := checkRange(value, 16); err != nil {
+			return nil, mode, err
+		}
+		return []uint8{opcode, uint8(value), uint8(value >> 8)}, mode, nil
+	}
+}
+
+// encodeBitBranch encodes the 65C02's BBRn and BBSn, whose operand is a zero
+// page address and a branch target
+func encodeBitBranch(opcode uint8, operand string, pc int, eval func(string) (int, error)) ([]uint8, int, error) {
+	items := splitOperands(operand)
+	if len(items) != 2 {
+		return nil, -1, fmt.Errorf("expected a zero page address and a branch target, got %q", operand)
+	}
+	address, err := eval(items[0])
+	if err != nil {
+		return nil, modeZeroPageRelative, err
+	}
+	target, err := eval(items[1])
+	if err != nil {
+		return nil, modeZeroPageRelative, err
+	}
+	if err := checkRange(address, 8); err != nil {
+		return nil, modeZeroPageRelative, err
+	}
+	// Branches are relative to the end of the instruction
+	offset := target - (pc + 3)
+	if offset < -128 || offset > 127 {
+		return nil, modeZeroPageRelative, fmt.Errorf("branch target $%04X is out of range", target)
+	}
+	return []uint8{opcode, uint8(address), uint8(offset)}, modeZeroPageRelative, nil
+}
+
+// chooseMode picks the addressing mode for an operand, using zero page when
+// the value is known to fit and the instruction allows it
+func chooseMode(modes map[int]uint8, parsed parsedOperand, value int, known bool) int {
+	for _, mode := range parsed.modes {
+		if _, ok := modes[mode]; !ok {
+			continue
+		}
+		zeroPage := mode == modeZeroPage || mode == modeZeroPageX || mode == modeZeroPageY
+		if zeroPage && (parsed.forceAbsolute || !known || value < 0 || value > 0xFF) {
+			// Only use zero page if there is no absolute form to fall back on
+			if _, ok := modes[mode+modeAbsolute-modeZeroPage]; ok {
+				continue
+			}
+		}
+		return mode
+	}
+	return -1
+}
+
+// image returns the assembled code as a flat binary covering everything from
+// the lowest to the highest address written, and the address it starts at
+func (asm *Assembler) image() ([]uint8, uint16) {
+	low, high := -1, -1
+	for address, used := range asm.used {
+		if used {
+			if low < 0 {
+				low = address
+			}
+			high = address
+		}
+	}
+	if low < 0 {
+		return nil, 0
+	}
+	return append([]uint8(nil), asm.memory[low:high+1]...), uint16(low)
+}
+
+// writeSymbols writes the symbol table as name = $value lines, which the
+// assembler can read back with .include
+func (asm *Assembler) writeSymbols(fileName string) error {
+	names := make([]string, 0, len(asm.symbols))
+	for name := range asm.symbols {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if asm.symbols[names[i]] != asm.symbols[names[j]] {
+			return asm.symbols[names[i]] < asm.symbols[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s = $%04X\n", name, asm.symbols[name]&0xFFFF)
+	}
+	return os.WriteFile(fileName, []byte(b.String()), 0644)
+}
+
+func printAssemblerUsage() {
+	fmt.Println("Usage: go6502 asm [options] source.asm")
+	fmt.Println("Options:")
+	fmt.Println("  -o, --output\t\tWrite the binary to this file (default source.bin)")
+	fmt.Println("  -s, --symbols\t\tWrite the symbols to this file (default source.sym)")
+	fmt.Println("  --cpu <6502|65c02>\tAssemble for this CPU (default 6502)")
+	fmt.Println("Example: go6502 asm -o test.bin test.asm")
+}
+
+// assemblerCommand implements the asm subcommand
+func assemblerCommand(args []string) int {
+	var source, output, symbols string
+	variant := NMOS6502
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-h", "--help":
+			printAssemblerUsage()
+			return 0
+		case "-o", "--output", "-s", "--symbols":
+			if i+1 >= len(args) {
+				fmt.Println("Missing file name for", args[i])
+				return 1
+			}
+			if args[i] == "-o" || args[i] == "--output" {
+				output = args[i+1]
+			} else {
+				symbols = args[i+1]
+			}
+			i++
+		case "--cpu":
+			if i+1 >= len(args) {
+				fmt.Println("Missing CPU")
+				return 1
+			}
+			i++
+			v, err := parseVariant(args[i])
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			variant = v
+		default:
+			if strings.HasPrefix(args[i], "-") || source != "" {
+				fmt.Println("Invalid option:", args[i])
+				return 1
+			}
+			source = args[i]
+		}
+	}
+	if source == "" {
+		printAssemblerUsage()
+		return 1
+	}
+	// Name the outputs after the source by default
+	base := strings.TrimSuffix(source, filepath.Ext(source))
+	if output == "" {
+		output = base + ".bin"
+	}
+	if symbols == "" {
+		symbols = base + ".sym"
+	}
+
+	asm := NewAssembler(variant)
+	if err := asm.assembleFile(source); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	code, start := asm.image()
+	if err := os.WriteFile(output, code, 0644); err != nil {
+		fmt.Println("Error writing binary:", err)
+		return 1
+	}
+	if err := asm.writeSymbols(symbols); err != nil {
+		fmt.Println("Error writing symbols:", err)
+		return 1
+	}
+	fmt.Printf("Assembled %d bytes at $%04X to %s\n", len(code), start, output)
+	return 0
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// assembleSource writes source files to a temporary directory and assembles
+// the first of them
+func assembleSource(t *testing.T, variant Variant, files ...string) (*Assembler, error) {
+	t.Helper()
+	dir := t.TempDir()
+	for i, source := range files {
+		name := "main.asm"
+		if i > 0 {
+			name = "include" + string(rune('0'+i)) + ".asm"
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	asm := NewAssembler(variant)
+	return asm, asm.assembleFile(filepath.Join(dir, "main.asm"))
+}
+
+func TestAssembleLabelsAndExpressions(t *testing.T) {
+	asm, err := assembleSource(t, NMOS6502, `
+count = 3
+ptr = $10
+.org $0200
+start:  ldx #count*2+1    ; 7
+        lda table,x
+        sta ptr
+        lda (ptr),y
+        lda a:ptr
+        bne later        ; a forward reference
+        jmp start
+later:  lda #<table
+        ldy #>table
+        rts
+table:  .byte 1, "ab", 'c'
+        .word later, table - start
+        bcc *
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, start := asm.image()
+	want := []uint8{
+		0xA2, 0x07, // LDX #7
+		0xBD, 0x16, 0x02, // LDA table,X
+		0x85, 0x10, // STA $10
+		0xB1, 0x10, // LDA ($10),Y
+		0xAD, 0x10, 0x00, // LDA a:$10
+		0xD0, 0x03, // BNE later
+		0x4C, 0x00, 0x02, // JMP start
+		0xA9, 0x16, // LDA #<table
+		0xA0, 0x02, // LDY #>table
+		0x60,                   // RTS
+		0x01, 0x61, 0x62, 0x63, // .byte
+		0x11, 0x02, 0x16, 0x00, // .word
+		0x90, 0xFE, // BCC *
+	}
+	if start != 0x0200 || !bytes.Equal(code, want) {
+		t.Errorf("expected at $0200:\n% X\ngot at $%04X:\n% X", want, start, code)
+	}
+	if asm.symbols["later"] != 0x0211 || asm.symbols["ptr"] != 0x10 {
+		t.Errorf("expected later = $0211 and ptr = $10, got $%04X and $%04X", asm.symbols["later"], asm.symbols["ptr"])
+	}
+}
+
+func TestAssembleForwardZeroPage(t *testing.T) {
+	// A forward reference takes absolute addressing in the first pass, and
+	// keeps it so that the labels after it do not move
+	asm, err := assembleSource(t, NMOS6502, `
+.org $0300
+        lda value
+after:  rts
+value = $20
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := asm.image()
+	if want := []uint8{0xAD, 0x20, 0x00, 0x60}; !bytes.Equal(code, want) {
+		t.Errorf("expected % X, got % X", want, code)
+	}
+	if asm.symbols["after"] != 0x0303 {
+		t.Errorf("expected after = $0303, got $%04X", asm.symbols["after"])
+	}
+}
+
+func TestAssembleInclude(t *testing.T) {
+	asm, err := assembleSource(t, NMOS6502, `
+.include "include1.asm"
+.org base
+        lda #value
+`, `base = $0400
+value = 'x'
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, start := asm.image()
+	if start != 0x0400 || !bytes.Equal(code, []uint8{0xA9, 'x'}) {
+		t.Errorf("expected A9 78 at $0400, got % X at $%04X", code, start)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		name, source, want string
+	}{
+		{"undefined symbol", ".org $0200\n nop\n lda missing\n", "main.asm:3: "},
+		{"unknown instruction", ".org $0200\n\n foo #1\n", "main.asm:3: unknown instruction \"foo\""},
+		{"branch out of range", ".org $0200\n bne far\n .org $0300\nfar: rts\n", "main.asm:2: branch target $0300 is out of range"},
+		{"duplicate label", "a1: nop\na1: nop\n", "main.asm:2: "},
+		{"(zp) on the 6502", " lda ($10)\n", "main.asm:1: LDA does not support operand \"($10)\" on the 6502"},
+		{"immediate too big", " lda #$100\n", "main.asm:1: "},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := assembleSource(t, NMOS6502, test.source)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("expected an error containing %q, got %q", test.want, err)
+			}
+		})
+	}
+}
+
+func TestAssemble65C02(t *testing.T) {
+	asm, err := assembleSource(t, CMOS65C02, `
+.org $0200
+start:  lda ($10)
+        jmp ($1234)
+        jmp (table,x)
+        stz $10
+        bbr3 $12, start
+        nop
+table:  rts
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := asm.image()
+	want := []uint8{
+		0xB2, 0x10, // LDA ($10)
+		0x6C, 0x34, 0x12, // JMP ($1234)
+		0x7C, 0x0E, 0x02, // JMP (table,X)
+		0x64, 0x10, // STZ $10
+		0x3F, 0x12, 0xF3, // BBR3 $12,start
+		0xEA, // NOP
+		0x60, // RTS
+	}
+	if !bytes.Equal(code, want) {
+		t.Errorf("expected:\n% X\ngot:\n% X", want, code)
+	}
+}
+
+func TestAssembleTestProgram(t *testing.T) {
+	asm := NewAssembler(NMOS6502)
+	if err := asm.assembleFile("test.asm"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("test.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, start := asm.image()
+	if start != 0x8000 || !bytes.Equal(code, want) {
+		t.Errorf("expected test.asm to assemble to test.bin at $8000, got %d bytes at $%04X", len(code), start)
+	}
+}
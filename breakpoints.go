@@ -0,0 +1,435 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// breakpointKind is what a breakpoint watches for
+type breakpointKind int
+
+const (
+	breakExecute   breakpointKind = iota // the PC reaching an address
+	breakRead                            // a read from an address range
+	breakWrite                           // a write to an address range
+	breakAccess                          // a read or write to an address range
+	breakOpcode                          // an opcode about to execute
+	breakIRQ                             // an IRQ being taken
+	breakNMI                             // an NMI being taken
+	breakInterrupt                       // either kind of interrupt
+)
+
+// breakpointKindNames maps the names used in breakpoint specs to their kinds
+var breakpointKindNames = map[string]breakpointKind{
+	"exec":      breakExecute,
+	"read":      breakRead,
+	"write":     breakWrite,
+	"access":    breakAccess,
+	"opcode":    breakOpcode,
+	"irq":       breakIRQ,
+	"nmi":       breakNMI,
+	"interrupt": breakInterrupt,
+}
+
+func (kind breakpointKind) String() string {
+	for name, k := range breakpointKindNames {
+		if k == kind {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// isWatchpoint reports whether the kind is triggered by memory accesses
+func (kind breakpointKind) isWatchpoint() bool {
+	return kind == breakRead || kind == breakWrite || kind == breakAccess
+}
+
+// Breakpoint stops execution when something happens, if its condition holds
+type Breakpoint struct {
+	id         int
+	kind       breakpointKind
+	start, end uint16 // the address or address range, or the opcode in start
+	condition  expr   // must be true for the breakpoint to count, if set
+	// conditionText is the condition as it was written
+	conditionText string
+	// hitCount is the hit to first stop on: it stops on that hit and every
+	// one after. 0 stops on every hit.
+	hitCount int
+	hits     int // times the breakpoint has been hit with its condition true
+}
+
+func (bp *Breakpoint) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#%d %s", bp.id, bp.kind)
+	switch {
+	case bp.kind == breakOpcode:
+		fmt.Fprintf(&b, " $%02X", bp.start)
+	case bp.kind == breakExecute || bp.start == bp.end && bp.kind.isWatchpoint():
+		fmt.Fprintf(&b, " $%04X", bp.start)
+	case bp.kind.isWatchpoint():
+		fmt.Fprintf(&b, " $%04X..$%04X", bp.start, bp.end)
+	}
+	if bp.hitCount > 0 {
+		fmt.Fprintf(&b, " hits %d", bp.hitCount)
+	}
+	if bp.condition != nil {
+		fmt.Fprintf(&b, " if %s", bp.conditionText)
+	}
+	fmt.Fprintf(&b, " (hit %d times)", bp.hits)
+	return b.String()
+}
+
+// parseBreakpoint parses a breakpoint spec:
+//
+//	[kind] [location] [hits count] [if condition]
+//
+// The kind defaults to exec. Locations are an address, a start..end range for
+// watchpoints, or an opcode; IRQ and NMI breaks take none. value evaluates
+// addresses and opcodes.
+func parseBreakpoint(spec string, value func(string) (int, error)) (*Breakpoint, error) {
+	bp := &Breakpoint{kind: breakExecute}
+	// The condition is everything after "if"
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "if ") {
+		spec = " " + spec
+	}
+	spec, bp.conditionText, _ = strings.Cut(spec, " if ")
+	fields := strings.Fields(spec)
+	if len(fields) > 0 {
+		if kind, ok := breakpointKindNames[strings.ToLower(fields[0])]; ok {
+			bp.kind = kind
+			fields = fields[1:]
+		}
+	}
+	// Look for a hit count
+	for i := 0; i+1 < len(fields); i++ {
+		if strings.ToLower(fields[i]) == "hits" {
+			count, err := strconv.Atoi(fields[i+1])
+			if err != nil || count < 0 {
+				return nil, fmt.Errorf("invalid hit count %q", fields[i+1])
+			}
+			bp.hitCount = count
+			fields = append(fields[:i], fields[i+2:]...)
+			break
+		}
+	}
+	switch bp.kind {
+	case breakIRQ, breakNMI, breakInterrupt:
+		if len(fields) > 0 {
+			return nil, fmt.Errorf("%s breakpoints do not take a location", bp.kind)
+		}
+	default:
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("%s breakpoints need one location", bp.kind)
+		}
+		if err := bp.parseLocation(fields[0], value); err != nil {
+			return nil, err
+		}
+	}
+	if bp.conditionText != "" {
+		condition, err := parseExpr(bp.conditionText)
+		if err != nil {
+			return nil, fmt.Errorf("condition: %v", err)
+		}
+		bp.condition = condition
+	}
+	return bp, nil
+}
+
+// parseLocation parses the address, range or opcode of a breakpoint
+func (bp *Breakpoint) parseLocation(location string, value func(string) (int, error)) error {
+	startText, endText, isRange := strings.Cut(location, "..")
+	if isRange && !bp.kind.isWatchpoint() {
+		return fmt.Errorf("%s breakpoints cannot cover a range", bp.kind)
+	}
+	start, err := value(startText)
+	if err != nil {
+		return err
+	}
+	limit := 0xFFFF
+	if bp.kind == breakOpcode {
+		limit = 0xFF
+	}
+	if start < 0 || start > limit {
+		return fmt.Errorf("$%X is out of range", start)
+	}
+	end := start
+	if isRange {
+		if end, err = value(endText); err != nil {
+			return err
+		}
+		if end < start || end > 0xFFFF {
+			return fmt.Errorf("invalid range %s", location)
+		}
+	}
+	bp.start, bp.end = uint16(start), uint16(end)
+	return nil
+}
+
+// BreakpointSet holds a CPU's breakpoints and watchpoints, and notes which one
+// stopped it. Its methods can be called on a nil set, which never stops.
+type BreakpointSet struct {
+	cpu         *CPU
+	breakpoints []*Breakpoint
+	nextID      int
+	// hit is the breakpoint that stopped execution, if one did
+	hit *Breakpoint
+	// hitAccess describes the access that triggered a watchpoint, and
+	// hitAddress is the address it was to
+	hitAccess  string
+	hitAddress uint16
+	// conditionError is the last error from evaluating a condition
+	conditionError error
+}
+
+// newBreakpointSet creates an empty set of breakpoints for a CPU
+func newBreakpointSet(cpu *CPU) *BreakpointSet {
+	return &BreakpointSet{cpu: cpu, nextID: 1}
+}
+
+// add adds a breakpoint to the set, giving it an id
+func (set *BreakpointSet) add(bp *Breakpoint) error {
+	if err := set.checkCondition(bp); err != nil {
+		return err
+	}
+	bp.id = set.nextID
+	set.nextID++
+	set.breakpoints = append(set.breakpoints, bp)
+	set.updateWatch()
+	return nil
+}
+
+// remove removes a breakpoint by its id
+func (set *BreakpointSet) remove(id int) error {
+	for i, bp := range set.breakpoints {
+		if bp.id == id {
+			set.breakpoints = append(set.breakpoints[:i], set.breakpoints[i+1:]...)
+			set.updateWatch()
+			return nil
+		}
+	}
+	return fmt.Errorf("no breakpoint #%d", id)
+}
+
+// clear removes all the breakpoints
+func (set *BreakpointSet) clear() {
+	set.breakpoints = nil
+	set.updateWatch()
+}
+
+// updateWatch hooks the set into the MMU if there are any watchpoints, so
+// that memory accesses cost nothing extra when there are none
+func (set *BreakpointSet) updateWatch() {
+	set.cpu.MMU.watch = nil
+	for _, bp := range set.breakpoints {
+		if bp.kind.isWatchpoint() {
+			set.cpu.MMU.watch = set.access
+			return
+		}
+	}
+}
+
+// resume forgets the last hit, before execution carries on
+func (set *BreakpointSet) resume() {
+	if set != nil {
+		set.hit = nil
+		set.hitAccess = ""
+	}
+}
+
+// stopped reports whether a breakpoint has stopped execution
+func (set *BreakpointSet) stopped() bool {
+	return set != nil && set.hit != nil
+}
+
+// trigger counts a hit on a breakpoint whose event has happened, stopping if
+// its condition holds and it has reached its hit count. Running backwards,
+// hits are not counted, and it stops whenever the condition holds.
+func (set *BreakpointSet) trigger(bp *Breakpoint, reverse bool) bool {
+	if bp.condition != nil {
+		value, err := bp.condition.eval(set.context())
+		if err != nil {
+			// Stop, so that a broken condition does not go unnoticed
+			set.conditionError = err
+			set.hit = bp
+			return true
+		}
+		if value == 0 {
+			return false
+		}
+	}
+	if !reverse {
+		bp.hits++
+		if bp.hits < bp.hitCount {
+			return false
+		}
+	}
+	set.hit = bp
+	return true
+}
+
+// context is the context conditions are evaluated in: the registers and flags
+// by name, the debug info's symbols and [address] memory reads
+func (set *BreakpointSet) context() *exprContext {
+	cpu := set.cpu
+	return &exprContext{symbol: cpu.registerValue, pc: int(cpu.PC), memory: cpu.MMU.peekByte}
+}
+
+// beforeInstruction checks the exec and opcode breakpoints against the
+// instruction at the PC, reporting whether execution should stop before it
+func (set *BreakpointSet) beforeInstruction() bool {
+	return set.checkInstruction(false)
+}
+
+// atInstruction is beforeInstruction for running backwards
+func (set *BreakpointSet) atInstruction() bool {
+	return set.checkInstruction(true)
+}
+
+// checkInstruction checks the exec and opcode breakpoints against the
+// instruction at the PC
+func (set *BreakpointSet) checkInstruction(reverse bool) bool {
+	if set == nil {
+		return false
+	}
+	cpu := set.cpu
+	for _, bp := range set.breakpoints {
+		switch {
+		case bp.kind == breakExecute && bp.start == cpu.PC,
+			bp.kind == breakOpcode && uint16(cpu.MMU.peekByte(cpu.PC)) == bp.start:
+			if set.trigger(bp, reverse) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// access checks the watchpoints against a memory access. The instruction's own
+// bytes being fetched do not count as reads.
+func (set *BreakpointSet) access(address uint16, value uint8, write bool) {
+	if set.hit != nil {
+		return
+	}
+	cpu := set.cpu
+	if !write {
+		length := 1
+		if inst, ok := cpu.instructionSet()[cpu.MMU.peekByte(cpu.instructionAddress)]; ok {
+			length = inst.length
+		}
+		if int(address-cpu.instructionAddress) < length {
+			return
+		}
+	}
+	for _, bp := range set.breakpoints {
+		if !bp.kind.isWatchpoint() || address < bp.start || address > bp.end {
+			continue
+		}
+		if bp.kind == breakRead && write || bp.kind == breakWrite && !write {
+			continue
+		}
+		if set.trigger(bp, false) {
+			action := "read"
+			if write {
+				action = "write"
+			}
+			set.hitAccess = fmt.Sprintf("%s $%02X at $%04X", action, value, address)
+			set.hitAddress = address
+			return
+		}
+	}
+}
+
+// undoneWrite checks the write watchpoints against a write being undone,
+// running backwards
+func (set *BreakpointSet) undoneWrite(address uint16, value uint8) {
+	if set == nil || set.hit != nil {
+		return
+	}
+	for _, bp := range set.breakpoints {
+		if (bp.kind == breakWrite || bp.kind == breakAccess) && address >= bp.start && address <= bp.end {
+			if set.trigger(bp, true) {
+				set.hitAccess = fmt.Sprintf("write $%02X at $%04X", value, address)
+				set.hitAddress = address
+				return
+			}
+		}
+	}
+}
+
+// interrupt checks the interrupt breakpoints when an IRQ or NMI is taken
+func (set *BreakpointSet) interrupt(nmi bool) {
+	if set == nil {
+		return
+	}
+	for _, bp := range set.breakpoints {
+		if bp.kind == breakInterrupt || bp.kind == breakNMI && nmi || bp.kind == breakIRQ && !nmi {
+			if set.trigger(bp, false) {
+				return
+			}
+		}
+	}
+}
+
+// describeHit describes the breakpoint that stopped execution
+func (set *BreakpointSet) describeHit() string {
+	if !set.stopped() {
+		return ""
+	}
+	message := fmt.Sprintf("Breakpoint %s at $%04X", set.hit, set.cpu.PC)
+	if set.hitAccess != "" {
+		message += ": " + set.hitAccess
+	}
+	if set.conditionError != nil {
+		message += fmt.Sprintf(" (condition failed: %v)", set.conditionError)
+		set.conditionError = nil
+	}
+	return message
+}
+
+// registerValue looks up a register or flag by name for an expression, or
+// else a symbol from the debug info
+func (cpu *CPU) registerValue(name string) (int, bool) {
+	switch strings.ToUpper(name) {
+	case "A":
+		return int(cpu.A), true
+	case "X":
+		return int(cpu.X), true
+	case "Y":
+		return int(cpu.Y), true
+	case "SP", "S":
+		return int(cpu.SP), true
+	case "P":
+		return int(cpu.P), true
+	case "PC":
+		return int(cpu.PC), true
+	case "CYCLES":
+		return cpu.cycles, true
+	}
+	if flag, ok := registerFlags[strings.ToUpper(name)]; ok {
+		return boolValue(cpu.getFlag(flag)), true
+	}
+	if cpu.debugInfo != nil {
+		if value, ok := cpu.debugInfo.symbols[name]; ok {
+			return int(value), true
+		}
+	}
+	return 0, false
+}
+
+// checkCondition evaluates a condition once, to catch mistakes such as
+// misspelt names when a breakpoint is set rather than when it is hit
+func (set *BreakpointSet) checkCondition(bp *Breakpoint) error {
+	if bp.condition == nil {
+		return nil
+	}
+	_, err := bp.condition.eval(set.context())
+	var undefined *undefinedSymbolError
+	if errors.As(err, &undefined) {
+		return fmt.Errorf("condition: %v", err)
+	}
+	return nil
+}
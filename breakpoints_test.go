@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// breakpointProgram stores 0..7 at $0200..$0207, then loops forever
+var breakpointProgram = []uint8{
+	0xA2, 0x00, // 8000 LDX #$00
+	0x8A,             // 8002 TXA
+	0x9D, 0x00, 0x02, // 8003 STA $0200,X
+	0xE8,       // 8006 INX
+	0xE0, 0x08, // 8007 CPX #$08
+	0xD0, 0xF7, // 8009 BNE $8002
+	0x4C, 0x0B, 0x80, // 800B JMP $800B
+}
+
+// parseTestBreakpoint parses a breakpoint spec whose locations are numbers
+func parseTestBreakpoint(spec string) (*Breakpoint, error) {
+	return parseBreakpoint(spec, func(s string) (int, error) {
+		return evalExpr(s, &exprContext{})
+	})
+}
+
+// runToBreakpoint steps the program the way run does until a breakpoint
+// stops it, reporting whether one did within a limit
+func runToBreakpoint(cpu *CPU, limit int) bool {
+	cpu.breakpoints.resume()
+	for i := 0; i < limit; i++ {
+		if i > 0 && cpu.breakpoints.beforeInstruction() {
+			return true
+		}
+		cpu.step()
+		if cpu.breakpoints.stopped() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestParseBreakpoint(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"$8000", "#0 exec $8000 (hit 0 times)"},
+		{"exec $8000 hits 3", "#0 exec $8000 hits 3 (hit 0 times)"},
+		{"$8000 if A==$40 && [$0200]>3", "#0 exec $8000 if A==$40 && [$0200]>3 (hit 0 times)"},
+		{"read $0200", "#0 read $0200 (hit 0 times)"},
+		{"WRITE $0200..$02FF hits 2 if X>1", "#0 write $0200..$02FF hits 2 if X>1 (hit 0 times)"},
+		{"access $D000..$D0FF", "#0 access $D000..$D0FF (hit 0 times)"},
+		{"opcode $00", "#0 opcode $00 (hit 0 times)"},
+		{"irq", "#0 irq (hit 0 times)"},
+		{"nmi if C", "#0 nmi if C (hit 0 times)"},
+		{"interrupt hits 10", "#0 interrupt hits 10 (hit 0 times)"},
+	}
+	for _, test := range tests {
+		bp, err := parseTestBreakpoint(test.spec)
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+		} else if got := bp.String(); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.spec, test.want, got)
+		}
+	}
+}
+
+func TestParseBreakpointErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"", "exec breakpoints need one location"},
+		{"$8000 $9000", "exec breakpoints need one location"},
+		{"if A==0", "exec breakpoints need one location"},
+		{"$8000..$80FF", "exec breakpoints cannot cover a range"},
+		{"write $0300..$0200", "invalid range $0300..$0200"},
+		{"read $10000", "$10000 is out of range"},
+		{"opcode $100", "$100 is out of range"},
+		{"irq $8000", "irq breakpoints do not take a location"},
+		{"$8000 hits many", `invalid hit count "many"`},
+		{"$8000 hits -1", `invalid hit count "-1"`},
+		{"$8000 if A==", "condition: unexpected end of expression"},
+		{"nowhere", `undefined symbol "nowhere"`},
+	}
+	for _, test := range tests {
+		_, err := parseTestBreakpoint(test.spec)
+		if err == nil {
+			t.Errorf("%q: expected an error", test.spec)
+		} else if err.Error() != test.want {
+			t.Errorf("%q: expected %q, got %q", test.spec, test.want, err)
+		}
+	}
+}
+
+func TestBreakpointTriggers(t *testing.T) {
+	tests := []struct {
+		spec   string
+		pc     uint16
+		x      uint8
+		access string
+	}{
+		// Execution stops before the instruction
+		{"$8006", 0x8006, 0, ""},
+		{"$8006 hits 3", 0x8006, 2, ""},
+		{"opcode $E8 if X==5", 0x8006, 5, ""},
+		{"$8002 if [$0202]==2", 0x8002, 3, ""},
+		// Watchpoints stop after the instruction that made the access
+		{"write $0203", 0x8006, 3, "write $03 at $0203"},
+		{"access $0200..$02FF if A==4", 0x8006, 4, "write $04 at $0204"},
+		{"write $0200..$02FF hits 6", 0x8006, 5, "write $05 at $0205"},
+	}
+	for _, test := range tests {
+		cpu := newTestCPU(t, NMOS6502, breakpointProgram)
+		cpu.breakpoints = newBreakpointSet(cpu)
+		bp, err := parseTestBreakpoint(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cpu.breakpoints.add(bp); err != nil {
+			t.Fatal(err)
+		}
+		if !runToBreakpoint(cpu, 100) {
+			t.Errorf("%q: expected to stop", test.spec)
+			continue
+		}
+		if cpu.PC != test.pc || cpu.X != test.x || cpu.breakpoints.hitAccess != test.access {
+			t.Errorf("%q: expected to stop at $%04X with X=%d (%q), stopped at $%04X with X=%d (%q)",
+				test.spec, test.pc, test.x, test.access, cpu.PC, cpu.X, cpu.breakpoints.hitAccess)
+		}
+	}
+}
+
+func TestBreakpointMisses(t *testing.T) {
+	// None of these happen: the program only writes, never reads, its table,
+	// and fetching the operand of CPX #$08 is not a read of $8008
+	for _, spec := range []string{
+		"read $0200..$02FF",
+		"read $8008",
+		"write $0208",
+		"$8002 if X==8",
+		"$8006 hits 9",
+		"irq",
+	} {
+		cpu := newTestCPU(t, NMOS6502, breakpointProgram)
+		cpu.breakpoints = newBreakpointSet(cpu)
+		bp, err := parseTestBreakpoint(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cpu.breakpoints.add(bp); err != nil {
+			t.Fatal(err)
+		}
+		if runToBreakpoint(cpu, 100) {
+			t.Errorf("%q: expected not to stop, stopped at $%04X", spec, cpu.PC)
+		}
+	}
+}
+
+func TestBreakpointConditionErrors(t *testing.T) {
+	cpu := newTestCPU(t, NMOS6502, breakpointProgram)
+	cpu.breakpoints = newBreakpointSet(cpu)
+
+	// Misspelt names are caught when the breakpoint is set
+	bp, err := parseTestBreakpoint("$8006 if XX==1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.breakpoints.add(bp); err == nil || err.Error() != `condition: undefined symbol "XX"` {
+		t.Errorf("expected the misspelt name to be rejected, got %v", err)
+	}
+
+	// Other errors stop execution where they happen, and are reported
+	bp, err = parseTestBreakpoint("$8006 if 10/X")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.breakpoints.add(bp); err != nil {
+		t.Fatal(err)
+	}
+	if !runToBreakpoint(cpu, 100) || cpu.PC != 0x8006 || cpu.X != 0 {
+		t.Fatalf("expected to stop at the first $8006, stopped at $%04X", cpu.PC)
+	}
+	if message := cpu.breakpoints.describeHit(); !strings.HasSuffix(message, "(condition failed: division by zero)") {
+		t.Errorf("expected the condition error to be reported, got %q", message)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Variant is a member of the 6502 family
+type Variant int
+
+const (
+	NMOS6502  Variant = iota // the original NMOS 6502
+	CMOS65C02                // the WDC 65C02, with the Rockwell bit instructions
+)
+
+// variantNames maps the names accepted by --cpu to variants
+var variantNames = map[string]Variant{
+	"6502":  NMOS6502,
+	"nmos":  NMOS6502,
+	"65c02": CMOS65C02,
+	"cmos":  CMOS65C02,
+}
+
+// String returns the name of the variant
+func (v Variant) String() string {
+	if v == CMOS65C02 {
+		return "65C02"
+	}
+	return "6502"
+}
+
+// parseVariant parses a CPU variant name
+func parseVariant(name string) (Variant, error) {
+	variant, ok := variantNames[strings.ToLower(name)]
+	if !ok {
+		return NMOS6502, fmt.Errorf("unknown CPU %q, use 6502 or 65c02", name)
+	}
+	return variant, nil
+}
+
+// instructionSet returns the instruction table for a variant
+func (v Variant) instructionSet() map[uint8]Instruction {
+	if v == CMOS65C02 {
+		return cmosInstructions
+	}
+	return instructions
+}
+
+// instructionSet returns the instruction table for the CPU's variant
+func (cpu *CPU) instructionSet() map[uint8]Instruction {
+	return cpu.variant.instructionSet()
+}
+
+// decode decodes the instruction at an address for the CPU's variant, without
+// side effects
+func (cpu *CPU) decode(address uint16) decodedInstruction {
+	return decodeInstructionFrom(cpu.instructionSet(), cpu.MMU.peekByte, address)
+}
+
+// cmosInstructions is the instruction table of the 65C02: the 6502's, with the
+// new instructions and addressing modes, and every undefined opcode a NOP
+var cmosInstructions = buildCMOSInstructions()
+
+func buildCMOSInstructions() map[uint8]Instruction {
+	table := map[uint8]Instruction{}
+	for opcode, inst := range instructions {
+		table[opcode] = inst
+	}
+	// JMP ($xxFF) is fixed, at the cost of a cycle
+	table[0x6C] = Instruction{mnemonic: "JMP", addressingMode: 10, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.jmp(operand)
+	}}
+	table[0x7C] = Instruction{mnemonic: "JMP", addressingMode: 14, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.jmp(operand)
+	}}
+	// Shifts and rotates with absolute,X only take the extra cycle when they
+	// cross a page
+	for _, opcode := range []uint8{0x1E, 0x3E, 0x5E, 0x7E} {
+		inst := table[opcode]
+		inst.cycles, inst.pageCrossCycle = 6, true
+		table[opcode] = inst
+	}
+
+	// (zp) versions of the accumulator instructions
+	for opcode, execute := range map[uint8]func(*CPU, uint16){
+		0x12: (*CPU).ora, 0x32: (*CPU).and, 0x52: (*CPU).eor, 0x72: (*CPU).adc,
+		0x92: (*CPU).sta, 0xB2: (*CPU).lda, 0xD2: (*CPU).cmp, 0xF2: (*CPU).sbc,
+	} {
+		table[opcode] = Instruction{mnemonic: table[opcode-0x0D].mnemonic, addressingMode: 13, length: 2, cycles: 5, execute: execute}
+	}
+
+	table[0x04] = Instruction{mnemonic: "TSB", addressingMode: 3, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+		cpu.tsb(operand)
+	}}
+	table[0x0C] = Instruction{mnemonic: "TSB", addressingMode: 7, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.tsb(operand)
+	}}
+	table[0x14] = Instruction{mnemonic: "TRB", addressingMode: 3, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+		cpu.trb(operand)
+	}}
+	table[0x1C] = Instruction{mnemonic: "TRB", addressingMode: 7, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.trb(operand)
+	}}
+	table[0x1A] = Instruction{mnemonic: "INC", addressingMode: 1, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.incAcc()
+	}}
+	table[0x3A] = Instruction{mnemonic: "DEC", addressingMode: 1, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.decAcc()
+	}}
+	table[0x34] = Instruction{mnemonic: "BIT", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.bit(operand)
+	}}
+	table[0x3C] = Instruction{mnemonic: "BIT", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.bit(operand)
+	}}
+	table[0x89] = Instruction{mnemonic: "BIT", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.bitImmediate(operand)
+	}}
+	table[0x80] = Instruction{mnemonic: "BRA", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.branch(true, operand)
+	}}
+	table[0x5A] = Instruction{mnemonic: "PHY", addressingMode: 0, length: 1, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.pushByte(cpu.Y)
+	}}
+	table[0x7A] = Instruction{mnemonic: "PLY", addressingMode: 0, length: 1, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.Y = cpu.popByte()
+		cpu.setZN(cpu.Y)
+	}}
+	table[0xDA] = Instruction{mnemonic: "PHX", addressingMode: 0, length: 1, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.pushByte(cpu.X)
+	}}
+	table[0xFA] = Instruction{mnemonic: "PLX", addressingMode: 0, length: 1, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.X = cpu.popByte()
+		cpu.setZN(cpu.X)
+	}}
+	for opcode, mode := range map[uint8]int{0x64: 3, 0x74: 4, 0x9C: 7, 0x9E: 8} {
+		length, cycles := 2, 3
+		switch mode {
+		case 4:
+			cycles = 4
+		case 7:
+			length, cycles = 3, 4
+		case 8:
+			length, cycles = 3, 5
+		}
+		table[opcode] = Instruction{mnemonic: "STZ", addressingMode: mode, length: length, cycles: cycles, execute: func(cpu *CPU, operand uint16) {
+			cpu.MMU.writeByte(operand, 0)
+		}}
+	}
+	table[0xCB] = Instruction{mnemonic: "WAI", addressingMode: 0, length: 1, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.waiting = true
+	}}
+	table[0xDB] = Instruction{mnemonic: "STP", addressingMode: 0, length: 1, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.running = false
+	}}
+
+	// The Rockwell bit instructions, with the bit number in the top of the opcode
+	for bit := uint8(0); bit < 8; bit++ {
+		mask := uint8(1) << bit
+		digit := string(rune('0' + bit))
+		table[bit<<4|0x07] = Instruction{mnemonic: "RMB" + digit, addressingMode: 3, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+			cpu.MMU.writeByte(operand, cpu.MMU.readByte(operand)&^mask)
+		}}
+		table[bit<<4|0x87] = Instruction{mnemonic: "SMB" + digit, addressingMode: 3, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+			cpu.MMU.writeByte(operand, cpu.MMU.readByte(operand)|mask)
+		}}
+		table[bit<<4|0x0F] = Instruction{mnemonic: "BBR" + digit, addressingMode: 15, length: 3, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+			cpu.branchOnBit(operand, mask, false)
+		}}
+		table[bit<<4|0x8F] = Instruction{mnemonic: "BBS" + digit, addressingMode: 15, length: 3, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+			cpu.branchOnBit(operand, mask, true)
+		}}
+	}
+
+	// Every opcode left over is a NOP, of one of several lengths
+	nop := func(cpu *CPU, operand uint16) {}
+	for opcode := 0; opcode < 0x100; opcode++ {
+		if _, ok := table[uint8(opcode)]; ok {
+			continue
+		}
+		inst := Instruction{mnemonic: "NOP", addressingMode: 0, length: 1, cycles: 1, execute: nop}
+		switch {
+		case opcode&0x0F == 0x02:
+			inst.addressingMode, inst.length, inst.cycles = 2, 2, 2
+		case opcode == 0x44:
+			inst.addressingMode, inst.length, inst.cycles = 3, 2, 3
+		case opcode&0x0F == 0x04:
+			inst.addressingMode, inst.length, inst.cycles = 4, 2, 4
+		case opcode == 0x5C:
+			inst.addressingMode, inst.length, inst.cycles = 7, 3, 8
+		case opcode&0x0F == 0x0C:
+			inst.addressingMode, inst.length, inst.cycles = 7, 3, 4
+		}
+		table[uint8(opcode)] = inst
+	}
+	markPageCrossCycles(table)
+	return table
+}
+
+func (cpu *CPU) incAcc() {
+	// Increment the accumulator
+	cpu.A++
+	cpu.setZNFlags()
+}
+
+func (cpu *CPU) decAcc() {
+	// Decrement the accumulator
+	cpu.A--
+	cpu.setZNFlags()
+}
+
+func (cpu *CPU) bitImmediate(address uint16) {
+	// With an immediate operand, BIT only sets the zero flag
+	cpu.setFlag(Zero, cpu.A&cpu.MMU.readByte(address) == 0)
+}
+
+func (cpu *CPU) tsb(address uint16) {
+	// Test the bits in the accumulator, then set them in memory
+	data := cpu.MMU.readByte(address)
+	cpu.setFlag(Zero, cpu.A&data == 0)
+	cpu.MMU.writeByte(address, data|cpu.A)
+}
+
+func (cpu *CPU) trb(address uint16) {
+	// Test the bits in the accumulator, then clear them in memory
+	data := cpu.MMU.readByte(address)
+	cpu.setFlag(Zero, cpu.A&data == 0)
+	cpu.MMU.writeByte(address, data&^cpu.A)
+}
+
+// branchOnBit fetches a branch offset and branches if a bit of the zero page
+// byte at an address is set (or clear)
+func (cpu *CPU) branchOnBit(address uint16, mask uint8, set bool) {
+	data := cpu.MMU.readByte(address)
+	offset := cpu.fetchSignedByte()
+	cpu.branch((data&mask != 0) == set, cpu.PC+uint16(offset))
+}
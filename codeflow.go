@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Interrupt vectors at the top of memory
+const (
+	nmiVector   = 0xFFFA
+	irqVector   = 0xFFFE
+	vectorTable = nmiVector // the vectors run from here to $FFFF
+)
+
+// jumpTable is a table of little-endian code addresses. RTS tables hold each
+// address minus one, for code that pushes an entry and returns to it.
+type jumpTable struct {
+	address uint16
+	count   int
+	rts     bool
+}
+
+// parseJumpTable parses an address:count table hint
+func parseJumpTable(spec string, rts bool) (jumpTable, error) {
+	addressText, countText, ok := strings.Cut(spec, ":")
+	if !ok {
+		return jumpTable{}, fmt.Errorf("jump table %q should be address:count", spec)
+	}
+	address, err := parseAddress(addressText)
+	if err != nil {
+		return jumpTable{}, fmt.Errorf("invalid jump table address %q", addressText)
+	}
+	count, err := strconv.Atoi(countText)
+	if err != nil || count < 1 {
+		return jumpTable{}, fmt.Errorf("invalid jump table count %q", countText)
+	}
+	return jumpTable{address: address, count: count, rts: rts}, nil
+}
+
+// codeFlow follows the flow of control from a set of entry points to find
+// which bytes in a range are code
+type codeFlow struct {
+	read       func(uint16) uint8
+	start, end uint16
+	// instructions maps the address of each instruction found to its decoding
+	instructions map[uint16]decodedInstruction
+	// covered marks every byte that belongs to an instruction
+	covered map[uint16]bool
+	// words marks the tables of addresses, which are listed as .word lines
+	words map[uint16]jumpTable
+	// entries names the entry points
+	entries map[uint16]string
+	pending []uint16
+}
+
+// traceCodeFlow disassembles a range by recursive traversal: starting from the
+// vectors (if they are in range), the given entry points, the entries of the
+// jump tables and any addresses known to have executed, it follows jumps,
+// calls and branches. Everything it never reaches is listed as data.
+func traceCodeFlow(read func(uint16) uint8, start, end uint16, entries []uint16, tables []jumpTable, executed []uint16, info *DebugInfo) *Listing {
+	flow := &codeFlow{
+		read:         read,
+		start:        start,
+		end:          end,
+		instructions: map[uint16]decodedInstruction{},
+		covered:      map[uint16]bool{},
+		words:        map[uint16]jumpTable{},
+		entries:      map[uint16]string{},
+	}
+	// The hardware vectors are the natural starting points
+	if start <= vectorTable && end == 0xFFFF {
+		names := []string{"nmi", "reset", "irq"}
+		for i, name := range names {
+			vector := uint16(vectorTable + 2*i)
+			flow.addEntry(uint16(read(vector))|uint16(read(vector+1))<<8, name)
+		}
+		tables = append(tables, jumpTable{address: vectorTable, count: len(names)})
+	}
+	for _, entry := range entries {
+		flow.addEntry(entry, "")
+	}
+	for _, table := range tables {
+		for i := 0; i < table.count; i++ {
+			address := table.address + uint16(2*i)
+			flow.words[address] = table
+			target := uint16(read(address)) | uint16(read(address+1))<<8
+			if table.rts {
+				target++
+			}
+			flow.addEntry(target, "")
+		}
+	}
+	for _, address := range executed {
+		flow.pending = append(flow.pending, address)
+	}
+	flow.follow()
+	return flow.listing(info)
+}
+
+// addEntry queues an entry point, naming it if it has no name yet
+func (flow *codeFlow) addEntry(address uint16, name string) {
+	if _, named := flow.entries[address]; !named || name != "" {
+		flow.entries[address] = name
+	}
+	flow.pending = append(flow.pending, address)
+}
+
+// inRange reports whether an address is in the range being disassembled
+func (flow *codeFlow) inRange(address uint16) bool {
+	return address >= flow.start && address <= flow.end
+}
+
+// follow decodes instructions from the pending addresses until every path
+// has ended
+func (flow *codeFlow) follow() {
+	for len(flow.pending) > 0 {
+		address := flow.pending[len(flow.pending)-1]
+		flow.pending = flow.pending[:len(flow.pending)-1]
+		for {
+			if !flow.inRange(address) {
+				break
+			}
+			if _, seen := flow.instructions[address]; seen {
+				break
+			}
+			d := decodeInstruction(flow.read, address)
+			// Unknown opcodes, instructions running out of range and
+			// instructions overlapping ones we already found end the path
+			if !d.known || int(address)+len(d.bytes)-1 > int(flow.end) || flow.overlaps(d) {
+				break
+			}
+			flow.instructions[address] = d
+			for i := range d.bytes {
+				flow.covered[address+uint16(i)] = true
+			}
+			if d.isJump() {
+				flow.pending = append(flow.pending, d.value)
+			}
+			// Work out whether execution carries on to the next instruction
+			if !fallsThrough(d) {
+				break
+			}
+			address += uint16(len(d.bytes))
+		}
+	}
+}
+
+// overlaps reports whether an instruction shares bytes with one already found
+func (flow *codeFlow) overlaps(d decodedInstruction) bool {
+	for i := range d.bytes {
+		if flow.covered[d.address+uint16(i)] {
+			return true
+		}
+	}
+	return false
+}
+
+// fallsThrough reports whether execution can continue after an instruction
+func fallsThrough(d decodedInstruction) bool {
+	switch d.inst.mnemonic {
+	case "JMP", "RTS", "RTI", "BRK", "BRA", "STP":
+		return false
+	}
+	return true
+}
+
+// listing builds the listing of the range: the instructions that were found,
+// address tables as .word lines, and everything else as data
+func (flow *codeFlow) listing(info *DebugInfo) *Listing {
+	listing := &Listing{start: flow.start, end: flow.end, labels: map[uint16]string{}}
+	for address := int(flow.start); address <= int(flow.end); {
+		if d, ok := flow.instructions[uint16(address)]; ok {
+			listing.lines = append(listing.lines, listingLine{decodedInstruction: d})
+			address += len(d.bytes)
+			continue
+		}
+		line := listingLine{decodedInstruction: decodedInstruction{address: uint16(address), bytes: []uint8{flow.read(uint16(address))}}, data: true}
+		// A table entry becomes a .word, as long as both bytes are data
+		if table, ok := flow.words[uint16(address)]; ok && address < int(flow.end) && !flow.covered[uint16(address+1)] {
+			line.bytes = append(line.bytes, flow.read(uint16(address+1)))
+			line.value = uint16(line.bytes[0]) | uint16(line.bytes[1])<<8
+			line.word = true
+			line.rts = table.rts
+		}
+		listing.lines = append(listing.lines, line)
+		address += len(line.bytes)
+	}
+	listing.addLabels(info)
+	// Label the entry points, and the targets of the address tables
+	for address, name := range flow.entries {
+		if _, ok := flow.instructions[address]; !ok {
+			continue
+		}
+		if _, labelled := listing.labels[address]; labelled && name == "" {
+			continue
+		}
+		if name == "" {
+			name = fmt.Sprintf("L%04X", address)
+		}
+		listing.labels[address] = name
+	}
+	return listing
+}
+
+// readExecutionLog reads the addresses from an execution log: any file whose
+// lines start with a hex address, such as one written by --exec-log or a trace
+func readExecutionLog(fileName string) ([]uint16, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var addresses []uint16
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		text := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(fields[0], "$"), "0x"), ":")
+		address, err := strconv.ParseUint(text, 16, 16)
+		if err != nil {
+			continue
+		}
+		addresses = append(addresses, uint16(address))
+	}
+	return addresses, scanner.Err()
+}
+
+// writeExecutionLog writes the addresses of the instructions that executed,
+// one per line, in a form readExecutionLog understands
+func writeExecutionLog(fileName string, executed *[RAMSize]bool) error {
+	var b strings.Builder
+	for address, ran := range executed {
+		if ran {
+			fmt.Fprintf(&b, "%04X\n", address)
+		}
+	}
+	return os.WriteFile(fileName, []byte(b.String()), 0644)
+}
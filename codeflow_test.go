@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// flowProgram dispatches through an RTS jump table, with data between the
+// routines that a linear sweep would misread as code
+var flowProgram = []uint8{
+	0xA2, 0x00, // 0600 LDX #$00
+	0xBD, 0x18, 0x06, // 0602 LDA $0618,X
+	0x48,             // 0605 PHA
+	0xBD, 0x17, 0x06, // 0606 LDA $0617,X
+	0x48,             // 0609 PHA
+	0x60,             // 060A RTS
+	0xFF, 0x02, 0xB1, // 060B data
+	0xA9, 0x01, // 060E LDA #$01
+	0x60,             // 0610 RTS
+	0x02, 0x20, 0x4C, // 0611 data
+	0xA9, 0x02, // 0614 LDA #$02
+	0x60,       // 0616 RTS
+	0x0D, 0x06, // 0617 table: $060E-1
+	0x13, 0x06, //      $0614-1
+}
+
+func TestTraceCodeFlow(t *testing.T) {
+	table, err := parseJumpTable("$0617:2", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing := traceCodeFlow(readFrom(flowProgram, 0x0600), 0x0600, 0x061A, []uint16{0x0600}, []jumpTable{table}, nil, nil)
+	want := `        .org $0600
+L0600:
+        LDX #$00                                ; 0600  A2 00
+        LDA $0618,X                             ; 0602  BD 18 06
+        PHA                                     ; 0605  48
+        LDA $0617,X                             ; 0606  BD 17 06
+        PHA                                     ; 0609  48
+        RTS                                     ; 060A  60
+        .byte $FF,$02,$B1                       ; 060B  FF 02 B1
+L060E:
+        LDA #$01                                ; 060E  A9 01
+        RTS                                     ; 0610  60
+        .byte $02,$20,$4C                       ; 0611  02 20 4C
+L0614:
+        LDA #$02                                ; 0614  A9 02
+        RTS                                     ; 0616  60
+        .word L060E-1                           ; 0617  0D 06
+        .word L0614-1                           ; 0619  13 06
+`
+	if got := listing.String(); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+	code, start := assembleListing(t, listing)
+	if start != 0x0600 || !bytes.Equal(code, flowProgram) {
+		t.Errorf("expected the listing to assemble to\n% X\ngot at $%04X\n% X", flowProgram, start, code)
+	}
+}
+
+func TestParseJumpTable(t *testing.T) {
+	table, err := parseJumpTable("$C000:4", false)
+	if err != nil || table != (jumpTable{address: 0xC000, count: 4}) {
+		t.Errorf("expected a table of 4 at $C000, got %+v, %v", table, err)
+	}
+	for _, spec := range []string{"$C000", "zz:4", "$C000:0", "$C000:x"} {
+		if _, err := parseJumpTable(spec, false); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
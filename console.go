@@ -0,0 +1,79 @@
+package main
+
+// The console's registers
+const (
+	consoleData = 0x0 // writes print a character, reads take the next one typed
+	consoleExit = 0x1 // writes exit the emulator, with the value as the status
+)
+
+// Console is a device for test programs that have no use for a real UART:
+// writing a character prints it, reading takes the next character from the
+// host or 0 when there is none, and writing the exit register stops the
+// emulator with the value as the exit status. Characters from the host come
+// through the input log as <name>.
+type Console struct {
+	label  string
+	output func(b uint8)
+	exit   func(status uint8)
+	input  []uint8 // characters from the host not yet read
+}
+
+// newConsole creates a console that prints with output and stops the
+// emulator with exit
+func newConsole(label string, output func(b uint8), exit func(status uint8)) *Console {
+	return &Console{label: label, output: output, exit: exit}
+}
+
+func (c *Console) name() string { return c.label }
+
+func (c *Console) size() int { return 2 }
+
+func (c *Console) peek(register uint16) uint8 {
+	if register == consoleData && len(c.input) > 0 {
+		return c.input[0]
+	}
+	return 0
+}
+
+func (c *Console) read(register uint16) uint8 {
+	value := c.peek(register)
+	if register == consoleData && len(c.input) > 0 {
+		c.input = c.input[1:]
+	}
+	return value
+}
+
+func (c *Console) write(register uint16, value uint8) {
+	switch register {
+	case consoleData:
+		if c.output != nil {
+			c.output(value)
+		}
+	case consoleExit:
+		if c.exit != nil {
+			c.exit(value)
+		}
+	}
+}
+
+func (c *Console) tick(cycles int) {}
+
+// connectInput takes the characters the host sends
+func (c *Console) connectInput(l *InputLog) {
+	l.handle(c.label, func(value int) { c.input = append(c.input, uint8(value)) })
+}
+
+func (c *Console) saveState(e *stateEncoder) {
+	e.u32(uint32(len(c.input)))
+	e.bytes(c.input)
+}
+
+func (c *Console) loadState(d *stateDecoder) {
+	// The length is checked against the chunk's, as the decoder would pad
+	// out any length it was given
+	if n := int(d.u32()); n <= len(d.data)-d.pos {
+		c.input = d.take(n)
+	} else {
+		c.input = nil
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConsoleRegisters(t *testing.T) {
+	var out []uint8
+	status := -1
+	c := newConsole("console", func(b uint8) { out = append(out, b) }, func(s uint8) { status = int(s) })
+	c.write(consoleData, 'h')
+	c.write(consoleData, 'i')
+	if !bytes.Equal(out, []uint8("hi")) {
+		t.Errorf("expected hi printed, got %q", out)
+	}
+	// Reads give 0 until something is typed, then what was typed in order
+	if got := c.read(consoleData); got != 0 {
+		t.Errorf("expected 0 with nothing typed, got $%02X", got)
+	}
+	c.input = append(c.input, 'a', 'b')
+	if got := c.peek(consoleData); got != 'a' || len(c.input) != 2 {
+		t.Error("peeking should not take the character")
+	}
+	if a, b, none := c.read(consoleData), c.read(consoleData), c.read(consoleData); a != 'a' || b != 'b' || none != 0 {
+		t.Errorf("expected a, b and then 0, got $%02X $%02X $%02X", a, b, none)
+	}
+	if status != -1 {
+		t.Fatal("exited too soon")
+	}
+	c.write(consoleExit, 42)
+	if status != 42 {
+		t.Errorf("expected to exit with 42, got %d", status)
+	}
+}
+
+func TestConsoleOnTheBus(t *testing.T) {
+	// Print what is typed until a newline, then exit with its count
+	program := []uint8{
+		0xAD, 0x00, 0xF0, // loop: LDA $F000
+		0xF0, 0xFB, // BEQ loop
+		0x8D, 0x00, 0xF0, // STA $F000
+		0xE8,       // INX
+		0xC9, 0x0A, // CMP #$0A
+		0xD0, 0xF3, // BNE loop
+		0x8E, 0x01, 0xF0, // STX $F001
+		0x4C, 0x10, 0x80, // JMP *
+	}
+	cpu := newTestCPU(t, NMOS6502, program)
+	cpu.input = newInputLog(cpu)
+	// Connected to a socket, to stay off the terminal
+	path := filepath.Join(t.TempDir(), "console")
+	host, err := cpu.attachDevices([]deviceFlag{{kind: "console", spec: "0xF000,unix:" + path}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.close()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("6502\n"))
+	// The characters come in from another goroutine
+	cpu.running = true
+	deadline := time.Now().Add(5 * time.Second)
+	for cpu.running && time.Now().Before(deadline) {
+		cpu.step()
+	}
+	if !host.exitRequested || host.exitStatus != 5 {
+		t.Fatalf("expected an exit with status 5, got %v %d", host.exitRequested, host.exitStatus)
+	}
+	echo := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "6502\n" {
+		t.Errorf("expected 6502 echoed, got %q (%v)", echo, err)
+	}
+
+	// Characters not yet read go in save states
+	console := cpu.MMU.device("console").(*Console)
+	console.input = []uint8("xy")
+	var buf bytes.Buffer
+	if err := cpu.saveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	console.input = nil
+	if err := cpu.loadState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(console.input, []uint8("xy")) {
+		t.Errorf("expected xy restored, got %q", console.input)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,23 +11,56 @@ var resetVector = 0xFFFC
 type CPU struct {
 	A, X, Y, P uint8
 	PC         uint16
-	SP         uint16
-	clockSpeed int64 // in Hz
-	MMU        *MMU  // memory management unit
-	running    bool  // is the CPU running?
-	cycles     int   // number of cycles executed
-	debug      bool  // is the CPU in debug mode?
+	SP         uint8
+	clockSpeed int64          // in Hz
+	MMU        *MMU           // memory management unit
+	running    bool           // is the CPU running?
+	cycles     int            // number of cycles executed
+	debug      bool           // is the CPU in debug mode?
+	debugInfo  *DebugInfo     // symbols and source lines, if loaded
+	executed   *[RAMSize]bool // addresses of executed instructions, if logging
+	// breakpoints stop run when they are hit
+	breakpoints *BreakpointSet
+	// instructionAddress is the address of the instruction being executed
+	instructionAddress uint16
+	// irq holds one bit for each device holding the IRQ line low
+	irq uint32
+	// nmiPending is set when the NMI line has been pulled low
+	nmiPending bool
+	// history holds undo records for stepping backwards, if enabled
+	history *History
+	// tracer writes a line for every instruction, if tracing
+	tracer *Tracer
+	// input hands the host's input to devices between instructions
+	input *InputLog
+	// irqSources is the number of IRQ sources given to devices
+	irqSources uint
+	// variant is the member of the 6502 family being emulated
+	variant Variant
+	// waiting is set by the 65C02's WAI until an interrupt comes in
+	waiting bool
+	// pageCrossed is set when indexing the operand address crossed a page
+	pageCrossed bool
+	// stopRequested asks run to stop after the current instruction. It is
+	// set from the signal handler, so it is atomic.
+	stopRequested atomic.Bool
 }
 
 func (cpu *CPU) reset() {
 	// Reset the CPU
 	cpu.PC = cpu.MMU.readWord(uint16(resetVector))
-	cpu.SP = 0x0100
+	cpu.SP = 0xFD
 	cpu.A = 0x00
 	cpu.X = 0x00
 	cpu.Y = 0x00
-	// Set None flags
-	cpu.setFlag(None, true)
+	// Interrupts are disabled until the program is ready for them
+	cpu.setFlag(Interrupt, true)
+	cpu.irq = 0
+	cpu.nmiPending = false
+	cpu.waiting = false
+	cpu.history.clear()
+	// The reset sequence takes 7 cycles, as traces from real hardware show
+	cpu.cycles = 7
 	cpu.running = true
 }
 
@@ -88,10 +122,10 @@ func (cpu *CPU) setZNFlags() {
 }
 
 func (cpu *CPU) pushByte(value uint8) {
-	// Decrement the stack pointer
-	cpu.SP--
 	// Write the value to the stack
 	cpu.MMU.writeByte(cpu.spToAddress(), value)
+	// Decrement the stack pointer
+	cpu.SP--
 }
 
 func (cpu *CPU) pushWord(value uint16) {
@@ -134,7 +168,7 @@ func (cpu *CPU) pushPCMinusOne() {
 
 func (cpu *CPU) fetchOperand(instruction uint8) uint16 {
 	// Get the addressing mode
-	inst := instructions[instruction]
+	inst := cpu.instructionSet()[instruction]
 	// Get the addressing mode function
 	mode, ok := addressingModes[inst.addressingMode]
 	if !ok {
@@ -145,45 +179,161 @@ func (cpu *CPU) fetchOperand(instruction uint8) uint16 {
 }
 
 func (cpu *CPU) disassemble() string {
-	// Get the instruction
-	inst := instructions[cpu.MMU.readByte(cpu.PC)]
-	// Get the addressing mode
-	mode := addressingModeNames[inst.addressingMode]
-
-	operandString := ""
-
-	// Get the operand string
-	switch mode {
-	case "Implied":
-		operandString = ""
-	case "Accumulator":
-		operandString = "A"
-	case "Immediate":
-		operandString = fmt.Sprintf("#$%02X", cpu.MMU.readByte(cpu.PC+1))
-	case "ZeroPage":
-		operandString = fmt.Sprintf("$%02X", cpu.MMU.readByte(cpu.PC+1))
-	case "ZeroPageX":
-		operandString = fmt.Sprintf("$%02X,X", cpu.MMU.readByte(cpu.PC+1))
-	case "ZeroPageY":
-		operandString = fmt.Sprintf("$%02X,Y", cpu.MMU.readByte(cpu.PC+1))
-	case "Relative":
-		operandString = fmt.Sprintf("$%02X", cpu.MMU.readByte(cpu.PC+1))
-	case "Absolute":
-		operandString = fmt.Sprintf("$%04X", cpu.MMU.readWord(cpu.PC+1))
-	case "AbsoluteX":
-		operandString = fmt.Sprintf("$%04X,X", cpu.MMU.readWord(cpu.PC+1))
-	case "AbsoluteY":
-		operandString = fmt.Sprintf("$%04X,Y", cpu.MMU.readWord(cpu.PC+1))
-	case "Indirect":
-		operandString = fmt.Sprintf("($%04X)", cpu.MMU.readWord(cpu.PC+1))
-	case "IndirectX":
-		operandString = fmt.Sprintf("($%02X,X)", cpu.MMU.readByte(cpu.PC+1))
-	case "IndirectY":
-		operandString = fmt.Sprintf("($%02X),Y", cpu.MMU.readByte(cpu.PC+1))
-
+	// Decode the instruction
+	d := cpu.decode(cpu.PC)
+	disassembly := d.text(cpu.formatAddress)
+	// Add the label and source line from the debug info, if we have it
+	if cpu.debugInfo != nil {
+		if label, ok := cpu.debugInfo.labelAt(cpu.PC); ok {
+			disassembly = label + ": " + disassembly
+		}
+		if line, ok := cpu.debugInfo.lineAt(cpu.PC); ok {
+			disassembly += " ; " + line.String()
+		}
 	}
 	// Return the disassembly
-	return (inst.mnemonic + " " + operandString)
+	return disassembly
+}
+
+// formatAddress formats an operand address as a symbol name if the debug info
+// has one, or as hex with the given number of digits otherwise
+func (cpu *CPU) formatAddress(address uint16, digits int) string {
+	if cpu.debugInfo != nil {
+		if name, ok := cpu.debugInfo.symbolFor(address); ok {
+			return name
+		}
+	}
+	return hexAddress(address, digits)
+}
+
+// setIRQ holds the IRQ line low for a source while active is true. Each
+// source has its own bit, and the line stays low while any of them is set.
+func (cpu *CPU) setIRQ(source uint, active bool) {
+	if active {
+		cpu.irq |= 1 << source
+	} else {
+		cpu.irq &^= 1 << source
+	}
+}
+
+// triggerNMI signals a non-maskable interrupt, which is taken before the next
+// instruction
+func (cpu *CPU) triggerNMI() {
+	cpu.nmiPending = true
+}
+
+// interruptPending reports whether the next step will take an interrupt
+// rather than run an instruction
+func (cpu *CPU) interruptPending() bool {
+	return cpu.nmiPending || cpu.irq != 0 && !cpu.getFlag(Interrupt)
+}
+
+// interrupt pushes the PC and status and jumps through an interrupt vector
+func (cpu *CPU) interrupt(vector uint16) {
+	cpu.pushPC()
+	// The status is pushed with the break flag clear, which is how a handler
+	// tells an interrupt from a BRK
+	cpu.pushByte(cpu.getStatus() &^ Break)
+	cpu.setFlag(Interrupt, true)
+	// The 65C02 also leaves decimal mode
+	if cpu.variant == CMOS65C02 {
+		cpu.setFlag(Decimal, false)
+	}
+	cpu.waiting = false
+	cpu.PC = cpu.MMU.readWord(vector)
+	cpu.cycles += 7
+}
+
+// step executes a single instruction and returns the number of cycles it took.
+// A pending interrupt is taken instead, if there is one. The devices on the
+// bus are then clocked for as many cycles.
+func (cpu *CPU) step() int {
+	cycles := cpu.stepCPU()
+	cpu.MMU.tick(cycles)
+	return cycles
+}
+
+// stepCPU executes an instruction or takes an interrupt, without the devices
+func (cpu *CPU) stepCPU() int {
+	startCycles := cpu.cycles
+	// Apply the input that has come in from the host, or is due in a replay
+	cpu.input.poll(cpu)
+	cpu.instructionAddress = cpu.PC
+	// Record the state, so that the instruction can be undone
+	cpu.history.begin(cpu)
+	if cpu.nmiPending {
+		cpu.nmiPending = false
+		cpu.interrupt(nmiVector)
+		cpu.breakpoints.interrupt(true)
+		return cpu.cycles - startCycles
+	}
+	if cpu.irq != 0 && !cpu.getFlag(Interrupt) {
+		cpu.interrupt(irqVector)
+		cpu.breakpoints.interrupt(false)
+		return cpu.cycles - startCycles
+	}
+	// After WAI, wait for an interrupt. One that is masked ends the wait
+	// without being taken.
+	if cpu.waiting {
+		if cpu.irq == 0 {
+			cpu.cycles++
+			return cpu.cycles - startCycles
+		}
+		cpu.waiting = false
+	}
+	cpu.tracer.trace(cpu)
+	// Note the instruction's address if we are logging execution
+	if cpu.executed != nil {
+		cpu.executed[cpu.PC] = true
+	}
+	// Fetch the instruction
+	instruction := cpu.fetchByte()
+	// Get the instruction from the instruction map
+	inst, ok := cpu.instructionSet()[instruction]
+	if !ok {
+		// Stop on an opcode we do not know, leaving the PC pointing at it
+		cpu.PC--
+		cpu.log(fmt.Sprintf("Unknown opcode $%02X at $%04X", instruction, cpu.PC))
+		cpu.running = false
+		return 0
+	}
+	// Fetch the operand
+	cpu.pageCrossed = false
+	operand := cpu.fetchOperand(instruction)
+	// Execute the instruction
+	inst.execute(cpu, operand)
+	// Increment the cycle count by the number of cycles the instruction takes
+	cpu.cycles += inst.cycles
+	if cpu.pageCrossed && inst.pageCrossCycle {
+		cpu.cycles++
+	}
+	return cpu.cycles - startCycles
+}
+
+// stepOver executes the instruction at the PC, running a subroutine called by
+// JSR until it returns. It stops early if the CPU stops or is asked to.
+func (cpu *CPU) stepOver() {
+	if cpu.MMU.peekByte(cpu.PC) != 0x20 {
+		cpu.step()
+		return
+	}
+	// Run until we are back after the JSR with the stack as it was
+	returnAddress := cpu.PC + 3
+	sp := cpu.SP
+	cpu.running = true
+	for first := true; ; first = false {
+		// Stop at breakpoints inside the subroutine
+		if !first && cpu.breakpoints.beforeInstruction() {
+			return
+		}
+		cpu.step()
+		if cpu.PC == returnAddress && cpu.SP == sp {
+			return
+		}
+		if !cpu.running || cpu.getFlag(Break) || cpu.stopRequested.Load() || cpu.breakpoints.stopped() {
+			return
+		}
+	}
 }
 
 func (cpu *CPU) run(watch bool, watchAddresses []uint16) {
@@ -191,32 +341,32 @@ func (cpu *CPU) run(watch bool, watchAddresses []uint16) {
 	cpu.running = true
 	// Set the cycle duration based on the clock speed
 	cycleDuration := time.Duration(1000000000 / cpu.clockSpeed)
-	for {
+	cpu.breakpoints.resume()
+	for first := true; ; first = false {
+		// Stop before an instruction with a breakpoint on it, unless we are
+		// resuming from there
+		if !first && cpu.breakpoints.beforeInstruction() {
+			break
+		}
 		if cpu.debug {
 			// Disassemble the next instruction if debugging is enabled
 			cpu.log(cpu.disassemble())
 			// Print the CPU registers in hex
 			cpu.log(fmt.Sprintf("A: %02X X: %02X Y: %02X P: %02X SP: %02X PC: %04X", cpu.A, cpu.X, cpu.Y, cpu.P, cpu.SP, cpu.PC))
 		}
-		// Fetch the instruction
-		instruction := cpu.fetchByte()
-		// Fetch the operand
-		operand := cpu.fetchOperand(instruction)
-		// Get the instruction from the instruction map
-		inst := instructions[instruction]
 		// Execute the instruction
-		inst.execute(cpu, operand)
+		cycles := cpu.step()
 		// If the watch flag is set, print the memory addresses
 		if watch {
 			var logMessage = ""
 			for _, address := range watchAddresses {
 				// Append the memory address to the log message
-				logMessage += fmt.Sprintf("$%04X %02X ", address, cpu.MMU.readByte(address))
+				logMessage += fmt.Sprintf("$%04X %02X ", address, cpu.MMU.peekByte(address))
 			}
 			// Log the message
 			Log("WATCH", logMessage)
 		}
-		for i := 0; i < inst.cycles; i++ {
+		for i := 0; i < cycles; i++ {
 			start := time.Now()
 			// TODO: perform any necessary operations
 			elapsed := time.Since(start)
@@ -226,8 +376,6 @@ func (cpu *CPU) run(watch bool, watchAddresses []uint16) {
 				time.Sleep(cycleDuration - elapsed)
 			}
 		}
-		// Increment the cycle count by the number of cycles the instruction takes
-		cpu.cycles += inst.cycles
 		// Check if the CPU is running
 		if !cpu.running {
 			break
@@ -236,5 +384,13 @@ func (cpu *CPU) run(watch bool, watchAddresses []uint16) {
 		if cpu.getFlag(Break) {
 			break
 		}
+		// Check if we have been asked to stop
+		if cpu.stopRequested.Load() {
+			break
+		}
+		// Check if a watchpoint or interrupt breakpoint was hit
+		if cpu.breakpoints.stopped() {
+			break
+		}
 	}
 }
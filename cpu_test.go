@@ -0,0 +1,774 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// stepBudget is how many instructions a test may run looking for a BRK
+const stepBudget = 10000
+
+// newTestCPU loads a program at the default load address and resets the CPU to
+// start there, with the cycle count cleared so that tests count from zero
+func newTestCPU(t *testing.T, variant Variant, program []uint8) *CPU {
+	t.Helper()
+	cpu := &CPU{MMU: &MMU{}, variant: variant}
+	if err := cpu.MMU.loadProgram(program, defaultLoadAddress); err != nil {
+		t.Fatal(err)
+	}
+	cpu.reset()
+	cpu.PC = defaultLoadAddress
+	cpu.cycles = 0
+	return cpu
+}
+
+// runUntilBreak runs until a BRK sets the break flag or the CPU stops,
+// failing the test if that takes more than the step budget
+func runUntilBreak(t *testing.T, cpu *CPU) {
+	t.Helper()
+	for i := 0; i < stepBudget; i++ {
+		cpu.step()
+		if cpu.getFlag(Break) || !cpu.running {
+			return
+		}
+	}
+	t.Fatalf("still running after %d instructions, at $%04X", stepBudget, cpu.PC)
+}
+
+// cpuTest runs a program and checks the state it leaves
+type cpuTest struct {
+	name    string
+	variant Variant
+	program []uint8          // loaded at $8000
+	memory  map[uint16]uint8 // set before running
+	setup   func(cpu *CPU)   // anything else to set up
+	steps   int              // instructions to run, or 0 to run until BRK
+	// want holds the expected registers (A X Y SP P PC), flags (N V D I Z C)
+	// and CYCLES, by the names conditions use
+	want    map[string]int
+	wantMem map[uint16]uint8
+}
+
+func runCPUTests(t *testing.T, tests []cpuTest) {
+	t.Helper()
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			cpu := newTestCPU(t, test.variant, test.program)
+			for address, value := range test.memory {
+				cpu.MMU.pokeByte(address, value)
+			}
+			if test.setup != nil {
+				test.setup(cpu)
+			}
+			if test.steps == 0 {
+				runUntilBreak(t, cpu)
+			}
+			for i := 0; i < test.steps; i++ {
+				cpu.step()
+			}
+			checkCPU(t, cpu, test.want, test.wantMem)
+		})
+	}
+}
+
+// checkCPU compares registers, flags and memory with what is expected
+func checkCPU(t *testing.T, cpu *CPU, want map[string]int, wantMem map[uint16]uint8) {
+	t.Helper()
+	for name, expected := range want {
+		got, ok := cpu.registerValue(name)
+		if !ok {
+			t.Fatalf("unknown register %q", name)
+		}
+		if got != expected {
+			t.Errorf("%s: expected $%02X, got $%02X (flags %s)", strings.ToUpper(name), expected, got, flagString(cpu.P))
+		}
+	}
+	for address, expected := range wantMem {
+		if got := cpu.MMU.peekByte(address); got != expected {
+			t.Errorf("$%04X: expected $%02X, got $%02X", address, expected, got)
+		}
+	}
+}
+
+func TestDemoProgram(t *testing.T) {
+	runCPUTests(t, []cpuTest{{
+		name:    "demo",
+		program: demoProgram,
+		// 1+3 is 4, less 2 and the borrow is 1 in decimal, then ASL and ROR put
+		// it back with the carry clear
+		want:    map[string]int{"A": 0x01, "X": 0x01, "PC": 0x0000},
+		wantMem: map[uint16]uint8{0x0200: 0x01, 0x0300: 0x01},
+	}})
+}
+
+func TestAddressingModes(t *testing.T) {
+	runCPUTests(t, []cpuTest{
+		{
+			name:    "immediate",
+			program: []uint8{0xA9, 0x42}, // LDA #$42
+			steps:   1,
+			want:    map[string]int{"A": 0x42, "Z": 0, "N": 0, "CYCLES": 2, "PC": 0x8002},
+		},
+		{
+			name:    "immediate sets zero",
+			program: []uint8{0xA9, 0x00}, // LDA #$00
+			steps:   1,
+			want:    map[string]int{"A": 0x00, "Z": 1, "N": 0},
+		},
+		{
+			name:    "immediate sets negative",
+			program: []uint8{0xA2, 0x80}, // LDX #$80
+			steps:   1,
+			want:    map[string]int{"X": 0x80, "Z": 0, "N": 1},
+		},
+		{
+			name:    "zero page",
+			program: []uint8{0xA5, 0x10}, // LDA $10
+			memory:  map[uint16]uint8{0x0010: 0x37},
+			steps:   1,
+			want:    map[string]int{"A": 0x37, "CYCLES": 3},
+		},
+		{
+			name:    "zero page,X",
+			program: []uint8{0xA2, 0x05, 0xB5, 0x10}, // LDX #$05 / LDA $10,X
+			memory:  map[uint16]uint8{0x0015: 0x99},
+			steps:   2,
+			want:    map[string]int{"A": 0x99, "N": 1, "CYCLES": 6},
+		},
+		{
+			name:    "zero page,X wraps around",
+			program: []uint8{0xA2, 0x02, 0xB5, 0xFF}, // LDX #$02 / LDA $FF,X
+			memory:  map[uint16]uint8{0x0001: 0xAB, 0x0101: 0xCD},
+			steps:   2,
+			want:    map[string]int{"A": 0xAB},
+		},
+		{
+			name:    "zero page,Y wraps around",
+			program: []uint8{0xA0, 0x03, 0xB6, 0xFE}, // LDY #$03 / LDX $FE,Y
+			memory:  map[uint16]uint8{0x0001: 0xAB, 0x0101: 0xCD},
+			steps:   2,
+			want:    map[string]int{"X": 0xAB, "CYCLES": 6},
+		},
+		{
+			name:    "zero page,X store wraps around",
+			program: []uint8{0xA2, 0x81, 0xA9, 0x5A, 0x95, 0x80}, // LDX #$81 / LDA #$5A / STA $80,X
+			steps:   3,
+			wantMem: map[uint16]uint8{0x0001: 0x5A, 0x0101: 0x00},
+		},
+		{
+			name:    "absolute",
+			program: []uint8{0xAD, 0x34, 0x12}, // LDA $1234
+			memory:  map[uint16]uint8{0x1234: 0x21},
+			steps:   1,
+			want:    map[string]int{"A": 0x21, "CYCLES": 4, "PC": 0x8003},
+		},
+		{
+			name:    "absolute,X",
+			program: []uint8{0xA2, 0x01, 0xBD, 0x34, 0x12}, // LDX #$01 / LDA $1234,X
+			memory:  map[uint16]uint8{0x1235: 0x22},
+			steps:   2,
+			want:    map[string]int{"A": 0x22, "CYCLES": 6},
+		},
+		{
+			name:    "absolute,X crossing a page",
+			program: []uint8{0xA2, 0x01, 0xBD, 0xFF, 0x12}, // LDX #$01 / LDA $12FF,X
+			memory:  map[uint16]uint8{0x1300: 0x23},
+			steps:   2,
+			want:    map[string]int{"A": 0x23, "CYCLES": 7},
+		},
+		{
+			name:    "absolute,Y crossing a page",
+			program: []uint8{0xA0, 0xFF, 0xB9, 0x01, 0x12}, // LDY #$FF / LDA $1201,Y
+			memory:  map[uint16]uint8{0x1300: 0x24},
+			steps:   2,
+			want:    map[string]int{"A": 0x24, "CYCLES": 7},
+		},
+		{
+			name:    "absolute,X store takes no extra cycle",
+			program: []uint8{0xA2, 0x01, 0xA9, 0x11, 0x9D, 0xFF, 0x12}, // LDX #$01 / LDA #$11 / STA $12FF,X
+			steps:   3,
+			want:    map[string]int{"CYCLES": 9},
+			wantMem: map[uint16]uint8{0x1300: 0x11},
+		},
+		{
+			name:    "absolute,X read-modify-write takes no extra cycle",
+			program: []uint8{0xA2, 0x01, 0xFE, 0xFF, 0x12}, // LDX #$01 / INC $12FF,X
+			memory:  map[uint16]uint8{0x1300: 0x41},
+			steps:   2,
+			want:    map[string]int{"CYCLES": 9},
+			wantMem: map[uint16]uint8{0x1300: 0x42},
+		},
+		{
+			name:    "absolute,X wraps around memory",
+			program: []uint8{0xA2, 0x02, 0xBD, 0xFF, 0xFF}, // LDX #$02 / LDA $FFFF,X
+			memory:  map[uint16]uint8{0x0001: 0x66},
+			steps:   2,
+			want:    map[string]int{"A": 0x66},
+		},
+		{
+			name:    "jump absolute",
+			program: []uint8{0x4C, 0x00, 0x90}, // JMP $9000
+			steps:   1,
+			want:    map[string]int{"PC": 0x9000, "CYCLES": 3},
+		},
+		{
+			name:    "jump indirect",
+			program: []uint8{0x6C, 0x00, 0x03}, // JMP ($0300)
+			memory:  map[uint16]uint8{0x0300: 0x34, 0x0301: 0x12},
+			steps:   1,
+			want:    map[string]int{"PC": 0x1234, "CYCLES": 5},
+		},
+		{
+			name:    "jump indirect reads the high byte from the same page",
+			program: []uint8{0x6C, 0xFF, 0x02}, // JMP ($02FF)
+			memory:  map[uint16]uint8{0x02FF: 0x34, 0x0300: 0x12, 0x0200: 0x56},
+			steps:   1,
+			want:    map[string]int{"PC": 0x5634},
+		},
+		{
+			name:    "jump indirect page bug is fixed on the 65C02",
+			variant: CMOS65C02,
+			program: []uint8{0x6C, 0xFF, 0x02}, // JMP ($02FF)
+			memory:  map[uint16]uint8{0x02FF: 0x34, 0x0300: 0x12, 0x0200: 0x56},
+			steps:   1,
+			want:    map[string]int{"PC": 0x1234, "CYCLES": 6},
+		},
+		{
+			name:    "(indirect,X)",
+			program: []uint8{0xA2, 0x04, 0xA1, 0x20}, // LDX #$04 / LDA ($20,X)
+			memory:  map[uint16]uint8{0x0024: 0x00, 0x0025: 0x13, 0x1300: 0x5A},
+			steps:   2,
+			want:    map[string]int{"A": 0x5A, "CYCLES": 8},
+		},
+		{
+			name:    "(indirect,X) pointer wraps around the zero page",
+			program: []uint8{0xA2, 0x01, 0xA1, 0xFE}, // LDX #$01 / LDA ($FE,X)
+			memory:  map[uint16]uint8{0x00FF: 0x00, 0x0000: 0x13, 0x0100: 0x14, 0x1300: 0x5B, 0x1400: 0xEE},
+			steps:   2,
+			want:    map[string]int{"A": 0x5B},
+		},
+		{
+			name:    "(indirect),Y",
+			program: []uint8{0xA0, 0x10, 0xB1, 0x40}, // LDY #$10 / LDA ($40),Y
+			memory:  map[uint16]uint8{0x0040: 0x00, 0x0041: 0x13, 0x1310: 0x77},
+			steps:   2,
+			want:    map[string]int{"A": 0x77, "CYCLES": 7},
+		},
+		{
+			name:    "(indirect),Y crossing a page",
+			program: []uint8{0xA0, 0xFF, 0xB1, 0x40}, // LDY #$FF / LDA ($40),Y
+			memory:  map[uint16]uint8{0x0040: 0x01, 0x0041: 0x13, 0x1400: 0x78},
+			steps:   2,
+			want:    map[string]int{"A": 0x78, "CYCLES": 8},
+		},
+		{
+			name:    "(indirect),Y pointer wraps around the zero page",
+			program: []uint8{0xA0, 0x00, 0xB1, 0xFF}, // LDY #$00 / LDA ($FF),Y
+			memory:  map[uint16]uint8{0x00FF: 0x00, 0x0000: 0x13, 0x0100: 0x14, 0x1300: 0x79, 0x1400: 0xEE},
+			steps:   2,
+			want:    map[string]int{"A": 0x79},
+		},
+		{
+			name:    "(indirect),Y store takes no extra cycle",
+			program: []uint8{0xA0, 0xFF, 0xA9, 0x33, 0x91, 0x40}, // LDY #$FF / LDA #$33 / STA ($40),Y
+			memory:  map[uint16]uint8{0x0040: 0x01, 0x0041: 0x13},
+			steps:   3,
+			want:    map[string]int{"CYCLES": 10},
+			wantMem: map[uint16]uint8{0x1400: 0x33},
+		},
+		{
+			name:    "accumulator",
+			program: []uint8{0xA9, 0x81, 0x0A}, // LDA #$81 / ASL A
+			steps:   2,
+			want:    map[string]int{"A": 0x02, "C": 1, "N": 0, "CYCLES": 4},
+		},
+		{
+			name:    "implied",
+			program: []uint8{0xE8, 0xC8, 0x88, 0x88}, // INX / INY / DEY / DEY
+			steps:   4,
+			want:    map[string]int{"X": 0x01, "Y": 0xFF, "N": 1, "CYCLES": 8},
+		},
+	})
+}
+
+func TestArithmetic(t *testing.T) {
+	runCPUTests(t, []cpuTest{
+		{
+			name:    "add with overflow",
+			program: []uint8{0x18, 0xA9, 0x50, 0x69, 0x50}, // CLC / LDA #$50 / ADC #$50
+			steps:   3,
+			want:    map[string]int{"A": 0xA0, "C": 0, "V": 1, "N": 1, "Z": 0},
+		},
+		{
+			name:    "add with carry in and out",
+			program: []uint8{0x38, 0xA9, 0xFF, 0x69, 0x00}, // SEC / LDA #$FF / ADC #$00
+			steps:   3,
+			want:    map[string]int{"A": 0x00, "C": 1, "V": 0, "Z": 1},
+		},
+		{
+			name:    "subtract with borrow",
+			program: []uint8{0x38, 0xA9, 0x50, 0xE9, 0xF0}, // SEC / LDA #$50 / SBC #$F0
+			steps:   3,
+			want:    map[string]int{"A": 0x60, "C": 0, "V": 0},
+		},
+		{
+			name:    "subtract with overflow",
+			program: []uint8{0x38, 0xA9, 0x50, 0xE9, 0xB0}, // SEC / LDA #$50 / SBC #$B0
+			steps:   3,
+			want:    map[string]int{"A": 0xA0, "C": 0, "V": 1, "N": 1},
+		},
+		{
+			name:    "subtract without borrow",
+			program: []uint8{0x18, 0xA9, 0x05, 0xE9, 0x03}, // CLC / LDA #$05 / SBC #$03
+			steps:   3,
+			want:    map[string]int{"A": 0x01, "C": 1},
+		},
+		{
+			name:    "decimal add",
+			program: []uint8{0xF8, 0x18, 0xA9, 0x25, 0x69, 0x48}, // SED / CLC / LDA #$25 / ADC #$48
+			steps:   4,
+			want:    map[string]int{"A": 0x73, "C": 0},
+		},
+		{
+			name:    "decimal add with carry out",
+			program: []uint8{0xF8, 0x18, 0xA9, 0x58, 0x69, 0x46}, // SED / CLC / LDA #$58 / ADC #$46
+			steps:   4,
+			want:    map[string]int{"A": 0x04, "C": 1},
+		},
+		{
+			name:    "decimal add sets N and Z from the binary sum on the 6502",
+			program: []uint8{0xF8, 0x18, 0xA9, 0x99, 0x69, 0x01}, // SED / CLC / LDA #$99 / ADC #$01
+			steps:   4,
+			want:    map[string]int{"A": 0x00, "C": 1, "Z": 0, "N": 1, "CYCLES": 8},
+		},
+		{
+			name:    "decimal add sets N and Z from the result on the 65C02",
+			variant: CMOS65C02,
+			program: []uint8{0xF8, 0x18, 0xA9, 0x99, 0x69, 0x01}, // SED / CLC / LDA #$99 / ADC #$01
+			steps:   4,
+			want:    map[string]int{"A": 0x00, "C": 1, "Z": 1, "N": 0, "CYCLES": 9},
+		},
+		{
+			name:    "decimal subtract",
+			program: []uint8{0xF8, 0x38, 0xA9, 0x46, 0xE9, 0x12}, // SED / SEC / LDA #$46 / SBC #$12
+			steps:   4,
+			want:    map[string]int{"A": 0x34, "C": 1},
+		},
+		{
+			name:    "decimal subtract with borrow out",
+			program: []uint8{0xF8, 0x38, 0xA9, 0x12, 0xE9, 0x21}, // SED / SEC / LDA #$12 / SBC #$21
+			steps:   4,
+			want:    map[string]int{"A": 0x91, "C": 0},
+		},
+		{
+			name:    "compare equal",
+			program: []uint8{0xA9, 0x40, 0xC9, 0x40}, // LDA #$40 / CMP #$40
+			steps:   2,
+			want:    map[string]int{"A": 0x40, "Z": 1, "C": 1, "N": 0},
+		},
+		{
+			name:    "compare less",
+			program: []uint8{0xA2, 0x40, 0xE0, 0x41}, // LDX #$40 / CPX #$41
+			steps:   2,
+			want:    map[string]int{"Z": 0, "C": 0, "N": 1},
+		},
+		{
+			name:    "compare greater",
+			program: []uint8{0xA0, 0x41, 0xC0, 0x40}, // LDY #$41 / CPY #$40
+			steps:   2,
+			want:    map[string]int{"Z": 0, "C": 1, "N": 0},
+		},
+		{
+			name:    "logic",
+			program: []uint8{0xA9, 0xF0, 0x29, 0x3C, 0x09, 0x01, 0x49, 0xFF}, // LDA #$F0 / AND #$3C / ORA #$01 / EOR #$FF
+			steps:   4,
+			want:    map[string]int{"A": 0xCE, "N": 1, "Z": 0},
+		},
+		{
+			name:    "bit test",
+			program: []uint8{0xA9, 0x01, 0x24, 0x10}, // LDA #$01 / BIT $10
+			memory:  map[uint16]uint8{0x0010: 0xC0},
+			steps:   2,
+			want:    map[string]int{"A": 0x01, "Z": 1, "N": 1, "V": 1},
+		},
+		{
+			name:    "decrement wraps around",
+			program: []uint8{0xC6, 0x10}, // DEC $10
+			steps:   1,
+			want:    map[string]int{"N": 1, "Z": 0, "CYCLES": 5},
+			wantMem: map[uint16]uint8{0x0010: 0xFF},
+		},
+	})
+}
+
+func TestShifts(t *testing.T) {
+	runCPUTests(t, []cpuTest{
+		{
+			name:    "shift right",
+			program: []uint8{0xA9, 0x01, 0x4A}, // LDA #$01 / LSR A
+			steps:   2,
+			want:    map[string]int{"A": 0x00, "C": 1, "Z": 1},
+		},
+		{
+			name:    "rotate left through the carry",
+			program: []uint8{0x38, 0xA9, 0x80, 0x2A}, // SEC / LDA #$80 / ROL A
+			steps:   3,
+			want:    map[string]int{"A": 0x01, "C": 1, "N": 0},
+		},
+		{
+			name:    "rotate right through the carry",
+			program: []uint8{0x38, 0xA9, 0x01, 0x6A}, // SEC / LDA #$01 / ROR A
+			steps:   3,
+			want:    map[string]int{"A": 0x80, "C": 1, "N": 1},
+		},
+		{
+			name:    "rotate right at address zero",
+			program: []uint8{0xA9, 0x55, 0x18, 0x66, 0x00}, // LDA #$55 / CLC / ROR $00
+			memory:  map[uint16]uint8{0x0000: 0x02},
+			steps:   3,
+			want:    map[string]int{"A": 0x55, "C": 0},
+			wantMem: map[uint16]uint8{0x0000: 0x01},
+		},
+		{
+			name:    "shift left in memory",
+			program: []uint8{0x0E, 0x00, 0x03}, // ASL $0300
+			memory:  map[uint16]uint8{0x0300: 0xC0},
+			steps:   1,
+			want:    map[string]int{"C": 1, "N": 1, "CYCLES": 6},
+			wantMem: map[uint16]uint8{0x0300: 0x80},
+		},
+	})
+}
+
+func TestBranches(t *testing.T) {
+	runCPUTests(t, []cpuTest{
+		{
+			name:    "not taken",
+			program: []uint8{0xA9, 0x01, 0xF0, 0x02}, // LDA #$01 / BEQ +2
+			steps:   2,
+			want:    map[string]int{"PC": 0x8004, "CYCLES": 4},
+		},
+		{
+			name:    "taken",
+			program: []uint8{0xA9, 0x00, 0xF0, 0x02}, // LDA #$00 / BEQ +2
+			steps:   2,
+			want:    map[string]int{"PC": 0x8006, "CYCLES": 5},
+		},
+		{
+			name:   "taken across a page",
+			memory: map[uint16]uint8{0x80FC: 0xD0, 0x80FD: 0x10}, // BNE +16
+			setup:  func(cpu *CPU) { cpu.PC = 0x80FC },
+			steps:  1,
+			want:   map[string]int{"PC": 0x810E, "CYCLES": 4},
+		},
+		{
+			name:    "backwards loop",
+			program: []uint8{0xA2, 0x03, 0xCA, 0xD0, 0xFD}, // LDX #$03 / loop: DEX / BNE loop
+			steps:   7,
+			want:    map[string]int{"X": 0x00, "Z": 1, "PC": 0x8005, "CYCLES": 16},
+		},
+		{
+			name:    "each condition",
+			program: []uint8{0x38, 0xB0, 0x00, 0x90, 0x10, 0xB8, 0x50, 0x00, 0x70, 0x10, 0xA9, 0x80, 0x30, 0x00, 0x10, 0x10}, // SEC / BCS / BCC / CLV / BVC / BVS / LDA #$80 / BMI / BPL
+			steps:   9,
+			want:    map[string]int{"PC": 0x8010},
+		},
+	})
+}
+
+func TestStack(t *testing.T) {
+	runCPUTests(t, []cpuTest{
+		{
+			name:    "push and pull the accumulator",
+			program: []uint8{0xA9, 0x42, 0x48, 0xA9, 0x00, 0x68}, // LDA #$42 / PHA / LDA #$00 / PLA
+			steps:   4,
+			want:    map[string]int{"A": 0x42, "Z": 0, "SP": 0xFD, "CYCLES": 11},
+			wantMem: map[uint16]uint8{0x01FD: 0x42},
+		},
+		{
+			name:    "push the status with break set",
+			program: []uint8{0x38, 0x08}, // SEC / PHP
+			steps:   2,
+			want:    map[string]int{"SP": 0xFC},
+			wantMem: map[uint16]uint8{0x01FD: 0x35},
+		},
+		{
+			name:    "pull the status without break",
+			program: []uint8{0xA9, 0xFF, 0x48, 0x28}, // LDA #$FF / PHA / PLP
+			steps:   3,
+			want:    map[string]int{"P": 0xCF},
+		},
+		{
+			name:    "call and return",
+			program: []uint8{0x20, 0x10, 0x80},      // JSR $8010
+			memory:  map[uint16]uint8{0x8010: 0x60}, // RTS
+			steps:   2,
+			want:    map[string]int{"PC": 0x8003, "SP": 0xFD, "CYCLES": 12},
+			wantMem: map[uint16]uint8{0x01FD: 0x80, 0x01FC: 0x02},
+		},
+		{
+			name:    "break and return from interrupt",
+			program: []uint8{0x00, 0xEA},                                        // BRK / padding
+			memory:  map[uint16]uint8{0xFFFE: 0x00, 0xFFFF: 0x90, 0x9000: 0x40}, // RTI
+			steps:   2,
+			want:    map[string]int{"PC": 0x8002, "SP": 0xFD, "I": 1, "P": 0x04, "CYCLES": 13},
+			wantMem: map[uint16]uint8{0x01FD: 0x80, 0x01FC: 0x02, 0x01FB: 0x34},
+		},
+		{
+			name:    "transfer to the stack pointer sets no flags",
+			program: []uint8{0xA2, 0x80, 0xA9, 0x01, 0x9A}, // LDX #$80 / LDA #$01 / TXS
+			steps:   3,
+			want:    map[string]int{"SP": 0x80, "N": 0},
+		},
+		{
+			name:    "transfer from the stack pointer sets flags",
+			program: []uint8{0xBA}, // TSX
+			steps:   1,
+			want:    map[string]int{"X": 0xFD, "N": 1},
+		},
+		{
+			name:    "transfers",
+			program: []uint8{0xA9, 0x07, 0xAA, 0xA8, 0xA9, 0x00, 0x8A, 0x98}, // LDA #$07 / TAX / TAY / LDA #$00 / TXA / TYA
+			steps:   6,
+			want:    map[string]int{"A": 0x07, "X": 0x07, "Y": 0x07, "Z": 0},
+		},
+	})
+}
+
+func TestFlagBits(t *testing.T) {
+	// Each flag sits at its bit in P, as PHP pushes it
+	bits := []struct {
+		name string
+		flag byte
+		bit  uint
+	}{
+		{"C", Carry, 0}, {"Z", Zero, 1}, {"I", Interrupt, 2}, {"D", Decimal, 3},
+		{"B", Break, 4}, {"-", Unused, 5}, {"V", Overflow, 6}, {"N", Negative, 7},
+	}
+	for _, b := range bits {
+		if b.flag != 1<<b.bit {
+			t.Errorf("%s: expected $%02X, got $%02X", b.name, 1<<b.bit, b.flag)
+		}
+		cpu := &CPU{MMU: &MMU{}}
+		cpu.setFlag(b.flag, true)
+		if cpu.P != b.flag || !cpu.getFlag(b.flag) {
+			t.Errorf("%s: setting it gave P $%02X", b.name, cpu.P)
+		}
+		cpu.setFlag(b.flag, false)
+		if cpu.P != 0 || cpu.getFlag(b.flag) {
+			t.Errorf("%s: clearing it left P $%02X", b.name, cpu.P)
+		}
+	}
+	runCPUTests(t, []cpuTest{{
+		name: "flags land on their bits",
+		// SEC / SED / LDA #$80 (N) / PHP
+		program: []uint8{0x38, 0xF8, 0xA9, 0x80, 0x08},
+		steps:   4,
+		wantMem: map[uint16]uint8{0x01FD: uint8(Negative | Unused | Break | Decimal | Interrupt | Carry)},
+	}})
+}
+
+func TestStackPointer(t *testing.T) {
+	runCPUTests(t, []cpuTest{
+		{
+			name:    "reset puts SP at $FD",
+			program: []uint8{0xEA},
+			steps:   1,
+			want:    map[string]int{"SP": 0xFD},
+		},
+		{
+			name: "SP wraps within page one when pushing",
+			// LDX #$00 / TXS / LDA #$42 / PHA
+			program: []uint8{0xA2, 0x00, 0x9A, 0xA9, 0x42, 0x48},
+			steps:   4,
+			want:    map[string]int{"SP": 0xFF},
+			wantMem: map[uint16]uint8{0x0100: 0x42, 0x0000: 0x00, 0x0200: 0x00},
+		},
+		{
+			name: "SP wraps within page one when pulling",
+			// LDX #$FF / TXS / PLA
+			program: []uint8{0xA2, 0xFF, 0x9A, 0x68},
+			memory:  map[uint16]uint8{0x0100: 0x37, 0x0200: 0x99},
+			steps:   3,
+			want:    map[string]int{"SP": 0x00, "A": 0x37},
+		},
+		{
+			name: "pushes write, then move down",
+			// LDA #$11 / PHA / LDA #$22 / PHA
+			program: []uint8{0xA9, 0x11, 0x48, 0xA9, 0x22, 0x48},
+			steps:   4,
+			want:    map[string]int{"SP": 0xFB},
+			wantMem: map[uint16]uint8{0x01FD: 0x11, 0x01FC: 0x22},
+		},
+		{
+			name: "nested calls push the addresses of their last bytes",
+			// JSR $8010, then $8010: JSR $8020, and $8020: LDA #$05
+			program: []uint8{0x20, 0x10, 0x80},
+			memory:  map[uint16]uint8{0x8010: 0x20, 0x8011: 0x20, 0x8012: 0x80, 0x8020: 0xA9, 0x8021: 0x05},
+			steps:   3,
+			want:    map[string]int{"A": 0x05, "SP": 0xF9, "PC": 0x8022},
+			wantMem: map[uint16]uint8{0x01FD: 0x80, 0x01FC: 0x02, 0x01FB: 0x80, 0x01FA: 0x12},
+		},
+		{
+			name: "nested calls return in order",
+			// JSR $8010 / LDX #$01, with $8010: JSR $8020 / RTS and $8020: RTS
+			program: []uint8{0x20, 0x10, 0x80, 0xA2, 0x01},
+			memory:  map[uint16]uint8{0x8010: 0x20, 0x8011: 0x20, 0x8012: 0x80, 0x8013: 0x60, 0x8020: 0x60},
+			steps:   5,
+			want:    map[string]int{"X": 0x01, "SP": 0xFD, "PC": 0x8005},
+		},
+	})
+}
+
+func TestInterrupts(t *testing.T) {
+	vectors := map[uint16]uint8{0xFFFA: 0x00, 0xFFFB: 0xA0, 0xFFFE: 0x00, 0xFFFF: 0x90}
+	runCPUTests(t, []cpuTest{
+		{
+			name:    "IRQ is masked after reset",
+			program: []uint8{0xEA}, // NOP
+			memory:  vectors,
+			setup:   func(cpu *CPU) { cpu.setIRQ(0, true) },
+			steps:   1,
+			want:    map[string]int{"PC": 0x8001},
+		},
+		{
+			name:    "IRQ is taken once enabled",
+			program: []uint8{0x58, 0xEA}, // CLI / NOP
+			memory:  vectors,
+			setup:   func(cpu *CPU) { cpu.setIRQ(0, true) },
+			steps:   2,
+			want:    map[string]int{"PC": 0x9000, "I": 1, "SP": 0xFA, "CYCLES": 9},
+			wantMem: map[uint16]uint8{0x01FD: 0x80, 0x01FC: 0x01, 0x01FB: 0x20},
+		},
+		{
+			name:    "NMI is taken with IRQs masked",
+			program: []uint8{0xEA}, // NOP
+			memory:  vectors,
+			setup:   func(cpu *CPU) { cpu.triggerNMI() },
+			steps:   1,
+			want:    map[string]int{"PC": 0xA000, "CYCLES": 7},
+			wantMem: map[uint16]uint8{0x01FB: 0x24},
+		},
+	})
+}
+
+func TestUnknownOpcodeStops(t *testing.T) {
+	cpu := newTestCPU(t, NMOS6502, []uint8{0x02}) // an undocumented opcode
+	cpu.step()
+	if cpu.running || cpu.PC != 0x8000 {
+		t.Errorf("expected to stop at $8000, running %v at $%04X", cpu.running, cpu.PC)
+	}
+}
+
+func Test65C02(t *testing.T) {
+	runCPUTests(t, []cpuTest{
+		{
+			name:    "store zero",
+			variant: CMOS65C02,
+			program: []uint8{0xA2, 0x01, 0x64, 0x10, 0x74, 0x10, 0x9C, 0x00, 0x03, 0x9E, 0x00, 0x03}, // LDX #$01 / STZ $10 / STZ $10,X / STZ $0300 / STZ $0300,X
+			memory:  map[uint16]uint8{0x0010: 1, 0x0011: 1, 0x0300: 1, 0x0301: 1},
+			steps:   5,
+			wantMem: map[uint16]uint8{0x0010: 0, 0x0011: 0, 0x0300: 0, 0x0301: 0},
+		},
+		{
+			name:    "branch always",
+			variant: CMOS65C02,
+			program: []uint8{0x80, 0x10}, // BRA +16
+			steps:   1,
+			want:    map[string]int{"PC": 0x8012, "CYCLES": 3},
+		},
+		{
+			name:    "push and pull X and Y",
+			variant: CMOS65C02,
+			program: []uint8{0xA2, 0x80, 0xDA, 0x7A}, // LDX #$80 / PHX / PLY
+			steps:   3,
+			want:    map[string]int{"Y": 0x80, "N": 1, "SP": 0xFD},
+		},
+		{
+			name:    "test and set and reset bits",
+			variant: CMOS65C02,
+			program: []uint8{0xA9, 0x0F, 0x04, 0x10, 0xA9, 0x03, 0x14, 0x10}, // LDA #$0F / TSB $10 / LDA #$03 / TRB $10
+			memory:  map[uint16]uint8{0x0010: 0x30},
+			steps:   4,
+			want:    map[string]int{"Z": 0},
+			wantMem: map[uint16]uint8{0x0010: 0x3C},
+		},
+		{
+			name:    "zero page indirect",
+			variant: CMOS65C02,
+			program: []uint8{0xB2, 0x40}, // LDA ($40)
+			memory:  map[uint16]uint8{0x0040: 0x00, 0x0041: 0x13, 0x1300: 0x5C},
+			steps:   1,
+			want:    map[string]int{"A": 0x5C, "CYCLES": 5},
+		},
+		{
+			name:    "jump absolute indexed indirect",
+			variant: CMOS65C02,
+			program: []uint8{0xA2, 0x02, 0x7C, 0x00, 0x03}, // LDX #$02 / JMP ($0300,X)
+			memory:  map[uint16]uint8{0x0302: 0x34, 0x0303: 0x12},
+			steps:   2,
+			want:    map[string]int{"PC": 0x1234},
+		},
+		{
+			name:    "set, reset and branch on bits",
+			variant: CMOS65C02,
+			program: []uint8{0xF7, 0x10, 0x07, 0x10, 0x0F, 0x10, 0x10, 0xFF, 0x10, 0x01}, // SMB7 $10 / RMB0 $10 / BBR0 $10,+16 / BBS7 $10,+1
+			memory:  map[uint16]uint8{0x0010: 0x01},
+			setup:   func(cpu *CPU) { cpu.MMU.pokeByte(0x8017, 0xFF) },
+			steps:   4,
+			want:    map[string]int{"PC": 0x801A},
+			wantMem: map[uint16]uint8{0x0010: 0x80},
+		},
+		{
+			name:    "bit immediate only sets zero",
+			variant: CMOS65C02,
+			program: []uint8{0xA9, 0x01, 0x89, 0xC0}, // LDA #$01 / BIT #$C0
+			steps:   2,
+			want:    map[string]int{"Z": 1, "N": 0, "V": 0},
+		},
+		{
+			name:    "increment and decrement the accumulator",
+			variant: CMOS65C02,
+			program: []uint8{0x1A, 0x1A, 0x3A}, // INC A / INC A / DEC A
+			steps:   3,
+			want:    map[string]int{"A": 0x01},
+		},
+		{
+			name:    "undefined opcodes are NOPs",
+			variant: CMOS65C02,
+			program: []uint8{0x03, 0x02, 0xFF, 0x5C, 0xFF, 0xFF, 0xDC, 0xFF, 0xFF}, // 1, 2, 3 and 3 byte NOPs
+			steps:   4,
+			want:    map[string]int{"PC": 0x8009, "A": 0, "CYCLES": 1 + 2 + 8 + 4},
+		},
+		{
+			name:    "break clears decimal mode",
+			variant: CMOS65C02,
+			program: []uint8{0xF8, 0x00}, // SED / BRK
+			steps:   2,
+			want:    map[string]int{"D": 0, "I": 1},
+		},
+		{
+			name:    "stop",
+			variant: CMOS65C02,
+			program: []uint8{0xDB}, // STP
+			steps:   1,
+			want:    map[string]int{"PC": 0x8001},
+		},
+	})
+}
+
+func TestWait(t *testing.T) {
+	cpu := newTestCPU(t, CMOS65C02, []uint8{0xCB, 0xEA}) // WAI / NOP
+	cpu.step()
+	cpu.step()
+	if cpu.PC != 0x8001 || !cpu.waiting {
+		t.Fatalf("expected to be waiting at $8001, at $%04X", cpu.PC)
+	}
+	// A masked IRQ ends the wait without being taken
+	cpu.setIRQ(0, true)
+	cpu.step()
+	if cpu.PC != 0x8002 || cpu.waiting {
+		t.Errorf("expected to run the NOP after the wait, at $%04X", cpu.PC)
+	}
+}
@@ -0,0 +1,955 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// dapRequest is a request from a Debug Adapter Protocol client
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// dapResponse answers a request
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+// dapEvent tells the client that something happened
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+// dapLaunchArguments are the arguments of the launch and attach requests,
+// which come from the client's launch configuration. Attaching uses whatever
+// the emulator already has loaded, so it ignores the program and files.
+type dapLaunchArguments struct {
+	Program     string   `json:"program"`     // file[@address] to load
+	Files       []string `json:"files"`       // more files to load
+	DbgFile     string   `json:"dbgFile"`     // ld65 debug file
+	MapFile     string   `json:"mapFile"`     // ld65 map file
+	SourceRoot  string   `json:"sourceRoot"`  // directory source paths are relative to
+	StopOnEntry bool     `json:"stopOnEntry"` // stop before the first instruction
+	RunAddress  bool     `json:"runAddress"`  // start at a PRG or XEX run address
+	ClockSpeed  float64  `json:"clockSpeed"`  // clock speed in MHz
+	History     string   `json:"history"`     // history budget, for stepping back
+}
+
+// dapSourceBreakpoint is a breakpoint set on a source line or function
+type dapSourceBreakpoint struct {
+	Line         int    `json:"line"`
+	Name         string `json:"name"`
+	Condition    string `json:"condition"`
+	HitCondition string `json:"hitCondition"`
+}
+
+// The variables references of the scopes, which are the same in every frame
+const (
+	dapRegisters = iota + 1
+	dapFlags
+	dapZeroPage
+)
+
+// dapThreadID is the id of the one and only thread
+const dapThreadID = 1
+
+// dapServer serves the Debug Adapter Protocol for a CPU
+type dapServer struct {
+	cpu *CPU
+	in  *bufio.Reader
+	out io.Writer
+	// writeLock serialises messages, as stopped events are sent from the
+	// goroutine that runs the CPU
+	writeLock sync.Mutex
+	seq       int
+	// running is set while the CPU is executing, and done receives a value
+	// when it stops: true if it was only suspended, to be carried on with
+	running atomic.Bool
+	done    chan bool
+	// suspending is set while the CPU is being stopped to change breakpoints
+	suspending atomic.Bool
+	// action and reason are what is being executed, so that it can be
+	// carried on with after a suspension
+	action func()
+	reason string
+	// sourceBreakpoints maps each source file to the ids of its breakpoints,
+	// as each setBreakpoints request replaces all those of a file
+	sourceBreakpoints   map[string][]int
+	functionBreakpoints []int
+	stopOnEntry         bool
+	sourceRoot          string
+}
+
+// newDAPServer creates a server that reads requests from in and writes
+// responses and events to out
+func newDAPServer(cpu *CPU, in io.Reader, out io.Writer) *dapServer {
+	if cpu.breakpoints == nil {
+		cpu.breakpoints = newBreakpointSet(cpu)
+	}
+	return &dapServer{
+		cpu:               cpu,
+		in:                bufio.NewReader(in),
+		out:               out,
+		sourceBreakpoints: map[string][]int{},
+	}
+}
+
+// printDAPUsage prints the usage of the dap subcommand
+func printDAPUsage() {
+	fmt.Println("Usage: go6502 dap [--port address]")
+	fmt.Println("Serves the Debug Adapter Protocol on stdin and stdout, or on a TCP address")
+	fmt.Println("The program is loaded by the client's launch request. To attach to a")
+	fmt.Println("program loaded from the command line instead, run it with --dap address")
+}
+
+// dapCommand runs the dap subcommand and returns the exit status
+func dapCommand(args []string) int {
+	port := ""
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-h", "--help":
+			printDAPUsage()
+			return 0
+		case "-p", "--port":
+			if i+1 >= len(args) {
+				fmt.Println("Missing address")
+				return 1
+			}
+			i++
+			port = args[i]
+		default:
+			fmt.Println("Invalid option:", args[i])
+			printDAPUsage()
+			return 1
+		}
+	}
+	cpu := &CPU{clockSpeed: mhzToHz(1), MMU: &MMU{}}
+	cpu.breakpoints = newBreakpointSet(cpu)
+	cpu.reset()
+	if port != "" {
+		if err := serveDAP(cpu, port); err != nil {
+			fmt.Println("DAP server error:", err)
+			return 1
+		}
+		return 0
+	}
+	// The protocol has stdout to itself, so send anything else to stderr
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	if err := newDAPServer(cpu, os.Stdin, out).serve(); err != nil {
+		fmt.Println("DAP server error:", err)
+		return 1
+	}
+	return 0
+}
+
+// serveDAP listens on a TCP address and serves a single client
+func serveDAP(cpu *CPU, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	fmt.Println("Waiting for a debug adapter client on", listener.Addr())
+	conn, err := listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return newDAPServer(cpu, conn, conn).serve()
+}
+
+// serve handles requests until the client disconnects
+func (d *dapServer) serve() error {
+	for {
+		request, err := d.readRequest()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		d.cpu.log("DAP: " + request.Command)
+		if !d.handle(request) {
+			return nil
+		}
+	}
+}
+
+// readRequest reads a message, a Content-Length header followed by JSON
+func (d *dapServer) readRequest() (*dapRequest, error) {
+	length := -1
+	for {
+		line, err := d.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if length >= 0 {
+				break
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(name, "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("invalid Content-Length %q", value)
+			}
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(d.in, body); err != nil {
+		return nil, err
+	}
+	request := &dapRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// send writes a message, giving it the next sequence number
+func (d *dapServer) send(message interface{}) {
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	d.seq++
+	switch m := message.(type) {
+	case *dapResponse:
+		m.Seq = d.seq
+	case *dapEvent:
+		m.Seq = d.seq
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(d.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+// respond sends a successful response to a request
+func (d *dapServer) respond(request *dapRequest, body interface{}) {
+	d.send(&dapResponse{Type: "response", RequestSeq: request.Seq, Success: true, Command: request.Command, Body: body})
+}
+
+// fail sends an error response to a request
+func (d *dapServer) fail(request *dapRequest, err error) {
+	d.send(&dapResponse{Type: "response", RequestSeq: request.Seq, Command: request.Command, Message: err.Error()})
+}
+
+// event sends an event
+func (d *dapServer) event(name string, body interface{}) {
+	d.send(&dapEvent{Type: "event", Event: name, Body: body})
+}
+
+// dapRunningRequests are the requests that can be made while the CPU is running. The
+// rest wait for it to stop.
+var dapRunningRequests = map[string]bool{
+	"pause": true, "threads": true, "disconnect": true, "terminate": true,
+	"setBreakpoints": true, "setFunctionBreakpoints": true,
+}
+
+// handle answers a request, reporting whether to carry on serving
+func (d *dapServer) handle(request *dapRequest) bool {
+	if d.running.Load() && !dapRunningRequests[request.Command] {
+		d.fail(request, fmt.Errorf("the program is running"))
+		return true
+	}
+	var err error
+	switch request.Command {
+	case "initialize":
+		d.respond(request, map[string]interface{}{
+			"supportsConfigurationDoneRequest":  true,
+			"supportsConditionalBreakpoints":    true,
+			"supportsHitConditionalBreakpoints": true,
+			"supportsFunctionBreakpoints":       true,
+			"supportsSetVariable":               true,
+			"supportsReadMemoryRequest":         true,
+			"supportsTerminateRequest":          true,
+			"supportsStepBack":                  true,
+		})
+	case "launch", "attach":
+		err = d.launch(request)
+	case "configurationDone":
+		d.respond(request, nil)
+		if d.stopOnEntry {
+			d.stopped("entry", "", nil)
+		} else {
+			d.execute("step", func() { d.cpu.run(false, nil) })
+		}
+	case "setBreakpoints":
+		d.whileStopped(func() { err = d.setBreakpoints(request) })
+	case "setFunctionBreakpoints":
+		d.whileStopped(func() { err = d.setFunctionBreakpoints(request) })
+	case "threads":
+		d.respond(request, map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": dapThreadID, "name": "6502"}},
+		})
+	case "stackTrace":
+		frames := d.stackFrames()
+		d.respond(request, map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)})
+	case "scopes":
+		d.respond(request, map[string]interface{}{"scopes": []map[string]interface{}{
+			{"name": "Registers", "variablesReference": dapRegisters, "expensive": false},
+			{"name": "Flags", "variablesReference": dapFlags, "expensive": false},
+			{"name": "Zero Page", "variablesReference": dapZeroPage, "expensive": true},
+		}})
+	case "variables":
+		err = d.variables(request)
+	case "setVariable":
+		err = d.setVariable(request)
+	case "evaluate":
+		err = d.evaluate(request)
+	case "readMemory":
+		err = d.readMemory(request)
+	case "continue":
+		d.respond(request, map[string]interface{}{"allThreadsContinued": true})
+		d.execute("step", func() { d.cpu.run(false, nil) })
+	case "next", "stepIn":
+		d.respond(request, nil)
+		over := request.Command == "next"
+		d.execute("step", func() { d.stepLine(over) })
+	case "stepOut":
+		d.respond(request, nil)
+		d.execute("step", d.stepOut)
+	case "stepBack", "reverseContinue":
+		if d.cpu.history == nil {
+			err = fmt.Errorf("there is no history to go back through, set history in the launch configuration")
+			break
+		}
+		d.respond(request, nil)
+		if request.Command == "stepBack" {
+			d.execute("step", d.stepBack)
+		} else {
+			d.execute("step", d.reverseContinue)
+		}
+	case "pause":
+		d.cpu.stopRequested.Store(true)
+		d.respond(request, nil)
+	case "disconnect", "terminate":
+		d.cpu.stopRequested.Store(true)
+		d.respond(request, nil)
+		if request.Command == "terminate" {
+			d.event("terminated", nil)
+		}
+		return false
+	default:
+		err = fmt.Errorf("%s is not supported", request.Command)
+	}
+	if err != nil {
+		d.fail(request, err)
+	}
+	return true
+}
+
+// launch loads the program (when launching rather than attaching) and the
+// debug info
+func (d *dapServer) launch(request *dapRequest) error {
+	var args dapLaunchArguments
+	if len(request.Arguments) > 0 {
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return err
+		}
+	}
+	cpu := d.cpu
+	if args.DbgFile != "" || args.MapFile != "" {
+		info, err := loadDebugInfo(args.DbgFile, args.MapFile)
+		if err != nil {
+			return fmt.Errorf("loading debug info: %v", err)
+		}
+		cpu.debugInfo = info
+	}
+	if args.ClockSpeed > 0 {
+		cpu.clockSpeed = mhzToHz(args.ClockSpeed)
+	}
+	if args.History != "" {
+		budget, err := parseSize(args.History)
+		if err != nil {
+			return fmt.Errorf("history: %v", err)
+		}
+		cpu.enableHistory(budget)
+	}
+	if request.Command == "launch" {
+		files := args.Files
+		if args.Program != "" {
+			files = append([]string{args.Program}, files...)
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("no program to launch")
+		}
+		var images []*programImage
+		for _, spec := range files {
+			file, err := parseFileSpec(spec)
+			if err != nil {
+				return err
+			}
+			img, err := loadProgramFromFile(file)
+			if err != nil {
+				return fmt.Errorf("loading %s: %v", file.fileName, err)
+			}
+			if err := cpu.loadImage(img); err != nil {
+				return fmt.Errorf("loading %s: %v", file.fileName, err)
+			}
+			images = append(images, img)
+		}
+		cpu.reset()
+		cpu.PC = entryPoint(images, cpu.PC, args.RunAddress)
+	}
+	d.stopOnEntry = args.StopOnEntry
+	d.sourceRoot = args.SourceRoot
+	d.respond(request, nil)
+	// The client sends its breakpoints once it knows we are ready for them
+	d.event("initialized", nil)
+	return nil
+}
+
+// execute runs the CPU in the background, sending a stopped event when it stops
+func (d *dapServer) execute(reason string, action func()) {
+	cpu := d.cpu
+	d.action, d.reason = action, reason
+	// The goroutine keeps its own channel, as the next execute may replace
+	// d.done once the stopped event is out
+	done := make(chan bool, 1)
+	d.done = done
+	d.running.Store(true)
+	cpu.stopRequested.Store(false)
+	cpu.breakpoints.resume()
+	cpu.running = true
+	go func() {
+		action()
+		d.running.Store(false)
+		// A suspension only counts if nothing else stopped the CPU
+		if d.suspending.Load() && !cpu.breakpoints.stopped() && !d.interruptedBy() {
+			done <- true
+			return
+		}
+		d.stopped(reason, "", nil)
+		done <- false
+	}()
+}
+
+// whileStopped makes a change, such as to the breakpoints, that must not
+// happen while the CPU runs. If it is running it is stopped for the change
+// and then carries on.
+func (d *dapServer) whileStopped(change func()) {
+	if !d.running.Load() {
+		change()
+		return
+	}
+	d.suspending.Store(true)
+	d.cpu.stopRequested.Store(true)
+	suspended := <-d.done
+	d.suspending.Store(false)
+	change()
+	if suspended {
+		d.execute(d.reason, d.action)
+	}
+}
+
+// stopped sends a stopped event, working out why the CPU stopped. The given
+// reason is used if nothing else stopped it.
+func (d *dapServer) stopped(reason, description string, ids []int) {
+	cpu := d.cpu
+	breakpoints := cpu.breakpoints
+	switch {
+	case breakpoints.stopped():
+		reason = "breakpoint"
+		if breakpoints.hit.kind.isWatchpoint() {
+			reason = "data breakpoint"
+		}
+		description = breakpoints.describeHit()
+		ids = []int{breakpoints.hit.id}
+	case cpu.stopRequested.Load():
+		reason = "pause"
+	case !cpu.running:
+		reason = "exception"
+		description = fmt.Sprintf("Unknown opcode $%02X", cpu.MMU.peekByte(cpu.PC))
+	case cpu.getFlag(Break):
+		reason = "exception"
+		description = "BRK"
+	}
+	cpu.stopRequested.Store(false)
+	body := map[string]interface{}{"reason": reason, "threadId": dapThreadID, "allThreadsStopped": true}
+	if description != "" {
+		body["description"] = description
+		body["text"] = description
+	}
+	if len(ids) > 0 {
+		body["hitBreakpointIds"] = ids
+	}
+	d.event("stopped", body)
+}
+
+// interrupted reports whether stepping should stop for something other than
+// reaching its goal
+func (d *dapServer) interrupted() bool {
+	return d.cpu.stopRequested.Load() || d.cpu.breakpoints.stopped() || d.interruptedBy()
+}
+
+// interruptedBy reports whether the program stopped itself, with a BRK or an
+// opcode the CPU does not know
+func (d *dapServer) interruptedBy() bool {
+	return !d.cpu.running || d.cpu.getFlag(Break)
+}
+
+// stepLine steps until the PC reaches a different source line, over or into
+// subroutine calls. Without line information it steps one instruction.
+func (d *dapServer) stepLine(over bool) {
+	cpu := d.cpu
+	start, hasLine := d.lineAt(cpu.PC)
+	for first := true; ; first = false {
+		if !first && cpu.breakpoints.beforeInstruction() {
+			return
+		}
+		if over {
+			cpu.stepOver()
+		} else {
+			cpu.step()
+		}
+		if d.interrupted() || !hasLine {
+			return
+		}
+		if line, ok := d.lineAt(cpu.PC); ok && line != start {
+			return
+		}
+	}
+}
+
+// stepOut runs until the current subroutine returns
+func (d *dapServer) stepOut() {
+	cpu := d.cpu
+	sp := cpu.SP
+	for first := true; ; first = false {
+		if !first && cpu.breakpoints.beforeInstruction() {
+			return
+		}
+		opcode := cpu.MMU.peekByte(cpu.PC)
+		cpu.step()
+		// An RTS or RTI that takes the stack above where it was returns
+		// from this subroutine
+		if (opcode == 0x60 || opcode == 0x40) && cpu.SP > sp {
+			return
+		}
+		if d.interrupted() {
+			return
+		}
+	}
+}
+
+// stepBack steps backwards to the start of the previous source line, or one
+// instruction without line information
+func (d *dapServer) stepBack() {
+	cpu := d.cpu
+	start, hasLine := d.lineAt(cpu.PC)
+	for {
+		if !cpu.stepBack() {
+			d.output("Reached the start of the history")
+			return
+		}
+		if !hasLine || cpu.breakpoints.stopped() || cpu.stopRequested.Load() {
+			return
+		}
+		// Stop at the first instruction of a different line
+		if line, ok := d.lineAt(cpu.PC); ok && line != start && !d.previousOnLine(line) {
+			return
+		}
+	}
+}
+
+// previousOnLine reports whether the instruction before the current one in
+// the history belongs to the same source line, which means the current one
+// is not where execution of the line began
+func (d *dapServer) previousOnLine(line sourceLine) bool {
+	history := d.cpu.history
+	if history.len() == 0 {
+		return false
+	}
+	previous, ok := d.lineAt(history.records[len(history.records)-1].PC)
+	return ok && previous == line
+}
+
+// reverseContinue runs backwards to a breakpoint
+func (d *dapServer) reverseContinue() {
+	if !d.cpu.reverseContinue() {
+		d.output("Reached the start of the history")
+	}
+}
+
+// output shows a message in the client's debug console
+func (d *dapServer) output(message string) {
+	d.event("output", map[string]interface{}{"category": "console", "output": message + "\n"})
+}
+
+// lineAt returns the source line of an address, if there is debug info
+func (d *dapServer) lineAt(address uint16) (sourceLine, bool) {
+	if d.cpu.debugInfo == nil {
+		return sourceLine{}, false
+	}
+	return d.cpu.debugInfo.lineAt(address)
+}
+
+// sourcePath turns a file name from the debug info into a path for the client
+func (d *dapServer) sourcePath(file string) string {
+	if filepath.IsAbs(file) || d.sourceRoot == "" {
+		if path, err := filepath.Abs(file); err == nil {
+			return path
+		}
+		return file
+	}
+	return filepath.Join(d.sourceRoot, file)
+}
+
+// sameSource reports whether a file named in the debug info is the file the
+// client has a path for. The debug info's names are often relative, so one
+// matches if it is a suffix of the path.
+func sameSource(debugFile, path string) bool {
+	debugFile = filepath.ToSlash(filepath.Clean(debugFile))
+	path = filepath.ToSlash(filepath.Clean(path))
+	return debugFile == path || strings.HasSuffix(path, "/"+strings.TrimPrefix(debugFile, "./"))
+}
+
+// sourceAddress finds the address of a source line. A line that produced no
+// code moves down to the next one that did, within a few lines.
+func (d *dapServer) sourceAddress(path string, line int) (sourceLine, uint16, bool) {
+	info := d.cpu.debugInfo
+	if info == nil {
+		return sourceLine{}, 0, false
+	}
+	best := sourceLine{}
+	var bestAddress uint16
+	found := false
+	for l, address := range info.addresses {
+		if l.line < line || l.line > line+10 || !sameSource(l.file, path) {
+			continue
+		}
+		if !found || l.line < best.line || l.line == best.line && address < bestAddress {
+			best, bestAddress, found = l, address, true
+		}
+	}
+	return best, bestAddress, found
+}
+
+// newSourceBreakpoint makes an exec breakpoint with a client's condition and
+// hit count
+func newSourceBreakpoint(address uint16, spec dapSourceBreakpoint) (*Breakpoint, error) {
+	bp := &Breakpoint{kind: breakExecute, start: address, end: address}
+	if spec.Condition != "" {
+		condition, err := parseExpr(spec.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("condition: %v", err)
+		}
+		bp.condition, bp.conditionText = condition, spec.Condition
+	}
+	if spec.HitCondition != "" {
+		// Accept "n" and ">= n", both meaning from the nth hit on
+		text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(spec.HitCondition), ">="))
+		count, err := strconv.Atoi(text)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid hit count %q", spec.HitCondition)
+		}
+		bp.hitCount = count
+	}
+	return bp, nil
+}
+
+// setBreakpoints answers setBreakpoints, replacing the breakpoints of a source
+func (d *dapServer) setBreakpoints(request *dapRequest) error {
+	var args struct {
+		Source struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []dapSourceBreakpoint `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(request.Arguments, &args); err != nil {
+		return err
+	}
+	path := args.Source.Path
+	for _, id := range d.sourceBreakpoints[path] {
+		d.cpu.breakpoints.remove(id)
+	}
+	d.sourceBreakpoints[path] = nil
+	results := []map[string]interface{}{}
+	for _, spec := range args.Breakpoints {
+		result := map[string]interface{}{"verified": false, "line": spec.Line}
+		results = append(results, result)
+		line, address, ok := d.sourceAddress(path, spec.Line)
+		if !ok {
+			result["message"] = "No code found for this line in the debug info"
+			continue
+		}
+		bp, err := newSourceBreakpoint(address, spec)
+		if err == nil {
+			err = d.cpu.breakpoints.add(bp)
+		}
+		if err != nil {
+			result["message"] = err.Error()
+			continue
+		}
+		d.sourceBreakpoints[path] = append(d.sourceBreakpoints[path], bp.id)
+		result["id"] = bp.id
+		result["verified"] = true
+		result["line"] = line.line
+		result["instructionReference"] = fmt.Sprintf("0x%04X", address)
+	}
+	d.respond(request, map[string]interface{}{"breakpoints": results})
+	return nil
+}
+
+// setFunctionBreakpoints answers setFunctionBreakpoints, which break on
+// symbols or addresses
+func (d *dapServer) setFunctionBreakpoints(request *dapRequest) error {
+	var args struct {
+		Breakpoints []dapSourceBreakpoint `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(request.Arguments, &args); err != nil {
+		return err
+	}
+	for _, id := range d.functionBreakpoints {
+		d.cpu.breakpoints.remove(id)
+	}
+	d.functionBreakpoints = nil
+	results := []map[string]interface{}{}
+	for _, spec := range args.Breakpoints {
+		result := map[string]interface{}{"verified": false}
+		results = append(results, result)
+		address, err := evalExpr(spec.Name, d.cpu.breakpoints.context())
+		if err != nil {
+			result["message"] = err.Error()
+			continue
+		}
+		bp, err := newSourceBreakpoint(uint16(address), spec)
+		if err == nil {
+			err = d.cpu.breakpoints.add(bp)
+		}
+		if err != nil {
+			result["message"] = err.Error()
+			continue
+		}
+		d.functionBreakpoints = append(d.functionBreakpoints, bp.id)
+		result["id"] = bp.id
+		result["verified"] = true
+	}
+	d.respond(request, map[string]interface{}{"breakpoints": results})
+	return nil
+}
+
+// stackFrames reconstructs the call stack. The top frame is at the PC; the
+// others are found by looking up the stack for return addresses pushed by
+// JSR, which point at the last byte of a JSR instruction.
+func (d *dapServer) stackFrames() []map[string]interface{} {
+	cpu := d.cpu
+	frames := []map[string]interface{}{d.frame(0, cpu.PC)}
+	for address := int(cpu.SP) + 1; address < 0xFF; address++ {
+		returnAddress := uint16(cpu.MMU.peekByte(uint16(0x100+address))) | uint16(cpu.MMU.peekByte(uint16(0x100+address+1)))<<8
+		call := returnAddress - 2
+		if cpu.MMU.peekByte(call) != 0x20 {
+			continue
+		}
+		frames = append(frames, d.frame(len(frames), call))
+		address++
+	}
+	return frames
+}
+
+// frame describes a stack frame at an address
+func (d *dapServer) frame(id int, address uint16) map[string]interface{} {
+	name := hexAddress(address, 4)
+	if info := d.cpu.debugInfo; info != nil {
+		if function, ok := info.functionAt(address); ok {
+			name = function
+		}
+	}
+	frame := map[string]interface{}{
+		"id":                          id,
+		"name":                        name,
+		"line":                        0,
+		"column":                      0,
+		"instructionPointerReference": fmt.Sprintf("0x%04X", address),
+	}
+	if line, ok := d.lineAt(address); ok {
+		frame["source"] = map[string]interface{}{"name": filepath.Base(line.file), "path": d.sourcePath(line.file)}
+		frame["line"] = line.line
+		frame["column"] = 1
+	} else {
+		frame["presentationHint"] = "subtle"
+	}
+	return frame
+}
+
+// variables answers a variables request for one of the scopes
+func (d *dapServer) variables(request *dapRequest) error {
+	var args struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := json.Unmarshal(request.Arguments, &args); err != nil {
+		return err
+	}
+	cpu := d.cpu
+	variable := func(name, value string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "value": value, "variablesReference": 0}
+	}
+	variables := []map[string]interface{}{}
+	switch args.VariablesReference {
+	case dapRegisters:
+		for _, name := range []string{"A", "X", "Y", "SP", "P"} {
+			value, _ := cpu.registerValue(name)
+			variables = append(variables, variable(name, fmt.Sprintf("$%02X", value)))
+		}
+		pc := variable("PC", fmt.Sprintf("$%04X", cpu.PC))
+		pc["memoryReference"] = fmt.Sprintf("0x%04X", cpu.PC)
+		variables = append(variables, pc)
+	case dapFlags:
+		for _, name := range "NVBDIZC" {
+			value, _ := cpu.registerValue(string(name))
+			variables = append(variables, variable(string(name), strconv.Itoa(value)))
+		}
+	case dapZeroPage:
+		for address := 0; address < 0x100; address++ {
+			name := fmt.Sprintf("$%02X", address)
+			if info := cpu.debugInfo; info != nil {
+				if symbol, ok := info.symbolFor(uint16(address)); ok {
+					name += " " + symbol
+				}
+			}
+			variables = append(variables, variable(name, fmt.Sprintf("$%02X", cpu.MMU.peekByte(uint16(address)))))
+		}
+	default:
+		return fmt.Errorf("unknown variables reference %d", args.VariablesReference)
+	}
+	d.respond(request, map[string]interface{}{"variables": variables})
+	return nil
+}
+
+// setVariable answers a setVariable request, for a register, flag or zero
+// page byte
+func (d *dapServer) setVariable(request *dapRequest) error {
+	var args struct {
+		VariablesReference int    `json:"variablesReference"`
+		Name               string `json:"name"`
+		Value              string `json:"value"`
+	}
+	if err := json.Unmarshal(request.Arguments, &args); err != nil {
+		return err
+	}
+	cpu := d.cpu
+	value, err := evalExpr(args.Value, cpu.breakpoints.context())
+	if err != nil {
+		return err
+	}
+	name := strings.Fields(args.Name + " ")[0]
+	result := ""
+	switch args.VariablesReference {
+	case dapRegisters:
+		if name == "PC" {
+			cpu.PC = uint16(value)
+			result = fmt.Sprintf("$%04X", cpu.PC)
+			break
+		}
+		registers := map[string]*uint8{"A": &cpu.A, "X": &cpu.X, "Y": &cpu.Y, "SP": &cpu.SP, "P": &cpu.P}
+		register, ok := registers[name]
+		if !ok {
+			return fmt.Errorf("unknown register %s", name)
+		}
+		*register = uint8(value)
+		result = fmt.Sprintf("$%02X", *register)
+	case dapFlags:
+		flag, ok := registerFlags[name]
+		if !ok {
+			return fmt.Errorf("unknown flag %s", name)
+		}
+		cpu.setFlag(flag, value != 0)
+		result = strconv.Itoa(boolValue(value != 0))
+	case dapZeroPage:
+		address, err := strconv.ParseUint(strings.TrimPrefix(name, "$"), 16, 8)
+		if err != nil {
+			return fmt.Errorf("unknown variable %s", args.Name)
+		}
+		cpu.MMU.pokeByte(uint16(address), uint8(value))
+		result = fmt.Sprintf("$%02X", uint8(value))
+	default:
+		return fmt.Errorf("unknown variables reference %d", args.VariablesReference)
+	}
+	d.respond(request, map[string]interface{}{"value": result})
+	return nil
+}
+
+// evaluate answers an evaluate request with the value of an expression over
+// the registers, flags, symbols and memory
+func (d *dapServer) evaluate(request *dapRequest) error {
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(request.Arguments, &args); err != nil {
+		return err
+	}
+	value, err := evalExpr(args.Expression, d.cpu.breakpoints.context())
+	if err != nil {
+		return err
+	}
+	result := fmt.Sprintf("$%X (%d)", value, value)
+	if value < 0 {
+		result = strconv.Itoa(value)
+	}
+	d.respond(request, map[string]interface{}{"result": result, "variablesReference": 0})
+	return nil
+}
+
+// readMemory answers a readMemory request
+func (d *dapServer) readMemory(request *dapRequest) error {
+	var args struct {
+		MemoryReference string `json:"memoryReference"`
+		Offset          int    `json:"offset"`
+		Count           int    `json:"count"`
+	}
+	if err := json.Unmarshal(request.Arguments, &args); err != nil {
+		return err
+	}
+	if args.Count < 0 {
+		return fmt.Errorf("invalid count %d", args.Count)
+	}
+	base, err := parseAddress(args.MemoryReference)
+	if err != nil {
+		return err
+	}
+	start := int(base) + args.Offset
+	if start < 0 || start >= RAMSize {
+		d.respond(request, map[string]interface{}{"address": args.MemoryReference, "unreadableBytes": args.Count})
+		return nil
+	}
+	end := start + args.Count
+	if end > RAMSize {
+		end = RAMSize
+	}
+	data := make([]byte, 0, end-start)
+	for address := start; address < end; address++ {
+		data = append(data, d.cpu.MMU.peekByte(uint16(address)))
+	}
+	d.respond(request, map[string]interface{}{
+		"address":         fmt.Sprintf("0x%04X", start),
+		"data":            base64.StdEncoding.EncodeToString(data),
+		"unreadableBytes": args.Count - len(data),
+	})
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dapProgram is testdata/debuginfo/prog.s assembled at $8000
+var dapProgram = []uint8{
+	0xA2, 0x00, 0x20, 0x10, 0x80, 0xE8, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0, // main
+	0xA9, 0x42, 0x20, 0x20, 0x80, 0x60, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // sub
+	0xC8, 0x60, // inner
+}
+
+// dapMessage is a response or event as the client sees it
+type dapMessage struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Command    string          `json:"command"`
+	Message    string          `json:"message"`
+	Event      string          `json:"event"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// dapClient is the client end of a DAP session
+type dapClient struct {
+	t        *testing.T
+	requests io.Writer
+	messages chan *dapMessage
+	seq      int
+}
+
+// newDAPTest serves DAP over pipes for a CPU with the test program loaded
+func newDAPTest(t *testing.T) (*dapClient, *CPU) {
+	t.Helper()
+	cpu := newTestCPU(t, NMOS6502, dapProgram)
+	cpu.clockSpeed = 1e9
+	requestReader, requestWriter := io.Pipe()
+	responseReader, responseWriter := io.Pipe()
+	server := newDAPServer(cpu, requestReader, responseWriter)
+	go func() {
+		server.serve()
+		responseWriter.Close()
+	}()
+	t.Cleanup(func() { requestWriter.Close() })
+	client := &dapClient{t: t, requests: requestWriter, messages: make(chan *dapMessage, 100)}
+	// Read the messages as they come, so that the server never waits on us
+	go func() {
+		defer close(client.messages)
+		in := bufio.NewReader(responseReader)
+		for {
+			message, err := readDAPMessage(in)
+			if err != nil {
+				return
+			}
+			client.messages <- message
+		}
+	}()
+	return client, cpu
+}
+
+// readDAPMessage reads a Content-Length framed message
+func readDAPMessage(in *bufio.Reader) (*dapMessage, error) {
+	header, err := in.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, "Content-Length:")))
+	if err != nil || !strings.HasSuffix(header, "\r\n") {
+		return nil, fmt.Errorf("bad header %q", header)
+	}
+	if blank, err := in.ReadString('\n'); err != nil || blank != "\r\n" {
+		return nil, fmt.Errorf("expected a blank line after the header, got %q", blank)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(in, body); err != nil {
+		return nil, err
+	}
+	message := &dapMessage{}
+	return message, json.Unmarshal(body, message)
+}
+
+// request sends a request and returns its response
+func (c *dapClient) request(command string, arguments interface{}) *dapMessage {
+	c.t.Helper()
+	c.seq++
+	body, err := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": arguments})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.write(fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body))
+	response := c.wait("response", command)
+	if response.RequestSeq != c.seq {
+		c.t.Errorf("%s: expected the response to request %d, got %d", command, c.seq, response.RequestSeq)
+	}
+	return response
+}
+
+// write sends raw bytes to the server
+func (c *dapClient) write(s string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.requests, s); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// wait returns the next response to a command or event of a kind, skipping
+// any others
+func (c *dapClient) wait(kind, name string) *dapMessage {
+	c.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("the server closed the connection waiting for %s %s", kind, name)
+			}
+			if message.Type == kind && (message.Command == name || message.Event == name) {
+				return message
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %s %s", kind, name)
+		}
+	}
+}
+
+// decode decodes a message's body
+func (c *dapClient) decode(message *dapMessage, body interface{}) {
+	c.t.Helper()
+	if err := json.Unmarshal(message.Body, body); err != nil {
+		c.t.Fatalf("%s%s: %v", message.Command, message.Event, err)
+	}
+}
+
+func TestDAPFraming(t *testing.T) {
+	client, _ := newDAPTest(t)
+	// Headers other than Content-Length are ignored, and the name is not
+	// case sensitive
+	body := `{"seq":1,"type":"request","command":"threads"}`
+	client.write(fmt.Sprintf("Content-Type: application/json\r\ncontent-length: %d\r\n\r\n%s", len(body), body))
+	response := client.wait("response", "threads")
+	var threads struct {
+		Threads []struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+		} `json:"threads"`
+	}
+	client.decode(response, &threads)
+	if !response.Success || len(threads.Threads) != 1 || threads.Threads[0].ID != dapThreadID {
+		t.Errorf("expected the one thread, got %s", response.Body)
+	}
+	// Sequence numbers go up with each message
+	response = client.request("initialize", nil)
+	if !response.Success || response.Seq != 2 {
+		t.Errorf("expected the second message to succeed, got seq %d: %s", response.Seq, response.Message)
+	}
+	if response = client.request("foo", nil); response.Success || response.Message != "foo is not supported" {
+		t.Errorf("expected foo to fail, got %+v", response)
+	}
+}
+
+func TestDAPBreakpointsAndStack(t *testing.T) {
+	client, cpu := newDAPTest(t)
+	client.request("initialize", nil)
+	if response := client.request("attach", map[string]interface{}{"dbgFile": "testdata/debuginfo/prog.dbg", "stopOnEntry": true}); !response.Success {
+		t.Fatalf("attach failed: %s", response.Message)
+	}
+	client.wait("event", "initialized")
+
+	// Line 7 is blank, so its breakpoint moves down to sub on line 9, and
+	// line 30 is past the end of the program
+	response := client.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": "/src/project/prog.s"},
+		"breakpoints": []map[string]int{{"line": 7}, {"line": 13}, {"line": 30}},
+	})
+	var set struct {
+		Breakpoints []struct {
+			ID                   int    `json:"id"`
+			Verified             bool   `json:"verified"`
+			Line                 int    `json:"line"`
+			InstructionReference string `json:"instructionReference"`
+		} `json:"breakpoints"`
+	}
+	client.decode(response, &set)
+	if len(set.Breakpoints) != 3 {
+		t.Fatalf("expected 3 breakpoints, got %s", response.Body)
+	}
+	for i, want := range []struct {
+		verified bool
+		line     int
+		address  string
+	}{{true, 9, "0x8010"}, {true, 13, "0x8020"}, {false, 30, ""}} {
+		bp := set.Breakpoints[i]
+		if bp.Verified != want.verified || bp.Line != want.line || bp.InstructionReference != want.address {
+			t.Errorf("breakpoint %d: expected line %d at %q (verified %v), got line %d at %q (verified %v)",
+				i, want.line, want.address, want.verified, bp.Line, bp.InstructionReference, bp.Verified)
+		}
+	}
+
+	client.request("configurationDone", nil)
+	var stopped struct {
+		Reason           string `json:"reason"`
+		HitBreakpointIDs []int  `json:"hitBreakpointIds"`
+	}
+	client.decode(client.wait("event", "stopped"), &stopped)
+	if stopped.Reason != "entry" {
+		t.Errorf("expected to stop on entry, got %q", stopped.Reason)
+	}
+	for _, bp := range set.Breakpoints[:2] {
+		client.request("continue", nil)
+		client.decode(client.wait("event", "stopped"), &stopped)
+		if stopped.Reason != "breakpoint" || len(stopped.HitBreakpointIDs) != 1 || stopped.HitBreakpointIDs[0] != bp.ID {
+			t.Errorf("expected to stop at breakpoint %d, got %q %v", bp.ID, stopped.Reason, stopped.HitBreakpointIDs)
+		}
+	}
+	if cpu.PC != 0x8020 {
+		t.Fatalf("expected to be in inner at $8020, at $%04X", cpu.PC)
+	}
+
+	// The stack is rebuilt from the return addresses the JSRs pushed
+	var trace struct {
+		StackFrames []struct {
+			Name   string `json:"name"`
+			Line   int    `json:"line"`
+			Source struct {
+				Name string `json:"name"`
+			} `json:"source"`
+			InstructionPointerReference string `json:"instructionPointerReference"`
+		} `json:"stackFrames"`
+	}
+	client.decode(client.request("stackTrace", map[string]int{"threadId": dapThreadID}), &trace)
+	want := []struct {
+		name    string
+		line    int
+		address string
+	}{{"inner", 13, "0x8020"}, {"sub", 10, "0x8012"}, {"main", 4, "0x8002"}}
+	if len(trace.StackFrames) != len(want) {
+		t.Fatalf("expected %d frames, got %+v", len(want), trace.StackFrames)
+	}
+	for i, frame := range trace.StackFrames {
+		if frame.Name != want[i].name || frame.Line != want[i].line || frame.InstructionPointerReference != want[i].address || frame.Source.Name != "prog.s" {
+			t.Errorf("frame %d: expected %s at prog.s:%d (%s), got %+v", i, want[i].name, want[i].line, want[i].address, frame)
+		}
+	}
+
+	// Setting the breakpoints of a source again replaces them
+	client.decode(client.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": "/src/project/prog.s"},
+		"breakpoints": []map[string]int{},
+	}), &set)
+	if len(set.Breakpoints) != 0 || len(cpu.breakpoints.breakpoints) != 0 {
+		t.Errorf("expected the breakpoints cleared, %d left", len(cpu.breakpoints.breakpoints))
+	}
+	client.request("disconnect", nil)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DebugInfo holds the segment layout, symbols and source line mappings of a
+// program built with the cc65 toolchain
+type DebugInfo struct {
+	segments []debugSegment
+	labels   map[uint16]string     // address -> label defined there
+	equates  map[uint16]string     // address -> equate with that value
+	symbols  map[string]uint16     // symbol name -> value
+	lines    map[uint16]sourceLine // address -> source line that produced it
+	// addresses maps a source line to the first address it produced
+	addresses map[sourceLine]uint16
+}
+
+// debugSegment is a segment placed by the linker
+type debugSegment struct {
+	name  string
+	start uint16
+	size  int
+}
+
+// sourceLine is a line in a source file
+type sourceLine struct {
+	file string
+	line int
+}
+
+func (l sourceLine) String() string {
+	return fmt.Sprintf("%s:%d", l.file, l.line)
+}
+
+func newDebugInfo() *DebugInfo {
+	return &DebugInfo{
+		labels:    map[uint16]string{},
+		equates:   map[uint16]string{},
+		symbols:   map[string]uint16{},
+		lines:     map[uint16]sourceLine{},
+		addresses: map[sourceLine]uint16{},
+	}
+}
+
+// addSymbol records a symbol, keeping the first global name seen for an address
+func (info *DebugInfo) addSymbol(name string, value uint16, label bool) {
+	info.symbols[name] = value
+	names := info.equates
+	if label {
+		names = info.labels
+	}
+	existing, ok := names[value]
+	// Prefer global names over cheap locals such as @loop
+	if !ok || (strings.HasPrefix(existing, "@") && !strings.HasPrefix(name, "@")) {
+		names[value] = name
+	}
+}
+
+// symbolFor returns the name to show for an address, preferring labels to equates
+func (info *DebugInfo) symbolFor(address uint16) (string, bool) {
+	if name, ok := info.labels[address]; ok {
+		return name, true
+	}
+	name, ok := info.equates[address]
+	return name, ok
+}
+
+// labelAt returns the label defined at an address
+func (info *DebugInfo) labelAt(address uint16) (string, bool) {
+	name, ok := info.labels[address]
+	return name, ok
+}
+
+// lineAt returns the source line that produced the byte at an address
+func (info *DebugInfo) lineAt(address uint16) (sourceLine, bool) {
+	line, ok := info.lines[address]
+	return line, ok
+}
+
+// functionAt returns the nearest global label at or before an address, which
+// names the routine the address is in
+func (info *DebugInfo) functionAt(address uint16) (string, bool) {
+	for a := int(address); a >= 0; a-- {
+		if name, ok := info.labels[uint16(a)]; ok && !strings.HasPrefix(name, "@") {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// loadDebugInfo loads a debug file, or else a map file. It returns nil if
+// neither was given.
+func loadDebugInfo(dbgFile, mapFile string) (*DebugInfo, error) {
+	if dbgFile != "" {
+		return loadDbgFile(dbgFile)
+	}
+	if mapFile != "" {
+		return loadMapFile(mapFile)
+	}
+	return nil, nil
+}
+
+// loadDbgFile reads the output of ld65 --dbgfile
+func loadDbgFile(fileName string) (*DebugInfo, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Records refer to each other by id, so collect them all before resolving
+	files := map[int]string{}
+	segments := map[int]debugSegment{}
+	type span struct{ seg, start, size int }
+	spans := map[int]span{}
+	type line struct {
+		file, line, kind int
+		spans            []int
+	}
+	var lines []line
+	type symbol struct {
+		name  string
+		value int
+		label bool
+	}
+	var symbols []symbol
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		text := scanner.Text()
+		kind, rest, ok := strings.Cut(text, "\t")
+		if !ok {
+			continue
+		}
+		fields := parseDbgFields(rest)
+		// Numeric fields are written in decimal or 0x hex
+		number := func(key string) int {
+			n, _ := strconv.ParseInt(fields[key], 0, 64)
+			return int(n)
+		}
+		switch kind {
+		case "version":
+			if major := number("major"); major != 2 {
+				return nil, fmt.Errorf("%s:%d: unsupported debug file version %d", fileName, lineNumber, major)
+			}
+		case "file":
+			files[number("id")] = fields["name"]
+		case "seg":
+			segments[number("id")] = debugSegment{name: fields["name"], start: uint16(number("start")), size: number("size")}
+		case "span":
+			spans[number("id")] = span{seg: number("seg"), start: number("start"), size: number("size")}
+		case "line":
+			if fields["span"] == "" {
+				continue
+			}
+			l := line{file: number("file"), line: number("line"), kind: number("type")}
+			for _, id := range strings.Split(fields["span"], "+") {
+				n, _ := strconv.Atoi(id)
+				l.spans = append(l.spans, n)
+			}
+			lines = append(lines, l)
+		case "sym":
+			// Imports have no value of their own
+			if fields["type"] == "imp" || fields["val"] == "" {
+				continue
+			}
+			symbols = append(symbols, symbol{name: fields["name"], value: number("val"), label: fields["type"] == "lab"})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	info := newDebugInfo()
+	for id := 0; id < len(segments); id++ {
+		if seg, ok := segments[id]; ok {
+			info.segments = append(info.segments, seg)
+		}
+	}
+	for _, sym := range symbols {
+		if sym.value >= 0 && sym.value < RAMSize {
+			info.addSymbol(sym.name, uint16(sym.value), sym.label)
+		}
+	}
+	// C source lines (type 1) beat assembler lines (type 0), which beat macro
+	// expansions (type 2)
+	rank := map[int]int{1: 0, 0: 1, 2: 2}
+	best := map[uint16]int{}
+	for _, l := range lines {
+		source := sourceLine{file: files[l.file], line: l.line}
+		for _, id := range l.spans {
+			s, ok := spans[id]
+			if !ok {
+				continue
+			}
+			start := int(segments[s.seg].start) + s.start
+			for address := start; address < start+s.size && address < RAMSize; address++ {
+				if r, seen := best[uint16(address)]; seen && r <= rank[l.kind] {
+					continue
+				}
+				best[uint16(address)] = rank[l.kind]
+				info.lines[uint16(address)] = source
+			}
+			if first, ok := info.addresses[source]; (!ok || start < int(first)) && start < RAMSize {
+				info.addresses[source] = uint16(start)
+			}
+		}
+	}
+	return info, nil
+}
+
+// parseDbgFields splits the key=value list of a debug file record, allowing
+// for commas inside quoted strings
+func parseDbgFields(s string) map[string]string {
+	fields := map[string]string{}
+	for s != "" {
+		key, rest, _ := strings.Cut(s, "=")
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			// Quoted string, runs to the next unescaped quote
+			end := 1
+			for end < len(rest) && (rest[end] != '"' || rest[end-1] == '\\') {
+				end++
+			}
+			value = rest[1:end]
+			if end < len(rest) {
+				end++
+			}
+			rest = strings.TrimPrefix(rest[end:], ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		fields[key] = value
+		s = rest
+	}
+	return fields
+}
+
+// mapExport matches one entry of the exports list in an ld65 map file: a name,
+// a six digit hex value and flags (R for referenced, L or E for label or
+// equate, then the address size)
+var mapExport = regexp.MustCompile(`(\S+)\s+([0-9A-Fa-f]{6})\s+R?([LE])[ZAF]?`)
+
+// loadMapFile reads an ld65 map file (-m). It has no source line information,
+// only the segment list and exported symbols.
+func loadMapFile(fileName string) (*DebugInfo, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info := newDebugInfo()
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		text := strings.TrimRight(scanner.Text(), " \t")
+		// Section titles end with a colon and are underlined with dashes
+		if strings.HasSuffix(text, ":") && !strings.HasPrefix(text, " ") {
+			section = text
+			continue
+		}
+		if text == "" || strings.HasPrefix(text, "---") {
+			continue
+		}
+		switch section {
+		case "Segment list:":
+			fields := strings.Fields(text)
+			// Skip the column headings
+			if len(fields) < 4 || fields[0] == "Name" {
+				continue
+			}
+			start, err1 := strconv.ParseUint(fields[1], 16, 32)
+			size, err2 := strconv.ParseUint(fields[3], 16, 32)
+			if err1 != nil || err2 != nil || start >= RAMSize {
+				continue
+			}
+			info.segments = append(info.segments, debugSegment{name: fields[0], start: uint16(start), size: int(size)})
+		case "Exports list by name:":
+			for _, m := range mapExport.FindAllStringSubmatch(text, -1) {
+				value, err := strconv.ParseUint(m[2], 16, 32)
+				if err != nil || value >= RAMSize {
+					continue
+				}
+				info.addSymbol(m[1], uint16(value), m[3] == "L")
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkSymbols checks the symbols every fixture defines
+func checkSymbols(t *testing.T, info *DebugInfo) {
+	t.Helper()
+	for name, value := range map[string]uint16{"main": 0x8000, "sub": 0x8010, "inner": 0x8020, "VIA_PORTB": 0x6000} {
+		if got, ok := info.symbols[name]; !ok || got != value {
+			t.Errorf("%s: expected $%04X, got $%04X (%v)", name, value, got, ok)
+		}
+	}
+	if name, ok := info.labelAt(0x8010); !ok || name != "sub" {
+		t.Errorf("expected the label sub at $8010, got %q", name)
+	}
+	// Equates name addresses, but are not labels
+	if name, ok := info.symbolFor(0x6000); !ok || name != "VIA_PORTB" {
+		t.Errorf("expected VIA_PORTB for $6000, got %q", name)
+	}
+	if name, ok := info.labelAt(0x6000); ok {
+		t.Errorf("expected no label at $6000, got %q", name)
+	}
+	if name, ok := info.functionAt(0x8015); !ok || name != "sub" {
+		t.Errorf("expected $8015 to be in sub, got %q", name)
+	}
+	if want := []debugSegment{{name: "CODE", start: 0x8000, size: 0x22}}; !reflect.DeepEqual(info.segments, want) {
+		t.Errorf("expected the segments %+v, got %+v", want, info.segments)
+	}
+}
+
+func TestLoadDbgFile(t *testing.T) {
+	info, err := loadDbgFile("testdata/debuginfo/prog.dbg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSymbols(t, info)
+	// Every byte of an instruction belongs to its line
+	for address, line := range map[uint16]int{0x8000: 3, 0x8001: 3, 0x8002: 4, 0x8004: 4, 0x8005: 5, 0x8012: 10, 0x8021: 14} {
+		if got, ok := info.lineAt(address); !ok || got != (sourceLine{file: "prog.s", line: line}) {
+			t.Errorf("$%04X: expected prog.s:%d, got %v (%v)", address, line, got, ok)
+		}
+	}
+	// The padding produced no lines
+	if line, ok := info.lineAt(0x8008); ok {
+		t.Errorf("expected no line at $8008, got %v", line)
+	}
+	for line, address := range map[int]uint16{3: 0x8000, 10: 0x8012, 13: 0x8020} {
+		if got, ok := info.addresses[sourceLine{file: "prog.s", line: line}]; !ok || got != address {
+			t.Errorf("prog.s:%d: expected $%04X, got $%04X (%v)", line, address, got, ok)
+		}
+	}
+	if _, ok := info.addresses[sourceLine{file: "prog.s", line: 15}]; ok {
+		t.Error("expected the equate's line to have no address")
+	}
+}
+
+func TestLoadMapFile(t *testing.T) {
+	info, err := loadMapFile("testdata/debuginfo/prog.map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSymbols(t, info)
+	if info.symbols["maponly"] != 0x9000 {
+		t.Errorf("expected maponly at $9000, got $%04X", info.symbols["maponly"])
+	}
+	// Map files have no line information
+	if len(info.lines) != 0 || len(info.addresses) != 0 {
+		t.Errorf("expected no lines, got %d", len(info.lines))
+	}
+}
+
+func TestLoadDebugInfo(t *testing.T) {
+	// The debug file is preferred to the map file
+	info, err := loadDebugInfo("testdata/debuginfo/prog.dbg", "testdata/debuginfo/prog.map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := info.symbols["maponly"]; ok || len(info.lines) == 0 {
+		t.Error("expected the debug file to be read rather than the map file")
+	}
+	if info, err = loadDebugInfo("", "testdata/debuginfo/prog.map"); err != nil || info.symbols["maponly"] != 0x9000 {
+		t.Errorf("expected the map file to be read without a debug file, got %v", err)
+	}
+	if info, err = loadDebugInfo("", ""); info != nil || err != nil {
+		t.Errorf("expected no debug info, got %v", err)
+	}
+
+	// Later versions of the debug file format are refused
+	path := filepath.Join(t.TempDir(), "new.dbg")
+	if err := os.WriteFile(path, []byte("version\tmajor=3,minor=0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDbgFile(path); err == nil || !strings.HasSuffix(err.Error(), ":1: unsupported debug file version 3") {
+		t.Errorf("expected the version to be refused, got %v", err)
+	}
+}
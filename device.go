@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Device is a peripheral on the bus. It answers reads and writes to a range
+// of addresses in place of memory, with its registers mirrored through the
+// range, and is clocked along with the CPU.
+type Device interface {
+	// name identifies the device in messages, save states and input sources
+	name() string
+	// size is the number of registers
+	size() int
+	read(register uint16) uint8
+	write(register uint16, value uint8)
+	// peek reads a register for the debugger, without side effects such as
+	// clearing interrupt flags
+	peek(register uint16) uint8
+	// tick advances the device's clock by a number of CPU cycles
+	tick(cycles int)
+}
+
+// stateful is anything whose state goes in save states, under its name. It
+// decodes what it can of older states, as missing fields read as zero.
+type stateful interface {
+	name() string
+	saveState(e *stateEncoder)
+	loadState(d *stateDecoder)
+}
+
+// statefulDevice is a device on the bus whose state goes in save states
+type statefulDevice interface {
+	Device
+	stateful
+}
+
+// statefulDevices returns everything whose state goes in save states: the
+// devices on the bus that have state, and the peripherals off it
+func (mmu *MMU) statefulDevices() []stateful {
+	var devices []stateful
+	for _, b := range mmu.devices {
+		if device, ok := b.device.(statefulDevice); ok {
+			devices = append(devices, device)
+		}
+	}
+	return append(devices, mmu.peripherals...)
+}
+
+// inputDevice is a device that takes input from the host, which has to come
+// through the input log so that it can be recorded and replayed
+type inputDevice interface {
+	Device
+	connectInput(l *InputLog)
+}
+
+// busDevice is a device mapped at a range of addresses
+type busDevice struct {
+	start, end uint16 // inclusive
+	device     Device
+}
+
+// register returns the register an address in the device's range selects
+func (b *busDevice) register(address uint16) uint16 {
+	return (address - b.start) % uint16(b.device.size())
+}
+
+// attach maps a device at the addresses from start to end, which must not
+// overlap another device's
+func (mmu *MMU) attach(device Device, start, end uint16) error {
+	if end < start {
+		return fmt.Errorf("%s: the range $%04X-$%04X is empty", device.name(), start, end)
+	}
+	for _, other := range mmu.devices {
+		if start <= other.end && other.start <= end {
+			return fmt.Errorf("%s at $%04X-$%04X overlaps %s at $%04X-$%04X",
+				device.name(), start, end, other.device.name(), other.start, other.end)
+		}
+	}
+	b := &busDevice{start: start, end: end, device: device}
+	mmu.devices = append(mmu.devices, b)
+	for page := int(start >> 8); page <= int(end>>8); page++ {
+		mmu.pages[page] = append(mmu.pages[page], b)
+	}
+	return nil
+}
+
+// deviceAt returns the device mapped at an address, if there is one
+func (mmu *MMU) deviceAt(address uint16) *busDevice {
+	for _, b := range mmu.pages[address>>8] {
+		if address >= b.start && address <= b.end {
+			return b
+		}
+	}
+	return nil
+}
+
+// tick advances the devices' clocks
+func (mmu *MMU) tick(cycles int) {
+	for _, b := range mmu.devices {
+		b.device.tick(cycles)
+	}
+}
+
+// device returns the attached device with a name
+func (mmu *MMU) device(name string) Device {
+	for _, b := range mmu.devices {
+		if b.device.name() == name {
+			return b.device
+		}
+	}
+	return nil
+}
+
+// attach maps a device on the bus and connects it to the host's input
+func (cpu *CPU) attach(device Device, start, end uint16) error {
+	if err := cpu.MMU.attach(device, start, end); err != nil {
+		return err
+	}
+	if d, ok := device.(inputDevice); ok && cpu.input != nil {
+		d.connectInput(cpu.input)
+	}
+	return nil
+}
+
+// newIRQLine returns a function that holds the IRQ line low for a device,
+// giving each device its own IRQ source
+func (cpu *CPU) newIRQLine() func(active bool) {
+	source := cpu.irqSources
+	cpu.irqSources++
+	return func(active bool) {
+		cpu.setIRQ(source, active)
+	}
+}
+
+// parseDeviceRange parses where to map a device: an address, for just its
+// registers, or a start-end range for them to be mirrored through
+func parseDeviceRange(spec string, size int) (uint16, uint16, error) {
+	startText, endText, isRange := strings.Cut(spec, "-")
+	start, err := parseAddress(startText)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid address %q", startText)
+	}
+	if !isRange {
+		if int(start)+size > RAMSize {
+			return 0, 0, fmt.Errorf("%d registers do not fit at $%04X", size, start)
+		}
+		return start, start + uint16(size-1), nil
+	}
+	end, err := parseAddress(endText)
+	if err != nil || end < start {
+		return 0, 0, fmt.Errorf("invalid range %q", spec)
+	}
+	return start, end, nil
+}
+
+// deviceFlag is a device asked for on the command line, where to map it and,
+// after a comma, how to connect it to the host
+type deviceFlag struct {
+	kind, spec string
+}
+
+// deviceKinds are the devices that can be asked for, with the number of
+// registers each has
+var deviceKinds = map[string]int{
+	"via":     16,
+	"acia":    4,
+	"riot":    256,
+	"pia":     4,
+	"console": 2,
+}
+
+// attachDevices creates the devices asked for and maps them on the bus,
+// returning what they connect to on the host. Devices of the same kind after
+// the first are numbered, as via2 and so on. With showPorts, the pins of
+// devices that have them are printed as they change.
+func (cpu *CPU) attachDevices(flags []deviceFlag, showPorts bool) (*hostIO, error) {
+	host := &hostIO{}
+	count := map[string]int{}
+	for _, flag := range flags {
+		spec, option, _ := strings.Cut(flag.spec, ",")
+		start, end, err := parseDeviceRange(spec, deviceKinds[flag.kind])
+		if err != nil {
+			host.close()
+			return nil, fmt.Errorf("--%s %s: %v", flag.kind, flag.spec, err)
+		}
+		count[flag.kind]++
+		name := flag.kind
+		if count[flag.kind] > 1 {
+			name = fmt.Sprintf("%s%d", flag.kind, count[flag.kind])
+		}
+		// Only the ACIA and the console have ways of connecting to the host
+		// to ask for
+		if option != "" && flag.kind != "acia" && flag.kind != "console" {
+			host.close()
+			return nil, fmt.Errorf("--%s %s: unknown option %q", flag.kind, flag.spec, option)
+		}
+		var device Device
+		switch flag.kind {
+		case "via":
+			via := newVIA(name, cpu.newIRQLine())
+			if showPorts {
+				via.watch(func() { fmt.Printf("%s: %s\n", via.name(), via) })
+			}
+			device = via
+		case "riot":
+			riot := newRIOT(name, cpu.newIRQLine())
+			if showPorts {
+				riot.watch(func() { fmt.Printf("%s: %s\n", riot.name(), riot) })
+			}
+			device = riot
+		case "pia":
+			pia := newPIA(name, cpu.newIRQLine())
+			if showPorts {
+				pia.watch(func() { fmt.Printf("%s: %s\n", pia.name(), pia) })
+			}
+			device = pia
+		case "acia":
+			input := cpu.input
+			send, err := host.openSerial(name, option, false, func(b uint8) { input.send(name, int(b)) })
+			if err != nil {
+				host.close()
+				return nil, fmt.Errorf("--%s %s: %v", flag.kind, flag.spec, err)
+			}
+			device = newACIA(name, cpu.clockSpeed, cpu.newIRQLine(), send)
+		case "console":
+			input := cpu.input
+			// On the terminal, the newlines test programs print go out as carriage
+			// returns and newlines, while the ACIA leaves what it sends as it is
+			send, err := host.openSerial(name, option, true, func(b uint8) { input.send(name, int(b)) })
+			if err != nil {
+				host.close()
+				return nil, fmt.Errorf("--%s %s: %v", flag.kind, flag.spec, err)
+			}
+			device = newConsole(name, send, func(status uint8) {
+				host.exitStatus, host.exitRequested = int(status), true
+				cpu.running = false
+			})
+		}
+		if err := cpu.attach(device, start, end); err != nil {
+			host.close()
+			return nil, err
+		}
+	}
+	return host, nil
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// decodedInstruction is an instruction decoded from memory
+type decodedInstruction struct {
+	address uint16
+	opcode  uint8
+	inst    Instruction
+	known   bool    // whether the opcode is in the instruction table
+	bytes   []uint8 // the opcode and operand bytes
+	value   uint16  // the operand: an immediate value, an address or a branch target
+}
+
+// decodeInstruction decodes the 6502 instruction at an address
+func decodeInstruction(read func(uint16) uint8, address uint16) decodedInstruction {
+	return decodeInstructionFrom(instructions, read, address)
+}
+
+// decodeInstructionFrom decodes the instruction at an address using an
+// instruction table
+func decodeInstructionFrom(set map[uint8]Instruction, read func(uint16) uint8, address uint16) decodedInstruction {
+	d := decodedInstruction{address: address, opcode: read(address)}
+	d.inst, d.known = set[d.opcode]
+	if !d.known {
+		d.bytes = []uint8{d.opcode}
+		return d
+	}
+	for i := 0; i < d.inst.length; i++ {
+		d.bytes = append(d.bytes, read(address+uint16(i)))
+	}
+	switch d.inst.length {
+	case 2:
+		d.value = uint16(d.bytes[1])
+		if d.inst.addressingMode == modeRelative {
+			// Branches are relative to the next instruction
+			d.value = address + 2 + uint16(int8(d.bytes[1]))
+		}
+	case 3:
+		d.value = uint16(d.bytes[1]) | uint16(d.bytes[2])<<8
+		if d.inst.addressingMode == modeZeroPageRelative {
+			// The branch target, with the zero page address in the first byte
+			d.value = address + 3 + uint16(int8(d.bytes[2]))
+		}
+	}
+	return d
+}
+
+// isJump reports whether the instruction transfers control to its operand
+func (d decodedInstruction) isJump() bool {
+	switch d.inst.addressingMode {
+	case modeRelative, modeZeroPageRelative:
+		return true
+	case modeAbsolute:
+		return d.inst.mnemonic == "JMP" || d.inst.mnemonic == "JSR"
+	}
+	return false
+}
+
+// operandString formats the operand, using name to format addresses
+func (d decodedInstruction) operandString(name func(address uint16, digits int) string) string {
+	switch d.inst.addressingMode {
+	case modeAccumulator:
+		return "A"
+	case modeImmediate:
+		return fmt.Sprintf("#$%02X", d.value)
+	case modeZeroPage:
+		return name(d.value, 2)
+	case modeZeroPageX:
+		return name(d.value, 2) + ",X"
+	case modeZeroPageY:
+		return name(d.value, 2) + ",Y"
+	case modeRelative:
+		return name(d.value, 4)
+	case modeAbsolute, modeAbsoluteX, modeAbsoluteY:
+		operand := name(d.value, 4)
+		// Mark absolute addressing of the zero page so that it assembles back
+		// to the same instruction. The 65C02 has every zero page form the
+		// 6502 has.
+		if _, zeroPage := opcodeTables[CMOS65C02][d.inst.mnemonic][d.inst.addressingMode-modeAbsolute+modeZeroPage]; zeroPage && d.value < 0x100 {
+			operand = "a:" + operand
+		}
+		switch d.inst.addressingMode {
+		case modeAbsoluteX:
+			operand += ",X"
+		case modeAbsoluteY:
+			operand += ",Y"
+		}
+		return operand
+	case modeIndirect:
+		return "(" + name(d.value, 4) + ")"
+	case modeIndirectX:
+		return "(" + name(d.value, 2) + ",X)"
+	case modeIndirectY:
+		return "(" + name(d.value, 2) + "),Y"
+	case modeZeroPageIndirect:
+		return "(" + name(d.value, 2) + ")"
+	case modeAbsoluteIndexedIndirect:
+		return "(" + name(d.value, 4) + ",X)"
+	case modeZeroPageRelative:
+		return name(uint16(d.bytes[1]), 2) + "," + name(d.value, 4)
+	}
+	return ""
+}
+
+// text formats the instruction, using name to format addresses
+func (d decodedInstruction) text(name func(address uint16, digits int) string) string {
+	if !d.known {
+		return fmt.Sprintf(".byte $%02X", d.opcode)
+	}
+	if operand := d.operandString(name); operand != "" {
+		return d.inst.mnemonic + " " + operand
+	}
+	return d.inst.mnemonic
+}
+
+// hexAddress formats an address as hex with the given number of digits
+func hexAddress(address uint16, digits int) string {
+	return fmt.Sprintf("$%0*X", digits, address)
+}
+
+// hexBytes formats bytes as space separated hex
+func hexBytes(data []uint8) string {
+	parts := make([]string, len(data))
+	for i, b := range data {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, " ")
+}
+
+// listingLine is one line of a disassembly listing: an instruction, or data
+// bytes that are not code
+type listingLine struct {
+	decodedInstruction
+	data bool // whether the bytes are data rather than an instruction
+	word bool // whether the data is an address, listed as a .word
+	rts  bool // whether the address is an RTS target (the code address minus one)
+}
+
+// Listing is the disassembly of a range of memory
+type Listing struct {
+	start, end uint16
+	lines      []listingLine
+	labels     map[uint16]string
+}
+
+// disassembleRange decodes the instructions from start to end inclusive with
+// a linear sweep, and labels the targets of jumps and branches that land on
+// an instruction in the range. Labels from the debug info are used when there
+// is some.
+func disassembleRange(read func(uint16) uint8, start, end uint16, info *DebugInfo) *Listing {
+	listing := &Listing{start: start, end: end, labels: map[uint16]string{}}
+	for address := int(start); address <= int(end); {
+		d := decodeInstruction(read, uint16(address))
+		line := listingLine{decodedInstruction: d}
+		// Anything that is not a known opcode, or runs past the end, is data
+		if !d.known || address+len(d.bytes)-1 > int(end) {
+			line = listingLine{decodedInstruction: decodedInstruction{address: uint16(address), bytes: []uint8{d.opcode}}, data: true}
+		}
+		listing.lines = append(listing.lines, line)
+		address += len(line.bytes)
+	}
+	listing.addLabels(info)
+	return listing
+}
+
+// addLabels labels the jump targets that land on instructions
+func (listing *Listing) addLabels(info *DebugInfo) {
+	boundaries := map[uint16]bool{}
+	for _, line := range listing.lines {
+		boundaries[line.address] = true
+	}
+	for _, line := range listing.lines {
+		if line.data || !line.isJump() || !boundaries[line.value] {
+			continue
+		}
+		listing.labels[line.value] = fmt.Sprintf("L%04X", line.value)
+	}
+	if info == nil {
+		return
+	}
+	// Prefer the real names, wherever they are
+	for _, line := range listing.lines {
+		if name, ok := info.labelAt(line.address); ok {
+			listing.labels[line.address] = name
+		}
+	}
+}
+
+// name formats an operand address, using a label if there is one
+func (listing *Listing) name(address uint16, digits int) string {
+	if label, ok := listing.labels[address]; ok {
+		return label
+	}
+	return hexAddress(address, digits)
+}
+
+// String formats the listing as source that the assembler can read back. The
+// address and bytes of each line are given in a comment.
+func (listing *Listing) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "        .org $%04X\n", listing.start)
+	for i := 0; i < len(listing.lines); i++ {
+		line := listing.lines[i]
+		if label, ok := listing.labels[line.address]; ok {
+			fmt.Fprintf(&b, "%s:\n", label)
+		}
+		text := line.text(listing.name)
+		bytes := line.bytes
+		if line.word {
+			text = ".word " + listing.name(line.value, 4)
+			if line.rts {
+				text = ".word " + listing.name(line.value+1, 4) + "-1"
+			}
+		} else if line.data {
+			// Gather data bytes up to the next label, eight to a line
+			for i+1 < len(listing.lines) && len(bytes) < 8 {
+				next := listing.lines[i+1]
+				if _, labelled := listing.labels[next.address]; !next.data || next.word || labelled {
+					break
+				}
+				bytes = append(bytes, next.bytes...)
+				i++
+			}
+			values := make([]string, len(bytes))
+			for j, value := range bytes {
+				values[j] = fmt.Sprintf("$%02X", value)
+			}
+			text = ".byte " + strings.Join(values, ",")
+		}
+		fmt.Fprintf(&b, "        %-40s; %04X  %s\n", text, line.address, hexBytes(bytes))
+	}
+	return b.String()
+}
+
+// imageRange returns the lowest and highest addresses covered by some images
+func imageRange(images []*programImage) (uint16, uint16, bool) {
+	var starts []int
+	var ends []int
+	for _, img := range images {
+		for _, seg := range img.segments {
+			if len(seg.data) == 0 {
+				continue
+			}
+			starts = append(starts, int(seg.address))
+			ends = append(ends, int(seg.address)+len(seg.data)-1)
+		}
+	}
+	if len(starts) == 0 {
+		return 0, 0, false
+	}
+	sort.Ints(starts)
+	sort.Ints(ends)
+	return uint16(starts[0]), uint16(ends[len(ends)-1]), true
+}
+
+func printDisassemblerUsage() {
+	fmt.Println("Usage: go6502 disasm [options] file[@address] ...")
+	fmt.Println("Options:")
+	fmt.Println("  -s, --start\t\tFirst address to disassemble (default: start of the loaded image)")
+	fmt.Println("  -e, --end\t\tLast address to disassemble (default: end of the loaded image)")
+	fmt.Println("  -o, --output\t\tWrite the listing to this file instead of stdout")
+	fmt.Println("  --dbgfile\t\tUse labels from an ld65 debug file")
+	fmt.Println("  --mapfile\t\tUse labels from an ld65 map file")
+	fmt.Println("  --flow\t\tFollow the flow of control from the vectors instead of a linear sweep,")
+	fmt.Println("\t\t\tlisting everything unreachable as data")
+	fmt.Println("  --entry\t\tAn extra entry point to follow (implies --flow, may be repeated)")
+	fmt.Println("  --jump-table\t\tA table of code addresses, as address:count (implies --flow, may be repeated)")
+	fmt.Println("  --rts-table\t\tA table of code addresses minus one, as address:count (implies --flow)")
+	fmt.Println("  --exec-log\t\tTreat the addresses in an execution log as code (implies --flow)")
+	fmt.Println("Files are loaded as with go6502 --file; raw binaries default to $8000")
+	fmt.Println("Example: go6502 disasm -s 0x8000 -e 0x8012 test.bin")
+	fmt.Println("Example: go6502 disasm --flow --jump-table 0x8100:4 rom.bin@0xC000")
+}
+
+// disassemblerCommand implements the disasm subcommand
+func disassemblerCommand(args []string) int {
+	var files []programFile
+	var start, end uint16
+	hasStart, hasEnd := false, false
+	output, dbgFile, mapFile := "", "", ""
+	flow := false
+	var entries []uint16
+	var tables []jumpTable
+	var executed []uint16
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--flow":
+			flow = true
+		case "--entry", "--jump-table", "--rts-table", "--exec-log":
+			if i+1 >= len(args) {
+				fmt.Println("Missing value for", args[i])
+				return 1
+			}
+			flow = true
+			i++
+			switch args[i-1] {
+			case "--entry":
+				address, err := parseAddress(args[i])
+				if err != nil {
+					fmt.Println("Invalid entry point:", args[i])
+					return 1
+				}
+				entries = append(entries, address)
+			case "--exec-log":
+				addresses, err := readExecutionLog(args[i])
+				if err != nil {
+					fmt.Println("Error reading execution log:", err)
+					return 1
+				}
+				executed = append(executed, addresses...)
+			default:
+				table, err := parseJumpTable(args[i], args[i-1] == "--rts-table")
+				if err != nil {
+					fmt.Println(err)
+					return 1
+				}
+				tables = append(tables, table)
+			}
+		case "-h", "--help":
+			printDisassemblerUsage()
+			return 0
+		case "-s", "--start", "-e", "--end":
+			if i+1 >= len(args) {
+				fmt.Println("Missing address for", args[i])
+				return 1
+			}
+			address, err := parseAddress(args[i+1])
+			if err != nil {
+				fmt.Println("Invalid address:", args[i+1])
+				return 1
+			}
+			if args[i] == "-s" || args[i] == "--start" {
+				start, hasStart = address, true
+			} else {
+				end, hasEnd = address, true
+			}
+			i++
+		case "-o", "--output", "--dbgfile", "--mapfile":
+			if i+1 >= len(args) {
+				fmt.Println("Missing file name for", args[i])
+				return 1
+			}
+			switch args[i] {
+			case "--dbgfile":
+				dbgFile = args[i+1]
+			case "--mapfile":
+				mapFile = args[i+1]
+			default:
+				output = args[i+1]
+			}
+			i++
+		default:
+			if strings.HasPrefix(args[i], "-") {
+				fmt.Println("Invalid option:", args[i])
+				return 1
+			}
+			file, err := parseFileSpec(args[i])
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		printDisassemblerUsage()
+		return 1
+	}
+
+	// Load the files into memory
+	mmu := &MMU{}
+	var images []*programImage
+	for _, file := range files {
+		img, err := loadProgramFromFile(file)
+		if err != nil {
+			fmt.Println("Error loading file:", err)
+			return 1
+		}
+		if err := mmu.loadImage(img); err != nil {
+			fmt.Printf("Error loading %s: %v\n", file.fileName, err)
+			return 1
+		}
+		images = append(images, img)
+	}
+	info, err := loadDebugInfo(dbgFile, mapFile)
+	if err != nil {
+		fmt.Println("Error loading debug info:", err)
+		return 1
+	}
+
+	// Default to the whole of the loaded image
+	low, high, ok := imageRange(images)
+	if !ok && (!hasStart || !hasEnd) {
+		fmt.Println("Nothing was loaded to disassemble")
+		return 1
+	}
+	if !hasStart {
+		start = low
+	}
+	if !hasEnd {
+		end = high
+	}
+	if end < start {
+		fmt.Printf("End address $%04X is before start address $%04X\n", end, start)
+		return 1
+	}
+
+	var listing string
+	if flow {
+		listing = traceCodeFlow(mmu.readByte, start, end, entries, tables, executed, info).String()
+	} else {
+		listing = disassembleRange(mmu.readByte, start, end, info).String()
+	}
+	if output == "" {
+		fmt.Print(listing)
+		return 0
+	}
+	if err := os.WriteFile(output, []byte(listing), 0644); err != nil {
+		fmt.Println("Error writing listing:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readFrom returns a read function for a program loaded at an address
+func readFrom(program []uint8, address uint16) func(uint16) uint8 {
+	return func(a uint16) uint8 {
+		if a < address || int(a-address) >= len(program) {
+			return 0
+		}
+		return program[a-address]
+	}
+}
+
+// assembleListing assembles a listing back, returning the bytes and the
+// address they start at
+func assembleListing(t *testing.T, listing *Listing) ([]uint8, uint16) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "listing.asm")
+	if err := os.WriteFile(path, []byte(listing.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	asm := NewAssembler(NMOS6502)
+	if err := asm.assembleFile(path); err != nil {
+		t.Fatalf("the listing does not assemble: %v\n%s", err, listing)
+	}
+	return asm.image()
+}
+
+func TestDisassembleRange(t *testing.T) {
+	program := []uint8{
+		0xA2, 0x00, // LDX #$00
+		0xBD, 0x10, 0x00, // LDA a:$0010,X
+		0xD0, 0xF9, // BNE $0600
+		0x02,             // not an opcode
+		0x4C, 0x08, 0x06, // JMP $0608
+		0x20, // JSR cut off by the end of the range
+	}
+	listing := disassembleRange(readFrom(program, 0x0600), 0x0600, 0x060B, nil)
+	want := `        .org $0600
+L0600:
+        LDX #$00                                ; 0600  A2 00
+        LDA a:$0010,X                           ; 0602  BD 10 00
+        BNE L0600                               ; 0605  D0 F9
+        .byte $02                               ; 0607  02
+L0608:
+        JMP L0608                               ; 0608  4C 08 06
+        .byte $20                               ; 060B  20
+`
+	if got := listing.String(); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+	code, start := assembleListing(t, listing)
+	if start != 0x0600 || !bytes.Equal(code, program) {
+		t.Errorf("expected the listing to assemble to\n% X\ngot at $%04X\n% X", program, start, code)
+	}
+
+	// Labels from the debug info are used wherever they are
+	info := newDebugInfo()
+	info.addSymbol("loop", 0x0602, true)
+	listing = disassembleRange(readFrom(program, 0x0600), 0x0600, 0x0607, info)
+	if listing.labels[0x0602] != "loop" || listing.labels[0x0600] != "L0600" {
+		t.Errorf("expected the labels loop and L0600, got %v", listing.labels)
+	}
+}
+
+func TestDisassembleTestProgram(t *testing.T) {
+	// test.bin goes through a linear sweep and back again unchanged
+	program, err := os.ReadFile("test.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing := disassembleRange(readFrom(program, 0x8000), 0x8000, 0xFFFF, nil)
+	code, start := assembleListing(t, listing)
+	if start != 0x8000 || !bytes.Equal(code, program) {
+		t.Errorf("expected test.bin back, got %d bytes at $%04X", len(code), start)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// exprContext supplies the values an expression can refer to
+type exprContext struct {
+	symbol func(name string) (int, bool) // looks up a symbol
+	pc     int                           // value of *
+	memory func(address uint16) uint8    // reads memory for [address], if allowed
+}
+
+// expr is a parsed expression
+type expr interface {
+	eval(ctx *exprContext) (int, error)
+}
+
+// undefinedSymbolError is returned when an expression uses a symbol that has
+// not been defined (yet)
+type undefinedSymbolError struct {
+	name string
+}
+
+func (e *undefinedSymbolError) Error() string {
+	return fmt.Sprintf("undefined symbol %q", e.name)
+}
+
+// numberExpr is a constant
+type numberExpr int
+
+func (n numberExpr) eval(ctx *exprContext) (int, error) {
+	return int(n), nil
+}
+
+// symbolExpr is a reference to a symbol
+type symbolExpr string
+
+func (s symbolExpr) eval(ctx *exprContext) (int, error) {
+	if ctx.symbol != nil {
+		if value, ok := ctx.symbol(string(s)); ok {
+			return value, nil
+		}
+	}
+	return 0, &undefinedSymbolError{name: string(s)}
+}
+
+// pcExpr is the current program counter, written *
+type pcExpr struct{}
+
+func (pcExpr) eval(ctx *exprContext) (int, error) {
+	return ctx.pc, nil
+}
+
+// unaryExpr applies an operator to a single operand
+type unaryExpr struct {
+	op      string
+	operand expr
+}
+
+func (u *unaryExpr) eval(ctx *exprContext) (int, error) {
+	value, err := u.operand.eval(ctx)
+	if err != nil {
+		return 0, err
+	}
+	switch u.op {
+	case "-":
+		return -value, nil
+	case "~":
+		return ^value, nil
+	case "<":
+		// Low byte
+		return value & 0xFF, nil
+	case ">":
+		// High byte
+		return (value >> 8) & 0xFF, nil
+	case "!":
+		return boolValue(value == 0), nil
+	}
+	return 0, fmt.Errorf("unknown operator %q", u.op)
+}
+
+// binaryExpr applies an operator to two operands
+type binaryExpr struct {
+	op          string
+	left, right expr
+}
+
+func (b *binaryExpr) eval(ctx *exprContext) (int, error) {
+	left, err := b.left.eval(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// The logical operators only evaluate the right side if they need to
+	switch {
+	case b.op == "&&" && left == 0:
+		return 0, nil
+	case b.op == "||" && left != 0:
+		return 1, nil
+	}
+	right, err := b.right.eval(ctx)
+	if err != nil {
+		return 0, err
+	}
+	switch b.op {
+	case "+":
+		return left + right, nil
+	case "-":
+		return left - right, nil
+	case "*":
+		return left * right, nil
+	case "/", "%":
+		if right == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		if b.op == "/" {
+			return left / right, nil
+		}
+		return left % right, nil
+	case "&":
+		return left & right, nil
+	case "|":
+		return left | right, nil
+	case "^":
+		return left ^ right, nil
+	case "<<":
+		return left << uint(right), nil
+	case ">>":
+		return left >> uint(right), nil
+	case "==":
+		return boolValue(left == right), nil
+	case "!=":
+		return boolValue(left != right), nil
+	case "<":
+		return boolValue(left < right), nil
+	case "<=":
+		return boolValue(left <= right), nil
+	case ">":
+		return boolValue(left > right), nil
+	case ">=":
+		return boolValue(left >= right), nil
+	case "&&", "||":
+		return boolValue(right != 0), nil
+	}
+	return 0, fmt.Errorf("unknown operator %q", b.op)
+}
+
+// memoryExpr reads a byte of memory, written [address]
+type memoryExpr struct {
+	address expr
+}
+
+func (m *memoryExpr) eval(ctx *exprContext) (int, error) {
+	if ctx.memory == nil {
+		return 0, fmt.Errorf("memory cannot be read here")
+	}
+	address, err := m.address.eval(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return int(ctx.memory(uint16(address))), nil
+}
+
+// boolValue converts the result of a comparison to 1 or 0
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// binaryPrecedence lists the binary operators from lowest to highest precedence
+var binaryPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// exprParser is a recursive descent parser for expressions
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseExpr parses an expression
+func parseExpr(s string) (expr, error) {
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("missing expression")
+	}
+	p := &exprParser{tokens: tokens}
+	e, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in expression", p.tokens[p.pos])
+	}
+	return e, nil
+}
+
+// evalExpr parses and evaluates an expression in one go
+func evalExpr(s string, ctx *exprContext) (int, error) {
+	e, err := parseExpr(s)
+	if err != nil {
+		return 0, err
+	}
+	return e.eval(ctx)
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+// parseBinary parses operators at the given precedence level and above
+func (p *exprParser) parseBinary(level int) (expr, error) {
+	if level == len(binaryPrecedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if !containsString(binaryPrecedence[level], op) {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+}
+
+// parseUnary parses prefix operators and primary expressions
+func (p *exprParser) parseUnary() (expr, error) {
+	token := p.next()
+	switch token {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "-", "~", "<", ">", "!":
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: token, operand: operand}, nil
+	case "+":
+		return p.parseUnary()
+	case "*":
+		return pcExpr{}, nil
+	case "(":
+		e, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return e, nil
+	case "[":
+		address, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != "]" {
+			return nil, fmt.Errorf("missing ]")
+		}
+		return &memoryExpr{address: address}, nil
+	}
+	// Character constant
+	if len(token) >= 3 && token[0] == '\'' {
+		return numberExpr(token[1]), nil
+	}
+	// Number
+	if value, ok := parseNumber(token); ok {
+		return numberExpr(value), nil
+	}
+	if isSymbolStart(rune(token[0])) {
+		return symbolExpr(token), nil
+	}
+	return nil, fmt.Errorf("unexpected %q in expression", token)
+}
+
+// parseNumber parses $hex, %binary, 0xhex or decimal numbers
+func parseNumber(token string) (int, bool) {
+	var value uint64
+	var err error
+	switch {
+	case strings.HasPrefix(token, "$"):
+		value, err = strconv.ParseUint(token[1:], 16, 32)
+	case strings.HasPrefix(token, "%"):
+		value, err = strconv.ParseUint(token[1:], 2, 32)
+	case token[0] >= '0' && token[0] <= '9':
+		value, err = strconv.ParseUint(token, 0, 32)
+	default:
+		return 0, false
+	}
+	if err != nil {
+		return 0, false
+	}
+	return int(value), true
+}
+
+func isSymbolStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_' || r == '.' || r == '@'
+}
+
+func isSymbolChar(r rune) bool {
+	return isSymbolStart(r) || unicode.IsDigit(r)
+}
+
+// tokenizeExpr splits an expression into numbers, symbols and operators
+func tokenizeExpr(s string) ([]string, error) {
+	var tokens []string
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'':
+			// Character constant, 'c' (the closing quote is optional)
+			if i+1 >= len(runes) {
+				return nil, fmt.Errorf("unterminated character constant")
+			}
+			tokens = append(tokens, "'"+string(runes[i+1])+"'")
+			i += 2
+			if i < len(runes) && runes[i] == '\'' {
+				i++
+			}
+		case r == '$' || r == '%' && i+1 < len(runes) && (runes[i+1] == '0' || runes[i+1] == '1') && expectsOperand(tokens):
+			// Hex or binary number
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || unicode.IsLetter(runes[j])) {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || unicode.IsLetter(runes[j])) {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		case isSymbolStart(r):
+			j := i
+			for j < len(runes) && isSymbolChar(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		default:
+			// Operators, longest first
+			op := ""
+			for _, candidate := range exprOperators {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q in expression", r)
+			}
+			tokens = append(tokens, op)
+			i += len([]rune(op))
+		}
+	}
+	return tokens, nil
+}
+
+// exprOperators lists the operator tokens, longest first
+var exprOperators = []string{
+	"<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"+", "-", "*", "/", "%", "&", "|", "^", "~", "!", "<", ">", "(", ")", "[", "]",
+}
+
+// expectsOperand reports whether the next token should be an operand rather
+// than an operator, which tells a %binary number from the % operator
+func expectsOperand(tokens []string) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	last := tokens[len(tokens)-1]
+	return last != ")" && last != "]" && containsString(exprOperators, last)
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEvalExpr(t *testing.T) {
+	symbols := map[string]int{"start": 0x8000, "count": 3}
+	memory := map[uint16]uint8{0x0200: 7, 0x0007: 0x42}
+	ctx := &exprContext{
+		symbol: func(name string) (int, bool) {
+			value, ok := symbols[name]
+			return value, ok
+		},
+		pc:     0x1234,
+		memory: func(address uint16) uint8 { return memory[address] },
+	}
+	tests := []struct {
+		expr string
+		want int
+	}{
+		{"$FF", 0xFF},
+		{"%1010", 10},
+		{"0x10", 16},
+		{"42", 42},
+		{"'A'", 'A'},
+		{"'A", 'A'},
+		{"*", 0x1234},
+		{"start+count", 0x8003},
+		{"1+2*3", 7},
+		{"(1+2)*3", 9},
+		{"10-4-3", 3},
+		{"100/10/5", 2},
+		{"7%4", 3},
+		{"5 % %11", 2},
+		{"1<<4|1", 17},
+		{"1|2^3&2", 1 | (2 ^ (3 & 2))},
+		{"-3+5", 2},
+		{"~0&$FF", 0xFF},
+		{"<start+$34", 0x34},
+		{">start", 0x80},
+		{">$1234+1", 0x13},
+		{"!0", 1},
+		{"!count", 0},
+		{"2+3==5", 1},
+		{"1<2==1", 1},
+		{"3>=4", 0},
+		{"1!=1 || 2<=2", 1},
+		{"0 && undefined", 0},
+		{"1 || undefined", 1},
+		{"count==3 && [$0200]>3", 1},
+		{"[[$0200]]", 0x42},
+	}
+	for _, test := range tests {
+		got, err := evalExpr(test.expr, ctx)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+		} else if got != test.want {
+			t.Errorf("%s: expected %d, got %d", test.expr, test.want, got)
+		}
+	}
+}
+
+func TestEvalExprErrors(t *testing.T) {
+	ctx := &exprContext{}
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "missing expression"},
+		{"1+", "unexpected end of expression"},
+		{"(1+2", "missing )"},
+		{"[1", "missing ]"},
+		{"1 2", `unexpected "2" in expression`},
+		{"1 # 2", `unexpected character '#' in expression`},
+		{"$FG", `unexpected "$FG" in expression`},
+		{"'", "unterminated character constant"},
+		{"1/0", "division by zero"},
+		{"1%0", "division by zero"},
+		{"[0]", "memory cannot be read here"},
+		{"nowhere+1", `undefined symbol "nowhere"`},
+	}
+	for _, test := range tests {
+		_, err := evalExpr(test.expr, ctx)
+		if err == nil {
+			t.Errorf("%q: expected an error", test.expr)
+		} else if err.Error() != test.want {
+			t.Errorf("%q: expected %q, got %q", test.expr, test.want, err)
+		}
+	}
+
+	// Undefined symbols are told apart, so the assembler can try again later
+	_, err := evalExpr("later", ctx)
+	var undefined *undefinedSymbolError
+	if !errors.As(err, &undefined) || undefined.name != "later" {
+		t.Errorf("expected an undefined symbol error, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// FuzzStep runs one instruction from a random state on the emulator and on
+// the reference model in refmodel_test.go, and fails if they disagree about
+// the registers, flags, cycles or memory afterwards. Inputs it fails on are
+// saved by go test in testdata/fuzz/FuzzStep, where they stay as regression
+// tests that plain go test runs.
+//
+//	go test -run '^$' -fuzz FuzzStep -fuzztime 1m
+//
+// The state is the registers, the instruction's bytes at the PC, and a
+// pattern the rest of memory is filled with so that pointers and indexed
+// operands land on varied values.
+func FuzzStep(f *testing.F) {
+	type seed struct {
+		a, x, y, p, sp uint8
+		pc             uint16
+		code, fill     []byte
+	}
+	for _, s := range []seed{
+		{a: 0x99, p: 0x09, sp: 0xFD, pc: 0x8000, code: []byte{0x69, 0x01}},                     // decimal ADC
+		{a: 0x12, p: 0x08, sp: 0xFD, pc: 0x8000, code: []byte{0xE9, 0x21}},                     // decimal SBC
+		{a: 0x0F, p: 0x08, sp: 0xFD, pc: 0x8000, code: []byte{0x69, 0x0F}},                     // decimal ADC of non-BCD digits
+		{pc: 0x8000, sp: 0xFD, code: []byte{0x6C, 0xFF, 0x02}, fill: []byte{0x34, 0x12, 0x56}}, // JMP ($02FF)
+		{x: 0x02, pc: 0x8000, sp: 0xFD, code: []byte{0xB5, 0xFF}, fill: []byte{0xAB}},          // zero page,X wrap
+		{x: 0x01, pc: 0x8000, sp: 0xFD, code: []byte{0xA1, 0xFE}, fill: []byte{0x00, 0x13}},    // (zp,X) pointer wrap
+		{y: 0xFF, pc: 0x8000, sp: 0xFD, code: []byte{0xB1, 0xFF}, fill: []byte{0x01, 0x13}},    // (zp),Y page cross
+		{p: 0x02, pc: 0x80FC, sp: 0xFD, code: []byte{0xF0, 0x10}},                              // branch across a page
+		{pc: 0x8000, sp: 0x00, code: []byte{0x20, 0x34, 0x12}},                                 // JSR wrapping the stack
+		{pc: 0x8000, sp: 0xFE, code: []byte{0x40}, fill: []byte{0xFF, 0x01, 0x80}},             // RTI
+		{p: 0x01, pc: 0x0000, sp: 0xFD, code: []byte{0x66, 0x00}},                              // ROR $00
+		{pc: 0xFFFF, sp: 0xFD, code: []byte{0xAD, 0x00, 0x03}, fill: []byte{0x11, 0x22, 0x33}}, // an operand wrapping memory
+	} {
+		f.Add(s.a, s.x, s.y, s.p, s.sp, s.pc, s.code, s.fill)
+	}
+	f.Fuzz(func(t *testing.T, a, x, y, p, sp uint8, pc uint16, code, fill []byte) {
+		if len(code) == 0 || refOps[code[0]] == nil {
+			// Undocumented opcodes are not modelled
+			return
+		}
+		memory := fuzzMemory(pc, code, fill)
+		p &^= Break | Unused
+
+		cpu := &CPU{MMU: &MMU{}, variant: NMOS6502}
+		copy(cpu.MMU.RAM[:], memory)
+		cpu.A, cpu.X, cpu.Y, cpu.P, cpu.SP, cpu.PC = a, x, y, p, sp, pc
+		cpu.running = true
+		cpu.step()
+
+		ref := &refCPU{a: a, x: x, y: y, p: p, s: sp, pc: pc, mem: memory}
+		ref.step()
+
+		if problems := compareWithReference(cpu, ref); len(problems) > 0 {
+			op := refOps[code[0]]
+			t.Errorf("%s %s from A=$%02X X=$%02X Y=$%02X P=$%02X (%s) SP=$%02X PC=$%04X:\n  %s",
+				op.name, op.mode, a, x, y, p, flagString(p), sp, pc, strings.Join(problems, "\n  "))
+		}
+	})
+}
+
+// fuzzMemory fills 64K with a repeating pattern and puts the instruction's
+// bytes at the PC, wrapping around the top of memory
+func fuzzMemory(pc uint16, code, fill []byte) []uint8 {
+	memory := make([]uint8, RAMSize)
+	if len(fill) > 0 {
+		for i := 0; i < RAMSize; i += copy(memory[i:], fill) {
+		}
+	}
+	if len(code) > 3 {
+		code = code[:3]
+	}
+	for i, b := range code {
+		memory[pc+uint16(i)] = b
+	}
+	return memory
+}
+
+// compareWithReference lists the ways the emulator's state differs from the
+// reference model's
+func compareWithReference(cpu *CPU, ref *refCPU) []string {
+	var problems []string
+	for _, r := range []struct {
+		name          string
+		got, expected int
+	}{
+		{"A", int(cpu.A), int(ref.a)},
+		{"X", int(cpu.X), int(ref.x)},
+		{"Y", int(cpu.Y), int(ref.y)},
+		{"SP", int(cpu.SP), int(ref.s)},
+		{"PC", int(cpu.PC), int(ref.pc)},
+		{"cycles", cpu.cycles, ref.cycles},
+	} {
+		if r.got != r.expected {
+			problems = append(problems, fmt.Sprintf("%s: expected $%02X, got $%02X", r.name, r.expected, r.got))
+		}
+	}
+	// The break and unused bits are not flags, so they are left out
+	if got, expected := cpu.P&^(Break|Unused), ref.p&^(refB|refU); got != expected {
+		problems = append(problems, fmt.Sprintf("P: expected %s, got %s", flagString(expected), flagString(got)))
+	}
+	if !bytes.Equal(cpu.MMU.RAM[:], ref.mem) {
+		for address := range ref.mem {
+			if got, expected := cpu.MMU.RAM[address], ref.mem[address]; got != expected {
+				problems = append(problems, fmt.Sprintf("$%04X: expected $%02X, got $%02X", address, expected, got))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// gdbTargetXML describes the 6502's registers to GDB, in the order the g
+// packet sends them
+const gdbTargetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.go6502.cpu">
+    <flags id="status" size="1">
+      <field name="C" start="0" end="0"/>
+      <field name="Z" start="1" end="1"/>
+      <field name="I" start="2" end="2"/>
+      <field name="D" start="3" end="3"/>
+      <field name="B" start="4" end="4"/>
+      <field name="V" start="6" end="6"/>
+      <field name="N" start="7" end="7"/>
+    </flags>
+    <reg name="a" bitsize="8" type="uint8" regnum="0"/>
+    <reg name="x" bitsize="8" type="uint8"/>
+    <reg name="y" bitsize="8" type="uint8"/>
+    <reg name="p" bitsize="8" type="status"/>
+    <reg name="sp" bitsize="8" type="uint8"/>
+    <reg name="pc" bitsize="16" type="code_ptr"/>
+  </feature>
+</target>
+`
+
+// Signals reported to GDB when the target stops
+const (
+	gdbSIGINT  = 2
+	gdbSIGILL  = 4
+	gdbSIGTRAP = 5
+)
+
+// gdbBreakpoint identifies a breakpoint or watchpoint set with a Z packet
+type gdbBreakpoint struct {
+	kind    int
+	address uint16
+	length  int
+}
+
+// gdbServer serves the GDB remote serial protocol for a CPU over a connection
+type gdbServer struct {
+	cpu  *CPU
+	conn io.ReadWriter
+	// in carries the bytes received from GDB. Interrupt requests (Ctrl-C,
+	// sent as a bare $03) are picked out as they arrive instead.
+	in    chan byte
+	out   *bufio.Writer
+	noAck bool
+	// breakpoints maps the breakpoints GDB set to their ids in the CPU's set
+	breakpoints map[gdbBreakpoint]int
+}
+
+// serveGDB listens on an address and serves GDB connections one at a time,
+// until one of them kills the target
+func serveGDB(cpu *CPU, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	for {
+		fmt.Println("Waiting for GDB on", listener.Addr())
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		fmt.Println("GDB connected from", conn.RemoteAddr())
+		server := newGDBServer(cpu, conn)
+		killed, err := server.serve()
+		conn.Close()
+		if err != nil {
+			fmt.Println("GDB connection error:", err)
+		}
+		if killed {
+			return nil
+		}
+		fmt.Println("GDB disconnected")
+	}
+}
+
+// newGDBServer creates a server for one connection
+func newGDBServer(cpu *CPU, conn io.ReadWriter) *gdbServer {
+	server := &gdbServer{
+		cpu:         cpu,
+		conn:        conn,
+		in:          make(chan byte, 4096),
+		out:         bufio.NewWriter(conn),
+		breakpoints: map[gdbBreakpoint]int{},
+	}
+	go server.receive()
+	return server
+}
+
+// receive reads from the connection until it closes, asking the CPU to stop
+// whenever GDB sends an interrupt
+func (s *gdbServer) receive() {
+	reader := bufio.NewReader(s.conn)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			close(s.in)
+			return
+		}
+		if b == 0x03 {
+			s.cpu.stopRequested.Store(true)
+			continue
+		}
+		s.in <- b
+	}
+}
+
+// serve handles packets until GDB detaches or kills the target, reporting
+// whether it was killed
+func (s *gdbServer) serve() (bool, error) {
+	for {
+		packet, ok := s.readPacket()
+		if !ok {
+			return false, nil
+		}
+		s.cpu.log("GDB: " + packet)
+		reply, done, killed := s.handle(packet)
+		if killed {
+			return true, nil
+		}
+		if err := s.writePacket(reply); err != nil {
+			return false, err
+		}
+		if done {
+			return false, nil
+		}
+	}
+}
+
+// readPacket reads the next $packet#checksum, acknowledging it. It returns
+// false when the connection closes.
+func (s *gdbServer) readPacket() (string, bool) {
+	for {
+		// Skip anything before the start of a packet, such as acks
+		b, ok := <-s.in
+		if !ok {
+			return "", false
+		}
+		if b != '$' {
+			continue
+		}
+		var data []byte
+		var sum uint8
+		for {
+			b, ok = <-s.in
+			if !ok {
+				return "", false
+			}
+			if b == '#' {
+				break
+			}
+			data = append(data, b)
+			sum += b
+		}
+		checksum := make([]byte, 2)
+		for i := range checksum {
+			if checksum[i], ok = <-s.in; !ok {
+				return "", false
+			}
+		}
+		if s.noAck {
+			return string(data), true
+		}
+		if expected, err := strconv.ParseUint(string(checksum), 16, 8); err != nil || uint8(expected) != sum {
+			s.out.WriteByte('-')
+			s.out.Flush()
+			continue
+		}
+		s.out.WriteByte('+')
+		s.out.Flush()
+		return string(data), true
+	}
+}
+
+// writePacket sends a packet, resending it until GDB acknowledges it
+func (s *gdbServer) writePacket(data string) error {
+	var sum uint8
+	var escaped strings.Builder
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		// Escape the characters that mean something in the framing
+		if b == '$' || b == '#' || b == '}' || b == '*' {
+			escaped.WriteByte('}')
+			sum += '}'
+			b ^= 0x20
+		}
+		escaped.WriteByte(b)
+		sum += b
+	}
+	packet := fmt.Sprintf("$%s#%02x", escaped.String(), sum)
+	for {
+		if _, err := s.out.WriteString(packet); err != nil {
+			return err
+		}
+		if err := s.out.Flush(); err != nil {
+			return err
+		}
+		if s.noAck {
+			return nil
+		}
+		b, ok := <-s.in
+		if !ok {
+			return io.EOF
+		}
+		if b != '-' {
+			return nil
+		}
+	}
+}
+
+// handle answers a packet, reporting whether the session is over and whether
+// the target was killed
+func (s *gdbServer) handle(packet string) (reply string, done, killed bool) {
+	if packet == "" {
+		return "", false, false
+	}
+	cpu := s.cpu
+	args := packet[1:]
+	switch packet[0] {
+	case '?':
+		return fmt.Sprintf("S%02x", gdbSIGTRAP), false, false
+	case 'g':
+		return hex.EncodeToString(s.registers()), false, false
+	case 'G':
+		values, err := hex.DecodeString(args)
+		if err != nil || len(values) != 7 {
+			return "E01", false, false
+		}
+		cpu.A, cpu.X, cpu.Y, cpu.P, cpu.SP = values[0], values[1], values[2], values[3], values[4]
+		cpu.PC = uint16(values[5]) | uint16(values[6])<<8
+		return "OK", false, false
+	case 'p':
+		return s.readRegister(args), false, false
+	case 'P':
+		return s.writeRegister(args), false, false
+	case 'm':
+		return s.readMemory(args), false, false
+	case 'M':
+		return s.writeMemory(args), false, false
+	case 's', 'c':
+		if args != "" {
+			address, err := strconv.ParseUint(args, 16, 16)
+			if err != nil {
+				return "E01", false, false
+			}
+			cpu.PC = uint16(address)
+		}
+		return s.resume(packet[0] == 's'), false, false
+	case 'Z', 'z':
+		return s.breakpoint(packet[0] == 'Z', args), false, false
+	case 'b':
+		if args == "s" || args == "c" {
+			return s.reverse(args == "s"), false, false
+		}
+	case 'H':
+		// There is only one thread
+		return "OK", false, false
+	case 'T':
+		return "OK", false, false
+	case 'D':
+		s.removeBreakpoints()
+		return "OK", true, false
+	case 'k':
+		s.removeBreakpoints()
+		return "", true, true
+	case 'q', 'Q':
+		return s.query(packet), false, false
+	}
+	// An empty reply tells GDB the packet is not supported
+	return "", false, false
+}
+
+// registers returns the registers in the order of the target description
+func (s *gdbServer) registers() []byte {
+	cpu := s.cpu
+	return []byte{cpu.A, cpu.X, cpu.Y, cpu.P, cpu.SP, uint8(cpu.PC), uint8(cpu.PC >> 8)}
+}
+
+// readRegister answers a p packet for a single register
+func (s *gdbServer) readRegister(args string) string {
+	n, err := strconv.ParseUint(args, 16, 8)
+	if err != nil || n > 5 {
+		return "E01"
+	}
+	registers := s.registers()
+	if n == 5 {
+		return hex.EncodeToString(registers[5:7])
+	}
+	return hex.EncodeToString(registers[n : n+1])
+}
+
+// writeRegister answers a P packet, n=value, for a single register
+func (s *gdbServer) writeRegister(args string) string {
+	cpu := s.cpu
+	numberText, valueText, ok := strings.Cut(args, "=")
+	n, err := strconv.ParseUint(numberText, 16, 8)
+	if !ok || err != nil || n > 5 {
+		return "E01"
+	}
+	value, err := hex.DecodeString(valueText)
+	if err != nil || len(value) == 0 || n == 5 && len(value) != 2 {
+		return "E01"
+	}
+	switch n {
+	case 0:
+		cpu.A = value[0]
+	case 1:
+		cpu.X = value[0]
+	case 2:
+		cpu.Y = value[0]
+	case 3:
+		cpu.P = value[0]
+	case 4:
+		cpu.SP = value[0]
+	case 5:
+		cpu.PC = uint16(value[0]) | uint16(value[1])<<8
+	}
+	return "OK"
+}
+
+// parseAddressLength parses the addr,length part of a packet
+func parseAddressLength(args string) (uint16, int, error) {
+	addressText, lengthText, ok := strings.Cut(args, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("missing length")
+	}
+	address, err := strconv.ParseUint(addressText, 16, 32)
+	if err != nil || address >= RAMSize {
+		return 0, 0, fmt.Errorf("invalid address")
+	}
+	length, err := strconv.ParseUint(lengthText, 16, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid length")
+	}
+	// Stop at the top of memory
+	if address+length > RAMSize {
+		length = RAMSize - address
+	}
+	return uint16(address), int(length), nil
+}
+
+// readMemory answers an m packet
+func (s *gdbServer) readMemory(args string) string {
+	address, length, err := parseAddressLength(args)
+	if err != nil {
+		return "E01"
+	}
+	values := make([]byte, length)
+	for i := range values {
+		values[i] = s.cpu.MMU.peekByte(address + uint16(i))
+	}
+	return hex.EncodeToString(values)
+}
+
+// writeMemory answers an M packet, addr,length:data
+func (s *gdbServer) writeMemory(args string) string {
+	location, data, ok := strings.Cut(args, ":")
+	if !ok {
+		return "E01"
+	}
+	address, length, err := parseAddressLength(location)
+	if err != nil {
+		return "E01"
+	}
+	values, err := hex.DecodeString(data)
+	if err != nil || len(values) < length {
+		return "E01"
+	}
+	for i := 0; i < length; i++ {
+		s.cpu.MMU.pokeByte(address+uint16(i), values[i])
+	}
+	return "OK"
+}
+
+// resume steps or continues, and returns the stop reply once the CPU stops
+func (s *gdbServer) resume(step bool) string {
+	cpu := s.cpu
+	cpu.stopRequested.Store(false)
+	if step {
+		cpu.running = true
+		cpu.breakpoints.resume()
+		cpu.step()
+	} else {
+		cpu.run(false, nil)
+	}
+	return s.stopReply()
+}
+
+// stopReply describes why the CPU stopped
+func (s *gdbServer) stopReply() string {
+	cpu := s.cpu
+	breakpoints := cpu.breakpoints
+	switch {
+	case breakpoints.stopped() && breakpoints.hit.kind.isWatchpoint():
+		kinds := map[breakpointKind]string{breakWrite: "watch", breakRead: "rwatch", breakAccess: "awatch"}
+		return fmt.Sprintf("T%02x%s:%04x;", gdbSIGTRAP, kinds[breakpoints.hit.kind], breakpoints.hitAddress)
+	case breakpoints.stopped():
+		return fmt.Sprintf("S%02x", gdbSIGTRAP)
+	case cpu.stopRequested.Load():
+		cpu.stopRequested.Store(false)
+		return fmt.Sprintf("S%02x", gdbSIGINT)
+	case !cpu.running:
+		// An opcode the CPU does not know
+		return fmt.Sprintf("S%02x", gdbSIGILL)
+	}
+	return fmt.Sprintf("S%02x", gdbSIGTRAP)
+}
+
+// reverse steps or continues backwards through the history, and returns the
+// stop reply
+func (s *gdbServer) reverse(step bool) string {
+	cpu := s.cpu
+	if cpu.history == nil {
+		return "E01"
+	}
+	cpu.stopRequested.Store(false)
+	ok := false
+	if step {
+		cpu.breakpoints.resume()
+		ok = cpu.stepBack()
+	} else {
+		ok = cpu.reverseContinue()
+	}
+	if !ok {
+		// The history has run out
+		return fmt.Sprintf("T%02xreplaylog:begin;", gdbSIGTRAP)
+	}
+	return s.stopReply()
+}
+
+// gdbBreakpointKinds maps the types of Z packet to breakpoint kinds. Software
+// and hardware breakpoints are the same thing here.
+var gdbBreakpointKinds = map[int]breakpointKind{
+	0: breakExecute,
+	1: breakExecute,
+	2: breakWrite,
+	3: breakRead,
+	4: breakAccess,
+}
+
+// breakpoint answers a Z (insert) or z (remove) packet, type,addr,kind
+func (s *gdbServer) breakpoint(insert bool, args string) string {
+	fields := strings.Split(args, ",")
+	if len(fields) < 3 {
+		return "E01"
+	}
+	kindNumber, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return "E01"
+	}
+	kind, ok := gdbBreakpointKinds[kindNumber]
+	if !ok {
+		return ""
+	}
+	address, length, err := parseAddressLength(fields[1] + "," + fields[2])
+	if err != nil {
+		return "E01"
+	}
+	// The length of a software breakpoint is the size of the instruction
+	// it replaces, which means nothing to us
+	if kind == breakExecute || length < 1 {
+		length = 1
+	}
+	key := gdbBreakpoint{kind: kindNumber, address: address, length: length}
+	if !insert {
+		if id, ok := s.breakpoints[key]; ok {
+			s.cpu.breakpoints.remove(id)
+			delete(s.breakpoints, key)
+		}
+		return "OK"
+	}
+	if _, ok := s.breakpoints[key]; ok {
+		return "OK"
+	}
+	bp := &Breakpoint{kind: kind, start: address, end: address + uint16(length-1)}
+	if err := s.cpu.breakpoints.add(bp); err != nil {
+		return "E01"
+	}
+	s.breakpoints[key] = bp.id
+	return "OK"
+}
+
+// removeBreakpoints removes the breakpoints GDB set when it goes away
+func (s *gdbServer) removeBreakpoints() {
+	for key, id := range s.breakpoints {
+		s.cpu.breakpoints.remove(id)
+		delete(s.breakpoints, key)
+	}
+}
+
+// query answers the q and Q packets we support
+func (s *gdbServer) query(packet string) string {
+	name, args, _ := strings.Cut(packet, ":")
+	switch name {
+	case "qSupported":
+		supported := "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+"
+		if s.cpu.history != nil {
+			supported += ";ReverseStep+;ReverseContinue+"
+		}
+		return supported
+	case "QStartNoAckMode":
+		// GDB still acknowledges the OK, which readPacket skips over
+		s.noAck = true
+		return "OK"
+	case "qAttached":
+		return "1"
+	case "qC":
+		return "QC1"
+	case "qfThreadInfo":
+		return "m1"
+	case "qsThreadInfo":
+		return "l"
+	case "qXfer":
+		// qXfer:features:read:target.xml:offset,length
+		fields := strings.Split(args, ":")
+		if len(fields) != 4 || fields[0] != "features" || fields[1] != "read" {
+			return ""
+		}
+		if fields[2] != "target.xml" {
+			return "E00"
+		}
+		offsetText, lengthText, ok := strings.Cut(fields[3], ",")
+		offset, err1 := strconv.ParseUint(offsetText, 16, 32)
+		length, err2 := strconv.ParseUint(lengthText, 16, 32)
+		if !ok || err1 != nil || err2 != nil {
+			return "E01"
+		}
+		if offset >= uint64(len(gdbTargetXML)) {
+			return "l"
+		}
+		end := offset + length
+		if end >= uint64(len(gdbTargetXML)) {
+			return "l" + gdbTargetXML[offset:]
+		}
+		return "m" + gdbTargetXML[offset:end]
+	}
+	return ""
+}
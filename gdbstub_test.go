@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// gdbProgram exercises breakpoints and watchpoints:
+//
+//	8000  LDX #$00
+//	8002  INX
+//	8003  STX $0200
+//	8006  LDA $0300
+//	8009  INC $0301
+//	800C  CPX #$03
+//	800E  BNE $8002
+//	8010  BRK
+var gdbProgram = []uint8{
+	0xA2, 0x00, 0xE8, 0x8E, 0x00, 0x02, 0xAD, 0x00, 0x03, 0xEE, 0x01, 0x03,
+	0xE0, 0x03, 0xD0, 0xF2, 0x00,
+}
+
+// gdbClient is the GDB end of a connection to a gdbServer
+type gdbClient struct {
+	t     *testing.T
+	conn  net.Conn
+	r     *bufio.Reader
+	noAck bool
+}
+
+// newGDBTest serves GDB for a CPU running the test program over a pipe,
+// returning the client end and a channel that gets the result of serve
+func newGDBTest(t *testing.T) (*gdbClient, *CPU, chan error) {
+	t.Helper()
+	cpu := newTestCPU(t, NMOS6502, gdbProgram)
+	cpu.breakpoints = newBreakpointSet(cpu)
+	cpu.clockSpeed = 1e9
+	serverConn, clientConn := net.Pipe()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { clientConn.Close() })
+	done := make(chan error, 1)
+	server := newGDBServer(cpu, serverConn)
+	go func() {
+		_, err := server.serve()
+		serverConn.Close()
+		done <- err
+	}()
+	return &gdbClient{t: t, conn: clientConn, r: bufio.NewReader(clientConn)}, cpu, done
+}
+
+// gdbChecksum sums the bytes of a packet's data
+func gdbChecksum(data string) uint8 {
+	var sum uint8
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// readByte reads a byte from the server
+func (c *gdbClient) readByte() byte {
+	c.t.Helper()
+	b, err := c.r.ReadByte()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return b
+}
+
+// write sends raw bytes to the server
+func (c *gdbClient) write(s string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(s)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// send sends a packet, checking that the server acknowledges it
+func (c *gdbClient) send(data string) {
+	c.t.Helper()
+	c.write(fmt.Sprintf("$%s#%02x", data, gdbChecksum(data)))
+	if !c.noAck {
+		if b := c.readByte(); b != '+' {
+			c.t.Fatalf("expected the server to acknowledge %q, got %q", data, b)
+		}
+	}
+}
+
+// receive reads a packet from the server, checking its checksum and
+// acknowledging it
+func (c *gdbClient) receive() string {
+	c.t.Helper()
+	if b := c.readByte(); b != '$' {
+		c.t.Fatalf("expected a packet, got %q", b)
+	}
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	data = data[:len(data)-1]
+	checksum := string([]byte{c.readByte(), c.readByte()})
+	if sum, err := strconv.ParseUint(checksum, 16, 8); err != nil || uint8(sum) != gdbChecksum(data) {
+		c.t.Fatalf("packet %q has checksum %s, expected %02x", data, checksum, gdbChecksum(data))
+	}
+	if !c.noAck {
+		c.write("+")
+	}
+	return data
+}
+
+// exchange sends a packet and returns the reply, checking it if want is set
+func (c *gdbClient) exchange(data, want string) string {
+	c.t.Helper()
+	c.send(data)
+	reply := c.receive()
+	if want != "" && reply != want {
+		c.t.Errorf("%s: expected %q, got %q", data, want, reply)
+	}
+	return reply
+}
+
+// detach ends the session, checking that the server finishes cleanly
+func (c *gdbClient) detach(done chan error) {
+	c.t.Helper()
+	c.exchange("D", "OK")
+	if err := <-done; err != nil {
+		c.t.Errorf("serve returned %v", err)
+	}
+}
+
+func TestGDBFraming(t *testing.T) {
+	client, _, done := newGDBTest(t)
+	// A bad checksum is refused, and the packet sent again
+	client.write("$?#00")
+	if b := client.readByte(); b != '-' {
+		t.Fatalf("expected a bad checksum to be refused, got %q", b)
+	}
+	client.exchange("?", "S05")
+
+	// A reply that is refused is sent again
+	client.send("qAttached")
+	// Leave the acknowledgements to the test for now
+	client.noAck = true
+	first := client.receive()
+	client.write("-")
+	second := client.receive()
+	client.write("+")
+	client.noAck = false
+	if first != "1" || second != "1" {
+		t.Errorf("expected the reply 1 twice, got %q and %q", first, second)
+	}
+
+	// Unsupported packets get an empty reply
+	client.exchange("vMustReplyEmpty", "")
+
+	// After QStartNoAckMode, neither end acknowledges packets
+	client.exchange("QStartNoAckMode", "OK")
+	client.noAck = true
+	// GDB still acknowledges the OK, which the server skips
+	client.write("+")
+	client.exchange("qC", "QC1")
+	client.detach(done)
+}
+
+func TestGDBRegistersAndMemory(t *testing.T) {
+	client, cpu, done := newGDBTest(t)
+	client.exchange("g", "000000"+"04"+"fd"+"0080")
+	client.exchange("G"+"112233"+"c1"+"f0"+"3412", "OK")
+	if cpu.A != 0x11 || cpu.X != 0x22 || cpu.Y != 0x33 || cpu.P != 0xC1 || cpu.SP != 0xF0 || cpu.PC != 0x1234 {
+		t.Errorf("G did not set the registers: %+v", cpu)
+	}
+	client.exchange("G1122", "E01")
+	client.exchange("p1", "22")
+	client.exchange("p5", "3412")
+	client.exchange("p6", "E01")
+	client.exchange("P0=7f", "OK")
+	client.exchange("P5=0080", "OK")
+	if cpu.A != 0x7F || cpu.PC != 0x8000 {
+		t.Errorf("P did not set the registers, A $%02X PC $%04X", cpu.A, cpu.PC)
+	}
+	client.exchange("P5=00", "E01")
+
+	client.exchange("M0200,3:a1b2c3", "OK")
+	client.exchange("m01ff,5", "00a1b2c300")
+	client.exchange("M0200,3:a1", "E01")
+	client.exchange("m10000,1", "E01")
+	// Reads stop at the top of memory
+	client.exchange("mfffe,4", "0000")
+	client.detach(done)
+}
+
+func TestGDBBreakpoints(t *testing.T) {
+	client, cpu, done := newGDBTest(t)
+	client.exchange("Z0,8009,1", "OK")
+	client.exchange("c", "S05")
+	if cpu.PC != 0x8009 {
+		t.Errorf("expected to stop at $8009, at $%04X", cpu.PC)
+	}
+	client.exchange("z0,8009,1", "OK")
+
+	// Watchpoints report the address they were hit at
+	client.exchange("Z2,0200,1", "OK")
+	client.exchange("c", "T05watch:0200;")
+	if cpu.PC != 0x8006 || cpu.X != 2 {
+		t.Errorf("expected to stop after the second STX, at $%04X X %d", cpu.PC, cpu.X)
+	}
+	client.exchange("z2,0200,1", "OK")
+	client.exchange("Z3,0300,1", "OK")
+	client.exchange("c", "T05rwatch:0300;")
+	client.exchange("z3,0300,1", "OK")
+	client.exchange("Z4,0301,1", "OK")
+	client.exchange("c", "T05awatch:0301;")
+	client.exchange("z4,0301,1", "OK")
+	// Type 5 is not supported
+	client.exchange("Z5,0301,1", "")
+
+	// With everything removed, the program runs to its BRK
+	client.exchange("s", "S05")
+	client.exchange("c", "S05")
+	if cpu.X != 3 || cpu.MMU.peekByte(0x0301) != 3 {
+		t.Errorf("expected the loop to run three times, X %d [$0301] %d", cpu.X, cpu.MMU.peekByte(0x0301))
+	}
+	client.detach(done)
+}
@@ -1,6 +1,9 @@
 package main
 
-import "strconv"
+import (
+	"strconv"
+	"strings"
+)
 
 // mhzToHz converts a frequency in MHz to Hz
 func mhzToHz(mhz float64) int64 {
@@ -18,3 +21,17 @@ func boolToInt(b bool) uint8 {
 	}
 	return 0
 }
+
+// parseAddress parses a 16-bit address written as $hex, 0xhex or decimal
+func parseAddress(s string) (uint16, error) {
+	s = strings.TrimSpace(s)
+	// Treat a leading $ as a hex prefix
+	if strings.HasPrefix(s, "$") {
+		s = "0x" + s[1:]
+	}
+	address, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(address), nil
+}
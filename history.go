@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// memoryWrite is a byte written by an instruction, with the value it replaced
+type memoryWrite struct {
+	address uint16
+	old     uint8
+}
+
+// undoRecord holds the state before an instruction, and the bytes it
+// overwrote, so that the instruction can be undone
+type undoRecord struct {
+	A, X, Y, P, SP uint8
+	PC             uint16
+	cycles         int
+	irq            uint32
+	nmiPending     bool
+	waiting        bool
+	writes         []memoryWrite
+	// devices holds what each device with state saved, in the order of
+	// statefulDevices
+	devices [][]byte
+}
+
+// size returns roughly how many bytes the record takes up
+func (r *undoRecord) size() int {
+	size := undoRecordSize + memoryWriteSize*len(r.writes)
+	for _, state := range r.devices {
+		size += deviceStateSize + len(state)
+	}
+	return size
+}
+
+// Rough sizes of the records, for keeping to the memory budget
+const (
+	undoRecordSize  = 64
+	memoryWriteSize = 4
+	deviceStateSize = 24
+)
+
+// History is a bounded list of undo records, oldest first. When it goes over
+// its memory budget the oldest records are dropped.
+type History struct {
+	records []undoRecord
+	first   int // index of the oldest record still kept
+	budget  int // in bytes
+	size    int // bytes used by the records kept
+}
+
+// newHistory creates a history that uses at most about budget bytes
+func newHistory(budget int) *History {
+	return &History{budget: budget}
+}
+
+// enableHistory starts keeping a history of at most about budget bytes
+func (cpu *CPU) enableHistory(budget int) {
+	cpu.history = newHistory(budget)
+	cpu.MMU.history = cpu.history
+}
+
+// len returns the number of instructions that can be undone
+func (h *History) len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.records) - h.first
+}
+
+// clear forgets the whole history
+func (h *History) clear() {
+	if h != nil {
+		h.records, h.first, h.size = nil, 0, 0
+	}
+}
+
+// begin records the state before an instruction
+func (h *History) begin(cpu *CPU) {
+	if h == nil {
+		return
+	}
+	record := undoRecord{
+		A: cpu.A, X: cpu.X, Y: cpu.Y, P: cpu.P, SP: cpu.SP, PC: cpu.PC,
+		cycles: cpu.cycles, irq: cpu.irq, nmiPending: cpu.nmiPending, waiting: cpu.waiting,
+	}
+	// The devices' registers, timers and IRQ outputs go back with the CPU's
+	// IRQ lines, so they are saved the way save states save them
+	for _, device := range cpu.MMU.statefulDevices() {
+		var e stateEncoder
+		device.saveState(&e)
+		record.devices = append(record.devices, e.buf)
+	}
+	h.records = append(h.records, record)
+	h.size += record.size()
+	h.trim()
+}
+
+// recordWrite records the byte a write is about to overwrite
+func (h *History) recordWrite(address uint16, old uint8) {
+	if h.len() == 0 {
+		return
+	}
+	record := &h.records[len(h.records)-1]
+	record.writes = append(record.writes, memoryWrite{address: address, old: old})
+	h.size += memoryWriteSize
+	h.trim()
+}
+
+// trim drops the oldest records until the history fits its budget, always
+// keeping the newest
+func (h *History) trim() {
+	for h.size > h.budget && h.len() > 1 {
+		record := &h.records[h.first]
+		h.size -= record.size()
+		*record = undoRecord{}
+		h.first++
+	}
+	// Move the records down once the dropped ones take up half the slice
+	if h.first > 1024 && h.first > len(h.records)/2 {
+		h.records = append(h.records[:0], h.records[h.first:]...)
+		h.first = 0
+	}
+}
+
+// pop removes the newest record
+func (h *History) pop() (undoRecord, bool) {
+	if h.len() == 0 {
+		return undoRecord{}, false
+	}
+	record := h.records[len(h.records)-1]
+	h.records = h.records[:len(h.records)-1]
+	h.size -= record.size()
+	return record, true
+}
+
+// oldestCycle returns the cycle count the history goes back to
+func (h *History) oldestCycle() (int, bool) {
+	if h.len() == 0 {
+		return 0, false
+	}
+	return h.records[h.first].cycles, true
+}
+
+// stepBack undoes the last instruction, reporting false if there is no
+// history left. Write watchpoints are checked against the bytes it restores.
+func (cpu *CPU) stepBack() bool {
+	record, ok := cpu.history.pop()
+	if !ok {
+		return false
+	}
+	// Put the bytes back in the reverse of the order they were written
+	for i := len(record.writes) - 1; i >= 0; i-- {
+		write := record.writes[i]
+		cpu.breakpoints.undoneWrite(write.address, cpu.MMU.peekByte(write.address))
+		cpu.MMU.pokeByte(write.address, write.old)
+	}
+	cpu.A, cpu.X, cpu.Y, cpu.P, cpu.SP, cpu.PC = record.A, record.X, record.Y, record.P, record.SP, record.PC
+	cpu.cycles, cpu.irq, cpu.nmiPending, cpu.waiting = record.cycles, record.irq, record.nmiPending, record.waiting
+	for i, device := range cpu.MMU.statefulDevices() {
+		if i < len(record.devices) {
+			device.loadState(&stateDecoder{data: record.devices[i]})
+		}
+	}
+	cpu.running = true
+	return true
+}
+
+// reverseContinue runs backwards until a breakpoint or watchpoint would have
+// stopped the program, it is asked to stop, or the history runs out, which
+// it reports by returning false
+func (cpu *CPU) reverseContinue() bool {
+	cpu.breakpoints.resume()
+	for {
+		if !cpu.stepBack() {
+			return false
+		}
+		if cpu.breakpoints.stopped() || cpu.breakpoints.atInstruction() || cpu.stopRequested.Load() {
+			return true
+		}
+	}
+}
+
+// runToCycle goes back through the history, or runs forwards, to the first
+// instruction that starts at or after a cycle count. It reports false if the
+// history does not go back that far, leaving the CPU at its oldest state.
+func (cpu *CPU) runToCycle(cycle int) bool {
+	for cpu.cycles > cycle {
+		if !cpu.stepBack() {
+			return false
+		}
+	}
+	cpu.running = true
+	cpu.breakpoints.resume()
+	for first := true; cpu.cycles < cycle; first = false {
+		if !first && cpu.breakpoints.beforeInstruction() {
+			break
+		}
+		cpu.step()
+		if !cpu.running || cpu.getFlag(Break) || cpu.stopRequested.Load() || cpu.breakpoints.stopped() {
+			break
+		}
+	}
+	return true
+}
+
+// parseSize parses a size in bytes, with an optional K, M or G suffix
+func parseSize(s string) (int, error) {
+	if s == "" {
+		return 0, fmt.Errorf("missing size")
+	}
+	multiplier := 1
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import "testing"
+
+// historyProgram loops forever, writing to memory and the stack:
+//
+//	8000  LDX #$00
+//	8002  TXA
+//	8003  STA $0200,X
+//	8006  INC $10
+//	8008  INX
+//	8009  JSR $8020
+//	800C  JMP $8002
+//	8020  PHA
+//	8021  PLA
+//	8022  RTS
+var historyProgram = []uint8{
+	0xA2, 0x00, 0x8A, 0x9D, 0x00, 0x02, 0xE6, 0x10, 0xE8, 0x20, 0x20, 0x80, 0x4C, 0x02, 0x80,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0x48, 0x68, 0x60,
+}
+
+// historySnapshot is the state of the machine at a point in a run
+type historySnapshot struct {
+	cycles int
+	pc     uint16
+	hash   uint64
+}
+
+// newHistoryTest runs the history program for a number of instructions with
+// a history budget, returning the state before each instruction and after
+// the last
+func newHistoryTest(t *testing.T, budget, steps int) (*CPU, []historySnapshot) {
+	t.Helper()
+	cpu := newTestCPU(t, NMOS6502, historyProgram)
+	cpu.breakpoints = newBreakpointSet(cpu)
+	cpu.enableHistory(budget)
+	var snapshots []historySnapshot
+	for i := 0; i <= steps; i++ {
+		snapshots = append(snapshots, historySnapshot{cycles: cpu.cycles, pc: cpu.PC, hash: stateHash(cpu)})
+		if i < steps {
+			cpu.step()
+		}
+	}
+	return cpu, snapshots
+}
+
+// checkSnapshot checks the machine is as it was at a snapshot
+func checkSnapshot(t *testing.T, cpu *CPU, snapshots []historySnapshot, i int) {
+	t.Helper()
+	want := snapshots[i]
+	if cpu.cycles != want.cycles || cpu.PC != want.pc || stateHash(cpu) != want.hash {
+		t.Errorf("expected the state after %d instructions, at $%04X cycle %d, got $%04X cycle %d",
+			i, want.pc, want.cycles, cpu.PC, cpu.cycles)
+	}
+}
+
+func TestHistoryStepBack(t *testing.T) {
+	cpu, snapshots := newHistoryTest(t, 1<<20, 100)
+	if cpu.history.len() != 100 {
+		t.Fatalf("expected 100 records, got %d", cpu.history.len())
+	}
+	for i := 99; i >= 40; i-- {
+		if !cpu.stepBack() {
+			t.Fatalf("ran out of history at %d", i)
+		}
+	}
+	checkSnapshot(t, cpu, snapshots, 40)
+	// That is LDX and four times round the loop, then TXA, STA and INC
+	if cpu.MMU.peekByte(0x10) != 5 || cpu.MMU.peekByte(0x0204) != 4 || cpu.MMU.peekByte(0x0205) != 0 {
+		t.Errorf("expected INC $10 to have run 5 times and $0204 the last byte written, got %d, $%02X and $%02X",
+			cpu.MMU.peekByte(0x10), cpu.MMU.peekByte(0x0204), cpu.MMU.peekByte(0x0205))
+	}
+	// Stepping forwards again gets back to where we were
+	for i := 40; i < 100; i++ {
+		cpu.step()
+	}
+	checkSnapshot(t, cpu, snapshots, 100)
+	// All the way back, and no further
+	for cpu.stepBack() {
+	}
+	checkSnapshot(t, cpu, snapshots, 0)
+}
+
+func TestHistoryReverseContinue(t *testing.T) {
+	cpu, snapshots := newHistoryTest(t, 1<<20, 100)
+	if err := cpu.breakpoints.add(&Breakpoint{kind: breakExecute, start: 0x8006, end: 0x8006}); err != nil {
+		t.Fatal(err)
+	}
+	// Each reverse continue stops at the previous INC $10
+	var incs []int
+	for i, s := range snapshots {
+		if s.pc == 0x8006 {
+			incs = append(incs, i)
+		}
+	}
+	for i := len(incs) - 1; i >= len(incs)-3; i-- {
+		if !cpu.reverseContinue() {
+			t.Fatal("ran out of history")
+		}
+		checkSnapshot(t, cpu, snapshots, incs[i])
+	}
+	// A write watchpoint stops where the byte was written, with it as it was
+	// before
+	cpu.breakpoints.clear()
+	if err := cpu.breakpoints.add(&Breakpoint{kind: breakWrite, start: 0x0203, end: 0x0203}); err != nil {
+		t.Fatal(err)
+	}
+	if !cpu.reverseContinue() {
+		t.Fatal("ran out of history")
+	}
+	if cpu.PC != 0x8003 || cpu.X != 3 || cpu.MMU.peekByte(0x0203) != 0 {
+		t.Errorf("expected to stop at the STA that wrote $0203, at $%04X X %d", cpu.PC, cpu.X)
+	}
+	// With nothing to stop it, it runs out of history at the start
+	cpu.breakpoints.clear()
+	if cpu.reverseContinue() {
+		t.Error("expected to run out of history")
+	}
+	checkSnapshot(t, cpu, snapshots, 0)
+}
+
+func TestHistoryRunToCycle(t *testing.T) {
+	cpu, snapshots := newHistoryTest(t, 1<<20, 100)
+	if !cpu.runToCycle(snapshots[30].cycles) {
+		t.Fatal("expected the history to go back to the cycle")
+	}
+	checkSnapshot(t, cpu, snapshots, 30)
+	// Going forwards runs the CPU, stopping at the first instruction that
+	// starts at or after the cycle
+	cpu.runToCycle(snapshots[70].cycles - 1)
+	checkSnapshot(t, cpu, snapshots, 70)
+}
+
+func TestHistoryBudget(t *testing.T) {
+	// Room for about 20 instructions
+	cpu, snapshots := newHistoryTest(t, 20*(undoRecordSize+memoryWriteSize), 100)
+	kept := cpu.history.len()
+	if kept < 10 || kept > 20 {
+		t.Fatalf("expected 10 to 20 records kept, got %d", kept)
+	}
+	if cycle, _ := cpu.history.oldestCycle(); cycle != snapshots[100-kept].cycles {
+		t.Errorf("expected the history to go back to cycle %d, got %d", snapshots[100-kept].cycles, cycle)
+	}
+	for i := 0; i < kept; i++ {
+		if !cpu.stepBack() {
+			t.Fatalf("ran out of history after %d of %d", i, kept)
+		}
+	}
+	if cpu.stepBack() {
+		t.Error("expected the history to run out")
+	}
+	checkSnapshot(t, cpu, snapshots, 100-kept)
+	// Going back further than the history leaves the CPU at its oldest state
+	cpu.step()
+	if cpu.runToCycle(snapshots[0].cycles) {
+		t.Error("expected running back to the start to fail")
+	}
+	checkSnapshot(t, cpu, snapshots, 100-kept)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// Intel HEX record types
+const (
+	ihexData                   = 0x00
+	ihexEndOfFile              = 0x01
+	ihexExtendedSegmentAddress = 0x02
+	ihexStartSegmentAddress    = 0x03
+	ihexExtendedLinearAddress  = 0x04
+	ihexStartLinearAddress     = 0x05
+)
+
+// parseIntelHex parses an Intel HEX file into a program image
+func parseIntelHex(data []uint8) (*programImage, error) {
+	img := &programImage{}
+	// Base address set by extended address records
+	var base uint32
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		lineNumber := i + 1
+		line = bytes.TrimSpace(line)
+		// Skip blank lines
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ':' {
+			return nil, fmt.Errorf("line %d: record does not start with ':'", lineNumber)
+		}
+		record, err := hex.DecodeString(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid hex digits", lineNumber)
+		}
+		// A record is at least a count, a two byte address, a type and a checksum
+		if len(record) < 5 || len(record) != int(record[0])+5 {
+			return nil, fmt.Errorf("line %d: record length does not match its byte count", lineNumber)
+		}
+		// The sum of every byte, including the checksum, must be zero
+		var sum uint8
+		for _, b := range record {
+			sum += b
+		}
+		if sum != 0 {
+			checksum := record[len(record)-1]
+			return nil, fmt.Errorf("line %d: checksum mismatch (expected $%02X, got $%02X)",
+				lineNumber, checksum-sum, checksum)
+		}
+		address := uint32(record[1])<<8 | uint32(record[2])
+		recordType := record[3]
+		payload := record[4 : len(record)-1]
+		switch recordType {
+		case ihexData:
+			address += base
+			if address+uint32(len(payload)) > RAMSize {
+				return nil, fmt.Errorf("line %d: data at $%X is outside the 64KB address space", lineNumber, address)
+			}
+			img.addData(uint16(address), payload)
+		case ihexEndOfFile:
+			return img, nil
+		case ihexExtendedSegmentAddress, ihexExtendedLinearAddress:
+			if len(payload) != 2 {
+				return nil, fmt.Errorf("line %d: extended address record must have 2 data bytes", lineNumber)
+			}
+			base = uint32(payload[0])<<8 | uint32(payload[1])
+			if recordType == ihexExtendedSegmentAddress {
+				base <<= 4
+			} else {
+				base <<= 16
+			}
+		case ihexStartSegmentAddress, ihexStartLinearAddress:
+			if len(payload) != 4 {
+				return nil, fmt.Errorf("line %d: start address record must have 4 data bytes", lineNumber)
+			}
+			start := uint32(payload[0])<<24 | uint32(payload[1])<<16 | uint32(payload[2])<<8 | uint32(payload[3])
+			if recordType == ihexStartSegmentAddress {
+				// CS:IP
+				start = (start>>16)<<4 + start&0xFFFF
+			}
+			if start >= RAMSize {
+				return nil, fmt.Errorf("line %d: start address $%X is outside the 64KB address space", lineNumber, start)
+			}
+			img.start = uint16(start)
+			img.hasStart = true
+		default:
+			return nil, fmt.Errorf("line %d: unknown record type $%02X", lineNumber, recordType)
+		}
+	}
+	return img, nil
+}
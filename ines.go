@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// inesMagic starts the header of an iNES (.nes) cartridge image
+var inesMagic = []uint8{'N', 'E', 'S', 0x1A}
+
+// Sizes in an iNES file
+const (
+	inesHeaderSize  = 16
+	inesTrainerSize = 512
+	inesPRGBankSize = 16 * 1024
+)
+
+// parseINES parses an iNES cartridge image. Only mapper 0 (NROM) is
+// supported: its 16K or 32K of PRG ROM is placed at $8000, with a 16K ROM
+// mirrored at $C000 as well. The CHR ROM is for the PPU, so it is left out.
+func parseINES(data []uint8) (*programImage, error) {
+	if len(data) < inesHeaderSize || !bytes.Equal(data[:4], inesMagic) {
+		return nil, fmt.Errorf("not an iNES file")
+	}
+	banks := int(data[4])
+	flags6, flags7 := data[6], data[7]
+	mapper := flags6>>4 | flags7&0xF0
+	if mapper != 0 {
+		return nil, fmt.Errorf("mapper %d is not supported, only NROM (mapper 0)", mapper)
+	}
+	if banks != 1 && banks != 2 {
+		return nil, fmt.Errorf("NROM has 1 or 2 banks of PRG ROM, not %d", banks)
+	}
+	offset := inesHeaderSize
+	// Skip the trainer, which would go at $7000
+	if flags6&0x04 != 0 {
+		offset += inesTrainerSize
+	}
+	size := banks * inesPRGBankSize
+	if len(data) < offset+size {
+		return nil, fmt.Errorf("file is too short for %d bytes of PRG ROM", size)
+	}
+	prg := data[offset : offset+size]
+	img := &programImage{}
+	img.addData(0x8000, prg)
+	if banks == 1 {
+		img.addData(0xC000, prg)
+	}
+	return img, nil
+}
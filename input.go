@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// hostIRQ is the IRQ source that the host's irq input holds low
+const hostIRQ uint = 31
+
+// defaultHashInterval is how often, in cycles, a recording notes the state
+const defaultHashInterval = 100000
+
+// inputLogHeader starts every input log
+const inputLogHeader = "go6502 input log 1"
+
+// inputEvent is a piece of input from the host for a source, such as a key
+// for a keyboard or a byte for a serial port
+type inputEvent struct {
+	source string
+	value  int
+}
+
+// inputLogEntry is a line of an input log: input applied at a cycle, or the
+// hash of the state there
+type inputLogEntry struct {
+	kind  string // input, start, hash or end
+	cycle int
+	event inputEvent
+	hash  uint64
+}
+
+// InputLog hands input from the host to the devices it is for. Host input
+// can arrive at any time, from any goroutine, so it is queued and applied
+// between instructions, which is what makes it possible to record it with
+// the cycle count it was applied at and replay it at exactly the same point.
+type InputLog struct {
+	mu     sync.Mutex
+	queued []inputEvent
+	// handlers take the input for each source, on the CPU's goroutine
+	handlers map[string]func(value int)
+
+	// record, if set, is where input and state hashes are written
+	record       *bufio.Writer
+	recordCloser io.Closer
+	hashInterval int
+	nextHash     int
+
+	// replay, if set, is a log being replayed in place of the host's input
+	replay    []inputLogEntry
+	replaying bool
+	next      int
+	// check compares the state hashes in the log with the replay's
+	check bool
+	// err is the first way the replay went differently from the recording
+	err error
+}
+
+// newInputLog creates an input log with the host's IRQ and NMI inputs
+func newInputLog(cpu *CPU) *InputLog {
+	l := &InputLog{handlers: map[string]func(int){}}
+	l.handle("irq", func(value int) { cpu.setIRQ(hostIRQ, value != 0) })
+	l.handle("nmi", func(value int) { cpu.triggerNMI() })
+	return l
+}
+
+// handle sets the function that takes the input for a source
+func (l *InputLog) handle(source string, handler func(value int)) {
+	l.handlers[source] = handler
+}
+
+// send queues input for a source. It can be called from any goroutine.
+// While replaying, input from the host is dropped, as the log supplies it.
+func (l *InputLog) send(source string, value int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.replaying {
+		l.queued = append(l.queued, inputEvent{source: source, value: value})
+	}
+}
+
+// stateHash hashes the whole machine state, as a save state would hold it
+func stateHash(cpu *CPU) uint64 {
+	h := fnv.New64a()
+	cpu.saveState(h)
+	return h.Sum64()
+}
+
+// startRecording starts writing input to w, from the state the CPU is in
+func (l *InputLog) startRecording(cpu *CPU, w io.WriteCloser, hashInterval int) error {
+	l.record, l.recordCloser = bufio.NewWriter(w), w
+	l.hashInterval = hashInterval
+	l.nextHash = cpu.cycles + hashInterval
+	_, err := fmt.Fprintf(l.record, "%s\nstart %d %016x\n", inputLogHeader, cpu.cycles, stateHash(cpu))
+	return err
+}
+
+// startReplay starts replaying a log. With check set, the state is compared
+// with the hashes in the log, starting with the state the CPU is in now.
+func (l *InputLog) startReplay(cpu *CPU, r io.Reader, check bool) error {
+	entries, err := parseInputLog(r)
+	if err != nil {
+		return err
+	}
+	l.replay, l.replaying, l.check = entries, true, check
+	if len(entries) > 0 && entries[0].kind == "start" {
+		start := entries[0]
+		l.next = 1
+		if start.cycle != cpu.cycles || start.hash != stateHash(cpu) {
+			err := fmt.Errorf("the recording started from a different state (cycle %d), use the same files or --load-state", start.cycle)
+			if check {
+				return err
+			}
+			fmt.Println("Warning:", err)
+		}
+	}
+	return nil
+}
+
+// parseInputLog reads the entries of an input log
+func parseInputLog(r io.Reader) ([]inputLogEntry, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() || scanner.Text() != inputLogHeader {
+		return nil, fmt.Errorf("not an input log")
+	}
+	var entries []inputLogEntry
+	for line := 2; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		entry := inputLogEntry{kind: fields[0]}
+		var err error
+		switch {
+		case entry.kind == "input" && len(fields) == 4:
+			entry.cycle, err = strconv.Atoi(fields[1])
+			entry.event.source = fields[2]
+			if err == nil {
+				entry.event.value, err = strconv.Atoi(fields[3])
+			}
+		case (entry.kind == "start" || entry.kind == "hash" || entry.kind == "end") && len(fields) == 3:
+			entry.cycle, err = strconv.Atoi(fields[1])
+			if err == nil {
+				entry.hash, err = strconv.ParseUint(fields[2], 16, 64)
+			}
+		default:
+			err = fmt.Errorf("unknown entry %q", scanner.Text())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// Entries must be in order for the replay to find them
+	if !sort.SliceIsSorted(entries, func(i, j int) bool { return entries[i].cycle < entries[j].cycle }) {
+		return nil, fmt.Errorf("the entries are not in cycle order")
+	}
+	return entries, nil
+}
+
+// poll applies the input due before the next instruction, recording it or
+// taking it from the log being replayed
+func (l *InputLog) poll(cpu *CPU) {
+	if l == nil {
+		return
+	}
+	if l.replaying {
+		l.replayDue(cpu)
+		return
+	}
+	l.mu.Lock()
+	queued := l.queued
+	l.queued = nil
+	l.mu.Unlock()
+	for _, event := range queued {
+		l.apply(event)
+		if l.record != nil {
+			fmt.Fprintf(l.record, "input %d %s %d\n", cpu.cycles, event.source, event.value)
+		}
+	}
+	if l.record != nil && cpu.cycles >= l.nextHash {
+		fmt.Fprintf(l.record, "hash %d %016x\n", cpu.cycles, stateHash(cpu))
+		for l.nextHash <= cpu.cycles {
+			l.nextHash += l.hashInterval
+		}
+	}
+}
+
+// replayDue applies the entries of the log that are due. As instructions
+// run the same way as when recording, input lands on the cycle it was
+// recorded at; if it does not, the replay has gone astray.
+func (l *InputLog) replayDue(cpu *CPU) {
+	for ; l.next < len(l.replay) && l.replay[l.next].cycle <= cpu.cycles; l.next++ {
+		entry := l.replay[l.next]
+		if entry.kind == "end" {
+			// The end is checked when the replay finishes
+			return
+		}
+		if entry.cycle != cpu.cycles && l.check {
+			l.diverged(cpu, fmt.Errorf("no instruction started at cycle %d, where the recording had %s", entry.cycle, entry.kind))
+			return
+		}
+		// Without checking, input that is late is applied anyway
+		switch entry.kind {
+		case "input":
+			l.apply(entry.event)
+		case "hash":
+			if !l.check {
+				continue
+			}
+			if hash := stateHash(cpu); hash != entry.hash {
+				l.diverged(cpu, fmt.Errorf("the state at cycle %d has hash %016x, the recording had %016x", cpu.cycles, hash, entry.hash))
+				return
+			}
+		}
+	}
+}
+
+// diverged stops the CPU on the first difference from the recording
+func (l *InputLog) diverged(cpu *CPU, err error) {
+	l.err = err
+	cpu.running = false
+}
+
+// apply passes input to its handler
+func (l *InputLog) apply(event inputEvent) {
+	if handler, ok := l.handlers[event.source]; ok {
+		handler(event.value)
+	} else {
+		Log("INPUT", fmt.Sprintf("No device takes input for %q", event.source))
+	}
+}
+
+// finish ends a recording with the final state, or checks a replay ended
+// where the recording did, returning the first difference if checking
+func (l *InputLog) finish(cpu *CPU) error {
+	if l == nil {
+		return nil
+	}
+	if l.record != nil {
+		fmt.Fprintf(l.record, "end %d %016x\n", cpu.cycles, stateHash(cpu))
+		err := l.record.Flush()
+		if closeErr := l.recordCloser.Close(); err == nil {
+			err = closeErr
+		}
+		l.record = nil
+		return err
+	}
+	if !l.check || l.err != nil {
+		return l.err
+	}
+	for _, entry := range l.replay[l.next:] {
+		if entry.kind == "end" {
+			if entry.cycle != cpu.cycles {
+				return fmt.Errorf("the replay ended at cycle %d, the recording at %d", cpu.cycles, entry.cycle)
+			}
+			if hash := stateHash(cpu); hash != entry.hash {
+				return fmt.Errorf("the final state has hash %016x, the recording had %016x", hash, entry.hash)
+			}
+			return nil
+		}
+		return fmt.Errorf("the replay ended at cycle %d, before the recording's %s at cycle %d", cpu.cycles, entry.kind, entry.cycle)
+	}
+	return nil
+}
+
+// open starts recording or replaying, as asked
+func (l *InputLog) open(cpu *CPU, recordFile, replayFile string, check bool, hashInterval int) error {
+	if recordFile != "" {
+		file, err := os.Create(recordFile)
+		if err != nil {
+			return err
+		}
+		return l.startRecording(cpu, file, hashInterval)
+	}
+	if replayFile != "" {
+		file, err := os.Open(replayFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := l.startReplay(cpu, file, check); err != nil {
+			return fmt.Errorf("%s: %v", replayFile, err)
+		}
+	}
+	return nil
+}
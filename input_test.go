@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// nopCloser lets a buffer stand in for a recording's file
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+// irqCounter counts IRQs in $10, while the main loop counts in X
+var irqCounter = []uint8{
+	0x58,             // CLI
+	0xE8,             // loop: INX
+	0x4C, 0x01, 0x80, // JMP loop
+	0xE6, 0x10, // irq: INC $10
+	0x40, // RTI
+}
+
+// newIRQCounter sets up a CPU running irqCounter with an input log
+func newIRQCounter(t *testing.T) *CPU {
+	cpu := newTestCPU(t, NMOS6502, irqCounter)
+	cpu.MMU.pokeByte(0xFFFE, 0x05)
+	cpu.MMU.pokeByte(0xFFFF, 0x80)
+	cpu.input = newInputLog(cpu)
+	return cpu
+}
+
+// recordIRQCounter runs irqCounter, raising and dropping the host's IRQ as
+// it goes, and returns the recording
+func recordIRQCounter(t *testing.T) (*CPU, string) {
+	cpu := newIRQCounter(t)
+	var log bytes.Buffer
+	if err := cpu.input.startRecording(cpu, nopCloser{&log}, 50); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		switch i {
+		case 40, 130:
+			cpu.input.send("irq", 1)
+		case 43, 131:
+			cpu.input.send("irq", 0)
+		}
+		cpu.step()
+	}
+	if err := cpu.input.finish(cpu); err != nil {
+		t.Fatal(err)
+	}
+	return cpu, log.String()
+}
+
+// replayIRQCounter replays a recording of irqCounter for as many steps
+func replayIRQCounter(t *testing.T, recording string) (*CPU, error) {
+	cpu := newIRQCounter(t)
+	if err := cpu.input.startReplay(cpu, strings.NewReader(recording), true); err != nil {
+		t.Fatal(err)
+	}
+	// Input from the host is ignored while replaying
+	cpu.input.send("irq", 1)
+	for i := 0; i < 300 && cpu.running; i++ {
+		cpu.step()
+	}
+	return cpu, cpu.input.finish(cpu)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	recorded, recording := recordIRQCounter(t)
+	if recorded.MMU.peekByte(0x10) == 0 {
+		t.Fatalf("no IRQs were taken while recording:\n%s", recording)
+	}
+	if !strings.Contains(recording, "\nhash ") {
+		t.Errorf("the recording has no state hashes:\n%s", recording)
+	}
+	replayed, err := replayIRQCounter(t, recording)
+	if err != nil {
+		t.Fatalf("replay check failed: %v\n%s", err, recording)
+	}
+	if stateHash(replayed) != stateHash(recorded) {
+		t.Error("the replay ended in a different state")
+	}
+}
+
+func TestReplayCheckFindsDivergence(t *testing.T) {
+	_, recording := recordIRQCounter(t)
+	// Delay the first IRQ by a cycle
+	lines := strings.Split(recording, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "input ") {
+			var cycle int
+			var source string
+			var value int
+			fmt.Sscanf(line, "input %d %s %d", &cycle, &source, &value)
+			lines[i] = fmt.Sprintf("input %d %s %d", cycle+1, source, value)
+			break
+		}
+	}
+	if _, err := replayIRQCounter(t, strings.Join(lines, "\n")); err == nil {
+		t.Error("expected the replay check to fail")
+	}
+
+	// Dropping an input changes the state the hashes see
+	lines = strings.Split(recording, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "input ") && strings.HasSuffix(line, " 0") {
+			lines = append(lines[:i], lines[i+1:]...)
+			break
+		}
+	}
+	if _, err := replayIRQCounter(t, strings.Join(lines, "\n")); err == nil || !strings.Contains(err.Error(), "hash") {
+		t.Errorf("expected a hash mismatch, got %v", err)
+	}
+}
+
+func TestMonitorHostInput(t *testing.T) {
+	cpu := newIRQCounter(t)
+	var log bytes.Buffer
+	if err := cpu.input.startRecording(cpu, nopCloser{&log}, 1000); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	m := NewMonitor(cpu, strings.NewReader(""), &out)
+	m.execute("irq on")
+	for i := 0; i < 5; i++ {
+		cpu.step()
+	}
+	m.execute("irq off")
+	cpu.step()
+	if cpu.irq != 0 || cpu.MMU.peekByte(0x10) == 0 {
+		t.Errorf("expected an IRQ taken and the input released, got $%02X IRQs and lines %b", cpu.MMU.peekByte(0x10), cpu.irq)
+	}
+	m.execute("irq maybe")
+	if !strings.Contains(out.String(), "?expected irq on or irq off") {
+		t.Errorf("expected an error, got %q", out.String())
+	}
+	if err := cpu.input.finish(cpu); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), " irq 1\n") || !strings.Contains(log.String(), " irq 0\n") {
+		t.Errorf("the monitor's input was not recorded:\n%s", log.String())
+	}
+}
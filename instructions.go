@@ -6,6 +6,7 @@ type Instruction struct {
 	addressingMode int                // The addressing mode
 	length         int                // The length of the instruction
 	cycles         int                // The number of cycles the instruction takes
+	pageCrossCycle bool               // Whether indexing across a page takes an extra cycle
 	execute        func(*CPU, uint16) // The function to execute
 }
 
@@ -14,78 +15,168 @@ var instructions = map[uint8]Instruction{
 	0x00: {mnemonic: "BRK", addressingMode: 0, length: 1, cycles: 7, execute: func(cpu *CPU, operand uint16) {
 		cpu.brk()
 	}},
-	0x01: {mnemonic: "ORA", addressingMode: 11, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {}},
-	0x05: {mnemonic: "ORA", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {}},
+	0x01: {mnemonic: "ORA", addressingMode: 11, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.ora(operand)
+	}},
+	0x05: {mnemonic: "ORA", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.ora(operand)
+	}},
 	0x06: {mnemonic: "ASL", addressingMode: 3, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
 		cpu.asl(operand)
 	}},
-	0x08: {mnemonic: "PHP", addressingMode: 0, length: 1, cycles: 3, execute: func(cpu *CPU, operand uint16) {}},
-	0x09: {mnemonic: "ORA", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
+	0x08: {mnemonic: "PHP", addressingMode: 0, length: 1, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.php()
+	}},
+	0x09: {mnemonic: "ORA", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.ora(operand)
+	}},
 	0x0A: {mnemonic: "ASL", addressingMode: 1, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
 		cpu.aslAcc()
 	}},
-	0x0D: {mnemonic: "ORA", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
+	0x0D: {mnemonic: "ORA", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.ora(operand)
+	}},
 	0x0E: {mnemonic: "ASL", addressingMode: 7, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {
 		cpu.asl(operand)
 	}},
-	0x10: {mnemonic: "BPL", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0x11: {mnemonic: "ORA", addressingMode: 9, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {}},
-	0x15: {mnemonic: "ORA", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
+	0x10: {mnemonic: "BPL", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.branch(!cpu.getFlag(Negative), operand)
+	}},
+	0x11: {mnemonic: "ORA", addressingMode: 12, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+		cpu.ora(operand)
+	}},
+	0x15: {mnemonic: "ORA", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.ora(operand)
+	}},
 	0x16: {mnemonic: "ASL", addressingMode: 4, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
 		cpu.asl(operand)
 	}},
 	0x18: {mnemonic: "CLC", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
 		cpu.clc()
 	}},
-	0x19: {mnemonic: "ORA", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0x1D: {mnemonic: "ORA", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
+	0x19: {mnemonic: "ORA", addressingMode: 9, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.ora(operand)
+	}},
+	0x1D: {mnemonic: "ORA", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.ora(operand)
+	}},
 	0x1E: {mnemonic: "ASL", addressingMode: 8, length: 3, cycles: 7, execute: func(cpu *CPU, operand uint16) {
 		cpu.asl(operand)
 	}},
-	0x20: {mnemonic: "JSR", addressingMode: 7, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {}},
-	0x21: {mnemonic: "AND", addressingMode: 11, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {}},
-	0x24: {mnemonic: "BIT", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {}},
-	0x25: {mnemonic: "AND", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {}},
-	0x26: {mnemonic: "ROL", addressingMode: 3, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {}},
-	0x28: {mnemonic: "PLP", addressingMode: 0, length: 1, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0x29: {mnemonic: "AND", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0x2A: {mnemonic: "ROL", addressingMode: 1, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0x2C: {mnemonic: "BIT", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0x2D: {mnemonic: "AND", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0x2E: {mnemonic: "ROL", addressingMode: 7, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {}},
-	0x30: {mnemonic: "BMI", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0x31: {mnemonic: "AND", addressingMode: 9, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {}},
-	0x35: {mnemonic: "AND", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0x36: {mnemonic: "ROL", addressingMode: 4, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {}},
+	0x20: {mnemonic: "JSR", addressingMode: 7, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.jsr(operand)
+	}},
+	0x21: {mnemonic: "AND", addressingMode: 11, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.and(operand)
+	}},
+	0x24: {mnemonic: "BIT", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.bit(operand)
+	}},
+	0x25: {mnemonic: "AND", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.and(operand)
+	}},
+	0x26: {mnemonic: "ROL", addressingMode: 3, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+		cpu.rol(operand)
+	}},
+	0x28: {mnemonic: "PLP", addressingMode: 0, length: 1, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.plp()
+	}},
+	0x29: {mnemonic: "AND", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.and(operand)
+	}},
+	0x2A: {mnemonic: "ROL", addressingMode: 1, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.rolAcc()
+	}},
+	0x2C: {mnemonic: "BIT", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.bit(operand)
+	}},
+	0x2D: {mnemonic: "AND", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.and(operand)
+	}},
+	0x2E: {mnemonic: "ROL", addressingMode: 7, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.rol(operand)
+	}},
+	0x30: {mnemonic: "BMI", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.branch(cpu.getFlag(Negative), operand)
+	}},
+	0x31: {mnemonic: "AND", addressingMode: 12, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+		cpu.and(operand)
+	}},
+	0x35: {mnemonic: "AND", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.and(operand)
+	}},
+	0x36: {mnemonic: "ROL", addressingMode: 4, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.rol(operand)
+	}},
 	0x38: {mnemonic: "SEC", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
 		cpu.sec()
 	}},
-	0x39: {mnemonic: "AND", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0x3D: {mnemonic: "AND", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0x3E: {mnemonic: "ROL", addressingMode: 8, length: 3, cycles: 7, execute: func(cpu *CPU, operand uint16) {}},
-	0x40: {mnemonic: "RTI", addressingMode: 0, length: 1, cycles: 6, execute: func(cpu *CPU, operand uint16) {}},
-	0x41: {mnemonic: "EOR", addressingMode: 11, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {}},
-	0x45: {mnemonic: "EOR", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {}},
-	0x46: {mnemonic: "LSR", addressingMode: 3, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {}},
-	0x48: {mnemonic: "PHA", addressingMode: 0, length: 1, cycles: 3, execute: func(cpu *CPU, operand uint16) {}},
-	0x49: {mnemonic: "EOR", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0x4A: {mnemonic: "LSR", addressingMode: 1, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
+	0x39: {mnemonic: "AND", addressingMode: 9, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.and(operand)
+	}},
+	0x3D: {mnemonic: "AND", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.and(operand)
+	}},
+	0x3E: {mnemonic: "ROL", addressingMode: 8, length: 3, cycles: 7, execute: func(cpu *CPU, operand uint16) {
+		cpu.rol(operand)
+	}},
+	0x40: {mnemonic: "RTI", addressingMode: 0, length: 1, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.rti()
+	}},
+	0x41: {mnemonic: "EOR", addressingMode: 11, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.eor(operand)
+	}},
+	0x45: {mnemonic: "EOR", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.eor(operand)
+	}},
+	0x46: {mnemonic: "LSR", addressingMode: 3, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+		cpu.lsr(operand)
+	}},
+	0x48: {mnemonic: "PHA", addressingMode: 0, length: 1, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.pha()
+	}},
+	0x49: {mnemonic: "EOR", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.eor(operand)
+	}},
+	0x4A: {mnemonic: "LSR", addressingMode: 1, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.lsrAcc()
+	}},
 	0x4C: {mnemonic: "JMP", addressingMode: 7, length: 3, cycles: 3, execute: func(cpu *CPU, operand uint16) {
 		cpu.jmp(operand)
 	}},
-	0x4D: {mnemonic: "EOR", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0x4E: {mnemonic: "LSR", addressingMode: 7, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {}},
-	0x50: {mnemonic: "BVC", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0x51: {mnemonic: "EOR", addressingMode: 9, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {}},
-	0x55: {mnemonic: "EOR", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0x56: {mnemonic: "LSR", addressingMode: 4, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {}},
+	0x4D: {mnemonic: "EOR", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.eor(operand)
+	}},
+	0x4E: {mnemonic: "LSR", addressingMode: 7, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.lsr(operand)
+	}},
+	0x50: {mnemonic: "BVC", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.branch(!cpu.getFlag(Overflow), operand)
+	}},
+	0x51: {mnemonic: "EOR", addressingMode: 12, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+		cpu.eor(operand)
+	}},
+	0x55: {mnemonic: "EOR", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.eor(operand)
+	}},
+	0x56: {mnemonic: "LSR", addressingMode: 4, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.lsr(operand)
+	}},
 	0x58: {mnemonic: "CLI", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
 		cpu.cli()
 	}},
-	0x59: {mnemonic: "EOR", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0x5D: {mnemonic: "EOR", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0x5E: {mnemonic: "LSR", addressingMode: 8, length: 3, cycles: 7, execute: func(cpu *CPU, operand uint16) {}},
-	0x60: {mnemonic: "RTS", addressingMode: 0, length: 1, cycles: 6, execute: func(cpu *CPU, operand uint16) {}},
+	0x59: {mnemonic: "EOR", addressingMode: 9, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.eor(operand)
+	}},
+	0x5D: {mnemonic: "EOR", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.eor(operand)
+	}},
+	0x5E: {mnemonic: "LSR", addressingMode: 8, length: 3, cycles: 7, execute: func(cpu *CPU, operand uint16) {
+		cpu.lsr(operand)
+	}},
+	0x60: {mnemonic: "RTS", addressingMode: 0, length: 1, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.rts()
+	}},
 	0x61: {mnemonic: "ADC", addressingMode: 11, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
 		cpu.adc(operand)
 	}},
@@ -95,12 +186,14 @@ var instructions = map[uint8]Instruction{
 	0x66: {mnemonic: "ROR", addressingMode: 3, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
 		cpu.ror(operand)
 	}},
-	0x68: {mnemonic: "PLA", addressingMode: 0, length: 1, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
+	0x68: {mnemonic: "PLA", addressingMode: 0, length: 1, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.pla()
+	}},
 	0x69: {mnemonic: "ADC", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
 		cpu.adc(operand)
 	}},
 	0x6A: {mnemonic: "ROR", addressingMode: 1, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
-		cpu.ror(operand)
+		cpu.rorAcc()
 	}},
 	0x6C: {mnemonic: "JMP", addressingMode: 10, length: 3, cycles: 5, execute: func(cpu *CPU, operand uint16) {
 		cpu.jmp(operand)
@@ -111,8 +204,10 @@ var instructions = map[uint8]Instruction{
 	0x6E: {mnemonic: "ROR", addressingMode: 7, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {
 		cpu.ror(operand)
 	}},
-	0x70: {mnemonic: "BVS", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0x71: {mnemonic: "ADC", addressingMode: 9, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+	0x70: {mnemonic: "BVS", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.branch(cpu.getFlag(Overflow), operand)
+	}},
+	0x71: {mnemonic: "ADC", addressingMode: 12, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
 		cpu.adc(operand)
 	}},
 	0x75: {mnemonic: "ADC", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {
@@ -124,7 +219,7 @@ var instructions = map[uint8]Instruction{
 	0x78: {mnemonic: "SEI", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
 		cpu.sei()
 	}},
-	0x79: {mnemonic: "ADC", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+	0x79: {mnemonic: "ADC", addressingMode: 9, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
 		cpu.adc(operand)
 	}},
 	0x7D: {mnemonic: "ADC", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
@@ -136,72 +231,102 @@ var instructions = map[uint8]Instruction{
 	0x81: {mnemonic: "STA", addressingMode: 11, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
 		cpu.sta(operand)
 	}},
-	0x84: {mnemonic: "STY", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {}},
+	0x84: {mnemonic: "STY", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.sty(operand)
+	}},
 	0x85: {mnemonic: "STA", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
 		cpu.sta(operand)
 	}},
 	0x86: {mnemonic: "STX", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
 		cpu.stx(operand)
 	}},
-	0x88: {mnemonic: "DEY", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0x8A: {mnemonic: "TXA", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0x8C: {mnemonic: "STY", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
+	0x88: {mnemonic: "DEY", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.dey()
+	}},
+	0x8A: {mnemonic: "TXA", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.txa()
+	}},
+	0x8C: {mnemonic: "STY", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.sty(operand)
+	}},
 	0x8D: {mnemonic: "STA", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
 		cpu.sta(operand)
 	}},
 	0x8E: {mnemonic: "STX", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
 		cpu.stx(operand)
 	}},
-	0x90: {mnemonic: "BCC", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0x91: {mnemonic: "STA", addressingMode: 9, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+	0x90: {mnemonic: "BCC", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.branch(!cpu.getFlag(Carry), operand)
+	}},
+	0x91: {mnemonic: "STA", addressingMode: 12, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
 		cpu.sta(operand)
 	}},
-	0x94: {mnemonic: "STY", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
+	0x94: {mnemonic: "STY", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.sty(operand)
+	}},
 	0x95: {mnemonic: "STA", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {
 		cpu.sta(operand)
 	}},
 	0x96: {mnemonic: "STX", addressingMode: 5, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {
 		cpu.stx(operand)
 	}},
-	0x98: {mnemonic: "TYA", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0x99: {mnemonic: "STA", addressingMode: 8, length: 3, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+	0x98: {mnemonic: "TYA", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.tya()
+	}},
+	0x99: {mnemonic: "STA", addressingMode: 9, length: 3, cycles: 5, execute: func(cpu *CPU, operand uint16) {
 		cpu.sta(operand)
 	}},
-	0x9A: {mnemonic: "TXS", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
+	0x9A: {mnemonic: "TXS", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.txs()
+	}},
 	0x9D: {mnemonic: "STA", addressingMode: 8, length: 3, cycles: 5, execute: func(cpu *CPU, operand uint16) {
 		cpu.sta(operand)
 	}},
-	0xA0: {mnemonic: "LDY", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
+	0xA0: {mnemonic: "LDY", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.ldy(operand)
+	}},
 	0xA1: {mnemonic: "LDA", addressingMode: 11, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
 		cpu.lda(operand)
 	}},
 	0xA2: {mnemonic: "LDX", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
 		cpu.ldx(operand)
 	}},
-	0xA4: {mnemonic: "LDY", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {}},
+	0xA4: {mnemonic: "LDY", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.ldy(operand)
+	}},
 	0xA5: {mnemonic: "LDA", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
 		cpu.lda(operand)
 	}},
 	0xA6: {mnemonic: "LDX", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
 		cpu.ldx(operand)
 	}},
-	0xA8: {mnemonic: "TAY", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
+	0xA8: {mnemonic: "TAY", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.tay()
+	}},
 	0xA9: {mnemonic: "LDA", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
 		cpu.lda(operand)
 	}},
-	0xAA: {mnemonic: "TAX", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0xAC: {mnemonic: "LDY", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
+	0xAA: {mnemonic: "TAX", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.tax()
+	}},
+	0xAC: {mnemonic: "LDY", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.ldy(operand)
+	}},
 	0xAD: {mnemonic: "LDA", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
 		cpu.lda(operand)
 	}},
 	0xAE: {mnemonic: "LDX", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
 		cpu.ldx(operand)
 	}},
-	0xB0: {mnemonic: "BCS", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0xB1: {mnemonic: "LDA", addressingMode: 9, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+	0xB0: {mnemonic: "BCS", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.branch(cpu.getFlag(Carry), operand)
+	}},
+	0xB1: {mnemonic: "LDA", addressingMode: 12, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
 		cpu.lda(operand)
 	}},
-	0xB4: {mnemonic: "LDY", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
+	0xB4: {mnemonic: "LDY", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.ldy(operand)
+	}},
 	0xB5: {mnemonic: "LDA", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {
 		cpu.lda(operand)
 	}},
@@ -211,65 +336,115 @@ var instructions = map[uint8]Instruction{
 	0xB8: {mnemonic: "CLV", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
 		cpu.clv()
 	}},
-	0xB9: {mnemonic: "LDA", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+	0xB9: {mnemonic: "LDA", addressingMode: 9, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
 		cpu.lda(operand)
 	}},
-	0xBA: {mnemonic: "TSX", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0xBC: {mnemonic: "LDY", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
+	0xBA: {mnemonic: "TSX", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.tsx()
+	}},
+	0xBC: {mnemonic: "LDY", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.ldy(operand)
+	}},
 	0xBD: {mnemonic: "LDA", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
 		cpu.lda(operand)
 	}},
-	0xBE: {mnemonic: "LDX", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+	0xBE: {mnemonic: "LDX", addressingMode: 9, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
 		cpu.ldx(operand)
 	}},
-	0xC0: {mnemonic: "CPY", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0xC1: {mnemonic: "CMP", addressingMode: 11, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {}},
-	0xC4: {mnemonic: "CPY", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {}},
-	0xC5: {mnemonic: "CMP", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {}},
-	0xC6: {mnemonic: "DEC", addressingMode: 3, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {}},
-	0xC8: {mnemonic: "INY", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0xC9: {mnemonic: "CMP", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0xCA: {mnemonic: "DEX", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0xCC: {mnemonic: "CPY", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0xCD: {mnemonic: "CMP", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0xCE: {mnemonic: "DEC", addressingMode: 7, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {}},
-	0xD0: {mnemonic: "BNE", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0xD1: {mnemonic: "CMP", addressingMode: 9, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {}},
-	0xD5: {mnemonic: "CMP", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0xD6: {mnemonic: "DEC", addressingMode: 4, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {}},
+	0xC0: {mnemonic: "CPY", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.cpy(operand)
+	}},
+	0xC1: {mnemonic: "CMP", addressingMode: 11, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.cmp(operand)
+	}},
+	0xC4: {mnemonic: "CPY", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.cpy(operand)
+	}},
+	0xC5: {mnemonic: "CMP", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.cmp(operand)
+	}},
+	0xC6: {mnemonic: "DEC", addressingMode: 3, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+		cpu.dec(operand)
+	}},
+	0xC8: {mnemonic: "INY", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.iny()
+	}},
+	0xC9: {mnemonic: "CMP", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.cmp(operand)
+	}},
+	0xCA: {mnemonic: "DEX", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.dex()
+	}},
+	0xCC: {mnemonic: "CPY", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.cpy(operand)
+	}},
+	0xCD: {mnemonic: "CMP", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.cmp(operand)
+	}},
+	0xCE: {mnemonic: "DEC", addressingMode: 7, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.dec(operand)
+	}},
+	0xD0: {mnemonic: "BNE", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.branch(!cpu.getFlag(Zero), operand)
+	}},
+	0xD1: {mnemonic: "CMP", addressingMode: 12, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+		cpu.cmp(operand)
+	}},
+	0xD5: {mnemonic: "CMP", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.cmp(operand)
+	}},
+	0xD6: {mnemonic: "DEC", addressingMode: 4, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
+		cpu.dec(operand)
+	}},
 	0xD8: {mnemonic: "CLD", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
 		cpu.cld()
 	}},
-	0xD9: {mnemonic: "CMP", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0xDD: {mnemonic: "CMP", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
-	0xDE: {mnemonic: "DEC", addressingMode: 8, length: 3, cycles: 7, execute: func(cpu *CPU, operand uint16) {}},
-	0xE0: {mnemonic: "CPX", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
+	0xD9: {mnemonic: "CMP", addressingMode: 9, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.cmp(operand)
+	}},
+	0xDD: {mnemonic: "CMP", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.cmp(operand)
+	}},
+	0xDE: {mnemonic: "DEC", addressingMode: 8, length: 3, cycles: 7, execute: func(cpu *CPU, operand uint16) {
+		cpu.dec(operand)
+	}},
+	0xE0: {mnemonic: "CPX", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.cpx(operand)
+	}},
 	0xE1: {mnemonic: "SBC", addressingMode: 11, length: 2, cycles: 6, execute: func(cpu *CPU, operand uint16) {
 		cpu.sbc(operand)
 	}},
-	0xE4: {mnemonic: "CPX", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {}},
+	0xE4: {mnemonic: "CPX", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
+		cpu.cpx(operand)
+	}},
 	0xE5: {mnemonic: "SBC", addressingMode: 3, length: 2, cycles: 3, execute: func(cpu *CPU, operand uint16) {
 		cpu.sbc(operand)
 	}},
 	0xE6: {mnemonic: "INC", addressingMode: 3, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
 		cpu.inc(operand)
 	}},
-	0xE8: {mnemonic: "INX", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
+	0xE8: {mnemonic: "INX", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.inx()
+	}},
 	0xE9: {mnemonic: "SBC", addressingMode: 2, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
 		cpu.sbc(operand)
 	}},
 	0xEA: {mnemonic: "NOP", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
 		cpu.nop()
 	}},
-	0xEC: {mnemonic: "CPX", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {}},
+	0xEC: {mnemonic: "CPX", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+		cpu.cpx(operand)
+	}},
 	0xED: {mnemonic: "SBC", addressingMode: 7, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
 		cpu.sbc(operand)
 	}},
 	0xEE: {mnemonic: "INC", addressingMode: 7, length: 3, cycles: 6, execute: func(cpu *CPU, operand uint16) {
 		cpu.inc(operand)
 	}},
-	0xF0: {mnemonic: "BEQ", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {}},
-	0xF1: {mnemonic: "SBC", addressingMode: 9, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
+	0xF0: {mnemonic: "BEQ", addressingMode: 6, length: 2, cycles: 2, execute: func(cpu *CPU, operand uint16) {
+		cpu.branch(cpu.getFlag(Zero), operand)
+	}},
+	0xF1: {mnemonic: "SBC", addressingMode: 12, length: 2, cycles: 5, execute: func(cpu *CPU, operand uint16) {
 		cpu.sbc(operand)
 	}},
 	0xF5: {mnemonic: "SBC", addressingMode: 4, length: 2, cycles: 4, execute: func(cpu *CPU, operand uint16) {
@@ -281,7 +456,7 @@ var instructions = map[uint8]Instruction{
 	0xF8: {mnemonic: "SED", addressingMode: 0, length: 1, cycles: 2, execute: func(cpu *CPU, operand uint16) {
 		cpu.sed()
 	}},
-	0xF9: {mnemonic: "SBC", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
+	0xF9: {mnemonic: "SBC", addressingMode: 9, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
 		cpu.sbc(operand)
 	}},
 	0xFD: {mnemonic: "SBC", addressingMode: 8, length: 3, cycles: 4, execute: func(cpu *CPU, operand uint16) {
@@ -292,55 +467,71 @@ var instructions = map[uint8]Instruction{
 	}},
 }
 
+func init() {
+	markPageCrossCycles(instructions)
+}
+
+// markPageCrossCycles marks the instructions that take an extra cycle when
+// indexing crosses a page: those that only read their operand. Stores and
+// read-modify-write instructions always take the time to fix up the address.
+func markPageCrossCycles(set map[uint8]Instruction) {
+	for opcode, inst := range set {
+		switch inst.addressingMode {
+		case 8, 9, 12:
+		default:
+			continue
+		}
+		switch inst.mnemonic {
+		case "STA", "STX", "STY", "STZ", "ASL", "LSR", "ROL", "ROR", "INC", "DEC":
+			continue
+		}
+		inst.pageCrossCycle = true
+		set[opcode] = inst
+	}
+}
+
 func (cpu *CPU) adc(address uint16) {
 	// Fetch the data from the address
 	data := cpu.MMU.readByte(address)
-	// Add the data to the accumulator
-	result := uint16(cpu.A) + uint16(data)
-	// Add one to the result if the carry flag is set
-	if cpu.getFlag(Carry) {
-		// Add one to the result
-		result++
-	}
-
-	// Set the zero flag to opposite of (result & 0xFF)
-	cpu.setFlag(Zero, result&0xFF == 0)
-
+	carry := uint16(boolToInt(cpu.getFlag(Carry)))
+	// Add the data and the carry to the accumulator
+	result := uint16(cpu.A) + uint16(data) + carry
 	// Check if decimal mode is enabled
 	if cpu.getFlag(Decimal) {
-		// Do BCD addition
-		// C# version: if (((registers.A & 0xF) + (value & 0xF) + (GetFlag(StatusFlags.Carry) ? 1 : 0)) > 9)
-		if ((cpu.A & 0xF) + (data & 0xF) + boolToInt(cpu.getFlag(Carry))) > 9 {
-			// Add 6 to the result
-			result += 6
+		// Add the low digits, carrying into the high digit if they pass 9
+		low := uint16(cpu.A&0x0F) + uint16(data&0x0F) + carry
+		if low >= 0x0A {
+			low = ((low + 0x06) & 0x0F) + 0x10
 		}
-
-		// Set the negative flag if the result is negative
-		if result&0x80 == 0x80 {
-			// Set the negative flag
-			cpu.setFlag(Negative, true)
+		// Add the high digits. The NMOS 6502 takes the negative and overflow
+		// flags from this, before it is adjusted, and the zero flag from the
+		// binary sum
+		sum := uint16(cpu.A&0xF0) + uint16(data&0xF0) + low
+		signed := int(int8(cpu.A&0xF0)) + int(int8(data&0xF0)) + int(low)
+		cpu.setFlag(Negative, sum&0x80 != 0)
+		cpu.setFlag(Overflow, signed < -128 || signed > 127)
+		cpu.setFlag(Zero, result&0xFF == 0)
+		// Adjust the high digit if it went past 9
+		if sum >= 0xA0 {
+			sum += 0x60
 		}
-		// Set the overflow flag if needed
-		cpu.setFlag(Overflow, ^uint16(cpu.A)^uint16(data)&0x80 != 0 && ^uint16(cpu.A)^result&0x80 != 0)
-
-		// If the result is greater than 0x99, we need to add 96 to it
-		if result > 0x99 {
-			// Add 96 to the result
-			result += 96
+		cpu.setFlag(Carry, sum >= 0x100)
+		cpu.A = uint8(sum)
+		// The 65C02 sets the negative and zero flags from the result, which
+		// takes an extra cycle
+		if cpu.variant == CMOS65C02 {
+			cpu.setZNFlags()
+			cpu.cycles++
 		}
-
-		// Set the carry flag if the result is greater than 0x99
-		cpu.setFlag(Carry, result > 0x99)
-	} else {
-		// Set the negative flag to opposite of (result & 0x80)
-		cpu.setFlag(Negative, result&0x80 == 0x80)
-		// Set overflow flag to opposite of ((registers.A ^ result) & (value ^ result) & 0x80)
-		cpu.setFlag(Overflow, ^uint16(cpu.A)^result&^uint16(data)^result&0x80 != 0)
-		// Set carry flag to opposite of (result > 0xFF)
-		cpu.setFlag(Carry, result > 0xFF)
+		return
 	}
+	// Overflow is set if both inputs have the same sign and the result does not
+	cpu.setFlag(Overflow, (uint16(cpu.A)^result)&(uint16(data)^result)&0x80 != 0)
+	// Set the carry flag if the result does not fit in a byte
+	cpu.setFlag(Carry, result > 0xFF)
 	// Set the accumulator to the result
-	cpu.A = uint8(result & 0xFF)
+	cpu.A = uint8(result)
+	cpu.setZNFlags()
 }
 
 func (cpu *CPU) aslAcc() {
@@ -382,6 +573,10 @@ func (cpu *CPU) brk() {
 	cpu.setFlag(Break, true)
 	// Set the Interrupt flag
 	cpu.setFlag(Interrupt, true)
+	// The 65C02 also leaves decimal mode
+	if cpu.variant == CMOS65C02 {
+		cpu.setFlag(Decimal, false)
+	}
 	// Set the program counter to the address stored at 0xFFFE
 	cpu.PC = cpu.MMU.readWord(0xFFFE)
 }
@@ -428,6 +623,13 @@ func (cpu *CPU) jmp(address uint16) {
 	cpu.PC = address
 }
 
+func (cpu *CPU) jsr(address uint16) {
+	// Push the address of the last byte of the JSR, which RTS adds one to
+	cpu.pushPCMinusOne()
+	// Set the program counter to the subroutine
+	cpu.PC = address
+}
+
 func (cpu *CPU) lda(address uint16) {
 	// Fetch the data from the address
 	data := cpu.MMU.readByte(address)
@@ -465,71 +667,86 @@ func (cpu *CPU) ldx(address uint16) {
 	}
 }
 
-func ror_wrapped(cpu *CPU, value uint8) uint8 {
-	// Rotate the value right
-	result := (value >> 1) | (value << 7)
-	// Set the carry flag to the value of the least significant bit
-	cpu.setFlag(Carry, value&0x01 == 0x01)
-	// Set the zero flag if the result is zero
-	cpu.setFlag(Zero, result == 0)
-	// Set the negative flag if the result is negative
-	cpu.setFlag(Negative, result&0x80 == 0x80)
-	// Return the result
-	return result
+func (cpu *CPU) rorAcc() {
+	// Rotate the accumulator right through the carry
+	cpu.A = cpu.rotateRight(cpu.A)
 }
 
 func (cpu *CPU) ror(address uint16) {
-	// Check if the address is zero, which means we are rotating the accumulator
-	if address == 0 {
-		// Rotate the accumulator right
-		cpu.A = ror_wrapped(cpu, cpu.A)
-	} else {
-		// Fetch the data from the address
-		data := cpu.MMU.readByte(address)
-		// Rotate the data right
-		result := ror_wrapped(cpu, data)
-		// Write the result back to the address
-		cpu.MMU.writeByte(address, result)
+	// Fetch the data from the address
+	data := cpu.MMU.readByte(address)
+	// Rotate the data right through the carry and write it back
+	cpu.MMU.writeByte(address, cpu.rotateRight(data))
+}
+
+// rotateRight rotates a value right through the carry flag, setting the flags
+func (cpu *CPU) rotateRight(value uint8) uint8 {
+	// The carry goes into bit 7
+	result := value >> 1
+	if cpu.getFlag(Carry) {
+		result |= 0x80
 	}
+	// Bit 0 goes into the carry
+	cpu.setFlag(Carry, value&0x01 != 0)
+	cpu.setFlag(Zero, result == 0)
+	cpu.setFlag(Negative, result&0x80 != 0)
+	return result
+}
+
+func (cpu *CPU) rti() {
+	// Pull the status register, ignoring the break and unused bits
+	cpu.P = cpu.popByte() &^ (Break | Unused)
+	// Pull the program counter
+	cpu.PC = cpu.popWord()
+}
+
+func (cpu *CPU) rts() {
+	// Pop the return address and add one
+	cpu.PC = cpu.popWord() + 1
 }
 
 func (cpu *CPU) sbc(address uint16) {
 	// Fetch the data from the address
 	value := cpu.MMU.readByte(address)
-	var result int16
-	// Check if the decimal flag is set
-	if cpu.getFlag(Decimal) {
-		// Convert the accumulator and the value to BCD format
-		a := (cpu.A/10)*16 + (cpu.A % 10)
-		b := (value/10)*16 + (value % 10)
-		// Perform the subtraction, taking into account the carry flag
-		if cpu.getFlag(Carry) {
-			result = int16(a) - int16(b) - 1
-		} else {
-			result = int16(a) - int16(b)
-		}
-		// If the result is negative, subtract 96 (6 * 16)
+	// The carry is clear when there is a borrow
+	borrow := 1 - boolToInt(cpu.getFlag(Carry))
+	// Subtract in binary. The NMOS 6502 sets all the flags from this, even in
+	// decimal mode
+	result := int(cpu.A) - int(value) - int(borrow)
+	cpu.setFlag(Carry, result >= 0)
+	cpu.setFlag(Overflow, (cpu.A^value)&(cpu.A^uint8(result))&0x80 != 0)
+	cpu.setFlag(Zero, uint8(result) == 0)
+	cpu.setFlag(Negative, uint8(result)&0x80 != 0)
+	// Check if decimal mode is enabled
+	if !cpu.getFlag(Decimal) {
+		cpu.A = uint8(result)
+		return
+	}
+	// Subtract the low digits, borrowing from the high digit if they go below 0
+	low := int(cpu.A&0x0F) - int(value&0x0F) - int(borrow)
+	if cpu.variant == CMOS65C02 {
+		// The 65C02 adjusts the binary result, and sets the negative and zero
+		// flags from it, which takes an extra cycle
 		if result < 0 {
-			result -= 96
+			result -= 0x60
 		}
-	} else {
-		// Perform the subtraction in binary format, taking into account the carry flag
-		if cpu.getFlag(Carry) {
-			result = int16(cpu.A) - int16(value) - 1
-		} else {
-			result = int16(cpu.A) - int16(value)
+		if low < 0 {
+			result -= 0x06
 		}
-		// Set the overflow flag if the result is out of range
-		cpu.setFlag(Overflow, (cpu.A^value)&0x80 == 0x80 && (cpu.A^uint8(result))&0x80 == 0x80)
+		cpu.A = uint8(result)
+		cpu.setZNFlags()
+		cpu.cycles++
+		return
 	}
-	// Set the carry flag if the result is positive
-	cpu.setFlag(Carry, result >= 0)
-	// Set the zero flag if the result is zero
-	cpu.setFlag(Zero, (result&0xFF) == 0)
-	// Set the negative flag if the result is negative
-	cpu.setFlag(Negative, result < 0)
-	// Store the result in the accumulator
-	cpu.A = uint8(result & 0xFF)
+	if low < 0 {
+		low = ((low - 0x06) & 0x0F) - 0x10
+	}
+	// Subtract the high digits, adjusting if they go below 0
+	result = int(cpu.A&0xF0) - int(value&0xF0) + low
+	if result < 0 {
+		result -= 0x60
+	}
+	cpu.A = uint8(result)
 }
 
 func (cpu *CPU) sec() {
@@ -556,3 +773,216 @@ func (cpu *CPU) stx(address uint16) {
 	// Write the X register to the address
 	cpu.MMU.writeByte(address, cpu.X)
 }
+
+func (cpu *CPU) sty(address uint16) {
+	// Write the Y register to the address
+	cpu.MMU.writeByte(address, cpu.Y)
+}
+
+func (cpu *CPU) and(address uint16) {
+	// AND the data with the accumulator
+	cpu.A &= cpu.MMU.readByte(address)
+	cpu.setZNFlags()
+}
+
+func (cpu *CPU) ora(address uint16) {
+	// OR the data with the accumulator
+	cpu.A |= cpu.MMU.readByte(address)
+	cpu.setZNFlags()
+}
+
+func (cpu *CPU) eor(address uint16) {
+	// Exclusive OR the data with the accumulator
+	cpu.A ^= cpu.MMU.readByte(address)
+	cpu.setZNFlags()
+}
+
+func (cpu *CPU) bit(address uint16) {
+	// Fetch the data from the address
+	data := cpu.MMU.readByte(address)
+	// The zero flag shows whether any of the bits in the accumulator are set
+	cpu.setFlag(Zero, cpu.A&data == 0)
+	// Bits 7 and 6 of the data go into the negative and overflow flags
+	cpu.setFlag(Negative, data&0x80 != 0)
+	cpu.setFlag(Overflow, data&0x40 != 0)
+}
+
+// compare sets the flags from subtracting the data at an address from a
+// register, without changing it
+func (cpu *CPU) compare(register uint8, address uint16) {
+	data := cpu.MMU.readByte(address)
+	result := register - data
+	cpu.setFlag(Carry, register >= data)
+	cpu.setFlag(Zero, result == 0)
+	cpu.setFlag(Negative, result&0x80 != 0)
+}
+
+func (cpu *CPU) cmp(address uint16) {
+	// Compare the accumulator with the data
+	cpu.compare(cpu.A, address)
+}
+
+func (cpu *CPU) cpx(address uint16) {
+	// Compare the X register with the data
+	cpu.compare(cpu.X, address)
+}
+
+func (cpu *CPU) cpy(address uint16) {
+	// Compare the Y register with the data
+	cpu.compare(cpu.Y, address)
+}
+
+// setZN sets the zero and negative flags from a value
+func (cpu *CPU) setZN(value uint8) {
+	cpu.setFlag(Zero, value == 0)
+	cpu.setFlag(Negative, value&0x80 != 0)
+}
+
+func (cpu *CPU) dec(address uint16) {
+	// Decrement the data at the address
+	result := cpu.MMU.readByte(address) - 1
+	cpu.setZN(result)
+	// Write the result back to the address
+	cpu.MMU.writeByte(address, result)
+}
+
+func (cpu *CPU) dex() {
+	// Decrement the X register
+	cpu.X--
+	cpu.setZN(cpu.X)
+}
+
+func (cpu *CPU) dey() {
+	// Decrement the Y register
+	cpu.Y--
+	cpu.setZN(cpu.Y)
+}
+
+func (cpu *CPU) inx() {
+	// Increment the X register
+	cpu.X++
+	cpu.setZN(cpu.X)
+}
+
+func (cpu *CPU) iny() {
+	// Increment the Y register
+	cpu.Y++
+	cpu.setZN(cpu.Y)
+}
+
+func (cpu *CPU) ldy(address uint16) {
+	// Load the Y register with the data
+	cpu.Y = cpu.MMU.readByte(address)
+	cpu.setZN(cpu.Y)
+}
+
+func (cpu *CPU) lsrAcc() {
+	// Shift the accumulator right
+	cpu.A = cpu.shiftRight(cpu.A)
+}
+
+func (cpu *CPU) lsr(address uint16) {
+	// Fetch the data from the address
+	data := cpu.MMU.readByte(address)
+	// Shift the data right and write it back
+	cpu.MMU.writeByte(address, cpu.shiftRight(data))
+}
+
+// shiftRight shifts a value right, with bit 0 going into the carry flag
+func (cpu *CPU) shiftRight(value uint8) uint8 {
+	result := value >> 1
+	cpu.setFlag(Carry, value&0x01 != 0)
+	cpu.setZN(result)
+	return result
+}
+
+func (cpu *CPU) rolAcc() {
+	// Rotate the accumulator left through the carry
+	cpu.A = cpu.rotateLeft(cpu.A)
+}
+
+func (cpu *CPU) rol(address uint16) {
+	// Fetch the data from the address
+	data := cpu.MMU.readByte(address)
+	// Rotate the data left through the carry and write it back
+	cpu.MMU.writeByte(address, cpu.rotateLeft(data))
+}
+
+// rotateLeft rotates a value left through the carry flag, setting the flags
+func (cpu *CPU) rotateLeft(value uint8) uint8 {
+	// The carry goes into bit 0
+	result := value<<1 | boolToInt(cpu.getFlag(Carry))
+	// Bit 7 goes into the carry
+	cpu.setFlag(Carry, value&0x80 != 0)
+	cpu.setZN(result)
+	return result
+}
+
+func (cpu *CPU) pha() {
+	// Push the accumulator
+	cpu.pushByte(cpu.A)
+}
+
+func (cpu *CPU) pla() {
+	// Pull the accumulator
+	cpu.A = cpu.popByte()
+	cpu.setZNFlags()
+}
+
+func (cpu *CPU) php() {
+	// Push the status with the break and unused bits set
+	cpu.pushByte(cpu.getStatus())
+}
+
+func (cpu *CPU) plp() {
+	// Pull the status register, ignoring the break and unused bits
+	cpu.P = cpu.popByte() &^ (Break | Unused)
+}
+
+func (cpu *CPU) tax() {
+	// Copy the accumulator to the X register
+	cpu.X = cpu.A
+	cpu.setZN(cpu.X)
+}
+
+func (cpu *CPU) tay() {
+	// Copy the accumulator to the Y register
+	cpu.Y = cpu.A
+	cpu.setZN(cpu.Y)
+}
+
+func (cpu *CPU) tsx() {
+	// Copy the stack pointer to the X register
+	cpu.X = cpu.SP
+	cpu.setZN(cpu.X)
+}
+
+func (cpu *CPU) txa() {
+	// Copy the X register to the accumulator
+	cpu.A = cpu.X
+	cpu.setZNFlags()
+}
+
+func (cpu *CPU) txs() {
+	// Copy the X register to the stack pointer, which sets no flags
+	cpu.SP = cpu.X
+}
+
+func (cpu *CPU) tya() {
+	// Copy the Y register to the accumulator
+	cpu.A = cpu.Y
+	cpu.setZNFlags()
+}
+
+// branch jumps to the target if the condition holds. A branch that is taken
+// takes an extra cycle, and another if it goes to a different page.
+func (cpu *CPU) branch(condition bool, target uint16) {
+	if !condition {
+		return
+	}
+	cpu.cycles++
+	if target&0xFF00 != cpu.PC&0xFF00 {
+		cpu.cycles++
+	}
+	cpu.PC = target
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//go:generate go run . asm -o testdata/klaus/6502_decimal_test.bin testdata/klaus/6502_decimal_test.asm
+//go:generate go run . asm -o testdata/klaus/65C02_decimal_test.bin testdata/klaus/65C02_decimal_test.asm
+//go:generate curl -sSfLo testdata/klaus/6502_functional_test.bin https://raw.githubusercontent.com/Klaus2m5/6502_65C02_functional_tests/master/bin_files/6502_functional_test.bin
+//go:generate curl -sSfLo testdata/klaus/65C02_extended_opcodes_test.bin https://raw.githubusercontent.com/Klaus2m5/6502_65C02_functional_tests/master/bin_files/65C02_extended_opcodes_test.bin
+
+// klausTest is one of Klaus Dormann's 6502 test programs, which are kept in
+// testdata/klaus; see testdata/klaus/README.md for where they come from.
+type klausTest struct {
+	name    string
+	file    string
+	variant Variant
+	load    uint16 // where the binary is loaded
+	start   uint16 // where execution starts
+	success uint16 // the branch to self reached when every test passes, or 0
+	// errorByte is a zero page byte that is zero when the tests pass, for the
+	// decimal test, which ends in the same place either way
+	errorByte    uint16
+	hasErrorByte bool
+}
+
+var klausTests = []klausTest{
+	{name: "functional", file: "6502_functional_test.bin", variant: NMOS6502, load: 0x0000, start: 0x0400, success: 0x3469},
+	{name: "decimal", file: "6502_decimal_test.bin", variant: NMOS6502, load: 0x0200, start: 0x0200, errorByte: 0x000B, hasErrorByte: true},
+	{name: "65C02 extended opcodes", file: "65C02_extended_opcodes_test.bin", variant: CMOS65C02, load: 0x0000, start: 0x0400, success: 0x24F1},
+	{name: "65C02 decimal", file: "65C02_decimal_test.bin", variant: CMOS65C02, load: 0x0200, start: 0x0200, errorByte: 0x000B, hasErrorByte: true},
+}
+
+// klausStepBudget is far more instructions than any of the tests needs, so a
+// program that runs away fails rather than hanging
+const klausStepBudget = 200_000_000
+
+// klausTestCase is where the functional tests keep the number of the test
+// being run
+const klausTestCase = 0x0200
+
+func TestKlausDormann(t *testing.T) {
+	for _, test := range klausTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "klaus", test.file))
+			if os.IsNotExist(err) {
+				t.Fatalf("testdata/klaus/%s is missing, run go generate; see testdata/klaus/README.md", test.file)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if testing.Short() {
+				t.Skip("skipping in short mode")
+			}
+			cpu := &CPU{MMU: &MMU{}, variant: test.variant}
+			if err := cpu.MMU.loadProgram(data, test.load); err != nil {
+				t.Fatal(err)
+			}
+			cpu.reset()
+			cpu.PC = test.start
+			trap, recent := runUntilTrap(cpu, klausStepBudget)
+			if test.hasErrorByte {
+				if value := cpu.MMU.peekByte(test.errorByte); value != 0 {
+					t.Fatalf("ended at $%04X with $%02X in the error byte at $%04X\n%s", trap, value, test.errorByte, describeTrap(cpu, trap, recent))
+				}
+				return
+			}
+			if trap != test.success {
+				t.Fatalf("trapped at $%04X instead of $%04X in test case $%02X\n%s",
+					trap, test.success, cpu.MMU.peekByte(klausTestCase), describeTrap(cpu, trap, recent))
+			}
+		})
+	}
+}
+
+// runUntilTrap runs until an instruction branches or jumps to itself, the CPU
+// stops, or the step budget runs out. It returns the address of the last
+// instruction and the addresses of the ones before it, oldest first.
+func runUntilTrap(cpu *CPU, budget int) (uint16, []uint16) {
+	const keep = 16
+	recent := make([]uint16, 0, keep)
+	for i := 0; i < budget; i++ {
+		pc := cpu.PC
+		if len(recent) == keep {
+			recent = append(recent[:0], recent[1:]...)
+		}
+		recent = append(recent, pc)
+		cpu.step()
+		if cpu.PC == pc || !cpu.running {
+			return pc, recent[:len(recent)-1]
+		}
+	}
+	return cpu.PC, recent
+}
+
+// describeTrap explains where a test stopped: the instructions leading up to
+// the trap, which usually show the comparison that failed, and the registers
+func describeTrap(cpu *CPU, trap uint16, recent []uint16) string {
+	var b strings.Builder
+	b.WriteString("Last instructions:\n")
+	for _, address := range append(recent, trap) {
+		d := cpu.decode(address)
+		fmt.Fprintf(&b, "  %04X  %-9s %s\n", address, hexBytes(d.bytes), d.text(hexAddress))
+	}
+	fmt.Fprintf(&b, "A=$%02X X=$%02X Y=$%02X P=$%02X (%s) SP=$%02X cycles=%d",
+		cpu.A, cpu.X, cpu.Y, cpu.P|Unused, flagString(cpu.P|Unused), cpu.SP, cpu.cycles)
+	return b.String()
+}
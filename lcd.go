@@ -0,0 +1,470 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The control lines of an LCD on port A of a VIA, as on the breadboard
+// computer, with the data lines on port B
+const (
+	lcdE  uint8 = 0x80 // enable: transfers happen on its falling edge
+	lcdRW uint8 = 0x40 // high to read, low to write
+	lcdRS uint8 = 0x20 // high for data, low for instructions
+)
+
+// How long the LCD is busy after an instruction, in microseconds
+const (
+	lcdClearTime = 1520 // clear and home
+	lcdShortTime = 37   // everything else
+)
+
+// lcdLineLength is the number of characters of DDRAM a line has when the
+// display has two lines. With one, it has twice as many.
+const lcdLineLength = 40
+
+// LCD is an HD44780 character LCD controller with its display, watching the
+// pins of a VIA. It has the 80 characters of display data RAM, the 64 bytes
+// of character generator RAM for eight characters of the program's own, an
+// address counter that moves as they are read and written, a display that
+// can be shifted, and a cursor. It talks over 8 data lines or, after a
+// function set says so, over the top 4 a nibble at a time.
+//
+// Instructions and data are only taken when the LCD is not busy with the last
+// one, as on the real thing, so programs have to wait, by reading the busy
+// flag or for long enough. The display is rendered to out whenever what it
+// shows changes.
+type LCD struct {
+	label         string
+	columns, rows int
+	out           io.Writer
+	// ansi shows the cursor with terminal escape codes
+	ansi bool
+	// now returns the cycle count, and clockSpeed how many cycles make a
+	// second, for how long the LCD is busy
+	now        func() int
+	clockSpeed int64
+	// drive drives the data lines when the LCD is read, or releases them
+	// with $FF
+	drive func(value uint8)
+
+	ddram [0x80]uint8 // by DDRAM address
+	cgram [64]uint8
+	ac    uint8 // the address counter
+	// cgMode is set when the address counter addresses CGRAM
+	cgMode                       bool
+	increment, shiftOnEntry      bool
+	displayOn, cursorOn, blinkOn bool
+	shift                        int // how far the display is shifted left
+	eightBit, twoLines           bool
+	// lowNibble is set in 4-bit mode when the next transfer is the low half
+	lowNibble bool
+	high      uint8 // the high half of the byte being written
+	busyUntil int
+
+	e, driving bool
+	lastFrame  string
+}
+
+// newLCD creates an LCD with a display of columns by rows characters, as it
+// comes out of power on reset: 8 bits, one line, display off, incrementing
+func newLCD(label string, columns, rows int, out io.Writer) *LCD {
+	l := &LCD{label: label, columns: columns, rows: rows, out: out, eightBit: true, increment: true}
+	for i := range l.ddram {
+		l.ddram[i] = ' '
+	}
+	l.lastFrame = l.frame()
+	return l
+}
+
+// connect watches the pins of a VIA, and drives its port B when read
+func (l *LCD) connect(cpu *CPU, via *VIA) {
+	l.now = func() int { return cpu.cycles }
+	l.clockSpeed = cpu.clockSpeed
+	l.drive = via.setPortB
+	via.watch(func() { l.update(via.portA(), via.portB()) })
+}
+
+func (l *LCD) name() string { return l.label }
+
+// update follows the pins: reads drive the data lines while E is high, and
+// transfers finish when it falls
+func (l *LCD) update(control, data uint8) {
+	e := control&lcdE != 0
+	if e == l.e {
+		return
+	}
+	l.e = e
+	rs := control&lcdRS != 0
+	if control&lcdRW == 0 {
+		if !e {
+			l.transfer(rs, data)
+		}
+		return
+	}
+	if e {
+		l.driving = true
+		l.driveData(l.readValue(rs))
+	} else if l.driving {
+		l.driving = false
+		l.driveData(0xFF)
+		if l.nextTransfer() && rs {
+			// Reading data moves the address counter
+			l.move(l.increment)
+		}
+	}
+}
+
+// driveData drives the data lines, if the LCD is connected to them
+func (l *LCD) driveData(value uint8) {
+	if l.drive != nil {
+		l.drive(value)
+	}
+}
+
+// nextTransfer moves on to the next transfer in 4-bit mode, returning
+// whether a whole byte has gone
+func (l *LCD) nextTransfer() bool {
+	if l.eightBit {
+		return true
+	}
+	l.lowNibble = !l.lowNibble
+	return !l.lowNibble
+}
+
+// readValue returns what a read puts on the data lines: the busy flag and
+// address counter, or data. In 4-bit mode each half goes on D7-D4 in turn.
+func (l *LCD) readValue(rs bool) uint8 {
+	value := l.ac & 0x7F
+	if rs {
+		value = l.readRAM()
+	} else if l.busy() {
+		value |= 0x80
+	}
+	if !l.eightBit {
+		if l.lowNibble {
+			value <<= 4
+		}
+		value |= 0x0F
+	}
+	return value
+}
+
+// transfer takes a write from the data lines
+func (l *LCD) transfer(rs bool, data uint8) {
+	if !l.eightBit {
+		if !l.lowNibble {
+			l.high = data & 0xF0
+			l.lowNibble = true
+			return
+		}
+		l.lowNibble = false
+		data = l.high | data>>4
+	}
+	// Writes while the LCD is busy are lost
+	if l.busy() {
+		return
+	}
+	if rs {
+		l.writeData(data)
+	} else {
+		l.instruction(data)
+	}
+	l.render()
+}
+
+// busy returns whether the LCD is still busy with the last instruction
+func (l *LCD) busy() bool {
+	return l.now != nil && l.now() < l.busyUntil
+}
+
+// wait makes the LCD busy for a number of microseconds
+func (l *LCD) wait(microseconds int64) {
+	if l.now != nil {
+		l.busyUntil = l.now() + int(l.clockSpeed*microseconds/1000000)
+	}
+}
+
+// instruction carries out an instruction
+func (l *LCD) instruction(value uint8) {
+	l.wait(lcdShortTime)
+	switch {
+	case value&0x80 != 0:
+		// Set the DDRAM address
+		l.cgMode = false
+		l.ac = value & 0x7F
+	case value&0x40 != 0:
+		// Set the CGRAM address
+		l.cgMode = true
+		l.ac = value & 0x3F
+	case value&0x20 != 0:
+		// Function set: 8 or 4 bits, and one or two lines. The font is
+		// always 5x8 here.
+		l.eightBit = value&0x10 != 0
+		l.twoLines = value&0x08 != 0
+		l.lowNibble = false
+	case value&0x10 != 0:
+		// Move the cursor, or shift the display, left or right
+		right := value&0x04 != 0
+		if value&0x08 != 0 {
+			l.shiftDisplay(right)
+		} else {
+			l.move(right)
+		}
+	case value&0x08 != 0:
+		l.displayOn = value&0x04 != 0
+		l.cursorOn = value&0x02 != 0
+		l.blinkOn = value&0x01 != 0
+	case value&0x04 != 0:
+		l.increment = value&0x02 != 0
+		l.shiftOnEntry = value&0x01 != 0
+	case value&0x02 != 0:
+		// Home
+		l.wait(lcdClearTime)
+		l.cgMode = false
+		l.ac = 0
+		l.shift = 0
+	case value&0x01 != 0:
+		// Clear
+		l.wait(lcdClearTime)
+		for i := range l.ddram {
+			l.ddram[i] = ' '
+		}
+		l.cgMode = false
+		l.ac = 0
+		l.shift = 0
+		l.increment = true
+	}
+}
+
+// writeData writes to the RAM the address counter addresses, and moves it
+func (l *LCD) writeData(value uint8) {
+	l.wait(lcdShortTime)
+	if l.cgMode {
+		l.cgram[l.ac&0x3F] = value
+	} else {
+		l.ddram[l.ac&0x7F] = value
+		if l.shiftOnEntry {
+			l.shiftDisplay(!l.increment)
+		}
+	}
+	l.move(l.increment)
+}
+
+// readRAM reads the RAM the address counter addresses
+func (l *LCD) readRAM() uint8 {
+	if l.cgMode {
+		return l.cgram[l.ac&0x3F]
+	}
+	return l.ddram[l.ac&0x7F]
+}
+
+// move moves the address counter up or down. With two lines, DDRAM addresses
+// run from $00 to $27 and on from $40 to $67; with one, from $00 to $4F.
+func (l *LCD) move(up bool) {
+	switch {
+	case l.cgMode:
+		if up {
+			l.ac = (l.ac + 1) & 0x3F
+		} else {
+			l.ac = (l.ac - 1) & 0x3F
+		}
+	case l.twoLines:
+		line, column := l.ac&0x40, int(l.ac&0x3F)
+		if up {
+			column++
+		} else {
+			column--
+		}
+		if column >= lcdLineLength {
+			line, column = line^0x40, 0
+		} else if column < 0 {
+			line, column = line^0x40, lcdLineLength-1
+		}
+		l.ac = line | uint8(column)
+	default:
+		if up {
+			l.ac = uint8((int(l.ac) + 1) % (2 * lcdLineLength))
+		} else {
+			l.ac = uint8((int(l.ac) + 2*lcdLineLength - 1) % (2 * lcdLineLength))
+		}
+	}
+}
+
+// lineLength returns the number of characters in a line of DDRAM
+func (l *LCD) lineLength() int {
+	if l.twoLines {
+		return lcdLineLength
+	}
+	return 2 * lcdLineLength
+}
+
+// shiftDisplay shifts what the display shows left or right
+func (l *LCD) shiftDisplay(right bool) {
+	if right {
+		l.shift--
+	} else {
+		l.shift++
+	}
+	l.shift = (l.shift + l.lineLength()) % l.lineLength()
+}
+
+// address returns the DDRAM address a position on the display shows. With
+// two lines, rows past the second carry on along the lines, as on 20x4
+// displays. It returns false for rows with nothing on them.
+func (l *LCD) address(row, column int) (uint8, bool) {
+	line, offset := row%2, row/2*l.columns
+	if !l.twoLines && line == 1 {
+		return 0, false
+	}
+	return uint8(line*0x40 + (offset+column+l.shift)%l.lineLength()), true
+}
+
+// cell returns the character a position on the display shows, and whether
+// the cursor is on it
+func (l *LCD) cell(row, column int) (string, bool) {
+	address, ok := l.address(row, column)
+	if !l.displayOn || !ok {
+		return " ", false
+	}
+	return lcdCharacter(l.ddram[address]), !l.cgMode && address == l.ac
+}
+
+// lines returns what the display shows, a string for each row
+func (l *LCD) lines() []string {
+	lines := make([]string, l.rows)
+	for row := range lines {
+		for column := 0; column < l.columns; column++ {
+			c, _ := l.cell(row, column)
+			lines[row] += c
+		}
+	}
+	return lines
+}
+
+// frame returns the display in a box, with the cursor shown if ansi is set
+func (l *LCD) frame() string {
+	border := "+" + strings.Repeat("-", l.columns) + "+\n"
+	var b strings.Builder
+	b.WriteString(border)
+	for row := 0; row < l.rows; row++ {
+		b.WriteString("|")
+		for column := 0; column < l.columns; column++ {
+			c, cursor := l.cell(row, column)
+			switch {
+			case !l.ansi || !cursor:
+			case l.blinkOn:
+				c = "\x1b[7m" + c + "\x1b[27m"
+			case l.cursorOn:
+				c = "\x1b[4m" + c + "\x1b[24m"
+			}
+			b.WriteString(c)
+		}
+		b.WriteString("|\n")
+	}
+	b.WriteString(border)
+	return b.String()
+}
+
+// render writes the display out when what it shows has changed
+func (l *LCD) render() {
+	frame := l.frame()
+	if frame == l.lastFrame {
+		return
+	}
+	l.lastFrame = frame
+	if l.out != nil {
+		fmt.Fprintf(l.out, "%s:\n%s", l.label, frame)
+	}
+}
+
+// lcdHighCharacters are the characters of the A00 character ROM from $E0 up
+// that are not katakana
+var lcdHighCharacters = []rune("αäβεμσρg√¹jˣ¢£ñöpqθ∞ΩüΣπxy???÷ █")
+
+// lcdCharacter returns how a character code shows on the terminal, going by
+// the A00 (Japanese) character ROM. The program's own characters show as a
+// shaded block.
+func lcdCharacter(code uint8) string {
+	switch {
+	case code < 0x10:
+		return "▒"
+	case code == 0x5C:
+		return "¥"
+	case code == 0x7E:
+		return "→"
+	case code == 0x7F:
+		return "←"
+	case code >= 0x20 && code < 0x7E:
+		return string(rune(code))
+	case code >= 0xA1 && code < 0xE0:
+		// Half-width katakana are in the same order in Unicode
+		return string(rune(0xFF61 + int(code) - 0xA1))
+	case code >= 0xE0:
+		return string(lcdHighCharacters[code-0xE0])
+	}
+	return " "
+}
+
+func (l *LCD) saveState(e *stateEncoder) {
+	e.bytes(l.ddram[:])
+	e.bytes(l.cgram[:])
+	e.u8(l.ac)
+	e.u8(uint8(l.shift))
+	e.u8(l.high)
+	for _, b := range []bool{l.cgMode, l.increment, l.shiftOnEntry, l.displayOn, l.cursorOn, l.blinkOn, l.eightBit, l.twoLines, l.lowNibble, l.e, l.driving} {
+		e.bool(b)
+	}
+	e.u64(uint64(l.busyUntil))
+}
+
+// loadState restores the LCD's state, and draws the display if it shows
+// something else now
+func (l *LCD) loadState(d *stateDecoder) {
+	copy(l.ddram[:], d.take(len(l.ddram)))
+	copy(l.cgram[:], d.take(len(l.cgram)))
+	l.ac = d.u8()
+	l.shift = int(d.u8())
+	l.high = d.u8()
+	for _, b := range []*bool{&l.cgMode, &l.increment, &l.shiftOnEntry, &l.displayOn, &l.cursorOn, &l.blinkOn, &l.eightBit, &l.twoLines, &l.lowNibble, &l.e, &l.driving} {
+		*b = d.bool()
+	}
+	l.busyUntil = int(d.u64())
+	l.render()
+}
+
+// parseLCDSpec parses an --lcd argument: a size such as 16x2 or 20x4, then
+// optionally a comma and the name of the VIA it is connected to
+func parseLCDSpec(spec string) (columns, rows int, via string, err error) {
+	size, via, _ := strings.Cut(spec, ",")
+	if via == "" {
+		via = "via"
+	}
+	if n, _ := fmt.Sscanf(size, "%dx%d", &columns, &rows); n != 2 || columns < 1 || columns > lcdLineLength || rows < 1 || rows > 4 {
+		return 0, 0, "", fmt.Errorf("invalid LCD size %q (expected 16x2, 20x4 and so on)", size)
+	}
+	return columns, rows, via, nil
+}
+
+// attachLCD connects an LCD to the VIA an --lcd argument names, rendering it
+// to out
+func (cpu *CPU) attachLCD(spec string, out io.Writer, ansi bool) error {
+	columns, rows, name, err := parseLCDSpec(spec)
+	if err != nil {
+		return err
+	}
+	via, ok := cpu.MMU.device(name).(*VIA)
+	if !ok {
+		return fmt.Errorf("there is no VIA called %s for the LCD (use --via)", name)
+	}
+	label := "lcd"
+	if name != "via" {
+		label += "-" + name
+	}
+	l := newLCD(label, columns, rows, out)
+	l.ansi = ansi
+	l.connect(cpu, via)
+	cpu.MMU.peripherals = append(cpu.MMU.peripherals, l)
+	return nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// lcdWrite pulses E to write an instruction, or data with rs set
+func lcdWrite(l *LCD, rs bool, value uint8) {
+	control := uint8(0)
+	if rs {
+		control = lcdRS
+	}
+	l.update(control|lcdE, value)
+	l.update(control, value)
+}
+
+// lcdPrint writes a string as data
+func lcdPrint(l *LCD, text string) {
+	for _, c := range []byte(text) {
+		lcdWrite(l, true, c)
+	}
+}
+
+// newTestLCD creates a 16x2 LCD with two lines, the display on and the cursor
+// incrementing, rendering to out
+func newTestLCD(out *strings.Builder) *LCD {
+	l := newLCD("lcd", 16, 2, out)
+	lcdWrite(l, false, 0x38)
+	lcdWrite(l, false, 0x0C)
+	lcdWrite(l, false, 0x06)
+	lcdWrite(l, false, 0x01)
+	return l
+}
+
+// checkLines checks what the display shows
+func checkLines(t *testing.T, l *LCD, want ...string) {
+	t.Helper()
+	got := l.lines()
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("row %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestLCDInstructions(t *testing.T) {
+	var out strings.Builder
+	l := newTestLCD(&out)
+	lcdPrint(l, "Hello")
+	lcdWrite(l, false, 0x80|0x40)
+	lcdPrint(l, "6502")
+	checkLines(t, l, "Hello           ", "6502            ")
+	if !strings.Contains(out.String(), "|Hello           |\n|6502            |") {
+		t.Errorf("the display was not rendered:\n%s", out.String())
+	}
+	// Move the cursor left and overwrite
+	lcdWrite(l, false, 0x10)
+	lcdPrint(l, "!")
+	checkLines(t, l, "Hello           ", "650!            ")
+	// Shift the display left, then home, which also undoes the shift
+	lcdWrite(l, false, 0x18)
+	checkLines(t, l, "ello            ", "50!             ")
+	lcdWrite(l, false, 0x02)
+	lcdPrint(l, "J")
+	checkLines(t, l, "Jello           ", "650!            ")
+	// Decrementing, writing backwards from the end of the first row
+	lcdWrite(l, false, 0x04)
+	lcdWrite(l, false, 0x80|0x0F)
+	lcdPrint(l, "ab")
+	checkLines(t, l, "Jello         ba")
+	// Turning the display off blanks it, keeping what it shows
+	lcdWrite(l, false, 0x08)
+	checkLines(t, l, strings.Repeat(" ", 16), strings.Repeat(" ", 16))
+	lcdWrite(l, false, 0x0C)
+	checkLines(t, l, "Jello         ba")
+	// The program's own characters are in CGRAM
+	lcdWrite(l, false, 0x06)
+	lcdWrite(l, false, 0x40|0x08)
+	lcdPrint(l, "\x0E\x11")
+	if l.cgram[8] != 0x0E || l.cgram[9] != 0x11 {
+		t.Errorf("CGRAM not written: % X", l.cgram[8:10])
+	}
+	lcdWrite(l, false, 0x80)
+	lcdPrint(l, "\x01")
+	checkLines(t, l, "▒ello         ba")
+	// Clearing starts again
+	lcdWrite(l, false, 0x01)
+	checkLines(t, l, strings.Repeat(" ", 16))
+	if l.ac != 0 || !l.increment {
+		t.Errorf("expected the address counter at 0 incrementing, $%02X %v", l.ac, l.increment)
+	}
+}
+
+func TestLCDAddressCounter(t *testing.T) {
+	var out strings.Builder
+	l := newTestLCD(&out)
+	// The end of the first line runs on to the second
+	lcdWrite(l, false, 0x80|0x27)
+	lcdPrint(l, "xy")
+	if l.ac != 0x41 || l.ddram[0x27] != 'x' || l.ddram[0x40] != 'y' {
+		t.Errorf("expected x at $27 and y at $40, address counter $%02X", l.ac)
+	}
+	// And the second back to the first
+	lcdWrite(l, false, 0x80|0x67)
+	lcdPrint(l, "z")
+	if l.ac != 0x00 {
+		t.Errorf("expected the address counter to wrap to $00, got $%02X", l.ac)
+	}
+	// With one line, it runs from $00 to $4F
+	lcdWrite(l, false, 0x30)
+	lcdWrite(l, false, 0x80|0x4F)
+	lcdPrint(l, "w")
+	if l.ac != 0x00 || l.ddram[0x4F] != 'w' {
+		t.Errorf("expected w at $4F and the address counter at $00, got $%02X", l.ac)
+	}
+}
+
+func TestLCDBusy(t *testing.T) {
+	var out strings.Builder
+	l := newLCD("lcd", 16, 2, &out)
+	clock := 0
+	var bus uint8 = 0xFF
+	l.now = func() int { return clock }
+	l.clockSpeed = mhzToHz(1)
+	l.drive = func(value uint8) { bus = value }
+	read := func(rs bool) uint8 {
+		control := lcdRW
+		if rs {
+			control |= lcdRS
+		}
+		l.update(control|lcdE, 0)
+		value := bus
+		l.update(control, 0)
+		if bus != 0xFF {
+			t.Fatal("the data lines were not released")
+		}
+		return value
+	}
+
+	lcdWrite(l, false, 0x38)
+	lcdWrite(l, false, 0x0C)
+	if !l.twoLines || l.displayOn {
+		t.Fatal("an instruction written while busy was taken")
+	}
+	if got := read(false); got&0x80 == 0 {
+		t.Errorf("expected the busy flag, got $%02X", got)
+	}
+	clock += 37
+	lcdWrite(l, false, 0x0C)
+	clock += 37
+	lcdWrite(l, false, 0x01)
+	clock += 37
+	if got := read(false); got&0x80 == 0 {
+		t.Error("clearing should take longer than other instructions")
+	}
+	clock += 1520
+	lcdPrint(l, "A")
+	clock += 37
+	if got := read(false); got != 0x01 {
+		t.Errorf("expected not busy, with the address counter at 1, got $%02X", got)
+	}
+	// Reading data moves the address counter too
+	lcdWrite(l, false, 0x80)
+	clock += 37
+	if got := read(true); got != 'A' || l.ac != 1 {
+		t.Errorf("expected to read A and the address counter at 1, got %q and $%02X", got, l.ac)
+	}
+}
+
+func TestLCDFourBit(t *testing.T) {
+	var out strings.Builder
+	l := newLCD("lcd", 16, 2, &out)
+	// The function set to 4 bits is a single 8-bit transfer, after which
+	// everything goes as two nibbles on D7-D4
+	lcdWrite(l, false, 0x20)
+	for _, b := range []uint8{0x28, 0x0E, 0x06, 0x01} {
+		lcdWrite(l, false, b&0xF0)
+		lcdWrite(l, false, b<<4)
+	}
+	for _, c := range []uint8("OK") {
+		lcdWrite(l, true, c&0xF0)
+		lcdWrite(l, true, c<<4)
+	}
+	if l.eightBit || !l.twoLines {
+		t.Errorf("expected 4 bits and 2 lines, got 8 bits %v, 2 lines %v", l.eightBit, l.twoLines)
+	}
+	checkLines(t, l, "OK              ")
+	// Reads come back a nibble at a time too
+	var bus uint8
+	l.drive = func(value uint8) { bus = value }
+	var got uint8
+	for i := 0; i < 2; i++ {
+		l.update(lcdRW|lcdE, 0)
+		got = got<<4 | bus>>4
+		l.update(lcdRW, 0)
+	}
+	if got != 0x02 {
+		t.Errorf("expected the address counter at 2, got $%02X", got)
+	}
+}
+
+func TestLCD20x4(t *testing.T) {
+	var out strings.Builder
+	l := newLCD("lcd", 20, 4, &out)
+	lcdWrite(l, false, 0x38)
+	lcdWrite(l, false, 0x0C)
+	// The third and fourth rows carry on from the first and second lines
+	for i, address := range []uint8{0x00, 0x40, 0x14, 0x54} {
+		lcdWrite(l, false, 0x80|address)
+		lcdPrint(l, string(rune('1'+i)))
+	}
+	checkLines(t, l, "1"+strings.Repeat(" ", 19), "2"+strings.Repeat(" ", 19), "3"+strings.Repeat(" ", 19), "4"+strings.Repeat(" ", 19))
+	if !strings.Contains(out.String(), "+"+strings.Repeat("-", 20)+"+") {
+		t.Errorf("expected a 20 column frame:\n%s", out.String())
+	}
+}
+
+func TestLCDOnVIA(t *testing.T) {
+	cpu := newTestCPU(t, NMOS6502, []uint8{0x00})
+	cpu.clockSpeed = mhzToHz(1)
+	via := newVIA("via", nil)
+	if err := cpu.attach(via, 0x6000, 0x600F); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	l := newLCD("lcd", 16, 2, &out)
+	l.connect(cpu, via)
+	via.write(viaDDRA, 0xE0)
+	via.write(viaDDRB, 0xFF)
+	send := func(control, value uint8) {
+		via.write(viaORB, value)
+		via.write(viaORA, control)
+		via.write(viaORA, control|lcdE)
+		via.write(viaORA, control)
+		cpu.cycles += 2000
+	}
+	send(0, 0x38)
+	send(0, 0x0C)
+	send(lcdRS, 'V')
+	send(lcdRS, 'I')
+	send(lcdRS, 'A')
+	checkLines(t, l, "VIA             ")
+	// The busy flag and address counter come back on port B
+	via.write(viaDDRB, 0x00)
+	via.write(viaORA, lcdRW|lcdE)
+	if got := via.read(viaORB); got != 0x03 {
+		t.Errorf("expected the address counter at 3 on port B, got $%02X", got)
+	}
+	via.write(viaORA, lcdRW)
+	if got := via.read(viaORB); got != 0xFF {
+		t.Errorf("expected port B released, got $%02X", got)
+	}
+}
+
+func TestLCDSaveState(t *testing.T) {
+	cpu := newTestCPU(t, NMOS6502, []uint8{0x00})
+	if err := cpu.attach(newVIA("via", nil), 0x6000, 0x600F); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := cpu.attachLCD("16x2", &out, false); err != nil {
+		t.Fatal(err)
+	}
+	l := cpu.MMU.peripherals[0].(*LCD)
+	// 4 bits and two lines, and then a nibble at a time: display, cursor and
+	// blinking on, and half of an 'A'
+	for _, nibble := range []uint8{0x28, 0x00, 0xF0, 0x00, 0x60} {
+		lcdWrite(l, false, nibble)
+	}
+	lcdWrite(l, true, 0x40)
+	// The LCD is part of the machine state that input logs hash
+	hash := stateHash(cpu)
+	lcdWrite(l, true, 0x10)
+	if stateHash(cpu) == hash {
+		t.Error("the state hash did not change with the LCD")
+	}
+	checkLines(t, l, "A               ")
+
+	var buf bytes.Buffer
+	if err := cpu.saveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	saved := *l
+	// Clear, and write to CGRAM
+	for _, nibble := range []uint8{0x00, 0x10, 0x40, 0x00} {
+		lcdWrite(l, false, nibble)
+	}
+	lcdWrite(l, true, 0x10)
+	lcdWrite(l, true, 0xF0)
+	out.Reset()
+	if err := cpu.loadState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if l.ddram != saved.ddram || l.cgram != saved.cgram || l.ac != saved.ac || l.cgMode || l.eightBit || !l.twoLines || !l.blinkOn || l.busyUntil != saved.busyUntil {
+		t.Errorf("LCD state not restored: %+v, expected %+v", l, saved)
+	}
+	checkLines(t, l, "A               ")
+	if !strings.Contains(out.String(), "|A               |") {
+		t.Errorf("the restored display was not drawn:\n%s", out.String())
+	}
+}
+
+func TestParseLCDSpec(t *testing.T) {
+	columns, rows, via, err := parseLCDSpec("20x4,via2")
+	if err != nil || columns != 20 || rows != 4 || via != "via2" {
+		t.Errorf("20x4,via2: got %d %d %q %v", columns, rows, via, err)
+	}
+	if _, _, via, _ := parseLCDSpec("16x2"); via != "via" {
+		t.Errorf("expected the first VIA by default, got %q", via)
+	}
+	for _, bad := range []string{"16", "0x2", "16x5", "big"} {
+		if _, _, _, err := parseLCDSpec(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// segment is a block of bytes to be placed at a specific address
+type segment struct {
+	address uint16
+	data    []uint8
+	init    uint16 // Atari INITAD routine to call once the segment has loaded
+	hasInit bool   // whether the segment declared an init routine
+}
+
+// programImage is a program loaded from a file, ready to be placed in memory
+type programImage struct {
+	segments []segment
+	start    uint16 // entry point declared by the file
+	hasStart bool   // whether the file declared an entry point
+	run      uint16 // run address declared by the file, used with --run-address
+	hasRun   bool   // whether the file declared a run address
+}
+
+// addData appends data at the given address, merging it with the previous
+// segment when the two are contiguous
+func (img *programImage) addData(address uint16, data []uint8) {
+	if n := len(img.segments); n > 0 {
+		last := &img.segments[n-1]
+		if int(last.address)+len(last.data) == int(address) {
+			last.data = append(last.data, data...)
+			return
+		}
+	}
+	img.segments = append(img.segments, segment{address: address, data: append([]uint8(nil), data...)})
+}
+
+// fileFormat identifies the format of a program file
+type fileFormat int
+
+const (
+	formatBinary   fileFormat = iota // raw bytes
+	formatIntelHex                   // Intel HEX records
+	formatSRecord                    // Motorola S-records (S19/S28/S37)
+	formatPRG                        // Commodore PRG (load address header)
+	formatXEX                        // Atari DOS binary (segments)
+	formatINES                       // iNES cartridge image (NROM only)
+)
+
+// formatExtensions maps file extensions to their formats
+var formatExtensions = map[string]fileFormat{
+	".hex":  formatIntelHex,
+	".ihx":  formatIntelHex,
+	".ihex": formatIntelHex,
+	".s19":  formatSRecord,
+	".s28":  formatSRecord,
+	".s37":  formatSRecord,
+	".srec": formatSRecord,
+	".mot":  formatSRecord,
+	".prg":  formatPRG,
+	".xex":  formatXEX,
+	".nes":  formatINES,
+}
+
+// detectFormat works out the format of a program file, first from its
+// extension and then from its contents. A file given a load address is not
+// taken for an XEX by its contents, as ROM images are often padded with $FF.
+func detectFormat(fileName string, data []uint8, hasAddress bool) fileFormat {
+	// Trust the extension if we recognise it
+	if format, ok := formatExtensions[strings.ToLower(filepath.Ext(fileName))]; ok {
+		return format
+	}
+	// iNES images start with NES and an end of file character
+	if bytes.HasPrefix(data, inesMagic) {
+		return formatINES
+	}
+	// Atari DOS binaries start with a $FFFF header
+	if !hasAddress && len(data) >= 6 && data[0] == 0xFF && data[1] == 0xFF {
+		return formatXEX
+	}
+	// Otherwise look at the first line of the file
+	firstLine := bytes.TrimSpace(data)
+	if i := bytes.IndexAny(firstLine, "\r\n"); i >= 0 {
+		firstLine = firstLine[:i]
+	}
+	switch {
+	case len(firstLine) >= 11 && firstLine[0] == ':' && isHexText(firstLine[1:]):
+		return formatIntelHex
+	case len(firstLine) >= 10 && firstLine[0] == 'S' && isHexText(firstLine[1:]):
+		return formatSRecord
+	}
+	return formatBinary
+}
+
+// isHexText reports whether data consists only of hex digits
+func isHexText(data []uint8) bool {
+	for _, c := range data {
+		if !strings.ContainsRune("0123456789ABCDEFabcdef", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadProgramFromFile loads a program file in any supported format. Raw
+// binaries are placed at the file's load address; the other formats carry
+// their own addresses.
+func loadProgramFromFile(file programFile) (*programImage, error) {
+	// Load the program from a file as a byte array
+	data, err := os.ReadFile(file.fileName)
+	if err != nil {
+		return nil, err
+	}
+	var img *programImage
+	switch detectFormat(file.fileName, data, file.hasAddress) {
+	case formatIntelHex:
+		img, err = parseIntelHex(data)
+	case formatSRecord:
+		img, err = parseSRecord(data)
+	case formatPRG:
+		img, err = parsePRG(data)
+	case formatXEX:
+		img, err = parseXEX(data)
+	case formatINES:
+		img, err = parseINES(data)
+	default:
+		img = &programImage{segments: []segment{{address: file.address, data: data}}}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file.fileName, err)
+	}
+	return img, nil
+}
+
+// loadImage places every segment of a program image into memory, without
+// running anything
+func (mmu *MMU) loadImage(img *programImage) error {
+	for _, seg := range img.segments {
+		if err := mmu.loadProgram(seg.data, seg.address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadImage places every segment of a program image into memory, calling
+// each segment's init routine once it has loaded and before the next one is
+func (cpu *CPU) loadImage(img *programImage) error {
+	for _, seg := range img.segments {
+		if err := cpu.MMU.loadProgram(seg.data, seg.address); err != nil {
+			return err
+		}
+		if seg.hasInit {
+			if err := cpu.runInit(seg.init); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startAddress returns the entry point declared by the first image that has one
+func startAddress(images []*programImage) (uint16, bool) {
+	for _, img := range images {
+		if img.hasStart {
+			return img.start, true
+		}
+	}
+	return 0, false
+}
+
+// runAddress returns the run address declared by the first image that has one
+func runAddress(images []*programImage) (uint16, bool) {
+	for _, img := range images {
+		if img.hasRun {
+			return img.run, true
+		}
+	}
+	return 0, false
+}
+
+// entryPoint chooses where to start a loaded program: at its declared entry
+// point, or its run address if asked for, or else at the reset vector. If the
+// reset vector was not set either, it starts at the first program's load
+// address.
+func entryPoint(images []*programImage, reset uint16, useRunAddress bool) uint16 {
+	if run, ok := runAddress(images); useRunAddress && ok {
+		return run
+	}
+	if start, ok := startAddress(images); ok {
+		return start
+	}
+	if reset == 0x0000 && len(images) > 0 && len(images[0].segments) > 0 {
+		return images[0].segments[0].address
+	}
+	return reset
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	xex := []uint8{0xFF, 0xFF, 0x00, 0x06, 0x00, 0x06, 0x60}
+	if got := detectFormat("game", xex, false); got != formatXEX {
+		t.Errorf("expected a $FFFF header to be taken for an XEX, got %d", got)
+	}
+	if got := detectFormat("game.xex", xex, true); got != formatXEX {
+		t.Errorf("expected an .xex file to be an XEX at any address, got %d", got)
+	}
+	if got := detectFormat("game.bin", xex, true); got != formatBinary {
+		t.Errorf("expected a file given an address to be a binary, got %d", got)
+	}
+}
+
+func TestLoadPaddedROM(t *testing.T) {
+	// A ROM padded with $FF, as EPROM images usually are, with the code at
+	// the end of it
+	rom := make([]uint8, 0x8000)
+	for i := range rom {
+		rom[i] = 0xFF
+	}
+	copy(rom[0x6000:], []uint8{0xA9, 0x42})
+	path := filepath.Join(t.TempDir(), "rom.bin")
+	if err := os.WriteFile(path, rom, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := parseFileSpec(path + "@0x8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := loadProgramFromFile(file)
+	if err != nil {
+		t.Fatalf("expected the ROM to load as a binary: %v", err)
+	}
+	if len(img.segments) != 1 || img.segments[0].address != 0x8000 || len(img.segments[0].data) != len(rom) {
+		t.Fatalf("expected one segment of $8000 bytes at $8000, got %d", len(img.segments))
+	}
+	if img.segments[0].data[0x6000] != 0xA9 {
+		t.Error("the ROM's contents were not kept")
+	}
+}
+
+func TestXEXInit(t *testing.T) {
+	xex := []uint8{
+		0xFF, 0xFF,
+		// The init routine copies $0700 to $0710
+		0x00, 0x06, 0x06, 0x06,
+		0xAD, 0x00, 0x07, // LDA $0700
+		0x8D, 0x10, 0x07, // STA $0710
+		0x60, // RTS
+		0x00, 0x07, 0x00, 0x07, 0x11,
+		// INITAD, calling it now
+		0xE2, 0x02, 0xE3, 0x02, 0x00, 0x06,
+		// This must not load until the init routine has returned
+		0x00, 0x07, 0x00, 0x07, 0x22,
+		// RUNAD
+		0xE0, 0x02, 0xE1, 0x02, 0x00, 0x06,
+	}
+	img, err := parseXEX(xex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !img.hasRun || img.run != 0x0600 {
+		t.Errorf("expected the run address $0600, got $%04X", img.run)
+	}
+	cpu := &CPU{MMU: &MMU{}}
+	cpu.reset()
+	pc, sp := cpu.PC, cpu.SP
+	if err := cpu.loadImage(img); err != nil {
+		t.Fatal(err)
+	}
+	if got := cpu.MMU.RAM[0x0710]; got != 0x11 {
+		t.Errorf("expected the init routine to run between the segments, copying $11, got $%02X", got)
+	}
+	if got := cpu.MMU.RAM[0x0700]; got != 0x22 {
+		t.Errorf("expected the last segment loaded over $0700, got $%02X", got)
+	}
+	if cpu.PC != pc || cpu.SP != sp {
+		t.Errorf("expected the init routine to return to $%04X with SP $%02X, got $%04X and $%02X", pc, sp, cpu.PC, cpu.SP)
+	}
+
+	// A routine that never returns is an error rather than a hang
+	cpu.MMU.RAM[0x0600] = 0x4C // JMP $0600
+	cpu.MMU.RAM[0x0601], cpu.MMU.RAM[0x0602] = 0x00, 0x06
+	if err := cpu.runInit(0x0600); err == nil {
+		t.Error("expected an error for an init routine that does not return")
+	}
+}
+
+func TestSRecord(t *testing.T) {
+	img, err := parseSRecord([]uint8("S0030000FC\nS1060200A94260AC\nS9030200FA\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.segments) != 1 || img.segments[0].address != 0x0200 || len(img.segments[0].data) != 3 {
+		t.Fatalf("expected 3 bytes at $0200, got %d segments", len(img.segments))
+	}
+	if !img.hasStart || img.start != 0x0200 {
+		t.Errorf("expected the entry point $0200, got $%04X (%v)", img.start, img.hasStart)
+	}
+	// A termination address of zero is no entry point
+	img, err = parseSRecord([]uint8("S1060200A94260AC\nS9030000FC\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.hasStart {
+		t.Errorf("expected no entry point from S9030000FC, got $%04X", img.start)
+	}
+}
+
+func TestIntelHex(t *testing.T) {
+	img, err := parseIntelHex([]uint8(":03020000A94260B0\n:0400000500000200F5\n:00000001FF\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.segments) != 1 || img.segments[0].address != 0x0200 || len(img.segments[0].data) != 3 {
+		t.Fatalf("expected 3 bytes at $0200, got %d segments", len(img.segments))
+	}
+	if !img.hasStart || img.start != 0x0200 {
+		t.Errorf("expected the entry point $0200, got $%04X (%v)", img.start, img.hasStart)
+	}
+}
+
+func TestHexLoaderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func([]uint8) (*programImage, error)
+		data  string
+		want  string
+	}{
+		{"hex checksum", parseIntelHex, ":03020000A94260B0\n\n:03020000A94260B1\n", "line 3: checksum mismatch (expected $B0, got $B1)"},
+		{"hex start", parseIntelHex, "03020000A94260B0\n", "line 1: record does not start with ':'"},
+		{"hex digits", parseIntelHex, ":03020000A94260B0\n:0302000GA94260B0\n", "line 2: invalid hex digits"},
+		{"hex length", parseIntelHex, ":04020000A94260AF\n", "line 1: record length does not match its byte count"},
+		{"hex type", parseIntelHex, ":00000009F7\n", "line 1: unknown record type $09"},
+		{"S-record checksum", parseSRecord, "S0030000FC\nS1060200A94260AD\n", "line 2: checksum mismatch (expected $AC, got $AD)"},
+		{"S-record start", parseSRecord, "S0030000FC\n\nX1060200A94260AC\n", "line 3: record does not start with 'S'"},
+		{"S-record length", parseSRecord, "S1070200A94260AB\n", "line 1: record length does not match its byte count"},
+		{"S-record type", parseSRecord, "S4030000FC\n", "line 1: unknown record type S4"},
+		{"S-record range", parseSRecord, "S20501000000F9\n", "line 1: data at $10000 is outside the 64KB address space"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.parse([]uint8(test.data))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if err.Error() != test.want {
+				t.Errorf("expected %q, got %q", test.want, err)
+			}
+		})
+	}
+}
@@ -45,39 +45,85 @@ var demoProgram = []uint8{
 
 func printUsage() {
 	fmt.Println("Usage: go6502 [options]")
+	fmt.Println("       go6502 asm [options] source.asm")
+	fmt.Println("       go6502 disasm [options] file[@address] ...")
+	fmt.Println("       go6502 dap [--port address]")
+	fmt.Println("       go6502 tracediff [options] -f file[@address] ... reference.log")
 	fmt.Println("Options:")
 	fmt.Println("  -h, --help\t\tPrint this help message")
 	fmt.Println("  -d, --debug\t\tEnable debug mode")
 	fmt.Println("  -c, --clock-speed\tSet the clock speed in MHz")
 	fmt.Println("  --watch-addresses\tWatch the specified addresses (comma separated)")
 	fmt.Println("  --benchmark\t\tRun a benchmark")
-	fmt.Println("  -f, --file\t\tLoad a program from a file")
+	fmt.Println("  -f, --file\t\tLoad a program from a file, optionally at an address (file@address, default 0x8000)")
+	fmt.Println("\t\t\tMay be given more than once to load several files")
+	fmt.Println("\t\t\tIntel HEX (.hex) and Motorola S-record (.s19/.s28) files are detected")
+	fmt.Println("\t\t\tautomatically and loaded at their own addresses, as are Commodore")
+	fmt.Println("\t\t\t.prg files and Atari .xex binaries")
+	fmt.Println("  --dbgfile\t\tLoad symbols and source lines from an ld65 debug file (--dbgfile)")
+	fmt.Println("  --mapfile\t\tLoad symbols from an ld65 map file (-m) when there is no debug file")
+	fmt.Println("  --exec-log\t\tWrite the address of every instruction executed to a file, for disasm --exec-log")
+	fmt.Println("  --trace\t\tWrite a line for every instruction executed to a file ('-' for stdout)")
+	fmt.Println("  --trace-format\t\tThe trace layout: nestest (default), json or a template such as '{pc} {disasm} A:{a}'")
+	fmt.Println("  -b, --break\t\tSet a breakpoint, e.g. '0x8010', 'write 0x0200..0x02FF' or '0x8010 hits 3 if A==$40'")
+	fmt.Println("  --gdb\t\t\tServe the GDB remote protocol on an address (e.g. localhost:1234) instead of running")
+	fmt.Println("  --dap\t\t\tServe the Debug Adapter Protocol on an address for a client to attach to, instead of running")
+	fmt.Println("  --history\t\tKeep a history of about this many bytes (e.g. 64M) for stepping backwards")
+	fmt.Println("  -m, --monitor\t\tStart in the machine language monitor (Ctrl-C also enters it)")
+	fmt.Println("  --cpu\t\t\tThe CPU to emulate: 6502 (default) or 65c02")
+	fmt.Println("  --run-address\t\tStart at the run address declared by a PRG or XEX file instead of the RESET vector")
+	fmt.Println("  --load-state\t\tResume from a save state instead of resetting (files are loaded first, then overwritten)")
+	fmt.Println("  --save-state\t\tWrite a save state to a file when the emulation ends")
+	fmt.Println("  --via\t\t\tAttach a W65C22 VIA at an address, or mirrored through a range (e.g. 0x6000-0x7FFF)")
+	fmt.Println("  --riot\t\tAttach a 6532 RIOT at an address or range (its RAM, then its registers from +$80)")
+	fmt.Println("  --pia\t\t\tAttach a 6520/6821 PIA at an address or range")
+	fmt.Println("  --lcd\t\t\tConnect an HD44780 LCD of a size (e.g. 16x2 or 20x4) to a VIA, \"via\" unless another")
+	fmt.Println("\t\t\tis named after a comma (e.g. 20x4,via2): data on port B, and E, RW and RS on PA7-PA5")
+	fmt.Println("  --console\t\tAttach a console at an address: writing the first register prints a character, reading")
+	fmt.Println("\t\t\tit gets the next one typed or 0, and writing the second exits with the value as the status.")
+	fmt.Println("\t\t\tIt can be connected elsewhere after a comma, as --acia can")
+	fmt.Println("  --show-ports\t\tPrint the pins of the VIAs, RIOTs and PIAs whenever they change")
+	fmt.Println("  --acia\t\tAttach a 6551 ACIA at an address, connected to the terminal, or after a comma to")
+	fmt.Println("\t\t\ta Unix socket or a pseudo-terminal (e.g. 0x5000,unix:/tmp/acia or 0x5000,pty).")
+	fmt.Println("\t\t\tThe terminal is only put in raw mode on Linux, macOS and the BSDs, and pty")
+	fmt.Println("\t\t\tonly works on Linux and macOS.")
+	fmt.Println("\t\t\tWhile the terminal is connected, Ctrl-] enters the monitor")
+	fmt.Println("  --record\t\tRecord the input from the host, with the cycle it arrived at, to a file")
+	fmt.Println("  --replay\t\tReplay recorded input instead of taking input from the host")
+	fmt.Println("  --check\t\tWith --replay, check the state matches the recording's, exiting with status 1 if not")
+	fmt.Println("  --hash-interval\tHow often, in cycles, a recording notes the state for --check (default 100000)")
 	fmt.Println("Example: go6502 -c 1 -f program.bin --watch-addresses 0x6000,0x6002")
+	fmt.Println("Example: go6502 -f rom.bin@0xC000 -f prog.bin@0x0600")
+	fmt.Println("Example: go6502 -f test.bin --via 0x6000 --show-ports")
+	fmt.Println("Example: go6502 -f basic.bin@0xC000 --acia 0x5000")
+	fmt.Println("Example: go6502 -f selftest.bin --console 0xF000 && echo passed")
 }
 
-func loadProgramFromFile(fileName string) []uint8 {
-	// Load the program from a file as a byte array
-	file, err := os.Open(fileName)
-	if err != nil {
-		fmt.Println("Error opening file:", err)
-		return nil
+// defaultLoadAddress is where programs are loaded when no address is given
+const defaultLoadAddress = 0x8000
+
+// programFile is a program file to load and the address to load it at
+type programFile struct {
+	fileName   string
+	address    uint16
+	hasAddress bool // whether the address was given with @
+}
+
+// parseFileSpec parses a --file argument of the form file or file@address
+func parseFileSpec(spec string) (programFile, error) {
+	// Split off the load address, if there is one
+	at := strings.LastIndex(spec, "@")
+	if at < 0 {
+		return programFile{fileName: spec, address: defaultLoadAddress}, nil
 	}
-	defer file.Close()
-	// Get the file size
-	fileInfo, err := file.Stat()
+	address, err := parseAddress(spec[at+1:])
 	if err != nil {
-		fmt.Println("Error getting file info:", err)
-		return nil
+		return programFile{}, fmt.Errorf("invalid load address in %q: %v", spec, err)
 	}
-	fileSize := fileInfo.Size()
-	// Read the file
-	program := make([]uint8, fileSize)
-	_, err = file.Read(program)
-	if err != nil {
-		fmt.Println("Error reading file:", err)
-		return nil
+	if at == 0 {
+		return programFile{}, fmt.Errorf("missing file name in %q", spec)
 	}
-	return program
+	return programFile{fileName: spec[:at], address: address, hasAddress: true}, nil
 }
 
 func main() {
@@ -86,14 +132,41 @@ func main() {
 	// Listen for SIGINT
 	signal.Notify(sigs, syscall.SIGINT)
 
+	// Run a subcommand if one was given
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "asm":
+			os.Exit(assemblerCommand(os.Args[2:]))
+		case "disasm":
+			os.Exit(disassemblerCommand(os.Args[2:]))
+		case "dap":
+			os.Exit(dapCommand(os.Args[2:]))
+		case "tracediff":
+			os.Exit(traceDiffCommand(os.Args[2:]))
+		}
+	}
+
 	debug := false
 	speed := mhzToHz(1)
-	loadFromFile := false
 	watchAddresses := false
 	benchmark := false
 	benchmarkCount := 1000
+	useRunAddress := false
+	startMonitor := false
+	historyBudget := 0
+	variant := NMOS6502
+	traceFormat := traceNestest
+	var dbgFile, mapFile, execLog, traceFile, gdbAddress, dapAddress string
+	var loadStateFile, saveStateFile, recordFile, replayFile string
+	var devices []deviceFlag
+	var lcdSpecs []string
+	showPorts := false
+	checkReplay := false
+	hashInterval := defaultHashInterval
+	exitStatus := 0
 	var addressesToWatch []uint16
-	var program []uint8
+	var programFiles []programFile
+	var breakpointSpecs []string
 
 	// Parse the command line arguments
 	if len(os.Args) > 1 {
@@ -153,12 +226,163 @@ func main() {
 			case "-f", "--file":
 				if i+1 < len(os.Args) {
 					i++
-					loadFromFile = true
-					program = loadProgramFromFile(os.Args[i])
+					file, err := parseFileSpec(os.Args[i])
+					if err != nil {
+						fmt.Println(err)
+						return
+					}
+					programFiles = append(programFiles, file)
 				} else {
 					fmt.Println("Missing file name")
 					return
 				}
+			case "--dbgfile", "--mapfile":
+				if i+1 < len(os.Args) {
+					if os.Args[i] == "--dbgfile" {
+						dbgFile = os.Args[i+1]
+					} else {
+						mapFile = os.Args[i+1]
+					}
+					i++
+				} else {
+					fmt.Println("Missing debug file name")
+					return
+				}
+			case "--exec-log":
+				if i+1 < len(os.Args) {
+					i++
+					execLog = os.Args[i]
+				} else {
+					fmt.Println("Missing execution log file name")
+					return
+				}
+			case "--trace":
+				if i+1 < len(os.Args) {
+					i++
+					traceFile = os.Args[i]
+				} else {
+					fmt.Println("Missing trace file name")
+					return
+				}
+			case "--trace-format":
+				if i+1 < len(os.Args) {
+					i++
+					traceFormat = os.Args[i]
+				} else {
+					fmt.Println("Missing trace format")
+					return
+				}
+			case "-b", "--break":
+				if i+1 < len(os.Args) {
+					i++
+					breakpointSpecs = append(breakpointSpecs, os.Args[i])
+				} else {
+					fmt.Println("Missing breakpoint")
+					return
+				}
+			case "--gdb":
+				if i+1 < len(os.Args) {
+					i++
+					gdbAddress = os.Args[i]
+				} else {
+					fmt.Println("Missing GDB address")
+					return
+				}
+			case "--dap":
+				if i+1 < len(os.Args) {
+					i++
+					dapAddress = os.Args[i]
+				} else {
+					fmt.Println("Missing DAP address")
+					return
+				}
+			case "--history":
+				if i+1 < len(os.Args) {
+					i++
+					budget, err := parseSize(os.Args[i])
+					if err != nil {
+						fmt.Println("Invalid history size:", os.Args[i])
+						return
+					}
+					historyBudget = budget
+				} else {
+					fmt.Println("Missing history size")
+					return
+				}
+			case "--cpu":
+				if i+1 < len(os.Args) {
+					i++
+					v, err := parseVariant(os.Args[i])
+					if err != nil {
+						fmt.Println(err)
+						return
+					}
+					variant = v
+				} else {
+					fmt.Println("Missing CPU")
+					return
+				}
+			case "--load-state", "--save-state":
+				if i+1 < len(os.Args) {
+					if os.Args[i] == "--load-state" {
+						loadStateFile = os.Args[i+1]
+					} else {
+						saveStateFile = os.Args[i+1]
+					}
+					i++
+				} else {
+					fmt.Println("Missing save state file name")
+					return
+				}
+			case "--record", "--replay":
+				if i+1 < len(os.Args) {
+					if os.Args[i] == "--record" {
+						recordFile = os.Args[i+1]
+					} else {
+						replayFile = os.Args[i+1]
+					}
+					i++
+				} else {
+					fmt.Println("Missing input log file name")
+					return
+				}
+			case "--via", "--acia", "--riot", "--pia", "--console":
+				if i+1 < len(os.Args) {
+					i++
+					devices = append(devices, deviceFlag{kind: strings.TrimPrefix(os.Args[i-1], "--"), spec: os.Args[i]})
+				} else {
+					fmt.Println("Missing device address")
+					return
+				}
+			case "--lcd":
+				if i+1 < len(os.Args) {
+					i++
+					lcdSpecs = append(lcdSpecs, os.Args[i])
+				} else {
+					fmt.Println("Missing LCD size")
+					return
+				}
+			case "--show-ports":
+				showPorts = true
+			case "--check":
+				checkReplay = true
+			case "--hash-interval":
+				if i+1 < len(os.Args) {
+					i++
+					interval, err := strconv.Atoi(os.Args[i])
+					if err != nil || interval <= 0 {
+						fmt.Println("Invalid hash interval:", os.Args[i])
+						return
+					}
+					hashInterval = interval
+				} else {
+					fmt.Println("Missing hash interval")
+					return
+				}
+			case "-m", "--monitor":
+				startMonitor = true
+			case "--run-address":
+				useRunAddress = true
 			default:
 				fmt.Println("Invalid option:", os.Args[i])
 				return
@@ -168,31 +392,206 @@ func main() {
 		printUsage()
 		return
 	}
+	if recordFile != "" && replayFile != "" {
+		fmt.Println("Cannot record and replay at the same time")
+		return
+	}
+	if checkReplay && replayFile == "" {
+		fmt.Println("--check needs --replay")
+		return
+	}
 	mmu := &MMU{}
-	cpu := CPU{clockSpeed: speed, MMU: mmu, debug: debug} // 0.00001 MHz (10 hz)
+	cpu := CPU{clockSpeed: speed, MMU: mmu, debug: debug, variant: variant} // 0.00001 MHz (10 hz)
+	if execLog != "" {
+		cpu.executed = &[RAMSize]bool{}
+	}
+	cpu.input = newInputLog(&cpu)
+	host, err := cpu.attachDevices(devices, showPorts)
+	if err != nil {
+		fmt.Println("Error attaching devices:", err)
+		return
+	}
+	// Put the terminal back however we return
+	defer host.close()
+	// LCDs show the cursor when they are drawn on a terminal
+	_, notTerminal := getTermState(os.Stdout)
+	for _, spec := range lcdSpecs {
+		if err := cpu.attachLCD(spec, os.Stdout, notTerminal == nil); err != nil {
+			fmt.Println("Error attaching LCD:", err)
+			return
+		}
+	}
+	if historyBudget > 0 {
+		cpu.enableHistory(historyBudget)
+	}
+	if traceFile != "" {
+		tracer, err := openTracer(traceFile, traceFormat)
+		if err != nil {
+			fmt.Println("Error opening trace:", err)
+			return
+		}
+		cpu.tracer = tracer
+	}
+	// finish disconnects the devices from the host, settles the exit status
+	// and writes out the input log, save state, trace and execution log that
+	// were asked for, however the emulation ends
+	finish := func() {
+		host.close()
+		if err := cpu.input.finish(&cpu); err != nil {
+			if replayFile != "" {
+				fmt.Println("Replay check failed:", err)
+				exitStatus = 1
+			} else {
+				fmt.Println("Error writing input log:", err)
+			}
+		}
+		// A program that exits through the console sets the exit status,
+		// unless a replay check has already failed
+		if host.exitRequested && exitStatus == 0 {
+			exitStatus = host.exitStatus
+		}
+		if saveStateFile != "" {
+			if err := cpu.saveStateFile(saveStateFile); err != nil {
+				fmt.Println("Error writing save state:", err)
+			}
+		}
+		if err := cpu.tracer.close(); err != nil {
+			fmt.Println("Error writing trace:", err)
+		}
+		if execLog == "" {
+			return
+		}
+		if err := writeExecutionLog(execLog, cpu.executed); err != nil {
+			fmt.Println("Error writing execution log:", err)
+		}
+	}
 
-	// Handle signals
-	go func() {
-		<-sigs
-		fmt.Println()
+	// Load the debug info, preferring the debug file over the map file
+	debugInfo, err := loadDebugInfo(dbgFile, mapFile)
+	if err != nil {
+		fmt.Println("Error loading debug info:", err)
+		return
+	}
+	cpu.debugInfo = debugInfo
+
+	// Set the breakpoints, whose addresses can be numbers or symbols
+	cpu.breakpoints = newBreakpointSet(&cpu)
+	symbolValue := func(name string) (int, bool) {
+		if cpu.debugInfo == nil {
+			return 0, false
+		}
+		value, ok := cpu.debugInfo.symbols[name]
+		return int(value), ok
+	}
+	for _, spec := range breakpointSpecs {
+		bp, err := parseBreakpoint(spec, func(s string) (int, error) {
+			if address, err := parseAddress(s); err == nil {
+				return int(address), nil
+			}
+			return evalExpr(s, &exprContext{symbol: symbolValue})
+		})
+		if err == nil {
+			err = cpu.breakpoints.add(bp)
+		}
+		if err != nil {
+			fmt.Printf("Invalid breakpoint %q: %v\n", spec, err)
+			return
+		}
+	}
+
+	// exit stops the emulation and exits
+	exit := func() {
 		cpu.running = false
 		cpu.log("Stopped emulation")
 
 		// Log the registers
 		Log("EXIT", fmt.Sprintf("A: 0x%02X, X: 0x%02X, Y: 0x%02X, P: 0x%02X, SP: 0x%02X, PC: 0x%04X", cpu.A, cpu.X, cpu.Y, cpu.P, cpu.SP, cpu.PC))
-		os.Exit(0)
+		finish()
+		os.Exit(exitStatus)
+	}
+	monitor := NewMonitor(&cpu, os.Stdin, os.Stdout)
+	// A device with the terminal passes what is typed on to the monitor, and
+	// gives the terminal up while it is active
+	if t := host.terminal; t != nil {
+		monitor = NewMonitor(&cpu, t.monitorOut, os.Stdout)
+		monitor.suspend, monitor.resume = t.suspend, t.resume
+		t.start(monitor.active.Load, func() { cpu.stopRequested.Store(true) })
+	}
+
+	// Handle signals
+	go func() {
+		for range sigs {
+			fmt.Println()
+			// Ctrl-C stops the CPU and enters the monitor, unless we are
+			// benchmarking, debugging with GDB or DAP or already in the monitor
+			if benchmark || gdbAddress != "" || dapAddress != "" || monitor.active.Load() {
+				exit()
+			}
+			cpu.stopRequested.Store(true)
+		}
 	}()
 
-	// Load the demo program, if not loading from a file
-	if !loadFromFile {
-		program = demoProgram
+	loadFromFile := len(programFiles) > 0
+	var images []*programImage
+	if loadFromFile {
+		// XEX init routines run while loading, so they need the stack and
+		// interrupt mask a reset gives them
+		cpu.reset()
+		// Load each file at its requested address
+		for _, file := range programFiles {
+			img, err := loadProgramFromFile(file)
+			if err != nil {
+				fmt.Println("Error loading file:", err)
+				return
+			}
+			if err := cpu.loadImage(img); err != nil {
+				fmt.Printf("Error loading %s: %v\n", file.fileName, err)
+				return
+			}
+			images = append(images, img)
+		}
+	} else {
+		// Load the demo program
+		if err := mmu.loadProgram(demoProgram, defaultLoadAddress); err != nil {
+			fmt.Println("Error loading demo program:", err)
+			return
+		}
 	}
-	mmu.loadProgram(program)
-	// Reset the CPU to the demo program
+	// Reset the CPU
 	cpu.reset()
-	// If we did not load from a file, we need to set the program counter to 0x8000
+	// Files that declare an entry point start there, as do declared run addresses
+	// if asked for. Otherwise, if we did not load from a file, or none of the
+	// files set the reset vector, start at the first program's load address
 	if !loadFromFile {
-		cpu.PC = 0x8000
+		cpu.PC = defaultLoadAddress
+	} else {
+		cpu.PC = entryPoint(images, cpu.PC, useRunAddress)
+	}
+	// A save state replaces all of that, picking up where it was made
+	if loadStateFile != "" {
+		if err := cpu.loadStateFile(loadStateFile); err != nil {
+			fmt.Println("Error loading save state:", err)
+			return
+		}
+	}
+	// Input is recorded or replayed from here, the state the machine starts in
+	if err := cpu.input.open(&cpu, recordFile, replayFile, checkReplay, hashInterval); err != nil {
+		fmt.Println("Error opening input log:", err)
+		return
+	}
+	// Let GDB drive the CPU if asked to
+	if gdbAddress != "" {
+		if err := serveGDB(&cpu, gdbAddress); err != nil {
+			fmt.Println("GDB server error:", err)
+		}
+		exit()
+	}
+	// Or let a debug adapter client attach
+	if dapAddress != "" {
+		if err := serveDAP(&cpu, dapAddress); err != nil {
+			fmt.Println("DAP server error:", err)
+		}
+		exit()
 	}
 	// If benchmarking, run the program 1000 times,
 	// and print the average time it took to run. Otherwise, run the program once.
@@ -212,8 +611,31 @@ func main() {
 		fmt.Println("Average time per cycle:", averageTime/time.Duration(cpu.cycles))
 		fmt.Println("Total time elapsed:", totalTime)
 	} else {
-		// Run the CPU
-		cpu.run(watchAddresses, addressesToWatch)
+		if startMonitor && !monitor.enter() {
+			exit()
+		}
+		for {
+			// Run the CPU
+			cpu.run(watchAddresses, addressesToWatch)
+			// Enter the monitor if we were stopped with Ctrl-C or a breakpoint
+			if cpu.breakpoints.stopped() {
+				fmt.Println(cpu.breakpoints.describeHit())
+			} else if !cpu.stopRequested.Load() {
+				// Say so if the program ran into an opcode we do not know
+				opcode := mmu.peekByte(cpu.PC)
+				if _, known := cpu.instructionSet()[opcode]; !known && !cpu.running {
+					fmt.Printf("Stopped at unknown opcode $%02X at $%04X\n", opcode, cpu.PC)
+				}
+				break
+			}
+			if !monitor.enter() {
+				exit()
+			}
+		}
 	}
+	finish()
 	fmt.Println("Emulation done in", cpu.cycles, "cycles", "at", hzToMHz(cpu.clockSpeed), "MHz")
+	if exitStatus != 0 {
+		os.Exit(exitStatus)
+	}
 }
@@ -1,5 +1,7 @@
 package main
 
+import "fmt"
+
 const (
 	RAMSize = 0x10000 // 64KB
 )
@@ -7,22 +9,70 @@ const (
 type MMU struct {
 	RAM [RAMSize]uint8
 	// TODO: add PPU, APU, etc.
+	// watch, if set, is told about every read and write the CPU makes
+	watch func(address uint16, value uint8, write bool)
+	// history, if set, records the bytes that writes overwrite
+	history *History
+	// devices are the peripherals on the bus, and pages the ones in each page
+	// of memory, so that addresses without a device are quick to find
+	devices []*busDevice
+	pages   [256][]*busDevice
+	// peripherals are devices off the bus with state, such as LCDs, which
+	// watch a VIA's pins
+	peripherals []stateful
 }
 
 // Read a byte from the memory
 func (mmu *MMU) readByte(address uint16) uint8 {
-	// return the value at the address
-	return mmu.RAM[address]
+	// return the value at the address, or a device's register there
+	var value uint8
+	if b := mmu.deviceAt(address); b != nil {
+		value = b.device.read(b.register(address))
+	} else {
+		value = mmu.RAM[address]
+	}
+	if mmu.watch != nil {
+		mmu.watch(address, value, false)
+	}
+	return value
 }
 
 // Read a word from the memory
 func (mmu *MMU) readWord(address uint16) uint16 {
 	// return a 16-bit word from the memory
-	return uint16(mmu.RAM[address]) | uint16(mmu.RAM[address+1])<<8
+	return uint16(mmu.readByte(address)) | uint16(mmu.readByte(address+1))<<8
 }
 
 func (mmu *MMU) writeByte(address uint16, value uint8) {
-	// TODO: add PPU, APU, etc.
+	if b := mmu.deviceAt(address); b != nil {
+		// Writes to devices cannot be undone
+		b.device.write(b.register(address), value)
+	} else {
+		if mmu.history != nil {
+			mmu.history.recordWrite(address, mmu.RAM[address])
+		}
+		mmu.RAM[address] = value
+	}
+	if mmu.watch != nil {
+		mmu.watch(address, value, true)
+	}
+}
+
+// peekByte reads a byte for the debugger, without it counting as a bus access
+func (mmu *MMU) peekByte(address uint16) uint8 {
+	if b := mmu.deviceAt(address); b != nil {
+		return b.device.peek(b.register(address))
+	}
+	return mmu.RAM[address]
+}
+
+// pokeByte writes a byte for the debugger, without it counting as a bus
+// access. Devices take it as a write.
+func (mmu *MMU) pokeByte(address uint16, value uint8) {
+	if b := mmu.deviceAt(address); b != nil {
+		b.device.write(b.register(address), value)
+		return
+	}
 	mmu.RAM[address] = value
 }
 
@@ -32,9 +82,13 @@ func (mmu *MMU) writeWord(address uint16, value uint16) {
 	mmu.writeByte(address+1, uint8(value>>8))
 }
 
-// Load a program into the memory
-func (mmu *MMU) loadProgram(program []uint8) {
-	for i, instruction := range program {
-		mmu.RAM[0x8000+uint16(i)] = instruction
+// Load a program into the memory at the given address
+func (mmu *MMU) loadProgram(program []uint8, address uint16) error {
+	// Make sure the program fits between the load address and the top of memory
+	if int(address)+len(program) > RAMSize {
+		return fmt.Errorf("program of %d bytes does not fit at $%04X (%d bytes available)",
+			len(program), address, RAMSize-int(address))
 	}
+	copy(mmu.RAM[address:], program)
+	return nil
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLoadProgram(t *testing.T) {
+	mmu := &MMU{}
+	if err := mmu.loadProgram([]uint8{0x01, 0x02}, 0xFFFE); err != nil {
+		t.Fatalf("a program that ends at the top of memory should fit: %v", err)
+	}
+	if mmu.RAM[0xFFFE] != 0x01 || mmu.RAM[0xFFFF] != 0x02 {
+		t.Errorf("expected $01 $02 at $FFFE, got $%02X $%02X", mmu.RAM[0xFFFE], mmu.RAM[0xFFFF])
+	}
+	if err := mmu.loadProgram([]uint8{0x01, 0x02}, 0xFFFF); err == nil {
+		t.Error("expected an error for a program that runs past the top of memory")
+	}
+}
+
+func TestReadWord(t *testing.T) {
+	mmu := &MMU{}
+	mmu.RAM[0x1234], mmu.RAM[0x1235] = 0xCD, 0xAB
+	if got := mmu.readWord(0x1234); got != 0xABCD {
+		t.Errorf("expected $ABCD, got $%04X", got)
+	}
+	// A word at the top of memory wraps around to the bottom
+	mmu.RAM[0xFFFF], mmu.RAM[0x0000] = 0x34, 0x12
+	if got := mmu.readWord(0xFFFF); got != 0x1234 {
+		t.Errorf("expected $1234, got $%04X", got)
+	}
+	mmu.writeWord(0x0300, 0xBEEF)
+	if mmu.RAM[0x0300] != 0xEF || mmu.RAM[0x0301] != 0xBE {
+		t.Errorf("expected $EF $BE, got $%02X $%02X", mmu.RAM[0x0300], mmu.RAM[0x0301])
+	}
+}
+
+func TestWatch(t *testing.T) {
+	mmu := &MMU{}
+	var accesses []busAccess
+	mmu.watch = func(address uint16, value uint8, write bool) {
+		accesses = append(accesses, busAccess{address, value, write})
+	}
+	mmu.writeByte(0x0010, 0x42)
+	mmu.readByte(0x0010)
+	// The debugger's peeks and pokes are not bus accesses
+	mmu.pokeByte(0x0011, 0x43)
+	mmu.peekByte(0x0011)
+	want := []busAccess{{0x0010, 0x42, true}, {0x0010, 0x42, false}}
+	if !reflect.DeepEqual(accesses, want) {
+		t.Errorf("expected %v, got %v", want, accesses)
+	}
+}
+
+func TestWritesAreUndone(t *testing.T) {
+	cpu := newTestCPU(t, NMOS6502, []uint8{0xA9, 0x42, 0x8D, 0x00, 0x03}) // LDA #$42 / STA $0300
+	cpu.MMU.pokeByte(0x0300, 0x99)
+	cpu.enableHistory(1 << 20)
+	cpu.step()
+	cpu.step()
+	if got := cpu.MMU.peekByte(0x0300); got != 0x42 {
+		t.Fatalf("expected $42 at $0300, got $%02X", got)
+	}
+	if !cpu.stepBack() {
+		t.Fatal("expected to step back")
+	}
+	if got := cpu.MMU.peekByte(0x0300); got != 0x99 {
+		t.Errorf("expected $99 back at $0300, got $%02X", got)
+	}
+	if cpu.PC != 0x8002 || cpu.A != 0x42 || cpu.cycles != 2 {
+		t.Errorf("expected PC=$8002 A=$42 after 2 cycles, got PC=$%04X A=$%02X after %d", cpu.PC, cpu.A, cpu.cycles)
+	}
+}
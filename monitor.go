@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Monitor is an interactive machine language monitor for a CPU, in the style
+// of the C64 and Apple II monitors
+type Monitor struct {
+	cpu *CPU
+	in  *bufio.Scanner
+	out io.Writer
+	// active is set while the monitor is waiting for commands
+	active atomic.Bool
+	// lastCommand is repeated when an empty line is entered
+	lastCommand string
+	// Where the m and d commands carry on from
+	memoryAddress      uint16
+	disassemblyAddress uint16
+	// suspend and resume, if set, are called on entering and leaving the
+	// monitor, for a device to give up the terminal meanwhile
+	suspend, resume func()
+}
+
+// NewMonitor creates a monitor for a CPU that reads commands from in and
+// writes to out
+func NewMonitor(cpu *CPU, in io.Reader, out io.Writer) *Monitor {
+	return &Monitor{cpu: cpu, in: bufio.NewScanner(in), out: out}
+}
+
+// monitorHelp describes the monitor commands
+const monitorHelp = `Commands (numbers are hex, or symbols from the debug info):
+  r [reg=value ...]        show registers, or set A X Y SP P PC and flags N V D I Z C
+  z [count]                step one or more instructions (also s)
+  n [count]                step over subroutine calls
+  g [address]              continue, optionally from an address (also c)
+  m [start [end]]          dump memory
+  > address byte ...       write bytes to memory
+  f start end byte ...     fill memory with a byte pattern
+  d [start [end]]          disassemble
+  a address [instruction]  assemble, one instruction per line until a blank line
+  u [count]                step backwards (needs --history)
+  ur                       run backwards to a breakpoint or watchpoint
+  uc cycle                 go back or forward to a cycle count
+  b [spec]                 list breakpoints, or set one (see below)
+  bd id|all                delete a breakpoint, or all of them
+  dump file                write a save state of the whole machine
+  undump file              restore a save state
+  irq on|off               hold the host's IRQ input low, or release it
+  nmi                      signal an NMI on the host's NMI input
+  x                        exit the emulator (also q)
+Breakpoint specs are [kind] [location] [hits count] [if condition], where the
+kind is exec (the default), read, write or access with an address or a
+start..end range, opcode with an opcode, or irq, nmi or interrupt. Conditions
+are expressions over registers, flags, symbols and [address], e.g.
+  b write 0200..02FF if A==$40 && [$0200]>3
+An empty line repeats z, n, u, m and d.`
+
+// printf writes formatted output
+func (m *Monitor) printf(format string, args ...interface{}) {
+	fmt.Fprintf(m.out, format, args...)
+}
+
+// enter runs the monitor until the user continues, returning true, or exits,
+// returning false
+func (m *Monitor) enter() bool {
+	if m.suspend != nil {
+		m.suspend()
+		defer m.resume()
+	}
+	m.active.Store(true)
+	defer m.active.Store(false)
+	m.cpu.stopRequested.Store(false)
+	m.disassemblyAddress = m.cpu.PC
+	m.showRegisters()
+	for {
+		m.printf(". ")
+		if !m.in.Scan() {
+			// End of input, so there is nothing more to do
+			m.printf("\n")
+			return false
+		}
+		line := strings.TrimSpace(m.in.Text())
+		if line == "" {
+			line = m.lastCommand
+			if line == "" {
+				continue
+			}
+		}
+		resume, quit := m.execute(line)
+		if quit {
+			return false
+		}
+		if resume {
+			m.cpu.stopRequested.Store(false)
+			return true
+		}
+	}
+}
+
+// execute runs a monitor command and reports whether to resume emulation or
+// quit
+func (m *Monitor) execute(line string) (resume, quit bool) {
+	// Allow the command letter to run straight into its first argument, as in >8000 01
+	command, rest := line[:1], line[1:]
+	if fields := strings.Fields(line); len(fields[0]) > 1 && isLetters(fields[0]) {
+		command, rest = fields[0], strings.TrimPrefix(line, fields[0])
+	}
+	args := strings.Fields(rest)
+	m.lastCommand = ""
+	var err error
+	switch strings.ToLower(command) {
+	case "?", "h", "help":
+		m.printf("%s\n", monitorHelp)
+	case "r":
+		err = m.registers(args)
+	case "z", "s", "n":
+		err = m.step(args, strings.ToLower(command) == "n")
+		m.lastCommand = command
+	case "u":
+		err = m.stepBack(args)
+		m.lastCommand = command
+	case "ur":
+		err = m.reverseContinue()
+	case "uc":
+		err = m.runToCycle(args)
+	case "g", "c":
+		if len(args) > 0 {
+			address, err := m.value(args[0])
+			if err != nil {
+				m.printf("?%v\n", err)
+				return false, false
+			}
+			m.cpu.PC = uint16(address)
+		}
+		return true, false
+	case "m":
+		err = m.dumpMemory(args)
+		m.lastCommand = "m"
+	case ">":
+		err = m.writeMemory(args)
+	case "f":
+		err = m.fillMemory(args)
+	case "d":
+		err = m.disassemble(args)
+		m.lastCommand = "d"
+	case "a":
+		err = m.assemble(strings.TrimSpace(rest))
+	case "b", "bl":
+		err = m.breakpoint(strings.TrimSpace(rest))
+	case "bd":
+		err = m.deleteBreakpoint(args)
+	case "dump":
+		err = m.dump(strings.TrimSpace(rest))
+	case "undump":
+		err = m.undump(strings.TrimSpace(rest))
+	case "irq":
+		err = m.hostIRQ(args)
+	case "nmi":
+		err = m.hostInput("nmi", 1)
+	case "x", "q":
+		return false, true
+	default:
+		err = fmt.Errorf("unknown command %q, try ?", command)
+	}
+	if err != nil {
+		m.printf("?%v\n", err)
+	}
+	return false, false
+}
+
+// isLetters reports whether s is made of letters only
+func isLetters(s string) bool {
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// value parses a number, which is hex by default, or evaluates an expression
+// over the debug info's symbols
+func (m *Monitor) value(s string) (int, error) {
+	if n, err := strconv.ParseUint(strings.TrimPrefix(s, "$"), 16, 32); err == nil {
+		return int(n), nil
+	}
+	return evalExpr(s, &exprContext{symbol: m.symbol, pc: int(m.cpu.PC)})
+}
+
+// symbol looks up a symbol in the debug info
+func (m *Monitor) symbol(name string) (int, bool) {
+	if m.cpu.debugInfo == nil {
+		return 0, false
+	}
+	value, ok := m.cpu.debugInfo.symbols[name]
+	return int(value), ok
+}
+
+// address parses a 16-bit address
+func (m *Monitor) address(s string) (uint16, error) {
+	value, err := m.value(s)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 || value >= RAMSize {
+		return 0, fmt.Errorf("address $%X is out of range", value)
+	}
+	return uint16(value), nil
+}
+
+// bytes parses a list of byte values
+func (m *Monitor) bytes(args []string) ([]uint8, error) {
+	var values []uint8
+	for _, arg := range args {
+		value, err := m.value(arg)
+		if err != nil {
+			return nil, err
+		}
+		if value < -128 || value > 0xFF {
+			return nil, fmt.Errorf("$%X is not a byte", value)
+		}
+		values = append(values, uint8(value))
+	}
+	return values, nil
+}
+
+// showRegisters prints the registers and the next instruction
+func (m *Monitor) showRegisters() {
+	cpu := m.cpu
+	m.printf("  PC  AC XR YR SP SR NV-BDIZC  CYCLES\n")
+	m.printf("  %04X %02X %02X %02X %02X %02X %s  %d\n", cpu.PC, cpu.A, cpu.X, cpu.Y, cpu.SP, cpu.P, flagString(cpu.P), cpu.cycles)
+	m.printf("  %s\n", m.disassemblyLine(cpu.PC))
+}
+
+// hostIRQ holds the host's IRQ input low, or releases it
+func (m *Monitor) hostIRQ(args []string) error {
+	if len(args) != 1 || args[0] != "on" && args[0] != "off" {
+		return fmt.Errorf("expected irq on or irq off")
+	}
+	return m.hostInput("irq", int(boolToInt(args[0] == "on")))
+}
+
+// hostInput sends input from the host through the input log, so that it is
+// recorded, taking effect when the CPU carries on
+func (m *Monitor) hostInput(source string, value int) error {
+	if m.cpu.input == nil {
+		return fmt.Errorf("there is no host input")
+	}
+	m.cpu.input.send(source, value)
+	return nil
+}
+
+// registerFlags maps the flag names accepted by r to their bits
+var registerFlags = map[string]byte{
+	"N": Negative, "V": Overflow, "B": Break, "D": Decimal, "I": Interrupt, "Z": Zero, "C": Carry,
+}
+
+// registers shows or sets the registers
+func (m *Monitor) registers(args []string) error {
+	cpu := m.cpu
+	for _, arg := range args {
+		name, text, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("expected register=value, got %q", arg)
+		}
+		value, err := m.value(text)
+		if err != nil {
+			return err
+		}
+		name = strings.ToUpper(name)
+		if flag, ok := registerFlags[name]; ok {
+			cpu.setFlag(flag, value != 0)
+			continue
+		}
+		if name == "PC" {
+			if value < 0 || value > 0xFFFF {
+				return fmt.Errorf("$%X does not fit in PC", value)
+			}
+			cpu.PC = uint16(value)
+			continue
+		}
+		if value < 0 || value > 0xFF {
+			return fmt.Errorf("$%X does not fit in %s", value, name)
+		}
+		switch name {
+		case "A":
+			cpu.A = uint8(value)
+		case "X":
+			cpu.X = uint8(value)
+		case "Y":
+			cpu.Y = uint8(value)
+		case "SP", "S":
+			cpu.SP = uint8(value)
+		case "P", "SR":
+			cpu.P = uint8(value)
+		default:
+			return fmt.Errorf("unknown register %q", name)
+		}
+	}
+	m.showRegisters()
+	return nil
+}
+
+// step executes one or more instructions, stepping over subroutine calls if
+// asked to
+func (m *Monitor) step(args []string, over bool) error {
+	count := 1
+	if len(args) > 0 {
+		value, err := m.value(args[0])
+		if err != nil {
+			return err
+		}
+		count = value
+	}
+	m.cpu.running = true
+	m.cpu.breakpoints.resume()
+	for i := 0; i < count; i++ {
+		if i > 0 && m.cpu.breakpoints.beforeInstruction() {
+			break
+		}
+		if over {
+			m.cpu.stepOver()
+		} else {
+			m.cpu.step()
+		}
+		if !m.cpu.running || m.cpu.stopRequested.Load() || m.cpu.breakpoints.stopped() {
+			break
+		}
+	}
+	if m.cpu.breakpoints.stopped() {
+		m.printf("%s\n", m.cpu.breakpoints.describeHit())
+	}
+	m.cpu.stopRequested.Store(false)
+	m.disassemblyAddress = m.cpu.PC
+	m.showRegisters()
+	return nil
+}
+
+// stepBack undoes one or more instructions
+func (m *Monitor) stepBack(args []string) error {
+	if m.cpu.history == nil {
+		return fmt.Errorf("there is no history, run with --history")
+	}
+	count := 1
+	if len(args) > 0 {
+		value, err := m.value(args[0])
+		if err != nil {
+			return err
+		}
+		count = value
+	}
+	m.cpu.breakpoints.resume()
+	for i := 0; i < count; i++ {
+		if !m.cpu.stepBack() {
+			m.printf("Reached the start of the history\n")
+			break
+		}
+	}
+	m.disassemblyAddress = m.cpu.PC
+	m.showRegisters()
+	return nil
+}
+
+// reverseContinue runs backwards to a breakpoint
+func (m *Monitor) reverseContinue() error {
+	if m.cpu.history == nil {
+		return fmt.Errorf("there is no history, run with --history")
+	}
+	if !m.cpu.reverseContinue() {
+		m.printf("Reached the start of the history\n")
+	} else if m.cpu.breakpoints.stopped() {
+		m.printf("%s\n", m.cpu.breakpoints.describeHit())
+	}
+	m.cpu.stopRequested.Store(false)
+	m.disassemblyAddress = m.cpu.PC
+	m.showRegisters()
+	return nil
+}
+
+// runToCycle goes back or forward to a cycle count, which is decimal
+func (m *Monitor) runToCycle(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: uc cycle")
+	}
+	cycle, err := strconv.Atoi(args[0])
+	if err != nil || cycle < 0 {
+		return fmt.Errorf("invalid cycle count %q", args[0])
+	}
+	if cycle < m.cpu.cycles && m.cpu.history == nil {
+		return fmt.Errorf("there is no history, run with --history")
+	}
+	if !m.cpu.runToCycle(cycle) {
+		m.printf("Reached the start of the history\n")
+	} else if m.cpu.breakpoints.stopped() {
+		m.printf("%s\n", m.cpu.breakpoints.describeHit())
+	}
+	m.cpu.stopRequested.Store(false)
+	m.disassemblyAddress = m.cpu.PC
+	m.showRegisters()
+	return nil
+}
+
+// addressRange parses optional start and end arguments. Without a start the
+// range carries on from next; without an end it covers length units.
+func (m *Monitor) addressRange(args []string, next uint16) (uint16, int, bool, error) {
+	start := next
+	if len(args) > 0 {
+		address, err := m.address(args[0])
+		if err != nil {
+			return 0, 0, false, err
+		}
+		start = address
+	}
+	if len(args) > 1 {
+		end, err := m.address(args[1])
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if end < start {
+			return 0, 0, false, fmt.Errorf("end $%04X is before start $%04X", end, start)
+		}
+		return start, int(end), true, nil
+	}
+	return start, 0, false, nil
+}
+
+// dumpMemory shows memory as hex and ASCII, 16 bytes to a line
+func (m *Monitor) dumpMemory(args []string) error {
+	start, end, hasEnd, err := m.addressRange(args, m.memoryAddress)
+	if err != nil {
+		return err
+	}
+	if !hasEnd {
+		// Show 128 bytes, stopping at the top of memory
+		end = int(start) + 0x7F
+		if end > 0xFFFF {
+			end = 0xFFFF
+		}
+	}
+	address := int(start)
+	for ; address <= end; address += 16 {
+		var hexPart, textPart strings.Builder
+		for i := 0; i < 16 && address+i <= end; i++ {
+			b := m.cpu.MMU.peekByte(uint16(address + i))
+			fmt.Fprintf(&hexPart, "%02X ", b)
+			if b >= 0x20 && b < 0x7F {
+				textPart.WriteByte(b)
+			} else {
+				textPart.WriteByte('.')
+			}
+		}
+		m.printf(">%04X %-48s %s\n", address, hexPart.String(), textPart.String())
+	}
+	m.memoryAddress = uint16(address)
+	return nil
+}
+
+// writeMemory writes bytes starting at an address
+func (m *Monitor) writeMemory(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: > address byte ...")
+	}
+	address, err := m.address(args[0])
+	if err != nil {
+		return err
+	}
+	values, err := m.bytes(args[1:])
+	if err != nil {
+		return err
+	}
+	for i, value := range values {
+		m.cpu.MMU.pokeByte(address+uint16(i), value)
+	}
+	return m.dumpMemory([]string{args[0], fmt.Sprintf("%X", int(address)+len(values)-1)})
+}
+
+// fillMemory fills a range with a repeating byte pattern
+func (m *Monitor) fillMemory(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("usage: f start end byte ...")
+	}
+	start, end, _, err := m.addressRange(args[:2], 0)
+	if err != nil {
+		return err
+	}
+	pattern, err := m.bytes(args[2:])
+	if err != nil {
+		return err
+	}
+	for address := int(start); address <= end; address++ {
+		m.cpu.MMU.pokeByte(uint16(address), pattern[(address-int(start))%len(pattern)])
+	}
+	return nil
+}
+
+// disassemblyLine formats the instruction at an address with its bytes
+func (m *Monitor) disassemblyLine(address uint16) string {
+	d := m.cpu.decode(address)
+	label := ""
+	if m.cpu.debugInfo != nil {
+		if name, ok := m.cpu.debugInfo.labelAt(address); ok {
+			label = name + ":"
+		}
+	}
+	return fmt.Sprintf("%04X  %-9s %-12s%s", address, hexBytes(d.bytes), label, d.text(m.cpu.formatAddress))
+}
+
+// disassemble lists the instructions in a range, or 16 of them
+func (m *Monitor) disassemble(args []string) error {
+	start, end, hasEnd, err := m.addressRange(args, m.disassemblyAddress)
+	if err != nil {
+		return err
+	}
+	address := int(start)
+	for count := 0; address <= 0xFFFF; count++ {
+		if (hasEnd && address > end) || (!hasEnd && count == 16) {
+			break
+		}
+		m.printf(". %s\n", m.disassemblyLine(uint16(address)))
+		address += len(m.cpu.decode(uint16(address)).bytes)
+	}
+	m.disassemblyAddress = uint16(address)
+	return nil
+}
+
+// assemble assembles instructions into memory, starting with the one on the
+// command line if there is one, then one per line until a blank line
+func (m *Monitor) assemble(rest string) error {
+	addressText, instruction, _ := strings.Cut(rest, " ")
+	if addressText == "" {
+		return fmt.Errorf("usage: a address [instruction]")
+	}
+	address, err := m.address(addressText)
+	if err != nil {
+		return err
+	}
+	instruction = strings.TrimSpace(instruction)
+	for {
+		if instruction == "" {
+			m.printf("a %04X ", address)
+			if !m.in.Scan() {
+				return nil
+			}
+			instruction = strings.TrimSpace(stripComment(m.in.Text()))
+			if instruction == "" {
+				return nil
+			}
+		}
+		mnemonic, operand, _ := strings.Cut(instruction, " ")
+		eval := func(s string) (int, error) {
+			return evalExpr(s, &exprContext{symbol: m.symbol, pc: int(address)})
+		}
+		code, _, err := encodeInstruction(m.cpu.variant, mnemonic, strings.TrimSpace(operand), int(address), 0, true, eval)
+		if err != nil {
+			m.printf("?%v\n", err)
+		} else {
+			for i, b := range code {
+				m.cpu.MMU.pokeByte(address+uint16(i), b)
+			}
+			m.printf(". %s\n", m.disassemblyLine(address))
+			address += uint16(len(code))
+		}
+		instruction = ""
+	}
+}
+
+// breakpoint lists the breakpoints, or sets one from a spec
+func (m *Monitor) breakpoint(spec string) error {
+	breakpoints := m.cpu.breakpoints
+	if spec == "" {
+		if len(breakpoints.breakpoints) == 0 {
+			m.printf("No breakpoints\n")
+		}
+		for _, bp := range breakpoints.breakpoints {
+			m.printf("%s\n", bp)
+		}
+		return nil
+	}
+	bp, err := parseBreakpoint(spec, m.value)
+	if err != nil {
+		return err
+	}
+	if err := breakpoints.add(bp); err != nil {
+		return err
+	}
+	m.printf("%s\n", bp)
+	return nil
+}
+
+// deleteBreakpoint deletes a breakpoint by its id, or all of them
+func (m *Monitor) deleteBreakpoint(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: bd id|all")
+	}
+	if strings.ToLower(args[0]) == "all" {
+		m.cpu.breakpoints.clear()
+		return nil
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return fmt.Errorf("invalid breakpoint id %q", args[0])
+	}
+	return m.cpu.breakpoints.remove(id)
+}
+
+// dump writes a save state
+func (m *Monitor) dump(fileName string) error {
+	if fileName == "" {
+		return fmt.Errorf("usage: dump file")
+	}
+	if err := m.cpu.saveStateFile(fileName); err != nil {
+		return err
+	}
+	m.printf("Saved the state at cycle %d to %s\n", m.cpu.cycles, fileName)
+	return nil
+}
+
+// undump restores a save state
+func (m *Monitor) undump(fileName string) error {
+	if fileName == "" {
+		return fmt.Errorf("usage: undump file")
+	}
+	if err := m.cpu.loadStateFile(fileName); err != nil {
+		return err
+	}
+	m.disassemblyAddress = m.cpu.PC
+	m.showRegisters()
+	return nil
+}
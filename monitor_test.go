@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// monitorProgram calls a subroutine that loads A and increments Y:
+//
+//	8000  LDX #$00
+//	8002  JSR $8010
+//	8005  INX
+//	8006  BRK
+//	8010  LDA #$42
+//	8012  INY
+//	8013  RTS
+var monitorProgram = []uint8{0xA2, 0x00, 0x20, 0x10, 0x80, 0xE8, 0x00}
+
+// newTestMonitor runs the monitor program under a monitor reading commands
+// from input
+func newTestMonitor(t *testing.T, input string) (*Monitor, *CPU, *bytes.Buffer) {
+	t.Helper()
+	cpu := newTestCPU(t, NMOS6502, monitorProgram)
+	for i, b := range []uint8{0xA9, 0x42, 0xC8, 0x60} {
+		cpu.MMU.pokeByte(0x8010+uint16(i), b)
+	}
+	cpu.breakpoints = newBreakpointSet(cpu)
+	cpu.clockSpeed = 1e9
+	out := &bytes.Buffer{}
+	return NewMonitor(cpu, strings.NewReader(input), out), cpu, out
+}
+
+// checkOutput checks that the monitor printed each of the lines wanted
+func checkOutput(t *testing.T, out *bytes.Buffer, want ...string) {
+	t.Helper()
+	for _, line := range want {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected %q in the output:\n%s", line, out)
+		}
+	}
+}
+
+func TestMonitorStep(t *testing.T) {
+	// An empty line repeats the step
+	m, cpu, out := newTestMonitor(t, "z\n\nz 2\nx\n")
+	if m.enter() {
+		t.Error("expected x to exit")
+	}
+	if cpu.PC != 0x8013 || cpu.Y != 0x01 || cpu.SP != 0xFB {
+		t.Errorf("expected to be at $8013 in the subroutine, at $%04X SP $%02X", cpu.PC, cpu.SP)
+	}
+	checkOutput(t, out,
+		"  PC  AC XR YR SP SR NV-BDIZC  CYCLES\n  8000 00 00 00 FD 04 nv-bdIzc  0\n  8000  A2 00                 LDX #$00\n",
+		"  8010  A9 42                 LDA #$42\n",
+		"  8013 42 00 01 FB 04 nv-bdIzc  12\n")
+}
+
+func TestMonitorStepOver(t *testing.T) {
+	m, cpu, out := newTestMonitor(t, "n\nn\n\nx\n")
+	m.enter()
+	if cpu.PC != 0x8006 || cpu.A != 0x42 || cpu.X != 0x01 || cpu.Y != 0x01 || cpu.SP != 0xFD {
+		t.Errorf("expected the subroutine to have run, at $%04X A $%02X X $%02X Y $%02X SP $%02X",
+			cpu.PC, cpu.A, cpu.X, cpu.Y, cpu.SP)
+	}
+	checkOutput(t, out,
+		"  8005 42 00 01 FD 04 nv-bdIzc  18\n  8005  E8                    INX\n",
+		"  8006 42 01 01 FD 04 nv-bdIzc  20\n")
+}
+
+func TestMonitorBreakpoints(t *testing.T) {
+	// Stepping over a call stops at a breakpoint inside it
+	m, cpu, out := newTestMonitor(t, "b 8012\nb write 0200..02FF if A==$42\nb\nn 3\nx\n")
+	m.enter()
+	if cpu.PC != 0x8012 {
+		t.Errorf("expected to stop at the breakpoint at $8012, at $%04X", cpu.PC)
+	}
+	checkOutput(t, out,
+		"#1 exec $8012 (hit 0 times)\n",
+		"#2 write $0200..$02FF if A==$42 (hit 0 times)\n",
+		"Breakpoint #1 exec $8012 (hit 1 times) at $8012\n")
+
+	// g continues, and the emulator runs until the next breakpoint, where
+	// the monitor is entered again
+	m, cpu, out = newTestMonitor(t, "b 8005\ng\nr\nbd 1\nb\nx\n")
+	if !m.enter() {
+		t.Fatal("expected g to continue")
+	}
+	cpu.run(false, nil)
+	if cpu.PC != 0x8005 || !cpu.breakpoints.stopped() {
+		t.Fatalf("expected to stop at the breakpoint at $8005, at $%04X", cpu.PC)
+	}
+	if m.enter() {
+		t.Error("expected x to exit")
+	}
+	checkOutput(t, out, "  8005 42 00 01 FD 04 nv-bdIzc  18\n")
+	if len(cpu.breakpoints.breakpoints) != 0 {
+		t.Errorf("expected bd to delete the breakpoint, %d left", len(cpu.breakpoints.breakpoints))
+	}
+
+	// Errors are reported without leaving the monitor
+	m, _, out = newTestMonitor(t, "b read\nbd 9\nfoo\nx\n")
+	m.enter()
+	if strings.Count(out.String(), ". ?") != 3 {
+		t.Errorf("expected three errors:\n%s", out)
+	}
+}
+
+func TestMonitorMemory(t *testing.T) {
+	m, cpu, out := newTestMonitor(t, "> 0200 01 02 03\nf 0203 0207 AA 55\nm 0200 0207\na 0300 lda ($10),y\nsta $0200\n\nd 0300 0304\nr a=7f c=1\nx\n")
+	m.enter()
+	if want := []uint8{0x01, 0x02, 0x03, 0xAA, 0x55, 0xAA, 0x55, 0xAA}; !bytes.Equal(cpu.MMU.RAM[0x0200:0x0208], want) {
+		t.Errorf("expected % X at $0200, got % X", want, cpu.MMU.RAM[0x0200:0x0208])
+	}
+	if cpu.A != 0x7F || !cpu.getFlag(Carry) {
+		t.Errorf("expected A $7F and carry set, got A $%02X P $%02X", cpu.A, cpu.P)
+	}
+	checkOutput(t, out,
+		">0200 01 02 03 AA 55 AA 55 AA",
+		"0300  B1 10                 LDA ($10),Y\n",
+		"0302  8D 00 02              STA $0200\n")
+}
@@ -0,0 +1,305 @@
+package main
+
+// The PIA's registers. Bit 2 of a control register selects whether its
+// port's data register or data direction register is at the address below.
+const (
+	piaPortA = 0x0 // output register A, or DDRA
+	piaCRA   = 0x1
+	piaPortB = 0x2 // output register B, or DDRB
+	piaCRB   = 0x3
+)
+
+// The bits of the control registers
+const (
+	piaC1Enable   uint8 = 0x01 // an active edge on C1 interrupts
+	piaC1Positive uint8 = 0x02 // rising edges on C1 are active, rather than falling ones
+	piaSelectOR   uint8 = 0x04 // the output register is selected, rather than the DDR
+	piaC2Enable   uint8 = 0x08 // as an input, an active edge on C2 interrupts
+	piaC2Positive uint8 = 0x10 // as an input, rising edges on C2 are active
+	piaC2Output   uint8 = 0x20 // C2 is an output, in the mode bits 3 and 4 set
+	piaC2Flag     uint8 = 0x40 // read only
+	piaC1Flag     uint8 = 0x80 // read only
+)
+
+// PIA is a 6520 or 6821 peripheral interface adapter: two 8-bit ports with
+// data direction registers, and the control lines CA1, CA2, CB1 and CB2 for
+// handshaking, with the IRQA and IRQB outputs wired together.
+//
+// CA2 and CB2 as outputs are either handshake lines, which go low when port
+// A is read or port B written and high on the next active edge of CA1 or
+// CB1, pulses low for a cycle after the same accesses, or set by bit 3 of the
+// control register. The pins the PIA drives can be watched by the host, which
+// can also drive the input pins, through the input log as <name>.pa,
+// <name>.pb, <name>.ca1, <name>.ca2, <name>.cb1 and <name>.cb2.
+type PIA struct {
+	label string
+	irq   func(active bool)
+
+	ports
+	cra, crb uint8
+	// The control lines as the outside world drives them
+	ca1, ca2, cb1, cb2 bool
+	// ca2Out and cb2Out are CA2 and CB2 when they are outputs
+	ca2Out, cb2Out bool
+	// ca2Pulse and cb2Pulse are set for the cycle a pulse output is low
+	ca2Pulse, cb2Pulse bool
+	// irqActive is whether the IRQ outputs are low
+	irqActive bool
+}
+
+// newPIA creates a PIA, with its IRQ outputs connected to irq
+func newPIA(label string, irq func(active bool)) *PIA {
+	p := &PIA{label: label, irq: irq}
+	p.reset()
+	return p
+}
+
+// reset puts the PIA in the state it comes out of reset in, with every
+// register clear
+func (p *PIA) reset() {
+	*p = PIA{label: p.label, irq: p.irq, ports: p.ports}
+	p.ports.reset(p.changed)
+	p.ca1, p.ca2, p.cb1, p.cb2 = true, true, true, true
+	p.ca2Out, p.cb2Out = true, true
+	p.lastPins = p.pins()
+	p.updateIRQ()
+}
+
+func (p *PIA) name() string { return p.label }
+
+func (p *PIA) size() int { return 4 }
+
+// pinC2 returns the level of a C2 line, given its control register, its
+// level as an output and whether it is pulsing, and as driven from outside
+func pinC2(cr uint8, out, pulse, outside bool) bool {
+	if cr&piaC2Output == 0 {
+		return outside
+	}
+	return out && !pulse
+}
+
+func (p *PIA) pinCA2() bool { return pinC2(p.cra, p.ca2Out, p.ca2Pulse, p.ca2) }
+
+func (p *PIA) pinCB2() bool { return pinC2(p.crb, p.cb2Out, p.cb2Pulse, p.cb2) }
+
+// pins returns the levels of the pins the PIA can drive
+func (p *PIA) pins() portPins {
+	return portPins{pa: p.portA(), pb: p.portB(), ca2: p.pinCA2(), cb2: p.pinCB2()}
+}
+
+// changed tells the watchers if the pins have changed
+func (p *PIA) changed() {
+	p.notify(p.pins())
+}
+
+// irqFrom returns whether a control register has an enabled flag set
+func irqFrom(cr uint8) bool {
+	return cr&piaC1Flag != 0 && cr&piaC1Enable != 0 ||
+		cr&piaC2Flag != 0 && cr&piaC2Enable != 0 && cr&piaC2Output == 0
+}
+
+// updateIRQ pulls the IRQ outputs low while any enabled flag is set
+func (p *PIA) updateIRQ() {
+	active := irqFrom(p.cra) || irqFrom(p.crb)
+	if active != p.irqActive {
+		p.irqActive = active
+		if p.irq != nil {
+			p.irq(active)
+		}
+	}
+}
+
+// c2Mode returns the mode of an output C2 line in a control register: 0 for
+// handshaking, 1 for pulses, or 2 or 3 to set it low or high
+func c2Mode(cr uint8) uint8 {
+	return cr >> 3 & 3
+}
+
+func (p *PIA) peek(register uint16) uint8 {
+	switch register {
+	case piaPortA:
+		if p.cra&piaSelectOR == 0 {
+			return p.a.ddr
+		}
+		return p.portA()
+	case piaCRA:
+		return p.cra
+	case piaPortB:
+		if p.crb&piaSelectOR == 0 {
+			return p.b.ddr
+		}
+		return p.portB()
+	default:
+		return p.crb
+	}
+}
+
+func (p *PIA) read(register uint16) uint8 {
+	value := p.peek(register)
+	// Reading a port clears its flags, and starts a CA2 handshake or pulse
+	switch {
+	case register == piaPortA && p.cra&piaSelectOR != 0:
+		p.cra &^= piaC1Flag | piaC2Flag
+		if p.cra&piaC2Output != 0 {
+			switch c2Mode(p.cra) {
+			case 0:
+				p.ca2Out = false
+			case 1:
+				p.ca2Pulse = true
+			}
+		}
+	case register == piaPortB && p.crb&piaSelectOR != 0:
+		p.crb &^= piaC1Flag | piaC2Flag
+	}
+	p.updateIRQ()
+	p.changed()
+	return value
+}
+
+// writeControl writes a control register, whose flags cannot be written,
+// returning the new value and the level of an output C2 line
+func writeControl(cr, value uint8, out bool) (uint8, bool) {
+	cr = cr&(piaC1Flag|piaC2Flag) | value&^(piaC1Flag|piaC2Flag)
+	if cr&piaC2Output != 0 {
+		// An output has no flag
+		cr &^= piaC2Flag
+		switch c2Mode(cr) {
+		case 2:
+			out = false
+		case 3:
+			out = true
+		}
+	}
+	return cr, out
+}
+
+func (p *PIA) write(register uint16, value uint8) {
+	switch register {
+	case piaPortA:
+		if p.cra&piaSelectOR == 0 {
+			p.a.ddr = value
+		} else {
+			p.a.or = value
+		}
+	case piaCRA:
+		p.cra, p.ca2Out = writeControl(p.cra, value, p.ca2Out)
+	case piaPortB:
+		if p.crb&piaSelectOR == 0 {
+			p.b.ddr = value
+			break
+		}
+		p.b.or = value
+		// Writing port B starts a CB2 handshake or pulse
+		if p.crb&piaC2Output != 0 {
+			switch c2Mode(p.crb) {
+			case 0:
+				p.cb2Out = false
+			case 1:
+				p.cb2Pulse = true
+			}
+		}
+	case piaCRB:
+		p.crb, p.cb2Out = writeControl(p.crb, value, p.cb2Out)
+	}
+	p.updateIRQ()
+	p.changed()
+}
+
+// tick ends pulses, which last a cycle
+func (p *PIA) tick(cycles int) {
+	if p.ca2Pulse || p.cb2Pulse {
+		p.ca2Pulse, p.cb2Pulse = false, false
+		p.changed()
+	}
+}
+
+// edgeC1 handles a change of a C1 line, flagging active edges, which end a
+// handshake on C2. It returns the new control register and C2 output.
+func edgeC1(cr uint8, level, out bool) (uint8, bool) {
+	if activeEdge(level, cr&piaC1Positive != 0) {
+		cr |= piaC1Flag
+		if cr&piaC2Output != 0 && c2Mode(cr) == 0 {
+			out = true
+		}
+	}
+	return cr, out
+}
+
+// edgeC2 handles a change of a C2 line, flagging active edges when it is an
+// input
+func edgeC2(cr uint8, level bool) uint8 {
+	if cr&piaC2Output == 0 && activeEdge(level, cr&piaC2Positive != 0) {
+		cr |= piaC2Flag
+	}
+	return cr
+}
+
+// setCA1, setCA2, setCB1 and setCB2 drive the control lines from outside
+func (p *PIA) setCA1(level bool) {
+	if level != p.ca1 {
+		p.ca1 = level
+		p.cra, p.ca2Out = edgeC1(p.cra, level, p.ca2Out)
+		p.updateIRQ()
+		p.changed()
+	}
+}
+
+func (p *PIA) setCA2(level bool) {
+	if level != p.ca2 {
+		p.ca2 = level
+		p.cra = edgeC2(p.cra, level)
+		p.updateIRQ()
+		p.changed()
+	}
+}
+
+func (p *PIA) setCB1(level bool) {
+	if level != p.cb1 {
+		p.cb1 = level
+		p.crb, p.cb2Out = edgeC1(p.crb, level, p.cb2Out)
+		p.updateIRQ()
+		p.changed()
+	}
+}
+
+func (p *PIA) setCB2(level bool) {
+	if level != p.cb2 {
+		p.cb2 = level
+		p.crb = edgeC2(p.crb, level)
+		p.updateIRQ()
+		p.changed()
+	}
+}
+
+// connectInput lets the host drive the ports and control lines
+func (p *PIA) connectInput(l *InputLog) {
+	p.connectPorts(l, p.label)
+	l.handle(p.label+".ca1", func(value int) { p.setCA1(value != 0) })
+	l.handle(p.label+".ca2", func(value int) { p.setCA2(value != 0) })
+	l.handle(p.label+".cb1", func(value int) { p.setCB1(value != 0) })
+	l.handle(p.label+".cb2", func(value int) { p.setCB2(value != 0) })
+}
+
+// String describes the pins, for showing them as they change
+func (p *PIA) String() string {
+	return p.pins().describe(true)
+}
+
+func (p *PIA) saveState(e *stateEncoder) {
+	for _, b := range []uint8{p.a.or, p.b.or, p.a.ddr, p.b.ddr, p.cra, p.crb, p.a.in, p.b.in} {
+		e.u8(b)
+	}
+	for _, b := range []bool{p.ca1, p.ca2, p.cb1, p.cb2, p.ca2Out, p.cb2Out, p.ca2Pulse, p.cb2Pulse, p.irqActive} {
+		e.bool(b)
+	}
+}
+
+func (p *PIA) loadState(d *stateDecoder) {
+	for _, b := range []*uint8{&p.a.or, &p.b.or, &p.a.ddr, &p.b.ddr, &p.cra, &p.crb, &p.a.in, &p.b.in} {
+		*b = d.u8()
+	}
+	for _, b := range []*bool{&p.ca1, &p.ca2, &p.cb1, &p.cb2, &p.ca2Out, &p.cb2Out, &p.ca2Pulse, &p.cb2Pulse, &p.irqActive} {
+		*b = d.bool()
+	}
+	p.lastPins = p.pins()
+}
@@ -0,0 +1,109 @@
+package main
+
+import "testing"
+
+func TestPIAPorts(t *testing.T) {
+	p := newPIA("pia", nil)
+	// Out of reset the DDR is selected, and bit 2 of the control register
+	// selects the output register
+	p.write(piaPortA, 0x0F)
+	if p.a.ddr != 0x0F || p.a.or != 0 {
+		t.Fatalf("expected the write to go to DDRA, DDRA $%02X ORA $%02X", p.a.ddr, p.a.or)
+	}
+	p.write(piaCRA, piaSelectOR)
+	p.write(piaPortA, 0xA5)
+	if p.a.ddr != 0x0F || p.a.or != 0xA5 {
+		t.Fatalf("expected the write to go to ORA, DDRA $%02X ORA $%02X", p.a.ddr, p.a.or)
+	}
+	if got := p.read(piaPortA); got != 0xF5 {
+		t.Errorf("port A: expected $F5, got $%02X", got)
+	}
+	p.write(piaCRA, 0)
+	if got := p.read(piaPortA); got != 0x0F {
+		t.Errorf("DDRA: expected $0F, got $%02X", got)
+	}
+	// The flags cannot be written
+	p.write(piaCRB, 0xFF)
+	if got := p.read(piaCRB); got != 0x3F {
+		t.Errorf("CRB: expected $3F, got $%02X", got)
+	}
+}
+
+func TestPIAInterrupts(t *testing.T) {
+	output, irq := recordIRQ()
+	p := newPIA("pia", output)
+	// CA1 interrupts on rising edges, and CA2 is an input flagging falling
+	// ones without interrupting
+	p.write(piaCRA, piaSelectOR|piaC1Enable|piaC1Positive)
+	p.setCA1(false)
+	if *irq || p.peek(piaCRA)&piaC1Flag != 0 {
+		t.Fatal("a falling edge should not be flagged")
+	}
+	p.setCA1(true)
+	if !*irq || p.read(piaCRA)&piaC1Flag == 0 {
+		t.Fatalf("expected a CA1 interrupt, CRA $%02X", p.peek(piaCRA))
+	}
+	p.setCA2(false)
+	if p.peek(piaCRA)&piaC2Flag == 0 {
+		t.Error("expected the CA2 flag")
+	}
+	// Reading the port clears both flags
+	p.read(piaPortA)
+	if *irq || p.peek(piaCRA)&(piaC1Flag|piaC2Flag) != 0 {
+		t.Errorf("expected the flags cleared, CRA $%02X", p.peek(piaCRA))
+	}
+	// Reading the DDR does not
+	p.write(piaCRB, piaC2Enable)
+	p.setCB2(false)
+	p.read(piaPortB)
+	if !*irq {
+		t.Error("expected a CB2 interrupt that reading DDRB leaves")
+	}
+}
+
+func TestPIAHandshake(t *testing.T) {
+	p := newPIA("pia", nil)
+	// CA2 handshakes: low on reading port A, high on the next active edge of
+	// CA1
+	p.write(piaCRA, piaSelectOR|piaC2Output)
+	if !p.pinCA2() {
+		t.Fatal("expected CA2 high before the handshake")
+	}
+	p.read(piaPortA)
+	if p.pinCA2() {
+		t.Fatal("expected CA2 low after reading port A")
+	}
+	p.setCA1(false)
+	if !p.pinCA2() {
+		t.Error("expected CA1 to end the handshake")
+	}
+	// CB2 pulses low for a cycle after port B is written
+	p.write(piaCRB, piaSelectOR|piaC2Output|piaC2Enable)
+	p.write(piaPortB, 0x42)
+	if p.pinCB2() {
+		t.Error("expected the pulse to be low")
+	}
+	p.tick(1)
+	if !p.pinCB2() {
+		t.Error("expected the pulse to end after a cycle")
+	}
+	// And bit 3 sets it when it is neither
+	p.write(piaCRB, piaC2Output|piaC2Positive)
+	if p.pinCB2() {
+		t.Error("expected CB2 set low")
+	}
+	p.write(piaCRB, piaC2Output|piaC2Positive|piaC2Enable)
+	if !p.pinCB2() {
+		t.Error("expected CB2 set high")
+	}
+
+	// The state goes in save states
+	var e stateEncoder
+	p.saveState(&e)
+	saved := *p
+	p.reset()
+	p.loadState(&stateDecoder{data: e.buf})
+	if p.cra != saved.cra || p.crb != saved.crb || p.ports.a != saved.ports.a || p.ports.b != saved.ports.b || p.cb2Out != saved.cb2Out {
+		t.Errorf("PIA state not restored: %+v, expected %+v", p, saved)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import "fmt"
+
+// port is an 8-bit I/O port with a data direction register, as the VIA, RIOT
+// and PIA have. Pins whose DDR bit is set are outputs, and the rest inputs.
+type port struct {
+	or, ddr uint8
+	// in is the levels the outside world drives the pins to; pins that nothing
+	// drives are pulled up
+	in uint8
+}
+
+// pins returns the levels of the pins: the output register where the pins
+// are outputs, and what drives them from outside where they are inputs
+func (p *port) pins() uint8 {
+	return p.or&p.ddr | p.in&^p.ddr
+}
+
+// portPins are the levels of the pins a device with ports can drive: the
+// ports, and the CA2 and CB2 control lines of the devices that have them
+type portPins struct {
+	pa, pb   uint8
+	ca2, cb2 bool
+}
+
+// describe describes the pins, for showing them as they change, with the
+// control lines if c2 is set
+func (p portPins) describe(c2 bool) string {
+	s := fmt.Sprintf("PA %08b PB %08b", p.pa, p.pb)
+	if c2 {
+		s += fmt.Sprintf(" CA2 %d CB2 %d", boolToInt(p.ca2), boolToInt(p.cb2))
+	}
+	return s
+}
+
+// ports are the two ports of a VIA, RIOT or PIA, which the host can watch and
+// drive. The device calls notify with its pins whenever they may have changed.
+type ports struct {
+	a, b port
+	// onChange is the device's, called when the host drives the pins
+	onChange func()
+	// watchers are told when the pins the device drives change
+	watchers []func()
+	lastPins portPins
+}
+
+// reset puts the ports in the state they come out of reset in, with every pin
+// an input, keeping the watchers
+func (p *ports) reset(onChange func()) {
+	*p = ports{a: port{in: 0xFF}, b: port{in: 0xFF}, onChange: onChange, watchers: p.watchers}
+}
+
+// watch calls a function whenever the pins the device drives change
+func (p *ports) watch(f func()) {
+	p.watchers = append(p.watchers, f)
+}
+
+// notify tells the watchers if the pins have changed, returning them as they
+// were before
+func (p *ports) notify(pins portPins) portPins {
+	last := p.lastPins
+	if pins != last {
+		p.lastPins = pins
+		for _, f := range p.watchers {
+			f()
+		}
+	}
+	return last
+}
+
+// portA and portB return the levels of the port pins
+func (p *ports) portA() uint8 { return p.a.pins() }
+func (p *ports) portB() uint8 { return p.b.pins() }
+
+// setPortA and setPortB drive the port pins from outside
+func (p *ports) setPortA(value uint8) {
+	p.a.in = value
+	p.onChange()
+}
+
+func (p *ports) setPortB(value uint8) {
+	p.b.in = value
+	p.onChange()
+}
+
+// connectPorts lets the host drive the ports, through the input log as
+// <label>.pa and <label>.pb
+func (p *ports) connectPorts(l *InputLog, label string) {
+	l.handle(label+".pa", func(value int) { p.setPortA(uint8(value)) })
+	l.handle(label+".pb", func(value int) { p.setPortB(uint8(value)) })
+}
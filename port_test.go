@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// recordIRQ returns an IRQ output for a device that records whether it is
+// active in irq
+func recordIRQ() (output func(active bool), irq *bool) {
+	irq = new(bool)
+	return func(active bool) { *irq = active }, irq
+}
+
+func TestPorts(t *testing.T) {
+	var p ports
+	p.reset(func() { p.notify(portPins{pa: p.portA(), pb: p.portB()}) })
+	var seen []uint8
+	p.watch(func() { seen = append(seen, p.portB()) })
+	// Pins that nothing drives are pulled up
+	if p.portA() != 0xFF || p.portB() != 0xFF {
+		t.Fatalf("expected the pins pulled up, PA $%02X PB $%02X", p.portA(), p.portB())
+	}
+	// Half of port B outputs, and the outside world drives the rest low
+	p.b.ddr = 0xF0
+	p.onChange()
+	p.b.or = 0xA5
+	p.onChange()
+	p.setPortB(0x00)
+	if got := p.portB(); got != 0xA0 {
+		t.Errorf("port B pins: expected $A0, got $%02X", got)
+	}
+	// The watchers are only told about changes
+	p.onChange()
+	if !bytes.Equal(seen, []uint8{0x0F, 0xAF, 0xA0}) {
+		t.Errorf("watchers saw %X, expected [0F AF A0]", seen)
+	}
+
+	// The host drives the inputs through the input log
+	l := &InputLog{handlers: map[string]func(int){}}
+	p.connectPorts(l, "dev")
+	p.a.ddr = 0x0F
+	l.apply(inputEvent{source: "dev.pa", value: 0x3C})
+	if got := p.portA(); got != 0x30 {
+		t.Errorf("port A pins: expected $30, got $%02X", got)
+	}
+	if p.lastPins.pa != 0x30 {
+		t.Errorf("expected the device told of the change, last PA $%02X", p.lastPins.pa)
+	}
+
+	// Reset makes every pin an input again, keeping the watchers
+	p.reset(p.onChange)
+	if p.portA() != 0xFF || p.portB() != 0xFF || len(p.watchers) != 1 {
+		t.Errorf("expected reset to pull the pins up and keep the watchers, PA $%02X PB $%02X", p.portA(), p.portB())
+	}
+}
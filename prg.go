@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// basicSysToken is the Commodore BASIC V2 token for SYS
+const basicSysToken = 0x9E
+
+// parsePRG parses a Commodore PRG file: a two byte little-endian load address
+// followed by the data to load there
+func parsePRG(data []uint8) (*programImage, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("PRG file is too short to hold a load address")
+	}
+	address := uint16(data[0]) | uint16(data[1])<<8
+	payload := data[2:]
+	if int(address)+len(payload) > RAMSize {
+		return nil, fmt.Errorf("%d bytes at $%04X run past the end of memory", len(payload), address)
+	}
+	img := &programImage{}
+	img.addData(address, payload)
+	// A BASIC stub such as 10 SYS 2061 declares where the machine code starts,
+	// otherwise the program runs from its load address
+	if run, ok := basicSysAddress(payload); ok {
+		img.run = run
+	} else {
+		img.run = address
+	}
+	img.hasRun = true
+	return img, nil
+}
+
+// basicSysAddress looks for a SYS statement in the first line of a tokenised
+// BASIC program and returns the address it calls
+func basicSysAddress(program []uint8) (uint16, bool) {
+	// Skip the next-line link and the line number
+	if len(program) < 5 {
+		return 0, false
+	}
+	line := program[4:]
+	for i, b := range line {
+		// The line ends at a zero byte
+		if b == 0 {
+			return 0, false
+		}
+		if b != basicSysToken {
+			continue
+		}
+		// Collect the digits after SYS, skipping spaces and brackets
+		digits := ""
+		for _, c := range line[i+1:] {
+			if c >= '0' && c <= '9' {
+				digits += string(rune(c))
+			} else if digits != "" || (c != ' ' && c != '(') {
+				break
+			}
+		}
+		address, err := strconv.ParseUint(digits, 10, 16)
+		if err != nil {
+			return 0, false
+		}
+		return uint16(address), true
+	}
+	return 0, false
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// refCPU is a deliberately plain model of the NMOS 6502's documented
+// instructions, written from the datasheet without sharing any code with the
+// emulator, so that the fuzz tests have something independent to compare it
+// with. It runs one instruction at a time on a flat 64K of memory.
+type refCPU struct {
+	a, x, y, s, p uint8
+	pc            uint16
+	cycles        int
+	mem           []uint8
+}
+
+// The status register bits, as the datasheet numbers them
+const (
+	refC = 1 << iota
+	refZ
+	refI
+	refD
+	refB
+	refU
+	refV
+	refN
+)
+
+// refOp is one opcode of the reference model
+type refOp struct {
+	name, mode string
+	cycles     int
+}
+
+// refOpTable is the opcode matrix from the datasheet, one row for each high
+// nibble. Each entry is name/mode/cycles, or - for an undocumented opcode.
+var refOpTable = [16]string{
+	"BRK/imp/7 ORA/izx/6 - - - ORA/zp/3 ASL/zp/5 - PHP/imp/3 ORA/imm/2 ASL/acc/2 - - ORA/abs/4 ASL/abs/6 -",
+	"BPL/rel/2 ORA/izy/5 - - - ORA/zpx/4 ASL/zpx/6 - CLC/imp/2 ORA/aby/4 - - - ORA/abx/4 ASL/abx/7 -",
+	"JSR/abs/6 AND/izx/6 - - BIT/zp/3 AND/zp/3 ROL/zp/5 - PLP/imp/4 AND/imm/2 ROL/acc/2 - BIT/abs/4 AND/abs/4 ROL/abs/6 -",
+	"BMI/rel/2 AND/izy/5 - - - AND/zpx/4 ROL/zpx/6 - SEC/imp/2 AND/aby/4 - - - AND/abx/4 ROL/abx/7 -",
+	"RTI/imp/6 EOR/izx/6 - - - EOR/zp/3 LSR/zp/5 - PHA/imp/3 EOR/imm/2 LSR/acc/2 - JMP/abs/3 EOR/abs/4 LSR/abs/6 -",
+	"BVC/rel/2 EOR/izy/5 - - - EOR/zpx/4 LSR/zpx/6 - CLI/imp/2 EOR/aby/4 - - - EOR/abx/4 LSR/abx/7 -",
+	"RTS/imp/6 ADC/izx/6 - - - ADC/zp/3 ROR/zp/5 - PLA/imp/4 ADC/imm/2 ROR/acc/2 - JMP/ind/5 ADC/abs/4 ROR/abs/6 -",
+	"BVS/rel/2 ADC/izy/5 - - - ADC/zpx/4 ROR/zpx/6 - SEI/imp/2 ADC/aby/4 - - - ADC/abx/4 ROR/abx/7 -",
+	"- STA/izx/6 - - STY/zp/3 STA/zp/3 STX/zp/3 - DEY/imp/2 - TXA/imp/2 - STY/abs/4 STA/abs/4 STX/abs/4 -",
+	"BCC/rel/2 STA/izy/6 - - STY/zpx/4 STA/zpx/4 STX/zpy/4 - TYA/imp/2 STA/aby/5 TXS/imp/2 - - STA/abx/5 - -",
+	"LDY/imm/2 LDA/izx/6 LDX/imm/2 - LDY/zp/3 LDA/zp/3 LDX/zp/3 - TAY/imp/2 LDA/imm/2 TAX/imp/2 - LDY/abs/4 LDA/abs/4 LDX/abs/4 -",
+	"BCS/rel/2 LDA/izy/5 - - LDY/zpx/4 LDA/zpx/4 LDX/zpy/4 - CLV/imp/2 LDA/aby/4 TSX/imp/2 - LDY/abx/4 LDA/abx/4 LDX/aby/4 -",
+	"CPY/imm/2 CMP/izx/6 - - CPY/zp/3 CMP/zp/3 DEC/zp/5 - INY/imp/2 CMP/imm/2 DEX/imp/2 - CPY/abs/4 CMP/abs/4 DEC/abs/6 -",
+	"BNE/rel/2 CMP/izy/5 - - - CMP/zpx/4 DEC/zpx/6 - CLD/imp/2 CMP/aby/4 - - - CMP/abx/4 DEC/abx/7 -",
+	"CPX/imm/2 SBC/izx/6 - - CPX/zp/3 SBC/zp/3 INC/zp/5 - INX/imp/2 SBC/imm/2 NOP/imp/2 - CPX/abs/4 SBC/abs/4 INC/abs/6 -",
+	"BEQ/rel/2 SBC/izy/5 - - - SBC/zpx/4 INC/zpx/6 - SED/imp/2 SBC/aby/4 - - - SBC/abx/4 INC/abx/7 -",
+}
+
+// refOps is refOpTable decoded, indexed by opcode
+var refOps = decodeRefOps()
+
+func decodeRefOps() [256]*refOp {
+	var ops [256]*refOp
+	for row, line := range refOpTable {
+		for column, entry := range strings.Fields(line) {
+			if entry == "-" {
+				continue
+			}
+			op := &refOp{}
+			parts := strings.Split(entry, "/")
+			op.name, op.mode = parts[0], parts[1]
+			fmt.Sscan(parts[2], &op.cycles)
+			ops[row<<4|column] = op
+		}
+	}
+	return ops
+}
+
+func (r *refCPU) read(address uint16) uint8 { return r.mem[address] }
+
+func (r *refCPU) write(address uint16, value uint8) { r.mem[address] = value }
+
+func (r *refCPU) flag(bit uint8) bool { return r.p&bit != 0 }
+
+func (r *refCPU) set(bit uint8, on bool) {
+	if on {
+		r.p |= bit
+	} else {
+		r.p &^= bit
+	}
+}
+
+func (r *refCPU) nz(value uint8) uint8 {
+	r.set(refZ, value == 0)
+	r.set(refN, value >= 0x80)
+	return value
+}
+
+func (r *refCPU) push(value uint8) {
+	r.write(0x0100+uint16(r.s), value)
+	r.s--
+}
+
+func (r *refCPU) pull() uint8 {
+	r.s++
+	return r.read(0x0100 + uint16(r.s))
+}
+
+// next reads the byte at the PC and moves past it
+func (r *refCPU) next() uint8 {
+	value := r.read(r.pc)
+	r.pc++
+	return value
+}
+
+// address works out the effective address of an operand, and whether
+// indexing it crossed a page
+func (r *refCPU) address(mode string) (uint16, bool) {
+	switch mode {
+	case "imm":
+		r.pc++
+		return r.pc - 1, false
+	case "zp":
+		return uint16(r.next()), false
+	case "zpx":
+		return uint16(r.next() + r.x), false
+	case "zpy":
+		return uint16(r.next() + r.y), false
+	case "abs":
+		lo := r.next()
+		return uint16(r.next())<<8 | uint16(lo), false
+	case "abx", "aby":
+		lo := r.next()
+		base := uint16(r.next())<<8 | uint16(lo)
+		index := r.x
+		if mode == "aby" {
+			index = r.y
+		}
+		target := base + uint16(index)
+		return target, target&0xFF00 != base&0xFF00
+	case "ind":
+		// The high byte of the pointer is not carried into
+		lo, hi := r.next(), r.next()
+		return uint16(r.read(uint16(hi)<<8|uint16(lo+1)))<<8 | uint16(r.read(uint16(hi)<<8|uint16(lo))), false
+	case "izx":
+		z := r.next() + r.x
+		return uint16(r.read(uint16(z+1)))<<8 | uint16(r.read(uint16(z))), false
+	case "izy":
+		z := r.next()
+		base := uint16(r.read(uint16(z+1)))<<8 | uint16(r.read(uint16(z)))
+		target := base + uint16(r.y)
+		return target, target&0xFF00 != base&0xFF00
+	case "rel":
+		offset := int8(r.next())
+		return r.pc + uint16(offset), false
+	}
+	return 0, false
+}
+
+// step runs one instruction, returning false if the opcode is undocumented
+func (r *refCPU) step() bool {
+	op := refOps[r.read(r.pc)]
+	if op == nil {
+		return false
+	}
+	r.pc++
+	r.cycles += op.cycles
+	address, crossed := r.address(op.mode)
+	// Reads that index across a page take a cycle to fix the high byte
+	load := func() uint8 {
+		if crossed {
+			r.cycles++
+		}
+		return r.read(address)
+	}
+	// modify runs a read-modify-write on the accumulator or memory
+	modify := func(f func(uint8) uint8) {
+		if op.mode == "acc" {
+			r.a = r.nz(f(r.a))
+			return
+		}
+		r.write(address, r.nz(f(r.read(address))))
+	}
+	branch := func(taken bool) {
+		if taken {
+			r.cycles++
+			if address&0xFF00 != r.pc&0xFF00 {
+				r.cycles++
+			}
+			r.pc = address
+		}
+	}
+	compare := func(register uint8) {
+		value := load()
+		r.set(refC, register >= value)
+		r.nz(register - value)
+	}
+
+	switch op.name {
+	case "LDA":
+		r.a = r.nz(load())
+	case "LDX":
+		r.x = r.nz(load())
+	case "LDY":
+		r.y = r.nz(load())
+	case "STA":
+		r.write(address, r.a)
+	case "STX":
+		r.write(address, r.x)
+	case "STY":
+		r.write(address, r.y)
+	case "TAX":
+		r.x = r.nz(r.a)
+	case "TAY":
+		r.y = r.nz(r.a)
+	case "TXA":
+		r.a = r.nz(r.x)
+	case "TYA":
+		r.a = r.nz(r.y)
+	case "TSX":
+		r.x = r.nz(r.s)
+	case "TXS":
+		r.s = r.x
+	case "PHA":
+		r.push(r.a)
+	case "PHP":
+		r.push(r.p | refB | refU)
+	case "PLA":
+		r.a = r.nz(r.pull())
+	case "PLP":
+		r.p = r.pull() &^ (refB | refU)
+	case "AND":
+		r.a = r.nz(r.a & load())
+	case "ORA":
+		r.a = r.nz(r.a | load())
+	case "EOR":
+		r.a = r.nz(r.a ^ load())
+	case "BIT":
+		value := load()
+		r.set(refZ, r.a&value == 0)
+		r.set(refN, value&0x80 != 0)
+		r.set(refV, value&0x40 != 0)
+	case "ADC":
+		r.addWithCarry(load())
+	case "SBC":
+		r.subtractWithBorrow(load())
+	case "CMP":
+		compare(r.a)
+	case "CPX":
+		compare(r.x)
+	case "CPY":
+		compare(r.y)
+	case "INC":
+		modify(func(v uint8) uint8 { return v + 1 })
+	case "DEC":
+		modify(func(v uint8) uint8 { return v - 1 })
+	case "INX":
+		r.x = r.nz(r.x + 1)
+	case "INY":
+		r.y = r.nz(r.y + 1)
+	case "DEX":
+		r.x = r.nz(r.x - 1)
+	case "DEY":
+		r.y = r.nz(r.y - 1)
+	case "ASL":
+		modify(func(v uint8) uint8 { r.set(refC, v&0x80 != 0); return v << 1 })
+	case "LSR":
+		modify(func(v uint8) uint8 { r.set(refC, v&1 != 0); return v >> 1 })
+	case "ROL":
+		modify(func(v uint8) uint8 {
+			carry := r.p & refC
+			r.set(refC, v&0x80 != 0)
+			return v<<1 | carry
+		})
+	case "ROR":
+		modify(func(v uint8) uint8 {
+			carry := r.p & refC
+			r.set(refC, v&1 != 0)
+			return v>>1 | carry<<7
+		})
+	case "JMP":
+		r.pc = address
+	case "JSR":
+		// The address pushed is that of the last byte of the JSR
+		r.pc--
+		r.push(uint8(r.pc >> 8))
+		r.push(uint8(r.pc))
+		r.pc = address
+	case "RTS":
+		lo := r.pull()
+		r.pc = (uint16(r.pull())<<8 | uint16(lo)) + 1
+	case "BRK":
+		// BRK skips a padding byte
+		r.pc++
+		r.push(uint8(r.pc >> 8))
+		r.push(uint8(r.pc))
+		r.push(r.p | refB | refU)
+		r.set(refI, true)
+		r.pc = uint16(r.read(0xFFFF))<<8 | uint16(r.read(0xFFFE))
+	case "RTI":
+		r.p = r.pull() &^ (refB | refU)
+		lo := r.pull()
+		r.pc = uint16(r.pull())<<8 | uint16(lo)
+	case "BPL":
+		branch(!r.flag(refN))
+	case "BMI":
+		branch(r.flag(refN))
+	case "BVC":
+		branch(!r.flag(refV))
+	case "BVS":
+		branch(r.flag(refV))
+	case "BCC":
+		branch(!r.flag(refC))
+	case "BCS":
+		branch(r.flag(refC))
+	case "BNE":
+		branch(!r.flag(refZ))
+	case "BEQ":
+		branch(r.flag(refZ))
+	case "CLC":
+		r.set(refC, false)
+	case "SEC":
+		r.set(refC, true)
+	case "CLI":
+		r.set(refI, false)
+	case "SEI":
+		r.set(refI, true)
+	case "CLD":
+		r.set(refD, false)
+	case "SED":
+		r.set(refD, true)
+	case "CLV":
+		r.set(refV, false)
+	case "NOP":
+	}
+	return true
+}
+
+// addWithCarry adds in binary or, on the NMOS part, in decimal, where N and V
+// come from the sum before the high digit is adjusted and Z from the binary sum
+func (r *refCPU) addWithCarry(value uint8) {
+	carry := int(r.p & refC)
+	a, b := int(r.a), int(value)
+	binary := a + b + carry
+	if !r.flag(refD) {
+		r.set(refC, binary > 0xFF)
+		r.set(refV, (a^binary)&(b^binary)&0x80 != 0)
+		r.a = r.nz(uint8(binary))
+		return
+	}
+	lo := a&0x0F + b&0x0F + carry
+	hi := a>>4 + b>>4
+	if lo > 9 {
+		lo += 6
+	}
+	if lo > 0x0F {
+		hi++
+	}
+	r.set(refZ, uint8(binary) == 0)
+	r.set(refN, hi&0x08 != 0)
+	r.set(refV, (a^hi<<4)&(b^hi<<4)&0x80 != 0)
+	if hi > 9 {
+		hi += 6
+	}
+	r.set(refC, hi > 0x0F)
+	r.a = uint8(hi<<4 | lo&0x0F)
+}
+
+// subtractWithBorrow subtracts in binary or decimal. In decimal the NMOS part
+// sets every flag as it would in binary.
+func (r *refCPU) subtractWithBorrow(value uint8) {
+	borrow := 1 - int(r.p&refC)
+	a, b := int(r.a), int(value)
+	binary := a - b - borrow
+	r.set(refC, binary >= 0)
+	r.set(refV, (a^b)&(a^binary)&0x80 != 0)
+	r.nz(uint8(binary))
+	if !r.flag(refD) {
+		r.a = uint8(binary)
+		return
+	}
+	lo := a&0x0F - b&0x0F - borrow
+	hi := a>>4 - b>>4
+	if lo < 0 {
+		lo -= 6
+		hi--
+	}
+	if hi < 0 {
+		hi -= 6
+	}
+	r.a = uint8(hi<<4 | lo&0x0F)
+}
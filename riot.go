@@ -0,0 +1,241 @@
+package main
+
+// The RIOT's I/O registers, selected by the low three address lines when the
+// RAM is not
+const (
+	riotORA  = 0x0 // port A
+	riotDDRA = 0x1
+	riotORB  = 0x2 // port B
+	riotDDRB = 0x3
+	// With A2 set, reads of even registers read the timer, and reads of odd
+	// ones the interrupt flags. Writes with A4 set start the timer, at the
+	// rate A0 and A1 select, and other writes set the PA7 edge detection.
+	riotTimer = 0x4
+	riotFlags = 0x5
+)
+
+// riotRAMSize is the number of bytes of RAM, at the bottom of the registers
+const riotRAMSize = 128
+
+// The interrupt flags, as they are read
+const (
+	riotPA7Flag   uint8 = 0x40
+	riotTimerFlag uint8 = 0x80
+)
+
+// riotPrescalers are the rates the timer can count at, in cycles a count
+var riotPrescalers = [4]int{1, 8, 64, 1024}
+
+// RIOT is a 6532 RAM-I/O-timer: 128 bytes of RAM, two 8-bit ports with data
+// direction registers, an interval timer that counts down every 1, 8, 64 or
+// 1024 cycles, and an IRQ output for the timer running out or an edge on PA7.
+//
+// A7 is its RS line, so its 256 registers are the RAM at $00-$7F, with the
+// I/O and timer registers at $80-$FF, decoded from A0-A4. The host can watch
+// the ports, and drive the inputs through the input log as <name>.pa and
+// <name>.pb.
+type RIOT struct {
+	label string
+	irq   func(active bool)
+
+	ram [riotRAMSize]uint8
+	ports
+
+	timer uint8
+	// prescale is the cycles a count takes, which is one once the timer has
+	// run out, and divider the cycles to the next count
+	prescale, divider int
+	timerFlag         bool
+	timerEnabled      bool // the timer interrupts when it runs out
+	pa7Flag           bool
+	pa7Enabled        bool // an edge on PA7 interrupts
+	pa7Positive       bool // rising edges on PA7 set the flag, rather than falling ones
+	// irqActive is whether the IRQ output is low
+	irqActive bool
+}
+
+// newRIOT creates a RIOT, with its IRQ output connected to irq
+func newRIOT(label string, irq func(active bool)) *RIOT {
+	r := &RIOT{label: label, irq: irq}
+	r.reset()
+	return r
+}
+
+// reset puts the RIOT in the state it comes out of reset in. The RAM and the
+// timer are left as they were.
+func (r *RIOT) reset() {
+	*r = RIOT{label: r.label, irq: r.irq, ports: r.ports, ram: r.ram, timer: r.timer}
+	r.ports.reset(r.changed)
+	r.prescale, r.divider = 1024, 1024
+	r.lastPins = r.pins()
+	r.updateIRQ()
+}
+
+func (r *RIOT) name() string { return r.label }
+
+func (r *RIOT) size() int { return 256 }
+
+// pins returns the levels of the port pins
+func (r *RIOT) pins() portPins {
+	return portPins{pa: r.portA(), pb: r.portB()}
+}
+
+// changed tells the watchers if the pins have changed, and flags edges on PA7
+func (r *RIOT) changed() {
+	pins := r.pins()
+	last := r.notify(pins)
+	if pa7 := pins.pa&0x80 != 0; pa7 != (last.pa&0x80 != 0) && activeEdge(pa7, r.pa7Positive) {
+		r.pa7Flag = true
+		r.updateIRQ()
+	}
+}
+
+// updateIRQ pulls the IRQ output low while an enabled flag is set
+func (r *RIOT) updateIRQ() {
+	active := r.timerFlag && r.timerEnabled || r.pa7Flag && r.pa7Enabled
+	if active != r.irqActive {
+		r.irqActive = active
+		if r.irq != nil {
+			r.irq(active)
+		}
+	}
+}
+
+// flags returns the interrupt flags register
+func (r *RIOT) flags() uint8 {
+	var flags uint8
+	if r.timerFlag {
+		flags |= riotTimerFlag
+	}
+	if r.pa7Flag {
+		flags |= riotPA7Flag
+	}
+	return flags
+}
+
+func (r *RIOT) peek(register uint16) uint8 {
+	if register < riotRAMSize {
+		return r.ram[register]
+	}
+	switch {
+	case register&0x04 == 0:
+		switch register & 0x03 {
+		case riotORA:
+			return r.portA()
+		case riotDDRA:
+			return r.a.ddr
+		case riotORB:
+			return r.portB()
+		default:
+			return r.b.ddr
+		}
+	case register&0x05 == riotTimer:
+		return r.timer
+	default:
+		return r.flags()
+	}
+}
+
+func (r *RIOT) read(register uint16) uint8 {
+	value := r.peek(register)
+	if register >= riotRAMSize && register&0x04 != 0 {
+		if register&0x05 == riotTimer {
+			// Reading the timer clears its flag, and A3 enables its interrupt
+			r.timerFlag = false
+			r.timerEnabled = register&0x08 != 0
+		} else {
+			r.pa7Flag = false
+		}
+		r.updateIRQ()
+	}
+	return value
+}
+
+func (r *RIOT) write(register uint16, value uint8) {
+	if register < riotRAMSize {
+		r.ram[register] = value
+		return
+	}
+	switch {
+	case register&0x04 == 0:
+		switch register & 0x03 {
+		case riotORA:
+			r.a.or = value
+		case riotDDRA:
+			r.a.ddr = value
+		case riotORB:
+			r.b.or = value
+		default:
+			r.b.ddr = value
+		}
+		r.changed()
+	case register&0x10 != 0:
+		// The timer counts down from the value, the first count a cycle later
+		r.timer = value
+		r.prescale = riotPrescalers[register&0x03]
+		r.divider = 1
+		r.timerFlag = false
+		r.timerEnabled = register&0x08 != 0
+		r.updateIRQ()
+	default:
+		r.pa7Positive = register&0x01 != 0
+		r.pa7Enabled = register&0x02 != 0
+		r.updateIRQ()
+	}
+}
+
+func (r *RIOT) tick(cycles int) {
+	for ; cycles > 0; cycles-- {
+		r.divider--
+		if r.divider > 0 {
+			continue
+		}
+		r.divider = r.prescale
+		r.timer--
+		// Running out, the timer carries on counting every cycle, so that
+		// how long ago it did can be read
+		if r.timer == 0xFF {
+			r.timerFlag = true
+			r.prescale, r.divider = 1, 1
+			r.updateIRQ()
+		}
+	}
+}
+
+// connectInput lets the host drive the ports
+func (r *RIOT) connectInput(l *InputLog) {
+	r.connectPorts(l, r.label)
+}
+
+// String describes the pins, for showing them as they change
+func (r *RIOT) String() string {
+	return r.pins().describe(false)
+}
+
+func (r *RIOT) saveState(e *stateEncoder) {
+	e.bytes(r.ram[:])
+	for _, b := range []uint8{r.a.or, r.b.or, r.a.ddr, r.b.ddr, r.a.in, r.b.in, r.timer} {
+		e.u8(b)
+	}
+	for _, b := range []bool{r.timerFlag, r.timerEnabled, r.pa7Flag, r.pa7Enabled, r.pa7Positive, r.irqActive} {
+		e.bool(b)
+	}
+	e.u16(uint16(r.prescale))
+	e.u16(uint16(r.divider))
+}
+
+func (r *RIOT) loadState(d *stateDecoder) {
+	copy(r.ram[:], d.take(riotRAMSize))
+	for _, b := range []*uint8{&r.a.or, &r.b.or, &r.a.ddr, &r.b.ddr, &r.a.in, &r.b.in, &r.timer} {
+		*b = d.u8()
+	}
+	for _, b := range []*bool{&r.timerFlag, &r.timerEnabled, &r.pa7Flag, &r.pa7Enabled, &r.pa7Positive, &r.irqActive} {
+		*b = d.bool()
+	}
+	r.prescale = int(d.u16())
+	r.divider = int(d.u16())
+	if r.prescale == 0 {
+		r.prescale, r.divider = 1024, 1024
+	}
+	r.lastPins = r.pins()
+}
@@ -0,0 +1,102 @@
+package main
+
+import "testing"
+
+func TestRIOTRegisters(t *testing.T) {
+	r := newRIOT("riot", nil)
+	for i := uint16(0); i < riotRAMSize; i++ {
+		r.write(i, uint8(i^0x55))
+	}
+	for i := uint16(0); i < riotRAMSize; i++ {
+		if got := r.read(i); got != uint8(i^0x55) {
+			t.Fatalf("RAM $%02X: expected $%02X, got $%02X", i, i^0x55, got)
+		}
+	}
+	// The registers are decoded from A0-A4, mirrored through $80-$FF
+	r.write(0xE0|riotDDRA, 0x3C)
+	if got := r.read(0x80 | riotDDRA); got != 0x3C {
+		t.Errorf("DDRA through a mirror: expected $3C, got $%02X", got)
+	}
+}
+
+func TestRIOTTimer(t *testing.T) {
+	output, irq := recordIRQ()
+	r := newRIOT("riot", output)
+	// Count 3 every 8 cycles, interrupting (A4 starts the timer, A3 enables
+	// its interrupt)
+	r.write(0x80|0x10|0x08|riotTimer|1, 3)
+	r.tick(1)
+	if got := r.read(0x80 | 0x08 | riotTimer); got != 2 {
+		t.Errorf("expected the first count after a cycle, got %d", got)
+	}
+	r.tick(23)
+	if *irq {
+		t.Fatal("interrupted too soon")
+	}
+	r.tick(1)
+	if !*irq || r.peek(0x80|riotFlags) != riotTimerFlag || r.peek(0x80|riotTimer) != 0xFF {
+		t.Fatalf("expected an interrupt after 25 cycles, flags $%02X timer $%02X", r.peek(0x80|riotFlags), r.peek(0x80|riotTimer))
+	}
+	// Past zero it counts every cycle
+	r.tick(5)
+	if got := r.peek(0x80 | riotTimer); got != 0xFA {
+		t.Errorf("expected $FA 5 cycles after running out, got $%02X", got)
+	}
+	// Reading the timer with A3 clear clears the flag and disables the interrupt
+	r.read(0x80 | riotTimer)
+	if *irq || r.peek(0x80|riotFlags) != 0 {
+		t.Error("reading the timer should clear the interrupt")
+	}
+
+	// Each prescaler, without interrupts
+	for i, prescale := range riotPrescalers {
+		r.write(0x80|0x10|riotTimer|uint16(i), 2)
+		r.tick(2 * prescale)
+		if r.peek(0x80|riotFlags) != 0 {
+			t.Errorf("prescaler %d: ran out too soon", prescale)
+		}
+		r.tick(1)
+		if r.peek(0x80|riotFlags) != riotTimerFlag || *irq {
+			t.Errorf("prescaler %d: expected the flag alone after %d cycles", prescale, 2*prescale+1)
+		}
+	}
+}
+
+func TestRIOTEdgeDetect(t *testing.T) {
+	output, irq := recordIRQ()
+	r := newRIOT("riot", output)
+	// Rising edges on PA7, interrupting
+	r.write(0x80|riotTimer|0x02|0x01, 0)
+	r.setPortA(0x7F)
+	if *irq {
+		t.Fatal("a falling edge should not interrupt")
+	}
+	r.setPortA(0xFF)
+	if !*irq {
+		t.Fatal("expected an interrupt on a rising edge")
+	}
+	if got := r.read(0x80 | riotFlags); got != riotPA7Flag {
+		t.Errorf("flags: expected $%02X, got $%02X", riotPA7Flag, got)
+	}
+	if *irq {
+		t.Error("reading the flags should clear the interrupt")
+	}
+	// PA7 as an output flags its own edges, falling ones now, without
+	// interrupting
+	r.write(0x80|riotTimer, 0)
+	r.write(0x80|riotDDRA, 0x80)
+	r.write(0x80|riotORA, 0x00)
+	if *irq || r.peek(0x80|riotFlags) != riotPA7Flag {
+		t.Errorf("expected the flag without an interrupt, flags $%02X", r.peek(0x80|riotFlags))
+	}
+
+	// The state goes in save states
+	var e stateEncoder
+	r.saveState(&e)
+	saved := *r
+	r.reset()
+	r.loadState(&stateDecoder{data: e.buf})
+	if r.ram != saved.ram || r.a != saved.a || r.pa7Flag != saved.pa7Flag || r.prescale != saved.prescale {
+		t.Errorf("RIOT state not restored: %+v, expected %+v", r, saved)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// A save state is a snapshot of the whole machine, written as:
+//
+//	magic    "GO6502ST"
+//	version  uint16, bumped only when old readers could not make sense of it
+//	chunks   a 4 byte ID, a uint32 length and that many bytes, ending with END
+//	checksum the CRC-32 (IEEE) of everything before it
+//
+// All numbers are little-endian. Readers skip chunks they do not know, and a
+// chunk that is shorter than a reader expects reads as zero past its end, so
+// that fields and chunks can be added without breaking older snapshots. Only
+// new fields whose zero value means "as before" may be added that way.
+//
+// The chunks are:
+//
+//	CPU   variant, A, X, Y, P, SP, PC, cycles, the IRQ lines, and the NMI
+//	      pending and WAI flags
+//	MEM   all 64K of memory
+//	DEV   a device's state: the length of its name as a byte, its name, and
+//	      what the device saves. There is one for each device with state,
+//	      including LCDs, which are off the bus, and devices that are not
+//	      attached when the state is loaded are skipped.
+//	END   the end of the chunks
+const (
+	stateMagic   = "GO6502ST"
+	stateVersion = 1
+)
+
+// stateEncoder builds the contents of a chunk
+type stateEncoder struct {
+	buf []byte
+}
+
+func (e *stateEncoder) u8(v uint8) { e.buf = append(e.buf, v) }
+
+func (e *stateEncoder) u16(v uint16) { e.buf = binary.LittleEndian.AppendUint16(e.buf, v) }
+
+func (e *stateEncoder) u32(v uint32) { e.buf = binary.LittleEndian.AppendUint32(e.buf, v) }
+
+func (e *stateEncoder) u64(v uint64) { e.buf = binary.LittleEndian.AppendUint64(e.buf, v) }
+
+func (e *stateEncoder) bytes(v []byte) { e.buf = append(e.buf, v...) }
+
+func (e *stateEncoder) bool(v bool) { e.u8(boolToInt(v)) }
+
+// chunk appends a chunk with an ID and contents
+func (e *stateEncoder) chunk(id string, contents []byte) {
+	e.bytes([]byte(id))
+	e.u32(uint32(len(contents)))
+	e.bytes(contents)
+}
+
+// stateDecoder reads the contents of a chunk. Reading past the end gives
+// zeros, which is how fields added after a snapshot was made read.
+type stateDecoder struct {
+	data []byte
+	pos  int
+}
+
+// take returns the next n bytes, padded with zeros past the end
+func (d *stateDecoder) take(n int) []byte {
+	out := make([]byte, n)
+	if d.pos < len(d.data) {
+		copy(out, d.data[d.pos:])
+	}
+	d.pos += n
+	return out
+}
+
+func (d *stateDecoder) u8() uint8 { return d.take(1)[0] }
+
+func (d *stateDecoder) u16() uint16 { return binary.LittleEndian.Uint16(d.take(2)) }
+
+func (d *stateDecoder) u32() uint32 { return binary.LittleEndian.Uint32(d.take(4)) }
+
+func (d *stateDecoder) u64() uint64 { return binary.LittleEndian.Uint64(d.take(8)) }
+
+func (d *stateDecoder) bool() bool { return d.u8() != 0 }
+
+// saveState writes a snapshot of the machine
+func (cpu *CPU) saveState(w io.Writer) error {
+	var file stateEncoder
+	file.bytes([]byte(stateMagic))
+	file.u16(stateVersion)
+
+	var c stateEncoder
+	c.u8(uint8(cpu.variant))
+	c.u8(cpu.A)
+	c.u8(cpu.X)
+	c.u8(cpu.Y)
+	c.u8(cpu.P)
+	c.u8(cpu.SP)
+	c.u16(cpu.PC)
+	c.u64(uint64(cpu.cycles))
+	c.u32(cpu.irq)
+	c.bool(cpu.nmiPending)
+	c.bool(cpu.waiting)
+	file.chunk("CPU ", c.buf)
+	file.chunk("MEM ", cpu.MMU.RAM[:])
+	for _, device := range cpu.MMU.statefulDevices() {
+		var d stateEncoder
+		d.u8(uint8(len(device.name())))
+		d.bytes([]byte(device.name()))
+		device.saveState(&d)
+		file.chunk("DEV ", d.buf)
+	}
+	file.chunk("END ", nil)
+
+	file.u32(crc32.ChecksumIEEE(file.buf))
+	_, err := w.Write(file.buf)
+	return err
+}
+
+// loadState restores a snapshot of the machine. Nothing is changed unless the
+// whole snapshot is good.
+func (cpu *CPU) loadState(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	header := len(stateMagic) + 2
+	if len(data) < header+4 || !bytes.Equal(data[:len(stateMagic)], []byte(stateMagic)) {
+		return fmt.Errorf("not a save state")
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("the save state is corrupt (bad checksum)")
+	}
+	if version := binary.LittleEndian.Uint16(data[len(stateMagic):]); version > stateVersion {
+		return fmt.Errorf("the save state is version %d, newer than this build reads (%d)", version, stateVersion)
+	}
+
+	// Collect the chunks, and the devices' by name
+	chunks := map[string][]byte{}
+	devices := map[string][]byte{}
+	for pos := header; ; {
+		if pos+8 > len(body) {
+			return fmt.Errorf("the save state is truncated")
+		}
+		id := string(body[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(body[pos+4:]))
+		pos += 8
+		if length > len(body)-pos {
+			return fmt.Errorf("chunk %q runs past the end of the save state", id)
+		}
+		if id == "END " {
+			break
+		}
+		if id == "DEV " {
+			contents := body[pos : pos+length]
+			if length == 0 || int(contents[0]) >= length {
+				return fmt.Errorf("a device chunk has no name")
+			}
+			devices[string(contents[1:1+contents[0]])] = contents[1+contents[0]:]
+		}
+		chunks[id] = body[pos : pos+length]
+		pos += length
+	}
+	for _, id := range []string{"CPU ", "MEM "} {
+		if _, ok := chunks[id]; !ok {
+			return fmt.Errorf("the save state has no %q chunk", id)
+		}
+	}
+	if len(chunks["MEM "]) != RAMSize {
+		return fmt.Errorf("the save state has %d bytes of memory, not %d", len(chunks["MEM "]), RAMSize)
+	}
+	c := &stateDecoder{data: chunks["CPU "]}
+	variant := Variant(c.u8())
+	if variant != NMOS6502 && variant != CMOS65C02 {
+		return fmt.Errorf("the save state is for an unknown CPU (%d)", variant)
+	}
+
+	cpu.variant = variant
+	cpu.A, cpu.X, cpu.Y, cpu.P, cpu.SP = c.u8(), c.u8(), c.u8(), c.u8(), c.u8()
+	cpu.PC = c.u16()
+	cpu.cycles = int(c.u64())
+	cpu.irq = c.u32()
+	cpu.nmiPending = c.bool()
+	cpu.waiting = c.bool()
+	copy(cpu.MMU.RAM[:], chunks["MEM "])
+	for _, device := range cpu.MMU.statefulDevices() {
+		if data, saved := devices[device.name()]; saved {
+			device.loadState(&stateDecoder{data: data})
+		}
+	}
+	// The history leads up to a state that no longer exists
+	cpu.history.clear()
+	cpu.running = true
+	return nil
+}
+
+// saveStateFile writes a snapshot of the machine to a file
+func (cpu *CPU) saveStateFile(fileName string) error {
+	var buf bytes.Buffer
+	if err := cpu.saveState(&buf); err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, buf.Bytes(), 0644)
+}
+
+// loadStateFile restores a snapshot of the machine from a file
+func (cpu *CPU) loadStateFile(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := cpu.loadState(file); err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+// saveTestState runs part of the demo program and returns the CPU and a save
+// state of it
+func saveTestState(t *testing.T) (*CPU, []byte) {
+	t.Helper()
+	cpu := newTestCPU(t, CMOS65C02, demoProgram)
+	for i := 0; i < 8; i++ {
+		cpu.step()
+	}
+	cpu.setIRQ(3, true)
+	cpu.nmiPending = true
+	var buf bytes.Buffer
+	if err := cpu.saveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return cpu, buf.Bytes()
+}
+
+// resign replaces the checksum of an edited save state
+func resign(data []byte) []byte {
+	body := data[:len(data)-4]
+	return binary.LittleEndian.AppendUint32(append([]byte{}, body...), crc32.ChecksumIEEE(body))
+}
+
+func TestSaveStateRoundTrip(t *testing.T) {
+	saved, data := saveTestState(t)
+	cpu := &CPU{MMU: &MMU{}}
+	if err := cpu.loadState(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.A != saved.A || cpu.X != saved.X || cpu.Y != saved.Y || cpu.P != saved.P || cpu.SP != saved.SP ||
+		cpu.PC != saved.PC || cpu.cycles != saved.cycles || cpu.irq != saved.irq ||
+		cpu.nmiPending != saved.nmiPending || cpu.waiting != saved.waiting || cpu.variant != saved.variant {
+		t.Errorf("restored %+v, expected %+v", cpu, saved)
+	}
+	if cpu.MMU.RAM != saved.MMU.RAM {
+		t.Error("memory was not restored")
+	}
+	// Both carry on the same way
+	for i := 0; i < 20; i++ {
+		saved.step()
+		cpu.step()
+	}
+	if cpu.PC != saved.PC || cpu.A != saved.A || cpu.cycles != saved.cycles {
+		t.Errorf("restored CPU ran to PC=$%04X A=$%02X cycle %d, expected PC=$%04X A=$%02X cycle %d",
+			cpu.PC, cpu.A, cpu.cycles, saved.PC, saved.A, saved.cycles)
+	}
+}
+
+func TestSaveStateRejectsBadFiles(t *testing.T) {
+	_, data := saveTestState(t)
+	corrupt := append([]byte{}, data...)
+	corrupt[100] ^= 0xFF
+	newer := append([]byte{}, data...)
+	newer[len(stateMagic)] = stateVersion + 1
+	for _, test := range []struct {
+		name, data, want string
+	}{
+		{"empty", "", "not a save state"},
+		{"other file", "hello, world", "not a save state"},
+		{"bad checksum", string(corrupt), "checksum"},
+		{"truncated", string(resign(data[:len(data)-1000])), "past the end"},
+		{"newer version", string(resign(newer)), "newer"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := &CPU{MMU: &MMU{}}
+			cpu.PC = 0x1234
+			err := cpu.loadState(strings.NewReader(test.data))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("expected an error about %q, got %v", test.want, err)
+			}
+			if cpu.PC != 0x1234 {
+				t.Error("a bad save state changed the CPU")
+			}
+		})
+	}
+}
+
+func TestSaveStateReadsOlderChunks(t *testing.T) {
+	// A save state with an unknown chunk, and a CPU chunk from before the
+	// interrupt lines were saved, still loads
+	var file stateEncoder
+	file.bytes([]byte(stateMagic))
+	file.u16(1)
+	file.chunk("XTRA", []byte{1, 2, 3})
+	file.chunk("CPU ", []byte{0, 0x11, 0x22, 0x33, 0x24, 0xF0, 0x00, 0x90})
+	file.chunk("MEM ", make([]byte, RAMSize))
+	file.chunk("END ", nil)
+	file.u32(crc32.ChecksumIEEE(file.buf))
+
+	cpu := &CPU{MMU: &MMU{}, irq: 1, waiting: true}
+	if err := cpu.loadState(bytes.NewReader(file.buf)); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.A != 0x11 || cpu.X != 0x22 || cpu.Y != 0x33 || cpu.P != 0x24 || cpu.SP != 0xF0 || cpu.PC != 0x9000 {
+		t.Errorf("registers not restored: %+v", cpu)
+	}
+	if cpu.cycles != 0 || cpu.irq != 0 || cpu.waiting {
+		t.Errorf("missing fields should read as zero, got cycles %d irq %d waiting %v", cpu.cycles, cpu.irq, cpu.waiting)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// terminalEscape is the key, Ctrl-], that stops the emulation and enters the
+// monitor while a device has the terminal, as Ctrl-C goes to the device
+const terminalEscape = 0x1D
+
+// hostIO is what devices connect to on the host, to be closed when the
+// emulation ends
+type hostIO struct {
+	closers []func()
+	// terminal is set when a device has taken over the terminal
+	terminal *terminal
+	// exitRequested is set when the program asked the emulator to exit, with
+	// exitStatus
+	exitRequested bool
+	exitStatus    int
+}
+
+// close closes the connections, putting the terminal back how it was
+func (h *hostIO) close() {
+	for i := len(h.closers) - 1; i >= 0; i-- {
+		h.closers[i]()
+	}
+	h.closers = nil
+}
+
+// openSerial connects a serial device to the host, by a bridge that is one of:
+//
+//	""          the terminal, which is put in raw mode, apart from newlines
+//	            going out as carriage returns and newlines if newlines is set
+//	unix:path   a Unix socket, that a client at a time can connect to
+//	pty         a pseudo-terminal, for a terminal program to open
+//
+// Bytes from the host are passed to receive, from another goroutine. It
+// returns the function that sends bytes to the host.
+func (h *hostIO) openSerial(name, bridge string, newlines bool, receive func(b uint8)) (func(b uint8), error) {
+	switch {
+	case bridge == "":
+		if h.terminal != nil {
+			return nil, fmt.Errorf("only one device can have the terminal")
+		}
+		t := newTerminal(newlines, receive)
+		h.terminal = t
+		h.closers = append(h.closers, t.close)
+		return t.send, nil
+	case strings.HasPrefix(bridge, "unix:"):
+		path := strings.TrimPrefix(bridge, "unix:")
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("%s: listening on %s\n", name, path)
+		s := &socketBridge{listener: listener, receive: receive}
+		go s.accept()
+		h.closers = append(h.closers, s.close)
+		return s.send, nil
+	case bridge == "pty":
+		master, slaveName, err := openPTY()
+		if err != nil {
+			return nil, err
+		}
+		// Keep the other side open, in raw mode, so that reads do not fail
+		// while nothing is connected and bytes pass through untouched
+		slave, err := os.OpenFile(slaveName, os.O_RDWR, 0)
+		if err != nil {
+			master.Close()
+			return nil, err
+		}
+		if state, err := getTermState(slave); err == nil {
+			setTermState(slave, state.raw(false))
+		}
+		fmt.Printf("%s: connect to %s\n", name, slaveName)
+		go readBytes(master, receive)
+		h.closers = append(h.closers, func() {
+			master.Close()
+			slave.Close()
+		})
+		return func(b uint8) { master.Write([]byte{b}) }, nil
+	}
+	return nil, fmt.Errorf("unknown serial bridge %q (expected unix:path or pty)", bridge)
+}
+
+// readBytes passes what is read from r to receive, a byte at a time, until
+// it fails
+func readBytes(r io.Reader, receive func(b uint8)) error {
+	buf := make([]byte, 256)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			receive(b)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// socketBridge serves a serial device on a socket, to the client that
+// connected last
+type socketBridge struct {
+	listener net.Listener
+	receive  func(b uint8)
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+// accept takes connections until the listener is closed
+func (s *socketBridge) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.conn = conn
+		s.mu.Unlock()
+		go readBytes(conn, s.receive)
+	}
+}
+
+// send writes a byte to the client, if there is one
+func (s *socketBridge) send(b uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Write([]byte{b})
+	}
+}
+
+func (s *socketBridge) close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// terminal is the host's terminal while a device has it. It reads stdin
+// itself, handing what is typed to the device, or to the monitor while the
+// monitor is active, which gets the terminal back in its usual mode.
+type terminal struct {
+	receive func(b uint8)
+	// cooked and raw are the terminal's settings as they were and for the
+	// device, or nil when stdin is not a terminal
+	cooked, raw *termState
+	// What is typed goes through a pipe to the monitor
+	monitorIn  *io.PipeWriter
+	monitorOut *io.PipeReader
+}
+
+// newTerminal takes over the terminal for a device, with newlines turned into
+// carriage returns and newlines if newlines is set
+func newTerminal(newlines bool, receive func(b uint8)) *terminal {
+	t := &terminal{receive: receive}
+	t.monitorOut, t.monitorIn = io.Pipe()
+	if state, err := getTermState(os.Stdin); err == nil {
+		t.cooked, t.raw = state, state.raw(newlines)
+		setTermState(os.Stdin, t.raw)
+	}
+	return t
+}
+
+// start reads stdin, sending it to the monitor while monitorActive says it
+// is, and calling escape when the escape key is typed
+func (t *terminal) start(monitorActive func() bool, escape func()) {
+	go func() {
+		readBytes(os.Stdin, func(b uint8) {
+			switch {
+			case monitorActive():
+				t.monitorIn.Write([]byte{b})
+			case b == terminalEscape:
+				escape()
+			default:
+				t.receive(b)
+			}
+		})
+		t.monitorIn.Close()
+	}()
+}
+
+// send writes a byte to the terminal
+func (t *terminal) send(b uint8) {
+	os.Stdout.Write([]byte{b})
+}
+
+// suspend gives the terminal back its usual settings, for the monitor
+func (t *terminal) suspend() {
+	if t.cooked != nil {
+		setTermState(os.Stdin, t.cooked)
+	}
+}
+
+// resume puts the terminal back in raw mode for the device
+func (t *terminal) resume() {
+	if t.raw != nil {
+		setTermState(os.Stdin, t.raw)
+	}
+}
+
+func (t *terminal) close() {
+	t.suspend()
+}
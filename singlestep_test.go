@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The per-instruction tests from https://github.com/SingleStepTests/65x02
+// (formerly TomHarte/ProcessorTests) are run from a local copy, as they are
+// far too big to vendor. See testdata/singlestep/README.md.
+var (
+	singleStepDir     = flag.String("singlestep", filepath.Join("testdata", "singlestep"), "directory holding the SingleStepTests 65x02 JSON tests")
+	singleStepSummary = flag.Bool("singlestep.summary", false, "print the pass rates for each opcode instead of failing")
+	singleStepBus     = flag.Bool("singlestep.bus", false, "check the bus activity cycle by cycle, not just the cycle count")
+	singleStepOpcodes = flag.String("singlestep.opcodes", "", "only run these opcodes, comma separated hex (e.g. a9,6d)")
+)
+
+// singleStepState is the CPU and memory state at the start or end of a test
+type singleStepState struct {
+	PC  uint16   `json:"pc"`
+	S   uint8    `json:"s"`
+	A   uint8    `json:"a"`
+	X   uint8    `json:"x"`
+	Y   uint8    `json:"y"`
+	P   uint8    `json:"p"`
+	RAM [][2]int `json:"ram"`
+}
+
+// singleStepCase is one test: a single instruction run from an initial state
+type singleStepCase struct {
+	Name    string          `json:"name"`
+	Initial singleStepState `json:"initial"`
+	Final   singleStepState `json:"final"`
+	// Cycles is the bus activity, one [address, value, "read" or "write"] per cycle
+	Cycles [][3]interface{} `json:"cycles"`
+}
+
+// busAccess is a read or write the CPU made
+type busAccess struct {
+	address uint16
+	value   uint8
+	write   bool
+}
+
+func (b busAccess) String() string {
+	kind := "read"
+	if b.write {
+		kind = "write"
+	}
+	return fmt.Sprintf("%s $%04X=$%02X", kind, b.address, b.value)
+}
+
+// singleStepVariants are the directories of tests for each variant
+var singleStepVariants = []struct {
+	dir     string
+	variant Variant
+}{
+	{"6502", NMOS6502},
+	{"wdc65c02", CMOS65C02},
+}
+
+// opcodeResult counts the results of the tests of one opcode
+type opcodeResult struct {
+	opcode                         uint8
+	cases, passed                  int
+	registers, memory, cycles, bus int // cases failing each check
+	supported                      bool
+}
+
+func TestSingleStep(t *testing.T) {
+	found := false
+	for _, v := range singleStepVariants {
+		dir := filepath.Join(*singleStepDir, v.dir, "v1")
+		if _, err := os.Stat(dir); err != nil {
+			dir = filepath.Join(*singleStepDir, v.dir)
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		if len(files) == 0 {
+			continue
+		}
+		found = true
+		v := v
+		t.Run(v.dir, func(t *testing.T) {
+			var results []opcodeResult
+			for _, file := range files {
+				opcode, ok := singleStepOpcode(file)
+				if !ok {
+					continue
+				}
+				t.Run(fmt.Sprintf("%02X", opcode), func(t *testing.T) {
+					result := runSingleStepFile(t, v.variant, opcode, file)
+					results = append(results, result)
+					if !result.supported {
+						t.Skipf("opcode $%02X is not implemented", opcode)
+					}
+				})
+			}
+			if *singleStepSummary {
+				printSingleStepSummary(v.variant, results)
+			}
+		})
+	}
+	if !found {
+		t.Skipf("no tests in %s, see testdata/singlestep/README.md", *singleStepDir)
+	}
+}
+
+// singleStepOpcode returns the opcode a test file is for, from its name, if
+// it is one of the opcodes asked for
+func singleStepOpcode(file string) (uint8, bool) {
+	var opcode uint8
+	name := strings.TrimSuffix(filepath.Base(file), ".json")
+	if _, err := fmt.Sscanf(name, "%02x", &opcode); err != nil || len(name) != 2 {
+		return 0, false
+	}
+	if *singleStepOpcodes == "" {
+		return opcode, true
+	}
+	for _, want := range strings.Split(*singleStepOpcodes, ",") {
+		if strings.EqualFold(strings.TrimSpace(want), name) {
+			return opcode, true
+		}
+	}
+	return 0, false
+}
+
+// runSingleStepFile runs the tests of one opcode. Failures are reported for
+// the first few cases, unless only a summary is wanted.
+func runSingleStepFile(t *testing.T, variant Variant, opcode uint8, file string) opcodeResult {
+	result := opcodeResult{opcode: opcode}
+	cpu := &CPU{MMU: &MMU{}, variant: variant}
+	if _, ok := cpu.instructionSet()[opcode]; !ok {
+		return result
+	}
+	result.supported = true
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []singleStepCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	const reportLimit = 5
+	failures := 0
+	for i := range cases {
+		c := &cases[i]
+		problems, failed := runSingleStepCase(cpu, c)
+		result.cases++
+		for _, check := range failed {
+			switch check {
+			case "registers":
+				result.registers++
+			case "memory":
+				result.memory++
+			case "cycles":
+				result.cycles++
+			case "bus":
+				result.bus++
+			}
+		}
+		if len(problems) == 0 {
+			result.passed++
+			continue
+		}
+		failures++
+		if !*singleStepSummary && failures <= reportLimit {
+			t.Errorf("%s:\n  %s", c.Name, strings.Join(problems, "\n  "))
+		}
+	}
+	if !*singleStepSummary && failures > reportLimit {
+		t.Errorf("and %d more of %d cases failed", failures-reportLimit, len(cases))
+	}
+	return result
+}
+
+// runSingleStepCase runs one test, returning what went wrong and which of the
+// checks (registers, memory, cycles and bus) failed
+func runSingleStepCase(cpu *CPU, c *singleStepCase) ([]string, []string) {
+	// Set up the memory, and clear what the test touched afterwards
+	var bus []busAccess
+	defer func() {
+		for _, cell := range c.Initial.RAM {
+			cpu.MMU.pokeByte(uint16(cell[0]), 0)
+		}
+		for _, access := range bus {
+			cpu.MMU.pokeByte(access.address, 0)
+		}
+	}()
+	for _, cell := range c.Initial.RAM {
+		cpu.MMU.pokeByte(uint16(cell[0]), uint8(cell[1]))
+	}
+	cpu.PC, cpu.SP, cpu.A, cpu.X, cpu.Y = c.Initial.PC, c.Initial.S, c.Initial.A, c.Initial.X, c.Initial.Y
+	cpu.P = c.Initial.P &^ (Break | Unused)
+	cpu.cycles, cpu.irq, cpu.nmiPending, cpu.waiting, cpu.running = 0, 0, false, false, true
+	cpu.MMU.watch = func(address uint16, value uint8, write bool) {
+		bus = append(bus, busAccess{address, value, write})
+	}
+	cpu.step()
+	cpu.MMU.watch = nil
+
+	var problems, failed []string
+	fail := func(check, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+		if len(failed) == 0 || failed[len(failed)-1] != check {
+			failed = append(failed, check)
+		}
+	}
+	final := c.Final
+	if cpu.PC != final.PC {
+		fail("registers", "PC: expected $%04X, got $%04X", final.PC, cpu.PC)
+	}
+	for _, r := range []struct {
+		name          string
+		expected, got uint8
+	}{{"A", final.A, cpu.A}, {"X", final.X, cpu.X}, {"Y", final.Y, cpu.Y}, {"SP", final.S, cpu.SP}} {
+		if r.expected != r.got {
+			fail("registers", "%s: expected $%02X, got $%02X", r.name, r.expected, r.got)
+		}
+	}
+	// The break and unused bits are not flags, so they are left out
+	if expected, got := final.P|Break|Unused, cpu.P|Break|Unused; expected != got {
+		fail("registers", "P: expected $%02X (%s), got $%02X (%s)", expected, flagString(expected), got, flagString(got))
+	}
+	for _, cell := range final.RAM {
+		address, expected := uint16(cell[0]), uint8(cell[1])
+		if got := cpu.MMU.peekByte(address); got != expected {
+			fail("memory", "$%04X: expected $%02X, got $%02X", address, expected, got)
+		}
+	}
+	if cpu.cycles != len(c.Cycles) {
+		fail("cycles", "cycles: expected %d, got %d", len(c.Cycles), cpu.cycles)
+	}
+	if *singleStepBus {
+		for i := 0; i < len(c.Cycles) || i < len(bus); i++ {
+			var expected, got string
+			if i < len(c.Cycles) {
+				expected = parseBusCycle(c.Cycles[i]).String()
+			}
+			if i < len(bus) {
+				got = bus[i].String()
+			}
+			if expected != got {
+				fail("bus", "cycle %d: expected %q, got %q", i+1, expected, got)
+				break
+			}
+		}
+	}
+	return problems, failed
+}
+
+// parseBusCycle parses a cycle of a test's bus activity
+func parseBusCycle(cycle [3]interface{}) busAccess {
+	address, _ := cycle[0].(float64)
+	value, _ := cycle[1].(float64)
+	kind, _ := cycle[2].(string)
+	return busAccess{address: uint16(address), value: uint8(value), write: kind == "write"}
+}
+
+// printSingleStepSummary prints the pass rate of each opcode, worst first
+func printSingleStepSummary(variant Variant, results []opcodeResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return passRate(results[i]) < passRate(results[j])
+	})
+	set := instructions
+	if variant == CMOS65C02 {
+		set = cmosInstructions
+	}
+	fmt.Printf("%s: pass rates by opcode\n", variant)
+	fmt.Println("Op  Instruction        Cases  Passed  Regs  Memory  Cycles   Bus")
+	cases, passed := 0, 0
+	for _, r := range results {
+		inst, ok := set[r.opcode]
+		name := "(not implemented)"
+		if ok {
+			name = inst.mnemonic + " " + addressingModeNames[inst.addressingMode]
+		}
+		if !r.supported {
+			fmt.Printf("%02X  %-17s\n", r.opcode, name)
+			continue
+		}
+		fmt.Printf("%02X  %-17s %6d %6.1f%% %5d %7d %7d %5d\n",
+			r.opcode, name, r.cases, passRate(r), r.registers, r.memory, r.cycles, r.bus)
+		cases += r.cases
+		passed += r.passed
+	}
+	if cases > 0 {
+		fmt.Printf("Total: %d of %d cases passed (%.1f%%)\n", passed, cases, 100*float64(passed)/float64(cases))
+	}
+}
+
+// passRate returns the percentage of an opcode's cases that passed, counting
+// opcodes that are not implemented as 0
+func passRate(r opcodeResult) float64 {
+	if r.cases == 0 {
+		return 0
+	}
+	return 100 * float64(r.passed) / float64(r.cases)
+}
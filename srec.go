@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// parseSRecord parses a Motorola S-record (S19/S28/S37) file into a program image
+func parseSRecord(data []uint8) (*programImage, error) {
+	img := &programImage{}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		lineNumber := i + 1
+		line = bytes.TrimSpace(line)
+		// Skip blank lines
+		if len(line) == 0 {
+			continue
+		}
+		if len(line) < 2 || line[0] != 'S' {
+			return nil, fmt.Errorf("line %d: record does not start with 'S'", lineNumber)
+		}
+		recordType := line[1]
+		record, err := hex.DecodeString(string(line[2:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid hex digits", lineNumber)
+		}
+		// The count covers the address, the data and the checksum
+		if len(record) < 2 || len(record) != int(record[0])+1 {
+			return nil, fmt.Errorf("line %d: record length does not match its byte count", lineNumber)
+		}
+		// The checksum is the ones' complement of the sum of the other bytes
+		var sum uint8
+		for _, b := range record[:len(record)-1] {
+			sum += b
+		}
+		if checksum := record[len(record)-1]; checksum != ^sum {
+			return nil, fmt.Errorf("line %d: checksum mismatch (expected $%02X, got $%02X)",
+				lineNumber, ^sum, checksum)
+		}
+		// Work out how many address bytes the record type uses
+		var addressLength int
+		switch recordType {
+		case '0', '1', '5', '9':
+			addressLength = 2
+		case '2', '6', '8':
+			addressLength = 3
+		case '3', '7':
+			addressLength = 4
+		default:
+			return nil, fmt.Errorf("line %d: unknown record type S%c", lineNumber, recordType)
+		}
+		if len(record) < addressLength+2 {
+			return nil, fmt.Errorf("line %d: record is too short for its address", lineNumber)
+		}
+		var address uint32
+		for _, b := range record[1 : 1+addressLength] {
+			address = address<<8 | uint32(b)
+		}
+		payload := record[1+addressLength : len(record)-1]
+		switch recordType {
+		case '1', '2', '3':
+			if address+uint32(len(payload)) > RAMSize {
+				return nil, fmt.Errorf("line %d: data at $%X is outside the 64KB address space", lineNumber, address)
+			}
+			img.addData(uint16(address), payload)
+		case '7', '8', '9':
+			if address >= RAMSize {
+				return nil, fmt.Errorf("line %d: start address $%X is outside the 64KB address space", lineNumber, address)
+			}
+			// Many tools write a termination record of zero when there is
+			// no entry point, so only an address other than zero is one
+			if address != 0 {
+				img.start = uint16(address)
+				img.hasStart = true
+			}
+		}
+		// S0 headers and S5/S6 record counts carry nothing we need
+	}
+	return img, nil
+}
@@ -2,14 +2,15 @@ package main
 
 // Flag bits
 const (
-	None      byte = 0         // No flags set
-	Carry     byte = 1 << iota // Carry
-	Zero                       // Zero
-	Interrupt                  // Interrupt
-	Decimal                    // Decimal
-	Break                      // Break
-	Overflow                   // Overflow
-	Negative                   // Negative
+	None      byte = 0      // No flags set
+	Carry     byte = 1 << 0 // Carry
+	Zero      byte = 1 << 1 // Zero
+	Interrupt byte = 1 << 2 // Interrupt
+	Decimal   byte = 1 << 3 // Decimal
+	Break     byte = 1 << 4 // Break
+	Unused    byte = 1 << 5 // Unused, always reads as 1
+	Overflow  byte = 1 << 6 // Overflow
+	Negative  byte = 1 << 7 // Negative
 )
 
 // setFlag sets the flag to the given value
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// The ioctls that get and set a terminal's settings
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
+
+// openPTY opens a pseudo-terminal, returning its master side and the name of
+// the device to connect to it with. It does what posix_openpt, grantpt,
+// unlockpt and ptsname do.
+func openPTY() (*os.File, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := ioctl(master.Fd(), syscall.TIOCPTYGRANT, nil); err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	if err := ioctl(master.Fd(), syscall.TIOCPTYUNLK, nil); err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	name := make([]byte, 128)
+	if err := ioctl(master.Fd(), syscall.TIOCPTYGNAME, unsafe.Pointer(&name[0])); err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return master, string(name), nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// errNoTerminal is returned where terminals cannot be set up on this system
+var errNoTerminal = errors.New("terminal control is not supported on this system")
+
+// termState is a terminal's settings, which cannot be changed here
+type termState struct{}
+
+func getTermState(f *os.File) (*termState, error) { return nil, errNoTerminal }
+
+func setTermState(f *os.File, s *termState) error { return errNoTerminal }
+
+func (s *termState) raw(newlines bool) *termState { return s }
+
+func openPTY() (*os.File, string, error) { return nil, "", errNoTerminal }
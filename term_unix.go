@@ -0,0 +1,56 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// termState is a terminal's settings
+type termState struct {
+	termios syscall.Termios
+}
+
+// ioctl calls the ioctl system call with a pointer argument
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// getTermState returns a terminal's settings, failing if the file is not a
+// terminal
+func getTermState(f *os.File) (*termState, error) {
+	var s termState
+	if err := ioctl(f.Fd(), ioctlGetTermios, unsafe.Pointer(&s.termios)); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// setTermState changes a terminal's settings
+func setTermState(f *os.File, s *termState) error {
+	return ioctl(f.Fd(), ioctlSetTermios, unsafe.Pointer(&s.termios))
+}
+
+// raw returns the settings changed to pass every byte through as it is typed
+// or written, with no echo, line editing or signals. With newlines, output
+// still has newlines turned into carriage returns and newlines, for programs
+// that only write newlines.
+func (s *termState) raw(newlines bool) *termState {
+	r := *s
+	t := &r.termios
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	if !newlines {
+		t.Oflag &^= syscall.OPOST
+	}
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	return &r
+}
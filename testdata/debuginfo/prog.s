@@ -0,0 +1,15 @@
+; A main program calling a subroutine that calls another
+.segment "CODE"
+main:   ldx #$00
+        jsr sub
+        inx
+        brk
+
+        .res 9
+sub:    lda #$42
+        jsr inner
+        rts
+        .res 10
+inner:  iny
+        rts
+VIA_PORTB = $6000
@@ -0,0 +1,6 @@
+; Klaus Dormann's decimal mode test for the 6502 (cputype = 0)
+    .org $0200
+    .include "decimal_test.inc"
+
+add_predict = a6502
+sub_predict = s6502
@@ -0,0 +1,6 @@
+; Klaus Dormann's decimal mode test for the 65C02 (cputype = 1)
+    .org $0200
+    .include "decimal_test.inc"
+
+add_predict = a65c02
+sub_predict = s65c02
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Trace format presets
+const (
+	traceNestest = "nestest"
+	traceJSON    = "json"
+)
+
+// Tracer writes a line for each instruction the CPU executes, showing the
+// state before it runs
+type Tracer struct {
+	w      *bufio.Writer
+	closer io.Closer
+	// line formats the line for the instruction at the PC
+	line func(cpu *CPU) string
+}
+
+// newTracer creates a tracer writing to w in a preset format (nestest or
+// json), or a custom format using the tokens in traceTokens
+func newTracer(w io.Writer, format string) (*Tracer, error) {
+	t := &Tracer{w: bufio.NewWriter(w)}
+	if closer, ok := w.(io.Closer); ok && w != os.Stdout {
+		t.closer = closer
+	}
+	switch format {
+	case traceNestest, "":
+		t.line = nestestTraceLine
+	case traceJSON:
+		t.line = jsonTraceLine
+	default:
+		if !strings.Contains(format, "{") {
+			return nil, fmt.Errorf("unknown trace format %q: use nestest, json or a format with {tokens}", format)
+		}
+		line, err := customTraceLine(format)
+		if err != nil {
+			return nil, err
+		}
+		t.line = line
+	}
+	return t, nil
+}
+
+// openTracer creates a tracer writing to a file, or to stdout for "-"
+func openTracer(fileName, format string) (*Tracer, error) {
+	if fileName == "-" {
+		return newTracer(os.Stdout, format)
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newTracer(file, format)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// trace writes the line for the instruction at the PC
+func (t *Tracer) trace(cpu *CPU) {
+	if t == nil {
+		return
+	}
+	t.w.WriteString(t.line(cpu))
+	t.w.WriteByte('\n')
+}
+
+// close flushes the trace and closes its file
+func (t *Tracer) close() error {
+	if t == nil {
+		return nil
+	}
+	err := t.w.Flush()
+	if t.closer != nil {
+		if closeErr := t.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// nestestTraceLine formats a line in the layout of nestest.log, as written by
+// Nintendulator. The PPU position is worked out from the cycle count, as
+// there is no PPU.
+func nestestTraceLine(cpu *CPU) string {
+	d := cpu.decode(cpu.PC)
+	dot := cpu.cycles * 3
+	return fmt.Sprintf("%04X  %-9s %-32sA:%02X X:%02X Y:%02X P:%02X SP:%02X PPU:%3d,%3d CYC:%d",
+		cpu.PC, hexBytes(d.bytes), nestestDisassembly(cpu, d),
+		cpu.A, cpu.X, cpu.Y, cpu.P|Unused, cpu.SP, dot/341%262, dot%341, cpu.cycles)
+}
+
+// nestestDisassembly disassembles an instruction the way nestest.log does,
+// annotated with the effective address and the value there
+func nestestDisassembly(cpu *CPU, d decodedInstruction) string {
+	if !d.known {
+		return fmt.Sprintf(".byte $%02X", d.opcode)
+	}
+	peek := cpu.MMU.peekByte
+	// peekWord reads a pointer, wrapping around within its page as the 6502 does
+	peekWord := func(address uint16) uint16 {
+		return uint16(peek(address)) | uint16(peek(address&0xFF00|(address+1)&0xFF))<<8
+	}
+	mnemonic := d.inst.mnemonic
+	switch d.inst.addressingMode {
+	case modeImplied:
+		return mnemonic
+	case modeAccumulator:
+		return mnemonic + " A"
+	case modeImmediate:
+		return fmt.Sprintf("%s #$%02X", mnemonic, d.value)
+	case modeZeroPage:
+		return fmt.Sprintf("%s $%02X = %02X", mnemonic, d.value, peek(d.value))
+	case modeZeroPageX, modeZeroPageY:
+		index, name := cpu.X, "X"
+		if d.inst.addressingMode == modeZeroPageY {
+			index, name = cpu.Y, "Y"
+		}
+		address := uint16(uint8(d.value) + index)
+		return fmt.Sprintf("%s $%02X,%s @ %02X = %02X", mnemonic, d.value, name, address, peek(address))
+	case modeRelative:
+		return fmt.Sprintf("%s $%04X", mnemonic, d.value)
+	case modeAbsolute:
+		if mnemonic == "JMP" || mnemonic == "JSR" {
+			return fmt.Sprintf("%s $%04X", mnemonic, d.value)
+		}
+		return fmt.Sprintf("%s $%04X = %02X", mnemonic, d.value, peek(d.value))
+	case modeAbsoluteX, modeAbsoluteY:
+		index, name := cpu.X, "X"
+		if d.inst.addressingMode == modeAbsoluteY {
+			index, name = cpu.Y, "Y"
+		}
+		address := d.value + uint16(index)
+		return fmt.Sprintf("%s $%04X,%s @ %04X = %02X", mnemonic, d.value, name, address, peek(address))
+	case modeIndirect:
+		return fmt.Sprintf("%s ($%04X) = %04X", mnemonic, d.value, peekWord(d.value))
+	case modeIndirectX:
+		pointer := uint16(uint8(d.value) + cpu.X)
+		address := peekWord(pointer)
+		return fmt.Sprintf("%s ($%02X,X) @ %02X = %04X = %02X", mnemonic, d.value, pointer, address, peek(address))
+	case modeIndirectY:
+		base := peekWord(d.value)
+		address := base + uint16(cpu.Y)
+		return fmt.Sprintf("%s ($%02X),Y = %04X @ %04X = %02X", mnemonic, d.value, base, address, peek(address))
+	}
+	return mnemonic
+}
+
+// jsonTraceEntry is a line of a JSON lines trace
+type jsonTraceEntry struct {
+	PC          uint16 `json:"pc"`
+	Bytes       []int  `json:"bytes"` // ints, as Marshal writes []uint8 as base64
+	Disassembly string `json:"disasm"`
+	A           uint8  `json:"a"`
+	X           uint8  `json:"x"`
+	Y           uint8  `json:"y"`
+	P           uint8  `json:"p"`
+	SP          uint8  `json:"sp"`
+	Cycles      int    `json:"cycles"`
+}
+
+// jsonTraceLine formats a line of a JSON lines trace
+func jsonTraceLine(cpu *CPU) string {
+	d := cpu.decode(cpu.PC)
+	entry := jsonTraceEntry{
+		PC:          cpu.PC,
+		Bytes:       make([]int, len(d.bytes)),
+		Disassembly: d.text(hexAddress),
+		A:           cpu.A,
+		X:           cpu.X,
+		Y:           cpu.Y,
+		P:           cpu.P | Unused,
+		SP:          cpu.SP,
+		Cycles:      cpu.cycles,
+	}
+	for i, b := range d.bytes {
+		entry.Bytes[i] = int(b)
+	}
+	line, _ := json.Marshal(entry)
+	return string(line)
+}
+
+// traceTokens are the values a custom trace format can show, written as
+// {name}. Registers are hex; cycles are decimal.
+var traceTokens = map[string]func(cpu *CPU, d decodedInstruction) string{
+	"pc":       func(cpu *CPU, d decodedInstruction) string { return fmt.Sprintf("%04X", cpu.PC) },
+	"bytes":    func(cpu *CPU, d decodedInstruction) string { return hexBytes(d.bytes) },
+	"opcode":   func(cpu *CPU, d decodedInstruction) string { return fmt.Sprintf("%02X", d.opcode) },
+	"mnemonic": func(cpu *CPU, d decodedInstruction) string { return d.inst.mnemonic },
+	"disasm":   func(cpu *CPU, d decodedInstruction) string { return d.text(cpu.formatAddress) },
+	"nestest":  func(cpu *CPU, d decodedInstruction) string { return nestestDisassembly(cpu, d) },
+	"a":        func(cpu *CPU, d decodedInstruction) string { return fmt.Sprintf("%02X", cpu.A) },
+	"x":        func(cpu *CPU, d decodedInstruction) string { return fmt.Sprintf("%02X", cpu.X) },
+	"y":        func(cpu *CPU, d decodedInstruction) string { return fmt.Sprintf("%02X", cpu.Y) },
+	"p":        func(cpu *CPU, d decodedInstruction) string { return fmt.Sprintf("%02X", cpu.P|Unused) },
+	"sp":       func(cpu *CPU, d decodedInstruction) string { return fmt.Sprintf("%02X", cpu.SP) },
+	"flags":    func(cpu *CPU, d decodedInstruction) string { return flagString(cpu.P) },
+	"cycles":   func(cpu *CPU, d decodedInstruction) string { return strconv.Itoa(cpu.cycles) },
+}
+
+// flagString shows the flags as letters, upper case when set
+func flagString(p uint8) string {
+	flags := ""
+	for i, name := range "NV-BDIZC" {
+		if p&(0x80>>i) != 0 {
+			flags += string(name)
+		} else {
+			flags += strings.ToLower(string(name))
+		}
+	}
+	return flags
+}
+
+// customTraceLine compiles a format such as "{pc} {disasm} A={a}" into a
+// function that formats a line
+func customTraceLine(format string) (func(cpu *CPU) string, error) {
+	type part struct {
+		text  string
+		token func(cpu *CPU, d decodedInstruction) string
+	}
+	var parts []part
+	for format != "" {
+		start := strings.Index(format, "{")
+		if start < 0 {
+			parts = append(parts, part{text: format})
+			break
+		}
+		end := strings.Index(format[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated token in trace format")
+		}
+		name := format[start+1 : start+end]
+		token, ok := traceTokens[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown trace token {%s}", name)
+		}
+		parts = append(parts, part{text: format[:start]}, part{token: token})
+		format = format[start+end+1:]
+	}
+	return func(cpu *CPU) string {
+		d := cpu.decode(cpu.PC)
+		var b strings.Builder
+		for _, p := range parts {
+			if p.token != nil {
+				b.WriteString(p.token(cpu, d))
+			} else {
+				b.WriteString(p.text)
+			}
+		}
+		return b.String()
+	}, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// newTraceCPU sets up a CPU about to run an instruction at $0600, with memory
+// for each addressing mode to point into
+func newTraceCPU(t *testing.T, code []uint8) *CPU {
+	t.Helper()
+	cpu := &CPU{MMU: &MMU{}}
+	cpu.reset()
+	cpu.PC = 0x0600
+	cpu.A, cpu.X, cpu.Y = 0x11, 0x02, 0x03
+	memory := map[uint16]uint8{
+		0x00: 0x03, 0x01: 0x03, 0x10: 0xAA, 0x13: 0xCC, 0xFF: 0x00,
+		0x0200: 0x12, 0x02FF: 0x34, 0x0300: 0xDD, 0x0301: 0xEE, 0x0303: 0x33,
+	}
+	for address, value := range memory {
+		cpu.MMU.pokeByte(address, value)
+	}
+	for i, b := range code {
+		cpu.MMU.pokeByte(0x0600+uint16(i), b)
+	}
+	return cpu
+}
+
+func TestNestestTraceLine(t *testing.T) {
+	// The first line of nestest.log
+	cpu := &CPU{MMU: &MMU{}}
+	cpu.MMU.pokeByte(0xFFFC, 0x00)
+	cpu.MMU.pokeByte(0xFFFD, 0xC0)
+	cpu.MMU.loadProgram([]uint8{0x4C, 0xF5, 0xC5}, 0xC000)
+	cpu.reset()
+	want := "C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7"
+	if got := nestestTraceLine(cpu); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+
+	tests := []struct {
+		code []uint8
+		want string
+	}{
+		{[]uint8{0xE8}, "0600  E8        INX                             A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{[]uint8{0x0A}, "0600  0A        ASL A                           A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{[]uint8{0xA9, 0x42}, "0600  A9 42     LDA #$42                        A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{[]uint8{0xA5, 0x10}, "0600  A5 10     LDA $10 = AA                    A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		// Zero page indexing wraps within the zero page
+		{[]uint8{0xB5, 0xFF}, "0600  B5 FF     LDA $FF,X @ 01 = 03             A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{[]uint8{0xB6, 0x10}, "0600  B6 10     LDX $10,Y @ 13 = CC             A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{[]uint8{0xD0, 0xFE}, "0600  D0 FE     BNE $0600                       A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{[]uint8{0xAD, 0x00, 0x03}, "0600  AD 00 03  LDA $0300 = DD                  A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		// Jumps do not show the value at their target
+		{[]uint8{0x4C, 0x00, 0xC0}, "0600  4C 00 C0  JMP $C000                       A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{[]uint8{0xBD, 0xFF, 0x02}, "0600  BD FF 02  LDA $02FF,X @ 0301 = EE         A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{[]uint8{0xB9, 0x00, 0x03}, "0600  B9 00 03  LDA $0300,Y @ 0303 = 33         A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		// The pointer's high byte comes from the start of its page
+		{[]uint8{0x6C, 0xFF, 0x02}, "0600  6C FF 02  JMP ($02FF) = 1234              A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{[]uint8{0xA1, 0xFE}, "0600  A1 FE     LDA ($FE,X) @ 00 = 0303 = 33    A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{[]uint8{0xB1, 0xFF}, "0600  B1 FF     LDA ($FF),Y = 0300 @ 0303 = 33  A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{[]uint8{0x02}, "0600  02        .byte $02                       A:11 X:02 Y:03 P:24 SP:FD PPU:  0, 21 CYC:7"},
+	}
+	for _, test := range tests {
+		if got := nestestTraceLine(newTraceCPU(t, test.code)); got != test.want {
+			t.Errorf("% X: expected\n%s\ngot\n%s", test.code, test.want, got)
+		}
+	}
+
+	// The PPU position moves on three dots a cycle, 341 to a line and 262
+	// lines to a frame
+	cpu = newTraceCPU(t, []uint8{0xE8})
+	cpu.cycles = 30000
+	if got := nestestTraceLine(cpu); !strings.HasSuffix(got, " PPU:  1,317 CYC:30000") {
+		t.Errorf("expected PPU:  1,317 at cycle 30000, got %s", got)
+	}
+}
+
+func TestJSONTrace(t *testing.T) {
+	var out bytes.Buffer
+	tracer, err := newTracer(&out, traceJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := newTraceCPU(t, []uint8{0xA9, 0x42, 0xE8})
+	tracer.trace(cpu)
+	cpu.step()
+	tracer.trace(cpu)
+	if err := tracer.close(); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"pc":1536,"bytes":[169,66],"disasm":"LDA #$42","a":17,"x":2,"y":3,"p":36,"sp":253,"cycles":7}` + "\n" +
+		`{"pc":1538,"bytes":[232],"disasm":"INX","a":66,"x":2,"y":3,"p":36,"sp":253,"cycles":9}` + "\n"
+	if out.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, out.String())
+	}
+	var entry jsonTraceEntry
+	if err := json.Unmarshal([]byte(strings.Split(out.String(), "\n")[1]), &entry); err != nil || entry.PC != 0x0602 || entry.A != 0x42 {
+		t.Errorf("expected the second line to read back, got %+v (%v)", entry, err)
+	}
+}
+
+func TestCustomTrace(t *testing.T) {
+	line, err := customTraceLine("{pc} {bytes} {opcode} {mnemonic} [{disasm}] A:{a} X:{x} Y:{y} P:{p} SP:{sp} {flags} {cycles}!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := newTraceCPU(t, []uint8{0xBD, 0xFF, 0x02})
+	want := "0600 BD FF 02 BD LDA [LDA $02FF,X] A:11 X:02 Y:03 P:24 SP:FD nv-bdIzc 7!"
+	if got := line(cpu); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+	line, err = customTraceLine("{nestest}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := line(cpu); got != "LDA $02FF,X @ 0301 = EE" {
+		t.Errorf("expected the nestest disassembly, got %q", got)
+	}
+}
+
+func TestTraceFormatErrors(t *testing.T) {
+	tests := []struct {
+		format, want string
+	}{
+		{"{pc} {foo}", "unknown trace token {foo}"},
+		{"{pc} {a", "unterminated token in trace format"},
+		{"nintendulator", `unknown trace format "nintendulator": use nestest, json or a format with {tokens}`},
+	}
+	for _, test := range tests {
+		_, err := newTracer(&bytes.Buffer{}, test.format)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%q: expected the error %q, got %v", test.format, test.want, err)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// traceFields are the fields of a trace line that are compared, in the order
+// differences are listed
+var traceFields = []string{"pc", "bytes", "a", "x", "y", "p", "sp", "cycles"}
+
+// traceState is the CPU state on a line of a trace. Fields missing from a
+// reference line are not compared.
+type traceState struct {
+	values map[string]int
+	bytes  []uint8
+	text   string // the line as it was written
+}
+
+// nestestRegisters matches the registers in a nestest style log, which most
+// NES emulators can write
+var nestestRegisters = regexp.MustCompile(`A:([0-9A-Fa-f]{2}) X:([0-9A-Fa-f]{2}) Y:([0-9A-Fa-f]{2}) P:([0-9A-Fa-f]{2}) SP:([0-9A-Fa-f]{2})`)
+
+// nestestCycles matches the cycle count in a nestest style log
+var nestestCycles = regexp.MustCompile(`CYC:\s*(\d+)`)
+
+// parseTraceLine parses a line of a reference trace, in the nestest layout or
+// as JSON lines like those --trace-format json writes
+func parseTraceLine(line string) (traceState, error) {
+	state := traceState{values: map[string]int{}, text: line}
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		var entry struct {
+			PC     *int  `json:"pc"`
+			Bytes  []int `json:"bytes"`
+			A      *int  `json:"a"`
+			X      *int  `json:"x"`
+			Y      *int  `json:"y"`
+			P      *int  `json:"p"`
+			SP     *int  `json:"sp"`
+			Cycles *int  `json:"cycles"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return state, err
+		}
+		for name, value := range map[string]*int{"pc": entry.PC, "a": entry.A, "x": entry.X, "y": entry.Y, "p": entry.P, "sp": entry.SP, "cycles": entry.Cycles} {
+			if value != nil {
+				state.values[name] = *value
+			}
+		}
+		if entry.Bytes != nil {
+			state.bytes = make([]uint8, len(entry.Bytes))
+			for i, b := range entry.Bytes {
+				state.bytes[i] = uint8(b)
+			}
+			state.values["bytes"] = 0
+		}
+		if _, ok := state.values["pc"]; !ok {
+			return state, fmt.Errorf("no pc")
+		}
+		return state, nil
+	}
+	// The line starts with the PC, then the instruction bytes
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return state, fmt.Errorf("empty line")
+	}
+	pc, err := strconv.ParseUint(fields[0], 16, 16)
+	if err != nil {
+		return state, fmt.Errorf("no PC at the start of the line")
+	}
+	state.values["pc"] = int(pc)
+	for _, field := range fields[1:] {
+		b, err := strconv.ParseUint(field, 16, 8)
+		if err != nil || len(field) != 2 || len(state.bytes) == 3 {
+			break
+		}
+		state.bytes = append(state.bytes, uint8(b))
+	}
+	if state.bytes != nil {
+		state.values["bytes"] = 0
+	}
+	registers := nestestRegisters.FindStringSubmatch(line)
+	if registers == nil {
+		return state, fmt.Errorf("no registers")
+	}
+	for i, name := range []string{"a", "x", "y", "p", "sp"} {
+		value, _ := strconv.ParseUint(registers[i+1], 16, 8)
+		state.values[name] = int(value)
+	}
+	if cycles := nestestCycles.FindStringSubmatch(line); cycles != nil {
+		state.values["cycles"], _ = strconv.Atoi(cycles[1])
+	}
+	return state, nil
+}
+
+// cpuTraceState returns the state of the CPU before the instruction at the PC,
+// written in the same layout as a reference line
+func cpuTraceState(cpu *CPU, reference traceState) traceState {
+	d := cpu.decode(cpu.PC)
+	state := traceState{values: map[string]int{
+		"pc": int(cpu.PC), "bytes": 0, "a": int(cpu.A), "x": int(cpu.X), "y": int(cpu.Y),
+		"p": int(cpu.P | Unused), "sp": int(cpu.SP), "cycles": cpu.cycles,
+	}, bytes: d.bytes}
+	if strings.HasPrefix(strings.TrimSpace(reference.text), "{") {
+		state.text = jsonTraceLine(cpu)
+	} else {
+		state.text = nestestTraceLine(cpu)
+	}
+	return state
+}
+
+// traceDifferences lists the fields where the CPU's state differs from a
+// reference line, skipping ignored fields and those the reference lacks
+func traceDifferences(reference, got traceState, ignore map[string]bool) []string {
+	var differences []string
+	for _, name := range traceFields {
+		expected, ok := reference.values[name]
+		if !ok || ignore[name] {
+			continue
+		}
+		switch name {
+		case "bytes":
+			// A reference may list fewer bytes than the instruction has
+			n := len(reference.bytes)
+			if n > len(got.bytes) || !equalBytes(reference.bytes, got.bytes[:n]) {
+				differences = append(differences, fmt.Sprintf("bytes: expected %s, got %s", hexBytes(reference.bytes), hexBytes(got.bytes)))
+			}
+		case "pc":
+			if got.values[name] != expected {
+				differences = append(differences, fmt.Sprintf("PC: expected $%04X, got $%04X", expected, got.values[name]))
+			}
+		case "cycles":
+			if got.values[name] != expected {
+				differences = append(differences, fmt.Sprintf("cycles: expected %d, got %d (%+d)", expected, got.values[name], got.values[name]-expected))
+			}
+		case "p":
+			if got.values[name] != expected {
+				differences = append(differences, fmt.Sprintf("P: expected $%02X (%s), got $%02X (%s)",
+					expected, flagString(uint8(expected)), got.values[name], flagString(uint8(got.values[name]))))
+			}
+		default:
+			if got.values[name] != expected {
+				differences = append(differences, fmt.Sprintf("%s: expected $%02X, got $%02X", strings.ToUpper(name), expected, got.values[name]))
+			}
+		}
+	}
+	return differences
+}
+
+// isTraceField reports whether a name is one of the compared fields
+func isTraceField(name string) bool {
+	for _, field := range traceFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// equalBytes reports whether two byte slices hold the same bytes
+func equalBytes(a, b []uint8) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// traceDiff runs the CPU against a reference trace, line by line, until the
+// first line that differs or the reference ends. It reports whether the
+// traces matched.
+func traceDiff(cpu *CPU, reference io.Reader, name string, contextLines int, ignore map[string]bool, out io.Writer) (bool, error) {
+	scanner := bufio.NewScanner(reference)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	// The matching lines before the current one, for context
+	var previous []string
+	lineNumber, instructions := 0, 0
+	for scanner.Scan() {
+		lineNumber++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		expected, err := parseTraceLine(scanner.Text())
+		if err != nil {
+			return false, fmt.Errorf("%s:%d: %v", name, lineNumber, err)
+		}
+		// Interrupts are not traced, so take any that are due first
+		for cpu.running && cpu.interruptPending() {
+			cpu.step()
+		}
+		got := cpuTraceState(cpu, expected)
+		var differences []string
+		if !cpu.running || cpu.getFlag(Break) {
+			differences = []string{"the program stopped, but the reference goes on"}
+		} else {
+			differences = traceDifferences(expected, got, ignore)
+		}
+		if len(differences) > 0 {
+			fmt.Fprintf(out, "Traces differ at instruction %d, line %d of %s\n", instructions+1, lineNumber, name)
+			for _, line := range previous {
+				fmt.Fprintln(out, "  ", line)
+			}
+			fmt.Fprintln(out, "- ", expected.text)
+			fmt.Fprintln(out, "+ ", got.text)
+			// Show what the reference does next
+			for i := 0; i < contextLines && scanner.Scan(); i++ {
+				fmt.Fprintln(out, "  ", scanner.Text())
+			}
+			fmt.Fprintln(out, "Differences:")
+			for _, difference := range differences {
+				fmt.Fprintln(out, "  ", difference)
+			}
+			fmt.Fprintf(out, "CPU: A=$%02X X=$%02X Y=$%02X P=$%02X (%s) SP=$%02X PC=$%04X cycles=%d\n",
+				cpu.A, cpu.X, cpu.Y, cpu.P, flagString(cpu.P), cpu.SP, cpu.PC, cpu.cycles)
+			return false, nil
+		}
+		if contextLines > 0 {
+			if len(previous) == contextLines {
+				previous = previous[1:]
+			}
+			previous = append(previous, got.text)
+		}
+		cpu.step()
+		instructions++
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	fmt.Fprintf(out, "Traces match for %d instructions\n", instructions)
+	return true, nil
+}
+
+// printTraceDiffUsage prints the usage of the tracediff subcommand
+func printTraceDiffUsage() {
+	fmt.Println("Usage: go6502 tracediff [options] -f file[@address] ... reference.log")
+	fmt.Println("Runs a program and compares its trace against a reference log, stopping at the first difference")
+	fmt.Println("The reference can be a nestest style log (from Nintendulator and most NES emulators) or JSON lines")
+	fmt.Println("as written by --trace-format json")
+	fmt.Println("Options:")
+	fmt.Println("  -f, --file\t\tLoad a program from a file, as with go6502 --file (may be repeated)")
+	fmt.Println("  -s, --start\t\tStart at this address instead of the RESET vector")
+	fmt.Println("  -C, --context\t\tThe number of lines to show around the difference (default 5)")
+	fmt.Println("  --ignore\t\tFields not to compare, comma separated: pc, bytes, a, x, y, p, sp, cycles")
+	fmt.Println("Example: go6502 tracediff -f nestest.nes --start 0xC000 --ignore bytes nestest.log")
+}
+
+// traceDiffCommand implements the tracediff subcommand
+func traceDiffCommand(args []string) int {
+	var files []programFile
+	var start uint16
+	hasStart := false
+	contextLines := 5
+	ignore := map[string]bool{}
+	reference := ""
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-h", "--help":
+			printTraceDiffUsage()
+			return 0
+		case "-f", "--file", "-s", "--start", "-C", "--context", "--ignore":
+			if i+1 >= len(args) {
+				fmt.Println("Missing value for", args[i])
+				return 1
+			}
+			i++
+			switch args[i-1] {
+			case "-f", "--file":
+				file, err := parseFileSpec(args[i])
+				if err != nil {
+					fmt.Println(err)
+					return 1
+				}
+				files = append(files, file)
+			case "-s", "--start":
+				address, err := parseAddress(args[i])
+				if err != nil {
+					fmt.Println("Invalid start address:", args[i])
+					return 1
+				}
+				start, hasStart = address, true
+			case "-C", "--context":
+				n, err := strconv.Atoi(args[i])
+				if err != nil || n < 0 {
+					fmt.Println("Invalid number of context lines:", args[i])
+					return 1
+				}
+				contextLines = n
+			case "--ignore":
+				for _, field := range strings.Split(strings.ToLower(args[i]), ",") {
+					field = strings.TrimSpace(field)
+					if !isTraceField(field) {
+						fmt.Println("Unknown field:", field)
+						return 1
+					}
+					ignore[field] = true
+				}
+			}
+		default:
+			if strings.HasPrefix(args[i], "-") || reference != "" {
+				fmt.Println("Invalid option:", args[i])
+				return 1
+			}
+			reference = args[i]
+		}
+	}
+	if len(files) == 0 || reference == "" {
+		printTraceDiffUsage()
+		return 1
+	}
+
+	cpu := &CPU{clockSpeed: mhzToHz(1), MMU: &MMU{}}
+	// Reset before loading, so XEX init routines have a stack to run on
+	cpu.reset()
+	var images []*programImage
+	for _, file := range files {
+		img, err := loadProgramFromFile(file)
+		if err != nil {
+			fmt.Println("Error loading file:", err)
+			return 1
+		}
+		if err := cpu.loadImage(img); err != nil {
+			fmt.Printf("Error loading %s: %v\n", file.fileName, err)
+			return 1
+		}
+		images = append(images, img)
+	}
+	cpu.reset()
+	cpu.PC = entryPoint(images, cpu.PC, false)
+	if hasStart {
+		cpu.PC = start
+	}
+
+	f, err := os.Open(reference)
+	if err != nil {
+		fmt.Println("Error opening reference:", err)
+		return 1
+	}
+	defer f.Close()
+	matched, err := traceDiff(cpu, f, reference, contextLines, ignore, os.Stdout)
+	if err != nil {
+		fmt.Println("Error reading reference:", err)
+		return 1
+	}
+	if !matched {
+		return 1
+	}
+	return 0
+}
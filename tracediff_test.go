@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		values map[string]int
+		bytes  []uint8
+	}{
+		{
+			name:   "nestest",
+			line:   "C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7",
+			values: map[string]int{"pc": 0xC000, "bytes": 0, "a": 0, "x": 0, "y": 0, "p": 0x24, "sp": 0xFD, "cycles": 7},
+			bytes:  []uint8{0x4C, 0xF5, 0xC5},
+		},
+		{
+			// An illegal opcode, marked with a star, and no cycle count
+			name:   "nestest without cycles",
+			line:   "C6BD  04 A9    *NOP $A9 = 00                    A:AA X:97 Y:4E P:EF SP:F5",
+			values: map[string]int{"pc": 0xC6BD, "bytes": 0, "a": 0xAA, "x": 0x97, "y": 0x4E, "p": 0xEF, "sp": 0xF5},
+			bytes:  []uint8{0x04, 0xA9},
+		},
+		{
+			// Only the PC and registers, as some emulators log
+			name:   "no bytes",
+			line:   "C000 JMP $C5F5 A:01 X:02 Y:03 P:24 SP:FD",
+			values: map[string]int{"pc": 0xC000, "a": 1, "x": 2, "y": 3, "p": 0x24, "sp": 0xFD},
+		},
+		{
+			name:   "JSON",
+			line:   `{"pc":1536,"bytes":[169,66],"disasm":"LDA #$42","a":17,"x":2,"y":3,"p":36,"sp":253,"cycles":7}`,
+			values: map[string]int{"pc": 0x0600, "bytes": 0, "a": 0x11, "x": 2, "y": 3, "p": 0x24, "sp": 0xFD, "cycles": 7},
+			bytes:  []uint8{0xA9, 0x42},
+		},
+		{
+			name:   "JSON with fields missing",
+			line:   `{"pc":1536,"a":17}`,
+			values: map[string]int{"pc": 0x0600, "a": 0x11},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state, err := parseTraceLine(test.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(state.values, test.values) {
+				t.Errorf("expected %v, got %v", test.values, state.values)
+			}
+			if !bytes.Equal(state.bytes, test.bytes) {
+				t.Errorf("expected the bytes % X, got % X", test.bytes, state.bytes)
+			}
+		})
+	}
+
+	for line, want := range map[string]string{
+		"":                              "empty line",
+		"JMP $C5F5 A:00":                "no PC at the start of the line",
+		"C000  4C F5 C5  JMP $C5F5":     "no registers",
+		`{"a":17}`:                      "no pc",
+		`{"pc":1536,"a":17`:             "unexpected end of JSON input",
+		"C000  A:00 X:00 Y:00 P:24 SP:": "no registers",
+	} {
+		if _, err := parseTraceLine(line); err == nil || err.Error() != want {
+			t.Errorf("%q: expected the error %q, got %v", line, want, err)
+		}
+	}
+}
+
+func TestTraceDifferences(t *testing.T) {
+	got := traceState{
+		values: map[string]int{"pc": 0x0600, "bytes": 0, "a": 0x11, "x": 2, "y": 3, "p": 0x24, "sp": 0xFD, "cycles": 9},
+		bytes:  []uint8{0xA9, 0x42},
+	}
+	tests := []struct {
+		name   string
+		line   string
+		ignore map[string]bool
+		want   []string
+	}{
+		{"the same", `{"pc":1536,"bytes":[169,66],"a":17,"x":2,"y":3,"p":36,"sp":253,"cycles":9}`, nil, nil},
+		{"missing fields are skipped", `{"pc":1536,"a":17}`, nil, nil},
+		{"fewer bytes", `{"pc":1536,"bytes":[169]}`, nil, nil},
+		{
+			"every field",
+			`{"pc":1537,"bytes":[169,67],"a":18,"x":1,"y":4,"p":37,"sp":252,"cycles":7}`,
+			nil,
+			[]string{
+				"PC: expected $0601, got $0600",
+				"bytes: expected A9 43, got A9 42",
+				"A: expected $12, got $11",
+				"X: expected $01, got $02",
+				"Y: expected $04, got $03",
+				"P: expected $25 (nv-bdIzC), got $24 (nv-bdIzc)",
+				"SP: expected $FC, got $FD",
+				"cycles: expected 7, got 9 (+2)",
+			},
+		},
+		{"ignored", `{"pc":1536,"a":17,"cycles":7}`, map[string]bool{"cycles": true}, nil},
+		{"more bytes than there are", `{"pc":1536,"bytes":[169,66,0]}`, nil, []string{"bytes: expected A9 42 00, got A9 42"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reference, err := parseTraceLine(test.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if differences := traceDifferences(reference, got, test.ignore); !reflect.DeepEqual(differences, test.want) {
+				t.Errorf("expected %q, got %q", test.want, differences)
+			}
+		})
+	}
+}
+
+// traceDiffProgram is LDA #$42 / INX / INY / BRK at $0600
+var traceDiffProgram = []uint8{0xA9, 0x42, 0xE8, 0xC8, 0x00}
+
+// traceDiffReference traces the program as a reference log, in the nestest
+// layout
+func traceDiffReference(t *testing.T) []string {
+	t.Helper()
+	cpu := newTraceCPU(t, traceDiffProgram)
+	var lines []string
+	for i := 0; i < 3; i++ {
+		lines = append(lines, nestestTraceLine(cpu))
+		cpu.step()
+	}
+	return lines
+}
+
+func TestTraceDiff(t *testing.T) {
+	reference := traceDiffReference(t)
+	var out bytes.Buffer
+	matched, err := traceDiff(newTraceCPU(t, traceDiffProgram), strings.NewReader(strings.Join(reference, "\n")+"\n"), "ref.log", 1, nil, &out)
+	if err != nil || !matched {
+		t.Fatalf("expected the traces to match, got %v:\n%s", err, out.String())
+	}
+	if out.String() != "Traces match for 3 instructions\n" {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+
+	// Y is off on the third instruction, which is on line 4 past a blank line
+	reference[2] = strings.Replace(reference[2], "Y:03", "Y:04", 1)
+	log := reference[0] + "\n\n" + strings.Join(reference[1:], "\n") + "\n"
+	out.Reset()
+	matched, err = traceDiff(newTraceCPU(t, traceDiffProgram), strings.NewReader(log), "ref.log", 1, nil, &out)
+	if err != nil || matched {
+		t.Fatalf("expected the traces to differ, got %v", err)
+	}
+	want := "Traces differ at instruction 3, line 4 of ref.log\n" +
+		"   " + reference[1] + "\n" +
+		"-  " + reference[2] + "\n" +
+		"+  " + strings.Replace(reference[2], "Y:04", "Y:03", 1) + "\n" +
+		"Differences:\n" +
+		"   Y: expected $04, got $03\n"
+	if !strings.HasPrefix(out.String(), want) {
+		t.Errorf("expected\n%s\ngot\n%s", want, out.String())
+	}
+
+	// Ignoring Y, they match
+	out.Reset()
+	matched, err = traceDiff(newTraceCPU(t, traceDiffProgram), strings.NewReader(log), "ref.log", 1, map[string]bool{"y": true}, &out)
+	if err != nil || !matched {
+		t.Errorf("expected the traces to match ignoring Y, got %v:\n%s", err, out.String())
+	}
+
+	// A line that cannot be read is reported with its number
+	_, err = traceDiff(newTraceCPU(t, traceDiffProgram), strings.NewReader(reference[0]+"\nnonsense\n"), "ref.log", 1, nil, &out)
+	if err == nil || err.Error() != "ref.log:2: no PC at the start of the line" {
+		t.Errorf("expected an error at line 2, got %v", err)
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+// The VIA's registers
+const (
+	viaORB  = 0x0 // output/input register B
+	viaORA  = 0x1 // output/input register A, with handshaking
+	viaDDRB = 0x2
+	viaDDRA = 0x3
+	viaT1CL = 0x4 // timer 1 counter, low byte (writes go to the latch)
+	viaT1CH = 0x5 // timer 1 counter, high byte
+	viaT1LL = 0x6 // timer 1 latch, low byte
+	viaT1LH = 0x7 // timer 1 latch, high byte
+	viaT2CL = 0x8 // timer 2 counter, low byte (writes go to the latch)
+	viaT2CH = 0x9 // timer 2 counter, high byte
+	viaSR   = 0xA // shift register
+	viaACR  = 0xB // auxiliary control register
+	viaPCR  = 0xC // peripheral control register
+	viaIFR  = 0xD // interrupt flag register
+	viaIER  = 0xE // interrupt enable register
+	viaORAN = 0xF // output/input register A, without handshaking
+)
+
+// The interrupt flags, in the IFR and IER
+const (
+	viaCA2 uint8 = 1 << iota
+	viaCA1
+	viaShift
+	viaCB2
+	viaCB1
+	viaTimer2
+	viaTimer1
+	viaIRQ // set in the IFR while any enabled flag is
+)
+
+// The modes of CA2 and CB2, in their three bits of the PCR
+const (
+	viaInputNegative       = 0 // an input, flagging falling edges
+	viaIndependentNegative = 1 // the same, without reading or writing the port clearing the flag
+	viaInputPositive       = 2
+	viaIndependentPositive = 3
+	viaHandshake           = 4 // an output, low from a port access until the next active edge of CA1/CB1
+	viaPulse               = 5 // an output, low for a cycle after a port access
+	viaLow                 = 6
+	viaHigh                = 7
+)
+
+// VIA is a W65C22 versatile interface adapter: two 8-bit ports with data
+// direction registers and the control lines CA1, CA2, CB1 and CB2 for
+// handshaking, two 16-bit timers, a shift register, and an IRQ output.
+//
+// The pins the VIA drives can be watched by the host, which can also drive
+// the input pins, through the input log as <name>.pa, <name>.pb, <name>.ca1,
+// <name>.ca2, <name>.cb1 and <name>.cb2.
+type VIA struct {
+	label string
+	irq   func(active bool)
+
+	ports
+	// ira and irb are the inputs latched on active edges of CA1 and CB1
+	ira, irb uint8
+	// The control lines as the outside world drives them
+	ca1, ca2, cb1, cb2 bool
+	// ca2Out and cb2Out are CA2 and CB2 when they are outputs
+	ca2Out, cb2Out bool
+	// ca2Pulse and cb2Pulse are set for the cycle a pulse output is low
+	ca2Pulse, cb2Pulse bool
+
+	// Timer 1 counts down from its latch, once or over and over
+	t1, t1Latch uint16
+	t1Armed     bool // it will interrupt when it runs out
+	t1Reload    bool // it ran out and reloads from the latch on the next cycle
+	pb7         bool // the timer's output on PB7
+	// Timer 2 counts down once, or counts pulses on PB6
+	t2       uint16
+	t2Latch  uint8 // the low byte, which also sets the shift rate
+	t2Armed  bool
+	sr       uint8
+	srCount  int // bits left to shift
+	srTimer  int // cycles to the next shift
+	acr, pcr uint8
+	ifr, ier uint8
+	// irqActive is whether the IRQ output is low
+	irqActive bool
+}
+
+// newVIA creates a VIA, with its IRQ output connected to irq
+func newVIA(label string, irq func(active bool)) *VIA {
+	v := &VIA{label: label, irq: irq}
+	v.reset()
+	return v
+}
+
+// reset puts the VIA in the state it comes out of reset in
+func (v *VIA) reset() {
+	*v = VIA{label: v.label, irq: v.irq, ports: v.ports}
+	v.ports.reset(v.changed)
+	v.ca1, v.ca2, v.cb1, v.cb2 = true, true, true, true
+	v.ca2Out, v.cb2Out = true, true
+	v.pb7 = true
+	v.lastPins = v.pins()
+}
+
+func (v *VIA) name() string { return v.label }
+
+func (v *VIA) size() int { return 16 }
+
+// portB returns the levels of the port B pins. Timer 1 can drive PB7.
+func (v *VIA) portB() uint8 {
+	pins := v.b.pins()
+	if v.acr&0x80 != 0 {
+		pins = pins&0x7F | boolToInt(v.pb7)<<7
+	}
+	return pins
+}
+
+// ca2Mode and cb2Mode return the modes of CA2 and CB2
+func (v *VIA) ca2Mode() uint8 { return v.pcr >> 1 & 7 }
+func (v *VIA) cb2Mode() uint8 { return v.pcr >> 5 & 7 }
+
+// shiftMode returns the shift register's mode, from the ACR
+func (v *VIA) shiftMode() uint8 { return v.acr >> 2 & 7 }
+
+// pinCA2 and pinCB2 return the levels of CA2 and CB2, whether the VIA or the
+// outside world drives them
+func (v *VIA) pinCA2() bool {
+	if v.ca2Mode() >= viaHandshake {
+		return v.ca2Out
+	}
+	return v.ca2
+}
+
+func (v *VIA) pinCB2() bool {
+	if v.cb2Mode() >= viaHandshake || v.shiftMode() >= 4 {
+		return v.cb2Out
+	}
+	return v.cb2
+}
+
+// pins returns the levels of the pins the VIA can drive
+func (v *VIA) pins() portPins {
+	return portPins{pa: v.portA(), pb: v.portB(), ca2: v.pinCA2(), cb2: v.pinCB2()}
+}
+
+// changed tells the watchers if the pins have changed. Falling edges on PB6
+// are counted by timer 2 in pulse counting mode.
+func (v *VIA) changed() {
+	pins := v.pins()
+	last := v.notify(pins)
+	if v.acr&0x20 != 0 && last.pb&0x40 != 0 && pins.pb&0x40 == 0 {
+		v.t2--
+		if v.t2 == 0 && v.t2Armed {
+			v.t2Armed = false
+			v.setFlags(viaTimer2)
+		}
+	}
+}
+
+// setFlags sets interrupt flags and clearFlags clears them, updating the IRQ
+// output
+func (v *VIA) setFlags(flags uint8) {
+	v.ifr |= flags
+	v.updateIRQ()
+}
+
+func (v *VIA) clearFlags(flags uint8) {
+	v.ifr &^= flags
+	v.updateIRQ()
+}
+
+// updateIRQ pulls the IRQ output low while any enabled flag is set
+func (v *VIA) updateIRQ() {
+	active := v.ifr&v.ier&0x7F != 0
+	if active != v.irqActive {
+		v.irqActive = active
+		if v.irq != nil {
+			v.irq(active)
+		}
+	}
+}
+
+// accessPortA handles the side effects of reading or writing ORA: clearing
+// the CA1 and CA2 flags and the CA2 handshake
+func (v *VIA) accessPortA() {
+	flags := viaCA1
+	if mode := v.ca2Mode(); mode != viaIndependentNegative && mode != viaIndependentPositive {
+		flags |= viaCA2
+	}
+	v.clearFlags(flags)
+	switch v.ca2Mode() {
+	case viaHandshake:
+		v.ca2Out = false
+	case viaPulse:
+		v.ca2Out, v.ca2Pulse = false, true
+	}
+}
+
+// accessPortB does the same for ORB. CB2 only handshakes on writes.
+func (v *VIA) accessPortB(write bool) {
+	flags := viaCB1
+	if mode := v.cb2Mode(); mode != viaIndependentNegative && mode != viaIndependentPositive {
+		flags |= viaCB2
+	}
+	v.clearFlags(flags)
+	if !write {
+		return
+	}
+	switch v.cb2Mode() {
+	case viaHandshake:
+		v.cb2Out = false
+	case viaPulse:
+		v.cb2Out, v.cb2Pulse = false, true
+	}
+}
+
+// readPortA returns what reading IRA gives: the pins, or what was latched on
+// the last active edge of CA1 if latching is on
+func (v *VIA) readPortA() uint8 {
+	if v.acr&0x01 != 0 {
+		return v.ira
+	}
+	return v.portA()
+}
+
+// readPortB returns what reading IRB gives: ORB for the output pins, and the
+// pins, or what was latched, for the inputs
+func (v *VIA) readPortB() uint8 {
+	inputs := v.portB()
+	if v.acr&0x02 != 0 {
+		inputs = v.irb
+	}
+	return v.b.or&v.b.ddr | inputs&^v.b.ddr
+}
+
+func (v *VIA) peek(register uint16) uint8 {
+	switch register {
+	case viaORB:
+		return v.readPortB()
+	case viaORA, viaORAN:
+		return v.readPortA()
+	case viaDDRB:
+		return v.b.ddr
+	case viaDDRA:
+		return v.a.ddr
+	case viaT1CL:
+		return uint8(v.t1)
+	case viaT1CH:
+		return uint8(v.t1 >> 8)
+	case viaT1LL:
+		return uint8(v.t1Latch)
+	case viaT1LH:
+		return uint8(v.t1Latch >> 8)
+	case viaT2CL:
+		return uint8(v.t2)
+	case viaT2CH:
+		return uint8(v.t2 >> 8)
+	case viaSR:
+		return v.sr
+	case viaACR:
+		return v.acr
+	case viaPCR:
+		return v.pcr
+	case viaIFR:
+		if v.irqActive {
+			return v.ifr | viaIRQ
+		}
+		return v.ifr
+	case viaIER:
+		return v.ier | 0x80
+	}
+	return 0
+}
+
+func (v *VIA) read(register uint16) uint8 {
+	value := v.peek(register)
+	switch register {
+	case viaORB:
+		v.accessPortB(false)
+	case viaORA:
+		v.accessPortA()
+	case viaT1CL:
+		v.clearFlags(viaTimer1)
+	case viaT2CL:
+		v.clearFlags(viaTimer2)
+	case viaSR:
+		v.startShift()
+	}
+	v.changed()
+	return value
+}
+
+func (v *VIA) write(register uint16, value uint8) {
+	switch register {
+	case viaORB:
+		v.b.or = value
+		v.accessPortB(true)
+	case viaORA:
+		v.a.or = value
+		v.accessPortA()
+	case viaORAN:
+		v.a.or = value
+	case viaDDRB:
+		v.b.ddr = value
+	case viaDDRA:
+		v.a.ddr = value
+	case viaT1CL, viaT1LL:
+		v.t1Latch = v.t1Latch&0xFF00 | uint16(value)
+	case viaT1CH:
+		// Writing the high byte of the counter starts the timer
+		v.t1Latch = v.t1Latch&0x00FF | uint16(value)<<8
+		v.t1, v.t1Armed, v.t1Reload = v.t1Latch, true, false
+		v.clearFlags(viaTimer1)
+		if v.acr&0x80 != 0 {
+			v.pb7 = false
+		}
+	case viaT1LH:
+		v.t1Latch = v.t1Latch&0x00FF | uint16(value)<<8
+		v.clearFlags(viaTimer1)
+	case viaT2CL:
+		v.t2Latch = value
+	case viaT2CH:
+		v.t2, v.t2Armed = uint16(value)<<8|uint16(v.t2Latch), true
+		v.clearFlags(viaTimer2)
+	case viaSR:
+		v.sr = value
+		v.startShift()
+	case viaACR:
+		// PB7 goes high when timer 1 starts driving it
+		if value&0x80 != 0 && v.acr&0x80 == 0 {
+			v.pb7 = true
+		}
+		v.acr = value
+	case viaPCR:
+		v.pcr = value
+		// Outputs start high, except a manual low
+		v.ca2Out = v.ca2Mode() != viaLow
+		v.cb2Out = v.cb2Mode() != viaLow
+		v.ca2Pulse, v.cb2Pulse = false, false
+	case viaIFR:
+		// Writing ones clears flags
+		v.clearFlags(value & 0x7F)
+	case viaIER:
+		if value&0x80 != 0 {
+			v.ier |= value & 0x7F
+		} else {
+			v.ier &^= value & 0x7F
+		}
+		v.updateIRQ()
+	}
+	v.changed()
+}
+
+// startShift starts shifting eight bits, after the shift register is read or
+// written
+func (v *VIA) startShift() {
+	v.clearFlags(viaShift)
+	if v.shiftMode() != 0 {
+		v.srCount = 8
+		v.srTimer = v.shiftPeriod()
+	}
+}
+
+// shiftPeriod returns the number of cycles between shifts: a cycle of CB1 at
+// the rate timer 2's low latch sets, or at half the clock rate
+func (v *VIA) shiftPeriod() int {
+	switch v.shiftMode() {
+	case 1, 4, 5:
+		return 2 * (int(v.t2Latch) + 2)
+	case 2, 6:
+		return 2
+	}
+	return 0
+}
+
+// shift shifts a bit in from CB2, or out to CB2, where it also goes back in
+// at the bottom
+func (v *VIA) shift() {
+	mode := v.shiftMode()
+	if mode >= 4 {
+		bit := v.sr >> 7
+		v.sr = v.sr<<1 | bit
+		v.cb2Out = bit != 0
+	} else {
+		v.sr = v.sr<<1 | boolToInt(v.cb2)
+	}
+	v.srCount--
+	if v.srCount == 0 {
+		if mode == 4 {
+			// Shifting out at the free running rate carries on for ever
+			v.srCount = 8
+			return
+		}
+		v.setFlags(viaShift)
+	}
+}
+
+func (v *VIA) tick(cycles int) {
+	for i := 0; i < cycles; i++ {
+		// Pulse outputs go back high after a cycle
+		if v.ca2Pulse {
+			v.ca2Out, v.ca2Pulse = true, false
+		}
+		if v.cb2Pulse {
+			v.cb2Out, v.cb2Pulse = true, false
+		}
+
+		// Timer 1 runs out a cycle after reaching zero, and reloads a cycle
+		// later when free running, so it interrupts every latch+2 cycles
+		if v.t1Reload {
+			v.t1, v.t1Reload = v.t1Latch, false
+		} else {
+			v.t1--
+			if v.t1 == 0xFFFF {
+				v.timer1Expired()
+			}
+		}
+
+		// Timer 2 runs out once, unless it is counting pulses on PB6
+		if v.acr&0x20 == 0 {
+			v.t2--
+			if v.t2 == 0xFFFF && v.t2Armed {
+				v.t2Armed = false
+				v.setFlags(viaTimer2)
+			}
+		}
+
+		// The shift register shifts under its own clock, unless CB1 drives it
+		if v.srCount > 0 && v.srTimer > 0 {
+			v.srTimer--
+			if v.srTimer == 0 {
+				v.shift()
+				if v.srCount > 0 {
+					v.srTimer = v.shiftPeriod()
+				}
+			}
+		}
+	}
+	v.changed()
+}
+
+// timer1Expired interrupts and toggles PB7 each time timer 1 runs out when
+// free running, or the first time in one-shot mode
+func (v *VIA) timer1Expired() {
+	if v.acr&0x40 != 0 {
+		v.t1Reload = true
+		v.setFlags(viaTimer1)
+		v.pb7 = !v.pb7
+		return
+	}
+	if v.t1Armed {
+		v.t1Armed = false
+		v.setFlags(viaTimer1)
+		v.pb7 = true
+	}
+}
+
+// activeEdge reports whether a change of a control line to level is the
+// transition it is set to respond to
+func activeEdge(level, positive bool) bool {
+	return level == positive
+}
+
+// setCA1 drives CA1 from outside
+func (v *VIA) setCA1(level bool) {
+	if level == v.ca1 {
+		return
+	}
+	v.ca1 = level
+	if activeEdge(level, v.pcr&0x01 != 0) {
+		v.ira = v.portA()
+		if v.ca2Mode() == viaHandshake {
+			v.ca2Out = true
+		}
+		v.setFlags(viaCA1)
+	}
+	v.changed()
+}
+
+// setCA2 drives CA2 from outside, when it is an input
+func (v *VIA) setCA2(level bool) {
+	if level == v.ca2 {
+		return
+	}
+	v.ca2 = level
+	if mode := v.ca2Mode(); mode < viaHandshake && activeEdge(level, mode&viaInputPositive != 0) {
+		v.setFlags(viaCA2)
+	}
+}
+
+// setCB1 drives CB1 from outside. It also clocks the shift register in the
+// modes that use an external clock.
+func (v *VIA) setCB1(level bool) {
+	if level == v.cb1 {
+		return
+	}
+	v.cb1 = level
+	if mode := v.shiftMode(); (mode == 3 || mode == 7) && level && v.srCount > 0 {
+		v.shift()
+	}
+	if activeEdge(level, v.pcr&0x10 != 0) {
+		v.irb = v.portB()
+		if v.cb2Mode() == viaHandshake {
+			v.cb2Out = true
+		}
+		v.setFlags(viaCB1)
+	}
+	v.changed()
+}
+
+// setCB2 drives CB2 from outside, when it is an input
+func (v *VIA) setCB2(level bool) {
+	if level == v.cb2 {
+		return
+	}
+	v.cb2 = level
+	if mode := v.cb2Mode(); mode < viaHandshake && activeEdge(level, mode&viaInputPositive != 0) {
+		v.setFlags(viaCB2)
+	}
+}
+
+// connectInput lets the host drive the ports and control lines
+func (v *VIA) connectInput(l *InputLog) {
+	v.connectPorts(l, v.label)
+	l.handle(v.label+".ca1", func(value int) { v.setCA1(value != 0) })
+	l.handle(v.label+".ca2", func(value int) { v.setCA2(value != 0) })
+	l.handle(v.label+".cb1", func(value int) { v.setCB1(value != 0) })
+	l.handle(v.label+".cb2", func(value int) { v.setCB2(value != 0) })
+}
+
+// String describes the pins, for showing them as they change
+func (v *VIA) String() string {
+	return v.pins().describe(true)
+}
+
+func (v *VIA) saveState(e *stateEncoder) {
+	for _, b := range []uint8{v.a.or, v.b.or, v.a.ddr, v.b.ddr, v.a.in, v.b.in, v.ira, v.irb, v.t2Latch, v.sr, v.acr, v.pcr, v.ifr, v.ier} {
+		e.u8(b)
+	}
+	for _, b := range []bool{v.ca1, v.ca2, v.cb1, v.cb2, v.ca2Out, v.cb2Out, v.ca2Pulse, v.cb2Pulse, v.t1Armed, v.t1Reload, v.pb7, v.t2Armed, v.irqActive} {
+		e.bool(b)
+	}
+	e.u16(v.t1)
+	e.u16(v.t1Latch)
+	e.u16(v.t2)
+	e.u8(uint8(v.srCount))
+	e.u16(uint16(v.srTimer))
+}
+
+func (v *VIA) loadState(d *stateDecoder) {
+	for _, b := range []*uint8{&v.a.or, &v.b.or, &v.a.ddr, &v.b.ddr, &v.a.in, &v.b.in, &v.ira, &v.irb, &v.t2Latch, &v.sr, &v.acr, &v.pcr, &v.ifr, &v.ier} {
+		*b = d.u8()
+	}
+	for _, b := range []*bool{&v.ca1, &v.ca2, &v.cb1, &v.cb2, &v.ca2Out, &v.cb2Out, &v.ca2Pulse, &v.cb2Pulse, &v.t1Armed, &v.t1Reload, &v.pb7, &v.t2Armed, &v.irqActive} {
+		*b = d.bool()
+	}
+	v.t1 = d.u16()
+	v.t1Latch = d.u16()
+	v.t2 = d.u16()
+	v.srCount = int(d.u8())
+	v.srTimer = int(d.u16())
+	v.lastPins = v.pins()
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVIAPorts(t *testing.T) {
+	v := newVIA("via", nil)
+	// Reading IRB gives ORB for the output pins, even where the outside world
+	// drives them otherwise, and the pins for the inputs
+	v.write(viaDDRB, 0xF0)
+	v.write(viaORB, 0xA5)
+	v.setPortB(0x00)
+	if got := v.read(viaORB); got != 0xA0 {
+		t.Errorf("IRB: expected $A0, got $%02X", got)
+	}
+	v.write(viaORB, 0x5A)
+	v.setPortB(0xFF)
+	if got := v.read(viaORB); got != 0x5F {
+		t.Errorf("IRB: expected $5F, got $%02X", got)
+	}
+}
+
+func TestVIAHandshake(t *testing.T) {
+	output, irq := recordIRQ()
+	v := newVIA("via", output)
+	v.write(viaIER, 0x80|viaCA1)
+	// CA1 flags rising edges, CA2 is a handshake output
+	v.write(viaPCR, 0x01|viaHandshake<<1)
+	v.write(viaACR, 0x01) // latch port A on CA1
+	v.setPortA(0x42)
+	v.setCA1(false)
+	if *irq {
+		t.Fatal("a falling edge should not interrupt")
+	}
+	v.setCA1(true)
+	if !*irq || v.peek(viaIFR) != viaIRQ|viaCA1 {
+		t.Fatalf("expected a CA1 interrupt, IFR $%02X", v.peek(viaIFR))
+	}
+	v.setPortA(0x00)
+	// Reading IRA gets the latched value, clears the flag and starts the handshake
+	if got := v.read(viaORA); got != 0x42 {
+		t.Errorf("expected the latched $42, got $%02X", got)
+	}
+	if *irq || v.pinCA2() {
+		t.Errorf("expected the interrupt cleared and CA2 low, IRQ %v CA2 %v", *irq, v.pinCA2())
+	}
+	// The next active edge of CA1 ends it
+	v.setCA1(false)
+	v.setCA1(true)
+	if !v.pinCA2() {
+		t.Error("expected CA2 high after the handshake")
+	}
+
+	// A pulse output is low for a cycle after a write
+	v.write(viaPCR, viaPulse<<1)
+	v.write(viaORA, 0x01)
+	if v.pinCA2() {
+		t.Error("expected the pulse to be low")
+	}
+	v.tick(1)
+	if !v.pinCA2() {
+		t.Error("expected the pulse to end after a cycle")
+	}
+}
+
+func TestVIATimer1(t *testing.T) {
+	output, irq := recordIRQ()
+	v := newVIA("via", output)
+	v.write(viaIER, 0x80|viaTimer1)
+	v.write(viaT1CL, 10)
+	v.write(viaT1CH, 0)
+	// One-shot: the timer runs out after the latch+1 cycles, once
+	v.tick(10)
+	if *irq {
+		t.Fatal("interrupted too soon")
+	}
+	v.tick(1)
+	if !*irq {
+		t.Fatal("expected an interrupt after 11 cycles")
+	}
+	v.read(viaT1CL)
+	if *irq {
+		t.Fatal("reading the low counter should clear the interrupt")
+	}
+	v.tick(0x20000)
+	if *irq {
+		t.Fatal("a one-shot timer should not interrupt again")
+	}
+
+	// Free running, toggling PB7 every latch+2 cycles
+	v.write(viaACR, 0xC0)
+	v.write(viaT1CL, 4)
+	v.write(viaT1CH, 0)
+	if v.portB()&0x80 != 0 {
+		t.Fatal("PB7 should go low when the timer starts")
+	}
+	v.tick(5)
+	if !*irq || v.portB()&0x80 == 0 {
+		t.Fatalf("expected an interrupt and PB7 high after 5 cycles, IRQ %v PB %08b", *irq, v.portB())
+	}
+	v.write(viaIFR, viaTimer1)
+	v.tick(5)
+	if *irq {
+		t.Fatal("interrupted too soon the second time")
+	}
+	v.tick(1)
+	if !*irq || v.portB()&0x80 != 0 {
+		t.Fatalf("expected an interrupt and PB7 low after 6 more cycles, IRQ %v PB %08b", *irq, v.portB())
+	}
+}
+
+func TestVIATimer2(t *testing.T) {
+	output, irq := recordIRQ()
+	v := newVIA("via", output)
+	v.write(viaIER, 0x80|viaTimer2)
+	v.write(viaT2CL, 3)
+	v.write(viaT2CH, 0)
+	v.tick(4)
+	if !*irq {
+		t.Fatal("expected an interrupt after 4 cycles")
+	}
+	v.read(viaT2CL)
+	v.tick(0x20000)
+	if *irq {
+		t.Fatal("timer 2 should only interrupt once")
+	}
+
+	// Counting pulses on PB6
+	v.write(viaACR, 0x20)
+	v.write(viaT2CL, 2)
+	v.write(viaT2CH, 0)
+	for i := 0; i < 2; i++ {
+		v.tick(100)
+		v.setPortB(0xBF)
+		v.setPortB(0xFF)
+	}
+	if !*irq {
+		t.Fatalf("expected an interrupt after 2 pulses, counter $%04X", v.t2)
+	}
+}
+
+func TestVIAShiftRegister(t *testing.T) {
+	output, irq := recordIRQ()
+	v := newVIA("via", output)
+	v.write(viaIER, 0x80|viaShift)
+	// Shift out at half the clock rate
+	v.write(viaACR, 6<<2)
+	v.write(viaSR, 0xA5)
+	var out uint8
+	for i := 0; i < 8; i++ {
+		if *irq {
+			t.Fatalf("interrupted after %d bits", i)
+		}
+		v.tick(2)
+		out = out<<1 | boolToInt(v.pinCB2())
+	}
+	if !*irq {
+		t.Fatal("expected an interrupt after 8 bits")
+	}
+	if out != 0xA5 || v.peek(viaSR) != 0xA5 {
+		t.Errorf("shifted out $%02X, and $%02X is left, expected $A5 both", out, v.peek(viaSR))
+	}
+
+	// Shift in under an external clock on CB1
+	v.write(viaACR, 3<<2)
+	v.read(viaSR)
+	for _, bit := range []bool{true, false, false, true, true, false, true, true} {
+		v.setCB2(bit)
+		v.setCB1(false)
+		v.setCB1(true)
+	}
+	if got := v.peek(viaSR); got != 0x9B || !*irq {
+		t.Errorf("shifted in $%02X (IRQ %v), expected $9B", got, *irq)
+	}
+}
+
+func TestVIAInterruptRegisters(t *testing.T) {
+	output, irq := recordIRQ()
+	v := newVIA("via", output)
+	v.write(viaIER, 0x80|viaCB1|viaCA1)
+	v.write(viaIER, viaCA1)
+	if got := v.read(viaIER); got != 0x80|viaCB1 {
+		t.Errorf("IER: expected $%02X, got $%02X", 0x80|viaCB1, got)
+	}
+	// A flag that is not enabled is set without interrupting
+	v.setCA1(false)
+	if *irq || v.peek(viaIFR) != viaCA1 {
+		t.Errorf("expected the CA1 flag without an interrupt, IFR $%02X", v.peek(viaIFR))
+	}
+	v.write(viaIFR, viaCA1)
+	if v.peek(viaIFR) != 0 {
+		t.Errorf("writing a one should clear the flag, IFR $%02X", v.peek(viaIFR))
+	}
+}
+
+func TestVIAOnTheBus(t *testing.T) {
+	// A timer interrupt wakes a 65C02 from WAI
+	program := []uint8{
+		0xA9, 0xC0, // LDA #$C0
+		0x8D, 0x0E, 0x60, // STA $600E (enable timer 1)
+		0xA9, 0x20, // LDA #$20
+		0x8D, 0x04, 0x60, // STA $6004
+		0x9C, 0x05, 0x60, // STZ $6005 (start the timer)
+		0x58,             // CLI
+		0xCB,             // WAI
+		0x4C, 0x0E, 0x80, // JMP *-1
+		0xAD, 0x04, 0x70, // irq: LDA $7004 (a mirror, clearing the flag)
+		0xE6, 0x10, // INC $10
+		0x40, // RTI
+	}
+	cpu := newTestCPU(t, CMOS65C02, program)
+	cpu.MMU.pokeByte(0xFFFE, 0x12)
+	cpu.MMU.pokeByte(0xFFFF, 0x80)
+	via := newVIA("via", cpu.newIRQLine())
+	if err := cpu.attach(via, 0x6000, 0x7FFF); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		cpu.step()
+	}
+	if cpu.MMU.peekByte(0x10) != 1 {
+		t.Errorf("expected one interrupt, got %d", cpu.MMU.peekByte(0x10))
+	}
+	if cpu.MMU.RAM[0x6004] != 0 || cpu.MMU.RAM[0x700E] != 0 {
+		t.Error("writes to the VIA went to memory")
+	}
+	// Peeking does not clear flags
+	via.write(viaIFR, 0x7F)
+	via.setCA1(false)
+	cpu.MMU.peekByte(0x6001)
+	if via.peek(viaIFR) == 0 {
+		t.Error("peeking IRA cleared the CA1 flag")
+	}
+
+	// The VIA's state goes in save states
+	var buf bytes.Buffer
+	if err := cpu.saveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	saved := *via
+	via.reset()
+	if err := cpu.loadState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if via.ifr != saved.ifr || via.ier != saved.ier || via.t1 != saved.t1 || via.acr != saved.acr {
+		t.Errorf("VIA state not restored: %+v, expected %+v", via, saved)
+	}
+}
+
+func TestVIAStepBack(t *testing.T) {
+	// Stepping back to before a timer ran out takes the interrupt back too
+	program := []uint8{
+		0xA9, 0xC0, // LDA #$C0
+		0x8D, 0x0E, 0x60, // STA $600E (enable timer 1)
+		0xA9, 0x04, // LDA #$04
+		0x8D, 0x04, 0x60, // STA $6004
+		0x9C, 0x05, 0x60, // STZ $6005 (start the timer)
+		0xEA, 0xEA, 0xEA, 0xEA, 0xEA, // NOPs, with interrupts disabled
+	}
+	cpu := newTestCPU(t, CMOS65C02, program)
+	via := newVIA("via", cpu.newIRQLine())
+	if err := cpu.attach(via, 0x6000, 0x7FFF); err != nil {
+		t.Fatal(err)
+	}
+	cpu.enableHistory(1 << 20)
+	for i := 0; i < 5; i++ {
+		cpu.step()
+	}
+	started := *via
+	for i := 0; i < 5; i++ {
+		cpu.step()
+	}
+	if !via.irqActive || cpu.irq == 0 {
+		t.Fatal("expected the timer to have run out")
+	}
+	for i := 0; i < 5; i++ {
+		if !cpu.stepBack() {
+			t.Fatal("ran out of history")
+		}
+	}
+	if via.irqActive || cpu.irq != 0 || via.ifr != started.ifr || via.t1 != started.t1 {
+		t.Errorf("expected the VIA as it was, IRQ %v IFR $%02X T1 %d, got IRQ %v IFR $%02X T1 %d",
+			started.irqActive, started.ifr, started.t1, via.irqActive, via.ifr, via.t1)
+	}
+	// Running forwards again, the timer runs out again
+	for i := 0; i < 5; i++ {
+		cpu.step()
+	}
+	if !via.irqActive || cpu.irq == 0 {
+		t.Error("expected the timer to run out again")
+	}
+}
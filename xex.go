@@ -0,0 +1,87 @@
+package main
+
+import "fmt"
+
+// Atari DOS vectors that a binary file can load to declare its entry points
+const (
+	atariRUNAD  = 0x02E0 // run address, jumped to once loading completes
+	atariINITAD = 0x02E2 // init address, called as soon as its segment loads
+)
+
+// parseXEX parses an Atari DOS binary (XEX) file: a $FFFF header followed by
+// segments, each a start and end address and the bytes between them
+func parseXEX(data []uint8) (*programImage, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xFF {
+		return nil, fmt.Errorf("missing $FFFF header")
+	}
+	img := &programImage{}
+	offset := 0
+	for offset < len(data) {
+		// The $FFFF marker is optional in front of all but the first segment
+		if offset+2 <= len(data) && data[offset] == 0xFF && data[offset+1] == 0xFF {
+			offset += 2
+		}
+		if offset+4 > len(data) {
+			return nil, fmt.Errorf("segment header at offset %d is truncated", offset)
+		}
+		start := uint16(data[offset]) | uint16(data[offset+1])<<8
+		end := uint16(data[offset+2]) | uint16(data[offset+3])<<8
+		offset += 4
+		if end < start {
+			return nil, fmt.Errorf("segment at offset %d ends ($%04X) before it starts ($%04X)", offset-4, end, start)
+		}
+		length := int(end-start) + 1
+		if offset+length > len(data) {
+			return nil, fmt.Errorf("segment $%04X-$%04X is truncated", start, end)
+		}
+		payload := data[offset : offset+length]
+		offset += length
+		seg := segment{address: start, data: append([]uint8(nil), payload...)}
+		// Pick up the entry point vectors if this segment writes them
+		if run, ok := segmentWord(start, payload, atariRUNAD); ok {
+			img.run = run
+			img.hasRun = true
+		}
+		if init, ok := segmentWord(start, payload, atariINITAD); ok {
+			seg.init = init
+			seg.hasInit = true
+		}
+		img.segments = append(img.segments, seg)
+	}
+	return img, nil
+}
+
+// segmentWord returns the little-endian word a segment loaded at start
+// writes to address, if it covers both bytes
+func segmentWord(start uint16, payload []uint8, address uint16) (uint16, bool) {
+	if address < start || int(address-start)+2 > len(payload) {
+		return 0, false
+	}
+	i := address - start
+	return uint16(payload[i]) | uint16(payload[i+1])<<8, true
+}
+
+// initStepLimit is how many instructions an init routine can run for before
+// loading gives up on it returning
+const initStepLimit = 10000000
+
+// runInit calls an INITAD routine as DOS does while loading: as a subroutine,
+// which returns to the loader with its RTS
+func (cpu *CPU) runInit(address uint16) error {
+	// Call it as a JSR just before the PC would
+	pc, sp := cpu.PC, cpu.SP
+	cpu.pushWord(pc - 1)
+	cpu.PC = address
+	cpu.running = true
+	defer func() { cpu.running = false }()
+	for i := 0; i < initStepLimit; i++ {
+		cpu.step()
+		if cpu.PC == pc && cpu.SP == sp {
+			return nil
+		}
+		if !cpu.running || cpu.getFlag(Break) {
+			break
+		}
+	}
+	return fmt.Errorf("init routine at $%04X did not return", address)
+}